@@ -0,0 +1,359 @@
+package cxfw
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The account databases edited by the user operation. The image's busybox
+// has no useradd, so they are edited directly.
+const (
+	passwdFile = "/etc/passwd"
+	groupFile  = "/etc/group"
+	shadowFile = "/etc/shadow"
+)
+
+// Defaults for the dedicated system users the user operation is meant for.
+const (
+	defaultAccountHome  = "/var/empty"
+	defaultAccountShell = "/sbin/nologin"
+)
+
+// accountNamePattern matches user and group names safe in the account files.
+var accountNamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// Account is a user added or removed by the user operation.
+type Account struct {
+	Name  string
+	UID   int
+	GID   int
+	Home  string
+	Shell string
+
+	// JoinGroup is set when the gid was given explicitly, allowing the user
+	// to join an existing group of another name as primary group.
+	JoinGroup bool
+}
+
+// AccountFromOperation builds the account of a user operation. uid is
+// required to add a user, gid defaults to uid, and home and shell default
+// to /var/empty and /sbin/nologin.
+func AccountFromOperation(op Operation) (Account, error) {
+	account := Account{Name: op.Name, UID: -1, GID: -1, Home: op.Home, Shell: op.Shell}
+	if !accountNamePattern.MatchString(account.Name) {
+		return account, fmt.Errorf("invalid user name %q", account.Name)
+	}
+	if op.Action != "add" && op.Action != "remove" {
+		return account, fmt.Errorf("invalid user action %q, expected add or remove", op.Action)
+	}
+	if op.Action == "remove" {
+		return account, nil
+	}
+	if op.UID == nil || *op.UID < 0 {
+		return account, fmt.Errorf("user %s needs a non-negative uid", account.Name)
+	}
+	account.UID = *op.UID
+	account.GID = account.UID
+	if op.GID != nil {
+		if *op.GID < 0 {
+			return account, fmt.Errorf("user %s has a negative gid", account.Name)
+		}
+		account.GID = *op.GID
+		account.JoinGroup = true
+	}
+	if account.Home == "" {
+		account.Home = defaultAccountHome
+	}
+	if account.Shell == "" {
+		account.Shell = defaultAccountShell
+	}
+	for _, path := range []string{account.Home, account.Shell} {
+		if !filepath.IsAbs(path) || strings.ContainsAny(path, ":\r\n") {
+			return account, fmt.Errorf("invalid path %q for user %s", path, account.Name)
+		}
+	}
+	return account, nil
+}
+
+// LookupOwner resolves owner and group, each a name in the image's
+// /etc/passwd and /etc/group or a numeric id, to ids for os.Chown. An empty
+// owner or group resolves to -1, which leaves it unchanged.
+func LookupOwner(owner, group string) (int, int, error) {
+	uid, err := lookupAccountID(passwdFile, "user", owner)
+	if err != nil {
+		return -1, -1, err
+	}
+	gid, err := lookupAccountID(groupFile, "group", group)
+	if err != nil {
+		return -1, -1, err
+	}
+	return uid, gid, nil
+}
+
+// LookupUser returns the uid, primary gid and home of the user name in the
+// image's /etc/passwd, for processes run inside the image.
+func LookupUser(name string) (uid, gid int, home string, err error) {
+	file, err := readAccountFile(passwdFile)
+	if err != nil {
+		return -1, -1, "", err
+	}
+	i := file.find(0, name)
+	if i < 0 {
+		return -1, -1, "", fmt.Errorf("unknown user %q, not in %s", name, passwdFile)
+	}
+	fields := file.fields(i)
+	if len(fields) < 6 {
+		return -1, -1, "", fmt.Errorf("malformed %s entry for user %s", passwdFile, name)
+	}
+	uid, uidErr := strconv.Atoi(fields[2])
+	gid, gidErr := strconv.Atoi(fields[3])
+	if uidErr != nil || gidErr != nil {
+		return -1, -1, "", fmt.Errorf("malformed %s entry for user %s", passwdFile, name)
+	}
+	return uid, gid, fields[5], nil
+}
+
+// lookupAccountID returns the id of the account name in the account
+// database path, or name itself when it is numeric.
+func lookupAccountID(path, kind, name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	file, err := readAccountFile(path)
+	if err != nil {
+		return -1, err
+	}
+	i := file.find(0, name)
+	if i < 0 {
+		return -1, fmt.Errorf("unknown %s %q, not in %s", kind, name, path)
+	}
+	fields := file.fields(i)
+	if len(fields) < 3 {
+		return -1, fmt.Errorf("malformed %s entry for %s %s", path, kind, name)
+	}
+	id, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return -1, fmt.Errorf("malformed %s entry for %s %s", path, kind, name)
+	}
+	return id, nil
+}
+
+// accountFile is one of the colon-separated account databases, kept line
+// by line so untouched lines are written back unchanged.
+type accountFile struct {
+	path  string
+	lines []string
+	found bool
+	mode  os.FileMode
+	uid   int
+	gid   int
+}
+
+func readAccountFile(path string) (*accountFile, error) {
+	file := &accountFile{path: HostPath(path), mode: 0644, uid: -1, gid: -1}
+	data, err := os.ReadFile(file.path)
+	if os.IsNotExist(err) {
+		return file, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	file.found = true
+	if info, err := os.Stat(file.path); err == nil {
+		file.mode = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			file.uid, file.gid = int(st.Uid), int(st.Gid)
+		}
+	}
+	if len(data) > 0 {
+		file.lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	return file, nil
+}
+
+// find returns the index of the entry whose field column equals value.
+func (f *accountFile) find(column int, value string) int {
+	return slices.IndexFunc(f.lines, func(line string) bool {
+		fields := strings.Split(line, ":")
+		return len(fields) > column && fields[column] == value
+	})
+}
+
+// fields returns the fields of line i.
+func (f *accountFile) fields(i int) []string {
+	return strings.Split(f.lines[i], ":")
+}
+
+// write replaces the file atomically, keeping its mode and owner.
+func (f *accountFile) write() error {
+	content := ""
+	if len(f.lines) > 0 {
+		content = strings.Join(f.lines, "\n") + "\n"
+	}
+	if err := WriteFileAtomic(f.path, []byte(content), f.mode); err != nil {
+		return err
+	}
+	return os.Chown(f.path, f.uid, f.gid)
+}
+
+// accountFiles holds the three account databases.
+type accountFiles struct {
+	passwd, group, shadow *accountFile
+}
+
+func readAccountFiles() (*accountFiles, error) {
+	var files accountFiles
+	var err error
+	if files.passwd, err = readAccountFile(passwdFile); err != nil {
+		return nil, err
+	}
+	if !files.passwd.found {
+		return nil, fmt.Errorf("%s not found", passwdFile)
+	}
+	if files.group, err = readAccountFile(groupFile); err != nil {
+		return nil, err
+	}
+	if files.shadow, err = readAccountFile(shadowFile); err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+// planAddAccount adds account to files in memory. It reports false when an
+// identical user already exists, and fails on any name or id conflict.
+func (files *accountFiles) planAddAccount(account Account) (bool, error) {
+	uid, gid := strconv.Itoa(account.UID), strconv.Itoa(account.GID)
+	if i := files.passwd.find(0, account.Name); i >= 0 {
+		fields := files.passwd.fields(i)
+		if len(fields) == 7 && fields[2] == uid && fields[3] == gid && fields[5] == account.Home && fields[6] == account.Shell {
+			return false, nil
+		}
+		return false, fmt.Errorf("user %s already exists with a different definition: %s", account.Name, files.passwd.lines[i])
+	}
+	if i := files.passwd.find(2, uid); i >= 0 {
+		return false, fmt.Errorf("uid %s is already used by user %s", uid, files.passwd.fields(i)[0])
+	}
+
+	// The primary group is a new group named after the user, or an existing
+	// group the user was explicitly given the gid of
+	byName, byGID := files.group.find(0, account.Name), files.group.find(2, gid)
+	switch {
+	case byName >= 0 && byName != byGID:
+		return false, fmt.Errorf("group %s already exists with gid %s, not %s", account.Name, files.group.fields(byName)[2], gid)
+	case byGID >= 0 && byName < 0 && !account.JoinGroup:
+		return false, fmt.Errorf("gid %s is already used by group %s, set gid to join it", gid, files.group.fields(byGID)[0])
+	case byGID < 0:
+		files.group.lines = append(files.group.lines, account.Name+":x:"+gid+":")
+	}
+
+	password := "!"
+	if files.shadow.found {
+		password = "x"
+		lastChange := strconv.FormatInt(time.Now().Unix()/86400, 10)
+		files.shadow.lines = append(files.shadow.lines, account.Name+":!:"+lastChange+":0:99999:7:::")
+	}
+	files.passwd.lines = append(files.passwd.lines, strings.Join([]string{account.Name, password, uid, gid, "", account.Home, account.Shell}, ":"))
+	return true, nil
+}
+
+// planRemoveAccount removes the user name from files in memory, with its
+// group when no other user has it as primary group. It reports false when
+// the user does not exist, and refuses to remove uid 0.
+func (files *accountFiles) planRemoveAccount(name string) (bool, error) {
+	i := files.passwd.find(0, name)
+	if i < 0 {
+		return false, nil
+	}
+	fields := files.passwd.fields(i)
+	if len(fields) < 4 {
+		return false, fmt.Errorf("malformed %s entry for user %s", passwdFile, name)
+	}
+	if fields[2] == "0" {
+		return false, fmt.Errorf("refusing to remove user %s with uid 0", name)
+	}
+	gid := fields[3]
+	files.passwd.lines = slices.Delete(files.passwd.lines, i, i+1)
+	if j := files.shadow.find(0, name); j >= 0 {
+		files.shadow.lines = slices.Delete(files.shadow.lines, j, j+1)
+	}
+
+	// Drop the user from supplementary group member lists, and the user's
+	// own group once nobody else uses it as primary group
+	for j, line := range files.group.lines {
+		groupFields := strings.Split(line, ":")
+		if len(groupFields) != 4 || groupFields[3] == "" {
+			continue
+		}
+		members := slices.DeleteFunc(strings.Split(groupFields[3], ","), func(member string) bool { return member == name })
+		groupFields[3] = strings.Join(members, ",")
+		files.group.lines[j] = strings.Join(groupFields, ":")
+	}
+	if j := files.group.find(0, name); j >= 0 && files.group.fields(j)[2] == gid && files.passwd.find(3, gid) < 0 {
+		files.group.lines = slices.Delete(files.group.lines, j, j+1)
+	}
+	return true, nil
+}
+
+// CheckAccountChange reports whether the user operation op would conflict
+// with the current account databases, without changing them.
+func CheckAccountChange(op Operation) error {
+	account, err := AccountFromOperation(op)
+	if err != nil {
+		return err
+	}
+	files, err := readAccountFiles()
+	if err != nil {
+		return err
+	}
+	if op.Action == "add" {
+		_, err = files.planAddAccount(account)
+	} else {
+		_, err = files.planRemoveAccount(account.Name)
+	}
+	return err
+}
+
+// ApplyAccountChange adds or removes the user of op in /etc/passwd,
+// /etc/group and /etc/shadow. Each file is replaced atomically; on add the
+// group is written first and passwd last, on remove the reverse, so a
+// partial failure never leaves a user without its group. It reports false
+// when the accounts already matched.
+func ApplyAccountChange(op Operation) (bool, error) {
+	account, err := AccountFromOperation(op)
+	if err != nil {
+		return false, err
+	}
+	files, err := readAccountFiles()
+	if err != nil {
+		return false, err
+	}
+	order := []*accountFile{files.group, files.shadow, files.passwd}
+	var changed bool
+	if op.Action == "add" {
+		changed, err = files.planAddAccount(account)
+	} else {
+		changed, err = files.planRemoveAccount(account.Name)
+		slices.Reverse(order)
+	}
+	if err != nil || !changed {
+		return false, err
+	}
+	for _, file := range order {
+		if !file.found && len(file.lines) == 0 {
+			continue
+		}
+		if err := file.write(); err != nil {
+			return false, fmt.Errorf("failed to write %s: %w", ImagePath(file.path), err)
+		}
+	}
+	return true, nil
+}
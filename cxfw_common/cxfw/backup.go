@@ -0,0 +1,102 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BackupIndexFile lives in the backup directory and records which original
+// path every backup file holds. Flattening paths with underscores is
+// ambiguous (/a_b/file and /a/b_file both become _a_b_file) and a later
+// patch may back up the same path again, so the executor gives a name that
+// is already taken by different content a numeric suffix and the rollback
+// binary resolves it here.
+const BackupIndexFile = ".backup_index.json"
+
+type BackupRecord struct {
+	Path     string `json:"path"`
+	Backup   string `json:"backup"`
+	Checksum string `json:"checksum"`
+}
+
+// LoadBackupIndex reads the index of backupDir. A missing index is empty.
+func LoadBackupIndex(backupDir string) ([]BackupRecord, error) {
+	data, err := os.ReadFile(filepath.Join(backupDir, BackupIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup index: %w", err)
+	}
+	var records []BackupRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse backup index: %w", err)
+	}
+	return records, nil
+}
+
+func writeBackupIndex(backupDir string, records []BackupRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal backup index: %w", err)
+	}
+	return WriteFileAtomic(filepath.Join(backupDir, BackupIndexFile), data, 0644)
+}
+
+// RecordBackup adds record to the index of backupDir. The record's paths are
+// stored as in-image paths.
+func RecordBackup(backupDir string, record BackupRecord) error {
+	records, err := LoadBackupIndex(backupDir)
+	if err != nil {
+		return err
+	}
+	record.Path, record.Backup = ImagePath(record.Path), ImagePath(record.Backup)
+	return writeBackupIndex(backupDir, append(records, record))
+}
+
+// ResolveBackupSource returns the backup file holding path. The newest
+// indexed backup of path is preferred over source, the name the rollback
+// manifest was generated with. Sources the creator placed in
+// DefaultBackupDir are looked up in BackupDir instead when that differs.
+func ResolveBackupSource(path, source string) string {
+	if rest, ok := strings.CutPrefix(source, DefaultBackupDir+"/"); ok && BackupDir != DefaultBackupDir {
+		source = filepath.Join(BackupDir, rest)
+	}
+	records, err := LoadBackupIndex(filepath.Dir(source))
+	if err != nil {
+		LogToFile("WARNING: Failed to read backup index, using " + source + " - " + err.Error())
+		return source
+	}
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Path != ImagePath(path) {
+			continue
+		}
+		backup := HostPath(records[i].Backup)
+		if _, err := os.Stat(backup); err == nil {
+			if backup != source {
+				LogToFile("INFO: Using indexed backup " + backup + " for " + path)
+			}
+			return backup
+		}
+	}
+	return source
+}
+
+// ForgetBackup drops the index records of a backup that has been restored.
+func ForgetBackup(backup string) error {
+	backupDir := filepath.Dir(backup)
+	records, err := LoadBackupIndex(backupDir)
+	if err != nil || records == nil {
+		return err
+	}
+	kept := []BackupRecord{}
+	for _, record := range records {
+		if record.Backup != ImagePath(backup) {
+			kept = append(kept, record)
+		}
+	}
+	return writeBackupIndex(backupDir, kept)
+}
@@ -0,0 +1,55 @@
+package cxfw
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupIndexResolvesFlattenedNameCollision(t *testing.T) {
+	dir := t.TempDir()
+	defer func(logFile, backupDir string) { LogFile, BackupDir = logFile, backupDir }(LogFile, BackupDir)
+	LogFile, BackupDir = filepath.Join(dir, "cxfw_patch.log"), filepath.Join(dir, "rollback")
+	if err := os.Mkdir(BackupDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both paths flatten to the same backup name
+	first, second := "/sda1/data/a_b/file", "/sda1/data/a/b_file"
+	canonical := filepath.Join(BackupDir, strings.ReplaceAll(first, "/", "_"))
+	if other := filepath.Join(BackupDir, strings.ReplaceAll(second, "/", "_")); other != canonical {
+		t.Fatalf("%s and %s flatten to %s and %s, want one name", first, second, canonical, other)
+	}
+	backups := map[string]string{first: canonical, second: canonical + ".1"}
+	for path, backup := range backups {
+		if err := os.WriteFile(backup, []byte("content of "+path), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := RecordBackup(BackupDir, BackupRecord{Path: path, Backup: backup}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rollback manifests of either patch name the flattened backup
+	for path, backup := range backups {
+		if got := ResolveBackupSource(path, canonical); got != backup {
+			t.Errorf("ResolveBackupSource(%s) = %s, want %s", path, got, backup)
+		}
+	}
+
+	// Restoring one backup keeps the index record of the other
+	if err := ForgetBackup(canonical); err != nil {
+		t.Fatal(err)
+	}
+	records, err := LoadBackupIndex(BackupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Path != second || records[0].Backup != backups[second] {
+		t.Errorf("index after restoring %s is %+v, want only the backup of %s", first, records, second)
+	}
+	if got := ResolveBackupSource(second, canonical); got != backups[second] {
+		t.Errorf("ResolveBackupSource(%s) after restoring %s = %s, want %s", second, first, got, backups[second])
+	}
+}
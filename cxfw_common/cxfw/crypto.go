@@ -0,0 +1,252 @@
+package cxfw
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Key extraction is retried because the image can be briefly locked by the
+// backup daemon.
+const (
+	keyExtractAttempts   = 3
+	keyExtractRetryDelay = 2 * time.Second
+)
+
+// KeyFile, when set, is read for the integrity database key instead of
+// extracting it from the device image. Used to patch or simulate against an
+// image on a build host, where steghide and the image key are unavailable.
+var KeyFile string
+
+// keyImage hides the integrity database key.
+const keyImage = "/sda1/data/.gems.jpeg"
+
+// ErrKeyUnavailable is wrapped by every error of ExtractKeyFromImage, so an
+// operation that fails for want of the key is reported key_unavailable.
+var ErrKeyUnavailable = errors.New("integrity key unavailable")
+
+// ExtractKeyFromImage returns the integrity database key hidden in the
+// device image, or the contents of KeyFile when one is configured.
+func ExtractKeyFromImage() ([]byte, error) {
+	key, err := extractKey()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrKeyUnavailable, err)
+	}
+	return key, nil
+}
+
+func extractKey() ([]byte, error) {
+	if KeyFile != "" {
+		key, err := os.ReadFile(KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		return checkKeyLength(key)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= keyExtractAttempts; attempt++ {
+		key, err := extractKeyOnce()
+		if err == nil {
+			return key, nil
+		}
+		lastErr = err
+		LogToFile(fmt.Sprintf("WARNING: Key extraction attempt %d/%d failed - %v", attempt, keyExtractAttempts, err))
+		if attempt < keyExtractAttempts {
+			time.Sleep(keyExtractRetryDelay)
+		}
+	}
+	return nil, lastErr
+}
+
+func extractKeyOnce() ([]byte, error) {
+	tempKeyFile := "/tmp/extracted_key.txt"
+	TrackTempFile(tempKeyFile)
+	defer UntrackTempFile(tempKeyFile)
+	defer os.Remove(tempKeyFile)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("steghide", "extract", "-sf", HostPath(keyImage), "-xf", tempKeyFile, "-p", "Sundyne@123")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("steghide extraction failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	key, err := os.ReadFile(tempKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read extracted key: %v", err)
+	}
+	return checkKeyLength(key)
+}
+
+func checkKeyLength(key []byte) ([]byte, error) {
+	// Anything but an AES-128/192/256 key means the wrong payload was extracted
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	case 0:
+		return nil, fmt.Errorf("key is empty")
+	default:
+		return nil, fmt.Errorf("key has implausible length of %d bytes", len(key))
+	}
+}
+
+// Encrypted files start with a header naming their format, so that the
+// algorithm can change without breaking the files already on devices:
+// encryptionMagic, the format version and the algorithm, followed by the
+// nonce and ciphertext of that algorithm. Files written before the header
+// was introduced are the bare nonce and AES-GCM ciphertext. Version 2 binds
+// the ciphertext to the path of the file, see EncryptFileFor; version 1 and
+// header-less files are not bound.
+const (
+	encryptionMagic   = "CXDB"
+	encryptionVersion = 2
+	encryptionHeader  = len(encryptionMagic) + 2
+)
+
+// Algorithms an encrypted file can name in its header.
+const (
+	algorithmAESGCM = 1
+)
+
+// Errors DecryptFile returns, wrapped, to tell why data did not decrypt.
+var (
+	// ErrUnknownEncryptionFormat means the header names a format version or
+	// algorithm this build cannot read, i.e. a newer one.
+	ErrUnknownEncryptionFormat = errors.New("unknown encryption format")
+	// ErrAuthenticationFailed means the data is corrupted or was encrypted
+	// with another key.
+	ErrAuthenticationFailed = errors.New("authentication failed, the file is corrupted or the key is wrong")
+	// ErrNotEncrypted means the data is plain JSON rather than encrypted.
+	ErrNotEncrypted = errors.New("file is not encrypted")
+)
+
+// DecryptFile decrypts data written by EncryptFile, or the header-less
+// files of earlier versions.
+func DecryptFile(key, encryptedData []byte) ([]byte, error) {
+	return DecryptFileFor(key, encryptedData, "")
+}
+
+// DecryptFileFor decrypts data written by EncryptFileFor for path. Files
+// written by earlier versions, which are not bound to a path, decrypt as
+// well; they are bound the next time they are written.
+func DecryptFileFor(key, encryptedData []byte, path string) ([]byte, error) {
+	if version, algorithm, ok := parseEncryptionHeader(encryptedData); ok {
+		plaintext, err := decryptVersioned(key, version, algorithm, encryptedData[encryptionHeader:], pathData(path))
+		if err == nil {
+			return plaintext, nil
+		}
+		// One in 2^32 legacy files starts with the magic by chance
+		if legacy, legacyErr := decryptAESGCM(key, encryptedData, nil); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
+	}
+
+	plaintext, err := decryptAESGCM(key, encryptedData, nil)
+	if err != nil && json.Valid(bytes.TrimSpace(encryptedData)) {
+		return nil, fmt.Errorf("decryption failed: %w", ErrNotEncrypted)
+	}
+	return plaintext, err
+}
+
+// parseEncryptionHeader returns the format version and algorithm of data,
+// and false if data has no header.
+func parseEncryptionHeader(data []byte) (byte, byte, bool) {
+	if len(data) < encryptionHeader || string(data[:len(encryptionMagic)]) != encryptionMagic {
+		return 0, 0, false
+	}
+	return data[len(encryptionMagic)], data[len(encryptionMagic)+1], true
+}
+
+// decryptVersioned decrypts body, the data following a header naming
+// version and algorithm, with additionalData if the version binds it.
+func decryptVersioned(key []byte, version, algorithm byte, body, additionalData []byte) ([]byte, error) {
+	switch version {
+	case 1:
+		additionalData = nil
+	case encryptionVersion:
+	default:
+		return nil, fmt.Errorf("decryption failed: %w: format version %d", ErrUnknownEncryptionFormat, version)
+	}
+	switch algorithm {
+	case algorithmAESGCM:
+		return decryptAESGCM(key, body, additionalData)
+	}
+	return nil, fmt.Errorf("decryption failed: %w: algorithm %d", ErrUnknownEncryptionFormat, algorithm)
+}
+
+// decryptAESGCM decrypts the nonce and AES-GCM ciphertext in data, which
+// must have been sealed with additionalData.
+func decryptAESGCM(key, data, additionalData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, fmt.Errorf("decryption failed: %w: ciphertext too short", ErrAuthenticationFailed)
+	}
+
+	nonce, ciphertext := data[:nonceSize], data[nonceSize:]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", ErrAuthenticationFailed)
+	}
+	return plaintext, nil
+}
+
+// EncryptFile encrypts plaintext with AES-GCM under a fresh nonce, behind a
+// header naming the format.
+func EncryptFile(key, plaintext []byte) ([]byte, error) {
+	return EncryptFileFor(key, plaintext, "")
+}
+
+// EncryptFileFor is EncryptFile for the file at path. The path, as seen on
+// the device, is authenticated along with plaintext, so the result only
+// decrypts with DecryptFileFor for the same path: a database copied over
+// the one of another directory fails to decrypt instead of being trusted.
+func EncryptFileFor(key, plaintext []byte, path string) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %w", err)
+	}
+
+	header := append([]byte(encryptionMagic), encryptionVersion, algorithmAESGCM)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	out := make([]byte, 0, len(header)+len(nonce)+len(plaintext)+gcm.Overhead())
+	out = append(append(out, header...), nonce...)
+	return gcm.Seal(out, nonce, plaintext, pathData(path)), nil
+}
+
+// pathData is the additional authenticated data binding a file to path,
+// which is the same whether or not the image is patched under --root.
+func pathData(path string) []byte {
+	if path == "" {
+		return nil
+	}
+	return []byte(ImagePath(path))
+}
@@ -0,0 +1,132 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// RebuildDatabases lets a database that neither decrypts nor has a readable
+// .db.json.bak be regenerated from the files present in its directory,
+// instead of failing every update of that directory.
+var RebuildDatabases bool
+
+// loadedDatabase is the content of a .db.json as read for an update.
+type loadedDatabase struct {
+	entries []IntegrityEntry
+	// previous is the encrypted form of entries, kept as .db.json.bak when
+	// the database is rewritten; nil when the entries were regenerated
+	previous []byte
+	// recovered is set when the .db.json itself was unreadable, so it must
+	// be rewritten even if the update changes no entry
+	recovered bool
+}
+
+// readDatabase reads and decrypts the .db.json of dir at dbPath, which the
+// caller holds the lock of. A database that does not exist reads as empty.
+// One that fails to decrypt or parse is read from its .db.json.bak instead,
+// and, when that is unreadable too and RebuildDatabases is set, regenerated
+// by hashing the files in dir. One in an unknown encryption format fails
+// with an error wrapping ErrUnknownEncryptionFormat.
+func readDatabase(dir, dbPath string, key []byte) (*loadedDatabase, error) {
+	encryptedData, err := os.ReadFile(dbPath)
+	if os.IsNotExist(err) {
+		return &loadedDatabase{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted db file: %w", err)
+	}
+	entries, err := decodeDatabase(key, encryptedData, dbPath)
+	if err == nil {
+		return &loadedDatabase{entries: entries, previous: encryptedData}, nil
+	}
+	// A database written by a newer version is not damaged, and neither its
+	// backup nor a rebuild may replace it
+	if errors.Is(err, ErrUnknownEncryptionFormat) {
+		return nil, err
+	}
+	LogToFile("WARNING: Integrity database " + dbPath + " is unreadable - " + err.Error())
+
+	backupPath := dbPath + ".bak"
+	backupData, backupErr := os.ReadFile(backupPath)
+	if backupErr == nil {
+		entries, backupErr = decodeDatabase(key, backupData, dbPath)
+	}
+	if backupErr == nil {
+		LogToFile(fmt.Sprintf("WARNING: Integrity database %s recovered from %s with %d entries", dbPath, backupPath, len(entries)))
+		return &loadedDatabase{entries: entries, previous: backupData, recovered: true}, nil
+	}
+	LogToFile("WARNING: Integrity database backup " + backupPath + " is unreadable - " + backupErr.Error())
+
+	if !RebuildDatabases {
+		return nil, fmt.Errorf("%w; its backup is unreadable too, rerun with --rebuild-db to regenerate it from the files in %s", err, dir)
+	}
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to rebuild db file: %w", err)
+	}
+	entries = make([]IntegrityEntry, 0, len(files))
+	for _, file := range files {
+		entries = append(entries, newIntegrityEntry(HostPath(file.Path), file.Hash))
+	}
+	LogToFile(fmt.Sprintf("WARNING: ******** Integrity database %s REGENERATED from the %d files present in %s - hashes of files changed since they were installed are now trusted ********", dbPath, len(entries), dir))
+	return &loadedDatabase{entries: entries, recovered: true}, nil
+}
+
+// decodeDatabase decrypts and parses the encrypted data of the .db.json at
+// dbPath, which a .db.json.bak is bound to as well.
+func decodeDatabase(key, encryptedData []byte, dbPath string) ([]IntegrityEntry, error) {
+	decryptedData, err := DecryptFileFor(key, encryptedData, dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt db file: %w", err)
+	}
+	var entries []IntegrityEntry
+	if err := json.Unmarshal(decryptedData, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal db data: %w", err)
+	}
+	return entries, nil
+}
+
+// writeDatabase replaces the database at dbPath with encryptedData, keeping
+// the previous version of db, if it had a readable one, as .db.json.bak so
+// a database damaged by the write can be recovered.
+func writeDatabase(dbPath string, db *loadedDatabase, encryptedData []byte) error {
+	if db.previous != nil {
+		if err := WriteFileAtomic(dbPath+".bak", db.previous, 0644); err != nil {
+			return fmt.Errorf("failed to write db backup: %w", err)
+		}
+	}
+	if err := WriteFileAtomic(dbPath, encryptedData, 0644); err != nil {
+		return fmt.Errorf("failed to write encrypted db: %w", err)
+	}
+	return nil
+}
+
+// readFolderFile reads and decrypts the folder file of dir. One that fails
+// to decrypt or parse, other than for an unknown encryption format, is
+// regenerated empty when RebuildDatabases is set; it only records the
+// checksum of the .db.json, which the caller writes.
+func readFolderFile(dir, folderFile string, key []byte) (FolderEntry, error) {
+	folderData := FolderEntry{Path: ImagePath(filepath.Join(dir, ".db.json"))}
+	encryptedData, err := os.ReadFile(folderFile)
+	if os.IsNotExist(err) {
+		return folderData, nil
+	} else if err != nil {
+		return folderData, fmt.Errorf("failed to read encrypted folder file: %w", err)
+	}
+	decryptedData, err := DecryptFileFor(key, encryptedData, folderFile)
+	if err != nil {
+		err = fmt.Errorf("failed to decrypt folder file: %w", err)
+	} else if err = json.Unmarshal(decryptedData, &folderData); err != nil {
+		err = fmt.Errorf("failed to unmarshal folder data: %w", err)
+	}
+	if err == nil {
+		return folderData, nil
+	}
+	if !RebuildDatabases || errors.Is(err, ErrUnknownEncryptionFormat) {
+		return folderData, fmt.Errorf("%w, rerun with --rebuild-db to regenerate it", err)
+	}
+	LogToFile("WARNING: ******** Folder file " + folderFile + " REGENERATED, it was unreadable - " + err.Error() + " ********")
+	return FolderEntry{Path: ImagePath(filepath.Join(dir, ".db.json"))}, nil
+}
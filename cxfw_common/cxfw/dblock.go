@@ -0,0 +1,67 @@
+package cxfw
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// databaseLockTimeout bounds the wait for another process, such as the
+// integrity checker, to release a database; databaseLockPoll is how often
+// the lock is tried meanwhile.
+const (
+	databaseLockTimeout = 30 * time.Second
+	databaseLockPoll    = 100 * time.Millisecond
+)
+
+// ErrDatabaseLocked is returned when another process holds the lock of a
+// database for longer than databaseLockTimeout.
+var ErrDatabaseLocked = errors.New("database locked by another process")
+
+// lockDatabase takes an exclusive flock on the sidecar path.lock of the
+// database at path, which every process that reads and rewrites the
+// database takes as well, and returns the function releasing it. The lock
+// is held across the whole decrypt, modify, encrypt and write sequence, so
+// no update of another process is lost.
+func lockDatabase(path string) (func(), error) {
+	lockPath := path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", ClassifyWriteError(lockPath, 0, err))
+	}
+	deadline := time.Now().Add(databaseLockTimeout)
+	for {
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, fmt.Errorf("%w: %s still locked after %s", ErrDatabaseLocked, path, databaseLockTimeout)
+		}
+		time.Sleep(databaseLockPoll)
+	}
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// IsDatabaseFile reports whether name, in dir, is one of the integrity files
+// of dir rather than a file they track: the .db.json and its backup, the
+// folder file, or the lock file of either.
+func IsDatabaseFile(dir, name string) bool {
+	folderFile := filepath.Base(folderFileOf(dir))
+	switch name {
+	case ".db.json", ".db.json.bak", folderFile, ".db.json.lock", folderFile + ".lock":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,325 @@
+package cxfw
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func ComputeChecksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(hash, file, NewCopyBuffer()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CopyFile copies src to dst and gives dst the owner, mode, extended
+// attributes and times of src.
+func CopyFile(src, dst string) error {
+	return CopyFileProgress(src, dst, nil)
+}
+
+// CopyFileProgress is CopyFile, copying in chunks of the copy buffer and
+// calling progress, if not nil, with the bytes written so far after each.
+func CopyFileProgress(src, dst string, progress func(written int64)) error {
+	return copyFile(src, dst, progress, io.Discard)
+}
+
+// CopyFileChecksum is CopyFileProgress, and returns the SHA256 checksum of
+// the data written to dst, computed in the same pass so that a large
+// payload is not read back to be verified.
+func CopyFileChecksum(src, dst string, progress func(written int64)) (string, error) {
+	hash := sha256.New()
+	if err := copyFile(src, dst, progress, hash); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ficlone is the FICLONE ioctl, which makes a file share the data of
+// another on filesystems with reflinks, such as btrfs and XFS.
+const ficlone = 0x40049409
+
+// copyFile copies src to dst, passing every chunk written to dst on to
+// written as well. On the same filesystem dst is made a reflink of src if
+// the filesystem supports it, so no data is written at all. Otherwise a
+// sparse src is copied with its holes, and any other through the copy
+// buffer, or through copy_file_range in the kernel when nothing needs to
+// see the data.
+func copyFile(src, dst string, progress func(written int64), written io.Writer) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	destFile, err := os.Create(dst)
+	if err != nil {
+		return ClassifyWriteError(dst, 0, err)
+	}
+	defer destFile.Close()
+
+	var total int64
+	switch {
+	case cloneFile(destFile, sourceFile) == nil:
+		// The clone wrote nothing to hash; reading it once stands in
+		if written != io.Discard {
+			total, err = io.CopyBuffer(written, destFile, NewCopyBuffer())
+		} else if info, statErr := destFile.Stat(); statErr == nil {
+			total = info.Size()
+		}
+		if err == nil && progress != nil {
+			progress(total)
+		}
+	case isSparse(sourceFile):
+		total, err = copySparse(destFile, sourceFile, progress, written)
+	case written == io.Discard:
+		total, err = copyFileRange(destFile, sourceFile, progress)
+	default:
+		total, err = copyBuffered(destFile, sourceFile, progress, written)
+	}
+	if err != nil {
+		// Do not leave a partial copy behind
+		destFile.Close()
+		os.Remove(dst)
+		return ClassifyWriteError(dst, total, err)
+	}
+
+	// Ensure file permissions are preserved
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return copyMetadata(src, dst, srcInfo)
+}
+
+// seekData and seekHole are the lseek whences that find the next data and
+// the next hole of a file.
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// isSparse reports whether f has fewer blocks allocated than its size
+// needs, which means it has holes.
+func isSparse(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Blocks*512 < info.Size()
+}
+
+// copySparse copies src to dst a stretch of data at a time, skipping over
+// the holes between them so that dst gets the same holes instead of blocks
+// of zeros. The zeros of the holes are still passed on to written, since
+// they are part of the content. A filesystem that cannot find holes
+// reports all of src as data, which makes this a plain copy.
+func copySparse(dst, src *os.File, progress func(written int64), written io.Writer) (int64, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	var offset int64
+	for offset < size {
+		data, err := src.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// Only a hole is left up to the end
+			data = size
+		} else if err != nil {
+			return offset, err
+		}
+		if err := writeZeros(written, data-offset); err != nil {
+			return offset, err
+		}
+		if data == size {
+			break
+		}
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return data, err
+		}
+		if _, err := src.Seek(data, io.SeekStart); err != nil {
+			return data, err
+		}
+		if _, err := dst.Seek(data, io.SeekStart); err != nil {
+			return data, err
+		}
+		n, err := copyBuffered(dst, io.LimitReader(src, hole-data), func(n int64) {
+			if progress != nil {
+				progress(data + n)
+			}
+		}, written)
+		if err != nil {
+			return data + n, err
+		}
+		offset = hole
+	}
+	// A trailing hole is made by the size alone
+	if err := dst.Truncate(size); err != nil {
+		return size, err
+	}
+	if progress != nil {
+		progress(size)
+	}
+	return size, nil
+}
+
+// writeZeros writes n zero bytes to w.
+func writeZeros(w io.Writer, n int64) error {
+	if w == io.Discard || n == 0 {
+		return nil
+	}
+	_, err := io.CopyBuffer(w, io.LimitReader(zeroReader{}, n), NewCopyBuffer())
+	return err
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// copiedXattrPrefixes are the namespaces of the extended attributes a copy
+// keeps: the security labels and capabilities, and those of applications.
+var copiedXattrPrefixes = []string{"security.", "user."}
+
+// copyMetadata gives dst the owner, mode, extended attributes and times of
+// src. Owner and extended attributes the filesystem or the caller cannot
+// set are logged and left out, so a copy to such a filesystem still works.
+// The owner is set first since changing it clears setuid bits, and the
+// times last since every other change touches them.
+func copyMetadata(src, dst string, srcInfo os.FileInfo) error {
+	st, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if ok {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			LogToFile(fmt.Sprintf("WARNING: Failed to keep owner %d:%d of %s - %v", st.Uid, st.Gid, src, err))
+		}
+	}
+	if err := os.Chmod(dst, srcInfo.Mode()); err != nil {
+		return err
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		LogToFile("WARNING: Failed to keep extended attributes of " + src + " - " + err.Error())
+	}
+	atime := srcInfo.ModTime()
+	if ok {
+		atime = time.Unix(st.Atim.Unix())
+	}
+	return os.Chtimes(dst, atime, srcInfo.ModTime())
+}
+
+// copyXattrs copies the extended attributes of src in copiedXattrPrefixes
+// to dst. A filesystem without extended attributes has none to copy.
+func copyXattrs(src, dst string) error {
+	size, err := syscall.Listxattr(src, nil)
+	if err != nil || size == 0 {
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+		return err
+	}
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(src, names); err != nil {
+		return err
+	}
+	var failed []string
+	for _, name := range strings.Split(strings.TrimRight(string(names[:size]), "\x00"), "\x00") {
+		if !slices.ContainsFunc(copiedXattrPrefixes, func(prefix string) bool { return strings.HasPrefix(name, prefix) }) {
+			continue
+		}
+		value, err := getXattr(src, name)
+		if err == nil {
+			err = syscall.Setxattr(dst, name, value, 0)
+		}
+		if err != nil {
+			failed = append(failed, name+": "+err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(path, name, value)
+	return value[:size], err
+}
+
+// cloneFile makes dst share the data of src, failing on filesystems
+// without reflinks and across filesystems.
+func cloneFile(dst, src *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// copyFileRange copies src to dst a copy buffer at a time. os.File.ReadFrom
+// uses copy_file_range or sendfile, so the data stays in the kernel, and
+// falls back to a plain copy where neither works.
+func copyFileRange(dst, src *os.File, progress func(written int64)) (int64, error) {
+	var total int64
+	for {
+		n, err := dst.ReadFrom(io.LimitReader(src, int64(CopyBufferSize)))
+		total += n
+		if err != nil || n == 0 {
+			return total, err
+		}
+		if progress != nil {
+			progress(total)
+		}
+	}
+}
+
+// copyBuffered copies src to dst through the copy buffer, passing every
+// chunk written on to written.
+func copyBuffered(dst *os.File, src io.Reader, progress func(written int64), written io.Writer) (int64, error) {
+	buf := NewCopyBuffer()
+	var total int64
+	for {
+		n, readErr := src.Read(buf)
+		if n > 0 {
+			w, writeErr := dst.Write(buf[:n])
+			written.Write(buf[:w])
+			total += int64(w)
+			if writeErr != nil {
+				return total, writeErr
+			}
+			if progress != nil {
+				progress(total)
+			}
+		}
+		if readErr == io.EOF {
+			return total, nil
+		}
+		if readErr != nil {
+			return total, readErr
+		}
+	}
+}
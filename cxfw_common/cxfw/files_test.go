@@ -0,0 +1,183 @@
+package cxfw
+
+import (
+	"bufio"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writePayload writes size bytes of random data to a file in dir, so that
+// no filesystem can store it sparse or compressed.
+func writePayload(tb testing.TB, dir string, size int64) string {
+	tb.Helper()
+	path := filepath.Join(dir, "payload.bin")
+	file, err := os.Create(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, 1<<20)
+	if _, err := io.Copy(w, io.LimitReader(rand.New(rand.NewSource(1)), size)); err != nil {
+		tb.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// bytesRead returns the bytes this process has read with read system calls
+// so far, or false where /proc/self/io is not available.
+func bytesRead() (int64, bool) {
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "rchar: "); ok {
+			n, err := strconv.ParseInt(value, 10, 64)
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// benchmarkInstall copies a payload of size bytes b.N times with install,
+// and reports the bytes read per copy next to the throughput.
+func benchmarkInstall(b *testing.B, size int64, install func(src, dst string) (string, error)) {
+	dir := b.TempDir()
+	src := writePayload(b, dir, size)
+	dst := filepath.Join(dir, "installed.bin")
+	want, err := ComputeChecksum(src)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(size)
+	before, counted := bytesRead()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		checksum, err := install(src, dst)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if checksum != want {
+			b.Fatalf("checksum %s, want %s", checksum, want)
+		}
+	}
+	b.StopTimer()
+	if after, ok := bytesRead(); counted && ok {
+		b.ReportMetric(float64(after-before)/float64(b.N), "read-B/op")
+	}
+}
+
+// BenchmarkInstallReadback is the install path of --verify-readback: the
+// payload is copied, then the copy is read back in full to be hashed.
+func BenchmarkInstallReadback(b *testing.B) {
+	benchmarkInstall(b, 64<<20, func(src, dst string) (string, error) {
+		if err := CopyFileProgress(src, dst, nil); err != nil {
+			return "", err
+		}
+		return ComputeChecksum(dst)
+	})
+}
+
+// BenchmarkInstallCopyChecksum is the default install path: the copy is
+// hashed as it is written, so the payload is read once. Its read-B/op is
+// half that of BenchmarkInstallReadback.
+func BenchmarkInstallCopyChecksum(b *testing.B) {
+	benchmarkInstall(b, 64<<20, func(src, dst string) (string, error) {
+		return CopyFileChecksum(src, dst, nil)
+	})
+}
+
+// copyPaths copy src to dst the ways copyFile can, or fail when the
+// filesystem does not support it.
+var copyPaths = map[string]func(dst, src *os.File) error{
+	"buffered": func(dst, src *os.File) error {
+		_, err := copyBuffered(dst, src, nil, io.Discard)
+		return err
+	},
+	"copy_file_range": func(dst, src *os.File) error {
+		_, err := copyFileRange(dst, src, nil)
+		return err
+	},
+	"reflink": cloneFile,
+}
+
+func TestCopyPathsMatchBufferedChecksum(t *testing.T) {
+	dir := t.TempDir()
+	// Not a multiple of the copy buffer, so the last chunk is short
+	src := writePayload(t, dir, 3*int64(CopyBufferSize)+12345)
+	want, err := ComputeChecksum(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, copyPath := range copyPaths {
+		t.Run(name, func(t *testing.T) {
+			srcFile, err := os.Open(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srcFile.Close()
+			dst := filepath.Join(dir, name+".bin")
+			dstFile, err := os.Create(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = copyPath(dstFile, srcFile)
+			if closeErr := dstFile.Close(); err == nil {
+				err = closeErr
+			}
+			if name == "reflink" && err != nil {
+				t.Skipf("filesystem has no reflinks: %v", err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := ComputeChecksum(dst); err != nil || got != want {
+				t.Errorf("checksum %s (%v), want %s", got, err, want)
+			}
+		})
+	}
+
+	// CopyFileChecksum hashes whichever path it takes
+	got, err := CopyFileChecksum(src, filepath.Join(dir, "copied.bin"), nil)
+	if err != nil || got != want {
+		t.Errorf("CopyFileChecksum = %s (%v), want %s", got, err, want)
+	}
+}
+
+// BenchmarkCopyLargePayload copies a 200 MB payload the way addFile does,
+// with CopyFileChecksum, through the 32 KiB buffer io.Copy used before and
+// through the default 1 MiB buffer. copy_file_range is the path of
+// --verify-readback, which leaves the data in the kernel.
+func BenchmarkCopyLargePayload(b *testing.B) {
+	dir := b.TempDir()
+	src := writePayload(b, dir, 200<<20)
+	dst := filepath.Join(dir, "installed.bin")
+	defer func(size int) { CopyBufferSize = size }(CopyBufferSize)
+	for _, bench := range []struct {
+		name   string
+		buffer int
+		copy   func() error
+	}{
+		{"buffer-32KiB", 32 << 10, func() error { _, err := CopyFileChecksum(src, dst, nil); return err }},
+		{"buffer-1MiB", DefaultCopyBufferSize, func() error { _, err := CopyFileChecksum(src, dst, nil); return err }},
+		{"copy_file_range", DefaultCopyBufferSize, func() error { return CopyFileProgress(src, dst, nil) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			CopyBufferSize = bench.buffer
+			b.SetBytes(200 << 20)
+			for i := 0; i < b.N; i++ {
+				if err := bench.copy(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
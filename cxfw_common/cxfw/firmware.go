@@ -0,0 +1,167 @@
+package cxfw
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultFirmwareVersionFile holds the installed firmware version.
+const DefaultFirmwareVersionFile = "/etc/cxfw-release"
+
+// firmwareVersion is a parsed firmware version: numeric release components
+// and an optional pre-release such as "rc2". Build metadata is dropped.
+type firmwareVersion struct {
+	release    []int
+	prerelease string
+}
+
+// versionChunks splits pre-release identifiers into runs of digits and
+// non-digits, so "rc10" orders after "rc2".
+var versionChunks = regexp.MustCompile(`\d+|[^\d.]+`)
+
+func parseFirmwareVersion(version string) (firmwareVersion, error) {
+	var parsed firmwareVersion
+	s := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, parsed.prerelease, _ = strings.Cut(s, "-")
+	for _, component := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(component)
+		if err != nil || n < 0 {
+			return parsed, fmt.Errorf("invalid firmware version %q", version)
+		}
+		parsed.release = append(parsed.release, n)
+	}
+	return parsed, nil
+}
+
+// comparePrerelease orders pre-releases chunk by chunk, numbers by value and
+// text lexically. A version without a pre-release orders after any with one.
+func comparePrerelease(a, b string) int {
+	if a == "" || b == "" {
+		return strings.Compare(b, a)
+	}
+	chunksA, chunksB := versionChunks.FindAllString(a, -1), versionChunks.FindAllString(b, -1)
+	for i := 0; i < len(chunksA) && i < len(chunksB); i++ {
+		numA, errA := strconv.Atoi(chunksA[i])
+		numB, errB := strconv.Atoi(chunksB[i])
+		switch {
+		case errA == nil && errB == nil && numA != numB:
+			if numA < numB {
+				return -1
+			}
+			return 1
+		case errA != nil || errB != nil:
+			if c := strings.Compare(chunksA[i], chunksB[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(chunksA) - len(chunksB)
+}
+
+// compare orders v against bound. When precision is set, only the release
+// components bound gives are compared, so a maximum of "4.2" admits 4.2.1
+// and 4.2.0-rc1.
+func (v firmwareVersion) compare(bound firmwareVersion, precision bool) int {
+	n := max(len(v.release), len(bound.release))
+	if precision {
+		n = len(bound.release)
+	}
+	for i := 0; i < n; i++ {
+		var a, b int
+		if i < len(v.release) {
+			a = v.release[i]
+		}
+		if i < len(bound.release) {
+			b = bound.release[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	if precision && bound.prerelease == "" {
+		return 0
+	}
+	return comparePrerelease(v.prerelease, bound.prerelease)
+}
+
+// CheckFirmwareRange reports an error if installed is below minimum or
+// above maximum. Either bound may be empty. Both are inclusive, and the
+// maximum covers every release it is a prefix of.
+func CheckFirmwareRange(installed, minimum, maximum string) error {
+	version, err := parseFirmwareVersion(installed)
+	if err != nil {
+		return err
+	}
+	if minimum != "" {
+		bound, err := parseFirmwareVersion(minimum)
+		if err != nil {
+			return fmt.Errorf("min_firmware_version: %w", err)
+		}
+		if version.compare(bound, false) < 0 {
+			return fmt.Errorf("firmware %s is older than the minimum %s", installed, minimum)
+		}
+	}
+	if maximum != "" {
+		bound, err := parseFirmwareVersion(maximum)
+		if err != nil {
+			return fmt.Errorf("max_firmware_version: %w", err)
+		}
+		if version.compare(bound, true) > 0 {
+			return fmt.Errorf("firmware %s is newer than the maximum %s", installed, maximum)
+		}
+	}
+	return nil
+}
+
+// ValidateFirmwareRange checks that the manifest's firmware bounds parse.
+func ValidateFirmwareRange(manifest *Manifest) error {
+	_, err := parseFirmwareVersion(manifest.MinFirmwareVersion)
+	if manifest.MinFirmwareVersion != "" && err != nil {
+		return fmt.Errorf("min_firmware_version: %w", err)
+	}
+	_, err = parseFirmwareVersion(manifest.MaxFirmwareVersion)
+	if manifest.MaxFirmwareVersion != "" && err != nil {
+		return fmt.Errorf("max_firmware_version: %w", err)
+	}
+	return nil
+}
+
+// ReadFirmwareVersion reads the installed firmware version from path. With
+// an empty key the first non-blank line is the version; otherwise path is
+// read as key=value lines, like .defaultvalues, and key's value is used. A
+// version that does not parse is an error too.
+func ReadFirmwareVersion(path, key string) (string, error) {
+	data, err := os.ReadFile(HostPath(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read firmware version: %w", err)
+	}
+	version := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if key == "" && line != "" && !strings.HasPrefix(line, "#") {
+			version = line
+			break
+		}
+		if name, value, ok := strings.Cut(line, "="); ok && key != "" && strings.TrimSpace(name) == key {
+			version = strings.Trim(strings.TrimSpace(value), `"'`)
+			break
+		}
+	}
+	switch {
+	case version == "" && key != "":
+		return "", fmt.Errorf("no %s entry in %s", key, path)
+	case version == "":
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	if _, err := parseFirmwareVersion(version); err != nil {
+		return "", fmt.Errorf("%w in %s", err, path)
+	}
+	return version, nil
+}
@@ -0,0 +1,435 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Structure for integrity database entries. Size, Mode and MTime describe
+// the file as installed, so a verifier can stat-compare it before hashing
+// and notice permission changes; entries written by older versions lack
+// them.
+type IntegrityEntry struct {
+	Path  string `json:"path"`
+	Hash  string `json:"hash"`
+	Size  int64  `json:"size,omitempty"`
+	Mode  string `json:"mode,omitempty"`  // permission bits in octal, e.g. "4755" for a setuid binary
+	MTime string `json:"mtime,omitempty"` // RFC 3339 with nanoseconds, in UTC
+}
+
+// newIntegrityEntry is the entry recording hash for the file at path, given
+// as host path, with the size, mode and mtime the file has now. A file that
+// cannot be stat'ed is recorded with its hash only.
+func newIntegrityEntry(path, hash string) IntegrityEntry {
+	entry := IntegrityEntry{Path: ImagePath(path), Hash: hash}
+	info, err := os.Lstat(path)
+	if err != nil {
+		LogToFile("WARNING: Recording only the hash of " + path + " in the integrity database - " + err.Error())
+		return entry
+	}
+	entry.Size = info.Size()
+	entry.Mode = fmt.Sprintf("%04o", UnixMode(info.Mode()))
+	entry.MTime = info.ModTime().UTC().Format(time.RFC3339Nano)
+	return entry
+}
+
+// UnixMode is the permission bits of mode as chmod takes them, including
+// the setuid, setgid and sticky bits.
+func UnixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+// FileModeOf is the inverse of UnixMode: the os.FileMode of chmod-style
+// permission bits.
+func FileModeOf(bits uint32) os.FileMode {
+	mode := os.FileMode(bits).Perm()
+	if bits&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// Structure for folder-specific JSON content (e.g., .apps.json, .basic.json)
+type FolderEntry struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+}
+
+// UpdateIntegrityDatabase records hash for filePath in the .db.json of its
+// directory and returns the checksum of the rewritten database.
+func UpdateIntegrityDatabase(filePath, hash string) (string, error) {
+	return UpdateIntegrityEntries(filepath.Dir(filePath), []IntegrityEntry{{Path: filePath, Hash: hash}})
+}
+
+// UpdateIntegrityEntries records the hashes of files, given by host path
+// and all in dir, in the .db.json of dir with a single decrypt and encrypt
+// cycle, and returns the checksum of the database. The database is not
+// rewritten when every hash is already recorded. With DeferIntegrityUpdates
+// the hashes are only collected and the checksum is empty.
+func UpdateIntegrityEntries(dir string, files []IntegrityEntry) (string, error) {
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+	if deferIntegrity {
+		deferIntegrityEntries(dir, files)
+		return "", nil
+	}
+	if pendingIntegrity[dir] != nil {
+		deferIntegrityEntries(dir, files)
+		return flushIntegrityDir(dir)
+	}
+	return updateIntegrityEntries(dir, files)
+}
+
+// updateIntegrityEntries is UpdateIntegrityEntries writing to the database
+// right away.
+func updateIntegrityEntries(dir string, files []IntegrityEntry) (string, error) {
+	dbPath := filepath.Join(dir, ".db.json")
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return "", fmt.Errorf("failed to extract key: %w", err)
+	}
+
+	db, err := readDatabase(dir, dbPath, key)
+	if err != nil {
+		return "", err
+	}
+	entries := db.entries
+
+	// Update existing entries by path, add the rest
+	index := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		if _, ok := index[entry.Path]; !ok {
+			index[entry.Path] = i
+		}
+	}
+	changed := db.recovered
+	for _, file := range files {
+		entry := newIntegrityEntry(file.Path, file.Hash)
+		i, ok := index[entry.Path]
+		switch {
+		case ok && entries[i] == entry:
+			LogToFile("DEBUG: File already exists with matching hash in database - " + file.Path)
+		case ok && entries[i].Hash == file.Hash:
+			entries[i] = entry
+			changed = true
+			LogToFile("DEBUG: Updated existing file attributes in database - " + file.Path)
+		case ok:
+			entries[i] = entry
+			changed = true
+			LogToFile("DEBUG: Updated existing file hash in database - " + file.Path)
+		default:
+			index[entry.Path] = len(entries)
+			entries = append(entries, entry)
+			changed = true
+			LogToFile("DEBUG: Added new file entry to database - " + file.Path)
+		}
+	}
+	if !changed {
+		// Return current .db.json hash without modification
+		dbHash, err := ComputeChecksum(dbPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to compute db hash: %w", err)
+		}
+		return dbHash, nil
+	}
+
+	// Marshal updated data
+	updatedJSON, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal updated db: %w", err)
+	}
+
+	// Encrypt and write back
+	encryptedData, err := EncryptFileFor(key, updatedJSON, dbPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt updated db: %w", err)
+	}
+	// Drop the plaintext, a large database holds megabytes of it
+	entries, updatedJSON = nil, nil
+
+	if err := writeDatabase(dbPath, db, encryptedData); err != nil {
+		return "", err
+	}
+	encryptedData = nil
+	ReleaseMemory()
+
+	// Calculate hash of encrypted .db.json
+	dbHash, err := ComputeChecksum(dbPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute db hash: %w", err)
+	}
+
+	return dbHash, nil
+}
+
+// RemoveFromIntegrityDatabase drops the entry of filePath, whether or not
+// the file still exists, from the .db.json of its directory. It reports
+// whether the database was rewritten and returns its checksum; a database
+// without an entry for filePath is left untouched and the checksum empty.
+func RemoveFromIntegrityDatabase(filePath string) (bool, string, error) {
+	dir := filepath.Dir(filePath)
+	dbPath := filepath.Join(dir, ".db.json")
+	imagePath := ImagePath(filePath)
+	if err := flushPendingIntegrity(dir); err != nil {
+		return false, "", err
+	}
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		return false, "", err
+	}
+	defer unlock()
+
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return false, "", fmt.Errorf("failed to extract key: %w", err)
+	}
+
+	db, err := readDatabase(dir, dbPath, key)
+	if err != nil {
+		return false, "", err
+	}
+	entries := db.entries
+
+	// Remove the entry for the file
+	updatedEntries := []IntegrityEntry{}
+	found := false
+	for _, entry := range entries {
+		if entry.Path != imagePath {
+			updatedEntries = append(updatedEntries, entry)
+		} else {
+			found = true
+		}
+	}
+
+	if !found {
+		LogToFile("WARNING: File hash not found in integrity database - " + filePath)
+		if !db.recovered {
+			return false, "", nil
+		}
+	}
+
+	// Marshal updated data
+	updatedJSON, err := json.MarshalIndent(updatedEntries, "", "  ")
+	if err != nil {
+		return false, "", fmt.Errorf("failed to marshal updated db: %w", err)
+	}
+
+	// Encrypt and write back
+	encryptedData, err := EncryptFileFor(key, updatedJSON, dbPath)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to encrypt updated db: %w", err)
+	}
+	entries, updatedEntries, updatedJSON = nil, nil, nil
+
+	if err := writeDatabase(dbPath, db, encryptedData); err != nil {
+		return false, "", err
+	}
+	encryptedData = nil
+	ReleaseMemory()
+
+	// Calculate hash of encrypted .db.json
+	dbHash, err := ComputeChecksum(dbPath)
+	if err != nil {
+		return false, "", fmt.Errorf("failed to compute db hash: %w", err)
+	}
+
+	LogToFile("DEBUG: Integrity database updated - removed entry for " + filePath)
+	return true, dbHash, nil
+}
+
+// ClearIntegrityDatabase empties the .db.json of dir, if it has one.
+func ClearIntegrityDatabase(dir string) error {
+	dbPath := filepath.Join(dir, ".db.json")
+	if err := flushPendingIntegrity(dir); err != nil {
+		return err
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil
+	}
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return fmt.Errorf("failed to extract key: %w", err)
+	}
+	db, err := readDatabase(dir, dbPath, key)
+	if err != nil {
+		return err
+	}
+	count := len(db.entries)
+	db.entries = nil
+
+	encryptedData, err := EncryptFileFor(key, []byte("[]"), dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt updated db: %w", err)
+	}
+	if err := writeDatabase(dbPath, db, encryptedData); err != nil {
+		return err
+	}
+	ReleaseMemory()
+	LogToFile(fmt.Sprintf("INFO: Integrity database cleared - removed %d entries from %s", count, dbPath))
+	return nil
+}
+
+// PruneIntegrityDatabase drops the entries of filePaths, which must all be in
+// dir, from the .db.json of dir. It returns the number of entries removed and
+// the checksum of the rewritten database; the database is left untouched and
+// the checksum empty when none of the files is tracked.
+func PruneIntegrityDatabase(dir string, filePaths []string) (int, string, error) {
+	dbPath := filepath.Join(dir, ".db.json")
+	if err := flushPendingIntegrity(dir); err != nil {
+		return 0, "", err
+	}
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return 0, "", nil
+	}
+	unlock, err := lockDatabase(dbPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer unlock()
+
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to extract key: %w", err)
+	}
+	db, err := readDatabase(dir, dbPath, key)
+	if err != nil {
+		return 0, "", err
+	}
+	entries := db.entries
+
+	pruned := make(map[string]bool)
+	for _, path := range filePaths {
+		pruned[ImagePath(path)] = true
+	}
+	updatedEntries := []IntegrityEntry{}
+	for _, entry := range entries {
+		if pruned[entry.Path] {
+			LogToFile("DEBUG: Integrity database updated - removed entry for " + entry.Path)
+			continue
+		}
+		updatedEntries = append(updatedEntries, entry)
+	}
+	removed := len(entries) - len(updatedEntries)
+	if removed == 0 && !db.recovered {
+		return 0, "", nil
+	}
+
+	updatedJSON, err := json.MarshalIndent(updatedEntries, "", "  ")
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to marshal updated db: %w", err)
+	}
+	encryptedData, err := EncryptFileFor(key, updatedJSON, dbPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to encrypt updated db: %w", err)
+	}
+	entries, updatedEntries, updatedJSON = nil, nil, nil
+	if err := writeDatabase(dbPath, db, encryptedData); err != nil {
+		return 0, "", err
+	}
+	encryptedData = nil
+	ReleaseMemory()
+
+	dbHash, err := ComputeChecksum(dbPath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to compute db hash: %w", err)
+	}
+	return removed, dbHash, nil
+}
+
+// UpdateFolderFile stores dbHash, the checksum of the .db.json of dir, in the
+// folder file of dir. A folder file that already records dbHash is left
+// untouched. While the database of dir has deferred entries, the folder
+// file is updated when they are flushed instead.
+func UpdateFolderFile(dir, dbHash string) error {
+	integrityMu.Lock()
+	pending := pendingIntegrity[dir] != nil
+	integrityMu.Unlock()
+	if pending {
+		return nil
+	}
+	return updateFolderFile(dir, dbHash)
+}
+
+// updateFolderFile is UpdateFolderFile writing to the folder file right
+// away.
+func updateFolderFile(dir, dbHash string) error {
+	// Extract folder name and construct the specific JSON filename
+	folderName := filepath.Base(dir)
+	folderFile := filepath.Join(dir, "."+folderName+".json") // e.g., .apps.json, .basic.json
+	unlock, err := lockDatabase(folderFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return fmt.Errorf("failed to extract key: %w", err)
+	}
+
+	// Read and decrypt existing folder-specific JSON
+	folderData, err := readFolderFile(dir, folderFile, key)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to write when the folder file already records dbHash
+	if folderData.Hash == dbHash {
+		LogToFile("DEBUG: Folder database already records db hash: " + dbHash)
+		return nil
+	}
+
+	// Update the hash value (path remains constant)
+	folderData.Hash = dbHash
+
+	// Marshal updated data
+	updatedJSON, err := json.MarshalIndent(folderData, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal updated folder data: %w", err)
+	}
+
+	// Encrypt and write back
+	encryptedData, err := EncryptFileFor(key, updatedJSON, folderFile)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt updated folder data: %w", err)
+	}
+
+	err = WriteFileAtomic(folderFile, encryptedData, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write encrypted folder file: %w", err)
+	}
+
+	LogToFile("DEBUG: Folder database updated with db hash: " + dbHash)
+	return nil
+}
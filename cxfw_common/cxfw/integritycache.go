@@ -0,0 +1,112 @@
+package cxfw
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// deferIntegrity is set by DeferIntegrityUpdates: the hashes recorded by
+// UpdateIntegrityEntries are then collected in pendingIntegrity, by
+// directory, and written by FlushIntegrityDatabases.
+var deferIntegrity bool
+
+// pendingIntegrity holds the entries to record in the database of each
+// directory, the last hash recorded for a path winning. integrityMu guards
+// it, since a run stopped by a signal flushes it from another goroutine.
+var (
+	pendingIntegrity = make(map[string]*pendingDatabase)
+	integrityMu      sync.Mutex
+)
+
+// pendingDatabase is the deferred entries of one directory, in the order
+// they were first recorded.
+type pendingDatabase struct {
+	entries []IntegrityEntry
+	index   map[string]int
+}
+
+// DeferIntegrityUpdates makes UpdateIntegrityEntries and UpdateFolderFile
+// collect the hashes they record instead of rewriting the databases, so
+// that many files installed into one directory cost a single decrypt and
+// encrypt cycle of its .db.json and folder file when they are flushed.
+// Only hashes of files present on disk are deferred; removing entries
+// flushes the directory first and writes through.
+func DeferIntegrityUpdates(on bool) {
+	deferIntegrity = on
+}
+
+// IntegrityPending reports whether any database has deferred entries.
+func IntegrityPending() bool {
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+	return len(pendingIntegrity) > 0
+}
+
+// FlushIntegrityDatabases writes the deferred entries of every directory,
+// with one rewrite of its .db.json and folder file each, and stops at the
+// first directory that fails. The entries of the directories not written
+// stay pending.
+func FlushIntegrityDatabases() error {
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+	dirs := make([]string, 0, len(pendingIntegrity))
+	for dir := range pendingIntegrity {
+		dirs = append(dirs, dir)
+	}
+	slices.Sort(dirs)
+	for _, dir := range dirs {
+		if _, err := flushIntegrityDir(dir); err != nil {
+			return fmt.Errorf("failed to update integrity database of %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// flushPendingIntegrity writes the deferred entries of dir before its
+// database is changed otherwise.
+func flushPendingIntegrity(dir string) error {
+	integrityMu.Lock()
+	defer integrityMu.Unlock()
+	_, err := flushIntegrityDir(dir)
+	return err
+}
+
+// deferIntegrityEntries adds files to the deferred entries of dir.
+func deferIntegrityEntries(dir string, files []IntegrityEntry) {
+	pending := pendingIntegrity[dir]
+	if pending == nil {
+		pending = &pendingDatabase{index: make(map[string]int)}
+		pendingIntegrity[dir] = pending
+	}
+	for _, file := range files {
+		if i, ok := pending.index[file.Path]; ok {
+			pending.entries[i].Hash = file.Hash
+			continue
+		}
+		pending.index[file.Path] = len(pending.entries)
+		pending.entries = append(pending.entries, file)
+	}
+}
+
+// flushIntegrityDir writes the deferred entries of dir, if any, and the
+// checksum of the database to the folder file, and returns the checksum.
+// The caller holds integrityMu.
+func flushIntegrityDir(dir string) (string, error) {
+	pending := pendingIntegrity[dir]
+	if pending == nil {
+		return "", nil
+	}
+	dbHash, err := updateIntegrityEntries(dir, pending.entries)
+	if err != nil {
+		return "", err
+	}
+	delete(pendingIntegrity, dir)
+	if err := updateFolderFile(dir, dbHash); err != nil {
+		// The database is written, only its folder file needs another try
+		pendingIntegrity[dir] = &pendingDatabase{index: make(map[string]int)}
+		return "", err
+	}
+	LogToFile(fmt.Sprintf("INFO: Integrity database of %s updated with %d entries", dir, len(pending.entries)))
+	return dbHash, nil
+}
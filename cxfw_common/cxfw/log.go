@@ -0,0 +1,199 @@
+// Package cxfw holds the code shared by the patch executor and the rollback
+// binary: manifest types, logging, the encrypted integrity databases, the
+// backup index and storage error classification. Anything both binaries
+// must agree on belongs here so that the two cannot drift apart.
+package cxfw
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultLogFile is the patch log shared by the executor and the rollback
+// binary, unless --log-file or CXFW_LOG_FILE name another.
+const DefaultLogFile = "/newroot/var/log/cxfw_patch.log"
+
+// LogFile is the patch log in use.
+var LogFile = DefaultLogFile
+
+// SetLogFile makes path the patch log, creating its directory if missing.
+func SetLogFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	LogFile, logSize = path, -1
+	return nil
+}
+
+// Verbose mirrors every log entry to standard output, for an operator
+// watching the run. Otherwise only the final exit code line is printed
+// there, unless Quiet suppresses that too for scripted use.
+var Verbose, Quiet bool
+
+// EnvDefault returns the environment variable name, or fallback when it is
+// unset or empty. Flags whose default can come from the environment use it.
+func EnvDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// clockJumpThreshold is the largest disagreement between wall-clock and
+// monotonic elapsed time tolerated between two log entries before the step
+// is noted in the log (RTC starting at 1970, NTP correcting mid-patch, ...).
+const clockJumpThreshold = 2 * time.Second
+
+// RunStart carries a monotonic clock reading; all durations and log offsets
+// are measured against it so that wall-clock steps cannot make them negative.
+var RunStart = time.Now()
+
+// lastLogTime is the time of the previous log entry, used to detect steps.
+var lastLogTime = RunStart
+
+// Log levels, lowest first. Messages carry their level as a prefix such as
+// "DEBUG:" or "WARNING:"; messages without one, including SUCCESS and
+// SKIPPED lines and the run banners, are INFO.
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelWarning
+	LogLevelError
+)
+
+// logLevel is the lowest level written to the log, set by SetLogLevel.
+var logLevel = LogLevelInfo
+
+// SetLogLevel makes name, one of debug, info, warn or error, the lowest
+// level written to the log. Errors are always written.
+func SetLogLevel(name string) error {
+	switch strings.ToLower(name) {
+	case "debug":
+		logLevel = LogLevelDebug
+	case "info":
+		logLevel = LogLevelInfo
+	case "warn", "warning":
+		logLevel = LogLevelWarning
+	case "error":
+		logLevel = LogLevelError
+	default:
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+	}
+	return nil
+}
+
+// messageLevel returns the level of message from its prefix.
+func messageLevel(message string) int {
+	switch {
+	case strings.HasPrefix(message, "DEBUG:"):
+		return LogLevelDebug
+	case strings.HasPrefix(message, "WARNING:"):
+		return LogLevelWarning
+	case strings.HasPrefix(message, "ERROR:"):
+		return LogLevelError
+	}
+	return LogLevelInfo
+}
+
+// LogToFile writes message to the log unless its level is below the level
+// in use.
+func LogToFile(message string) {
+	if messageLevel(message) < logLevel {
+		return
+	}
+	writeLog(message)
+}
+
+// writeLog writes message to the log, and to standard output with
+// Verbose, whatever its level.
+func writeLog(message string) {
+	now := time.Now()
+	logEntry := ""
+
+	// Round(0) strips the monotonic reading, leaving only the wall clock
+	jump := now.Round(0).Sub(lastLogTime.Round(0)) - now.Sub(lastLogTime)
+	if jump > clockJumpThreshold || jump < -clockJumpThreshold {
+		logEntry += formatLogEntry(now, "WARNING: Wall clock stepped by "+jump.Round(time.Millisecond).String()+" since previous log entry")
+	}
+	lastLogTime = now
+	logEntry += formatLogEntry(now, message)
+
+	if Verbose {
+		os.Stdout.WriteString(logEntry)
+	}
+	logEntry = rotateLogIfNeeded(now, logEntry)
+	file, err := os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err == nil {
+		_, err = file.WriteString(logEntry)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logToStderr(logEntry, err)
+	}
+}
+
+// logFileFailed is set once the log file could not be written and the
+// fallback to standard error has been announced.
+var logFileFailed bool
+
+// logToStderr writes a log entry the log file did not take to standard
+// error instead, so a read-only or full /var still leaves a record. The
+// first fallback of the run is announced with the error.
+func logToStderr(logEntry string, err error) {
+	if !logFileFailed {
+		logFileFailed = true
+		fmt.Fprintf(os.Stderr, "********** WARNING: Cannot write log file %s, logging to standard error - %v **********\n", LogFile, err)
+	}
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(logEntry, "\n"), "\n") {
+		fmt.Fprintln(os.Stderr, "[log fallback] "+strings.TrimSuffix(line, "\n"))
+	}
+}
+
+// CheckLogFile returns an error if the log file cannot be opened for
+// writing, for runs that must not go ahead without a log.
+func CheckLogFile() error {
+	file, err := os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot write log file: %w", err)
+	}
+	return file.Close()
+}
+
+// maxCommentLength caps operation comments carried into logs.
+const maxCommentLength = 200
+
+// commentSecretPattern matches credential-looking assignments that must not
+// reach the log even when an author pastes them into a comment.
+var commentSecretPattern = regexp.MustCompile(`(?i)\b(password|passwd|secret|token|api[_-]?key)(\s*[=:]\s*)\S+`)
+
+// SanitizeComment makes an operation comment safe to log: control characters
+// are flattened to spaces, credentials are redacted and the length is capped.
+func SanitizeComment(comment string) string {
+	comment = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, comment)
+	comment = commentSecretPattern.ReplaceAllString(strings.TrimSpace(comment), "${1}${2}[REDACTED]")
+	if runes := []rune(comment); len(runes) > maxCommentLength {
+		comment = string(runes[:maxCommentLength]) + "..."
+	}
+	return comment
+}
+
+// OperationStartMessage is the log line written before each operation runs.
+func OperationStartMessage(index, total int, op Operation) string {
+	message := fmt.Sprintf("INFO: Starting operation %d/%d: %s", index+1, total, op.Operation)
+	if comment := SanitizeComment(op.Comment); comment != "" {
+		message += " - " + comment
+	}
+	return message
+}
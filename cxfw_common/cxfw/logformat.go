@@ -0,0 +1,123 @@
+package cxfw
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Log formats. Plain lines read
+// "<UTC time> | +<offset>s | <run ID> | <message>"; JSON lines are one
+// object per entry for log shippers.
+const (
+	LogFormatPlain = "plain"
+	LogFormatJSON  = "json"
+)
+
+// logFormat is the format of log entries, set by SetLogFormat.
+var logFormat = LogFormatPlain
+
+// SetLogFormat makes format, plain or json, the format of log entries.
+func SetLogFormat(format string) error {
+	switch format {
+	case LogFormatPlain, LogFormatJSON:
+		logFormat = format
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q, expected %s or %s", format, LogFormatPlain, LogFormatJSON)
+}
+
+// RunID identifies the run on every log entry, in the report and in the
+// patch history, so the entries of one run can be told from the others in
+// a shared log. It is empty until SetRunID.
+var RunID string
+
+// runIDPattern is the form of run IDs, safe in log lines and file names.
+var runIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// SetRunID makes id the ID of the run, or a new random ID if id is empty.
+func SetRunID(id string) error {
+	if id == "" {
+		random := make([]byte, 4)
+		if _, err := rand.Read(random); err != nil {
+			return fmt.Errorf("failed to generate run ID: %w", err)
+		}
+		id = hex.EncodeToString(random)
+	}
+	if !runIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid run ID %q, expected up to 64 letters, digits, '.', '_' or '-'", id)
+	}
+	RunID = id
+	return nil
+}
+
+// logOperation is the operation JSON log entries are attributed to.
+var logOperation struct {
+	index     int
+	operation string
+	path      string
+}
+
+// SetLogOperation attributes the following log entries to the operation op
+// at the 0-based index, until ClearLogOperation.
+func SetLogOperation(index int, op Operation) {
+	logOperation.index, logOperation.operation, logOperation.path = index+1, op.Operation, op.Path
+}
+
+// ClearLogOperation ends the attribution of SetLogOperation.
+func ClearLogOperation() {
+	logOperation.index, logOperation.operation, logOperation.path = 0, "", ""
+}
+
+// messagePrefixes are the message prefixes JSON entries take their level
+// from. Messages without one, such as the run banners, are INFO.
+var messagePrefixes = []string{"DEBUG", "INFO", "WARNING", "ERROR", "SUCCESS", "SKIPPED-BY-FLAG", "SKIPPED"}
+
+// jsonLogEntry is one log entry in the JSON format.
+type jsonLogEntry struct {
+	Time    string  `json:"ts"`
+	Offset  float64 `json:"mono_s"`
+	Level   string  `json:"level"`
+	Message string  `json:"msg"`
+	OpIndex int     `json:"op_index,omitempty"`
+	OpType  string  `json:"op_type,omitempty"`
+	Path    string  `json:"path,omitempty"`
+	RunID   string  `json:"run_id,omitempty"`
+}
+
+// formatLogEntry renders a log entry in the log format. Both formats carry
+// the UTC wall-clock time and the monotonic offset since the start of the
+// run, to the millisecond, the run ID if set and the message.
+func formatLogEntry(t time.Time, message string) string {
+	if logFormat != LogFormatJSON {
+		prefix := t.UTC().Format("2006-01-02 15:04:05Z") + " | " + fmt.Sprintf("+%.3fs", t.Sub(RunStart).Seconds()) + " | "
+		if RunID != "" {
+			prefix += RunID + " | "
+		}
+		return prefix + message + "\n"
+	}
+	entry := jsonLogEntry{
+		Time:    t.UTC().Format(time.RFC3339Nano),
+		Offset:  math.Round(t.Sub(RunStart).Seconds()*1000) / 1000,
+		Level:   "INFO",
+		Message: message,
+		OpIndex: logOperation.index,
+		OpType:  logOperation.operation,
+		Path:    logOperation.path,
+		RunID:   RunID,
+	}
+	for _, level := range messagePrefixes {
+		if rest, ok := strings.CutPrefix(message, level+":"); ok {
+			entry.Level, entry.Message = level, strings.TrimSpace(rest)
+			break
+		}
+	}
+	// A struct of strings and an int always marshals
+	data, _ := json.Marshal(entry)
+	return string(data) + "\n"
+}
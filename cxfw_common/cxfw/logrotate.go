@@ -0,0 +1,95 @@
+package cxfw
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Defaults of the log rotation: the log is rotated once it would grow past
+// 1 MiB, keeping three rotated generations next to it.
+const (
+	DefaultLogMaxSize = 1 << 20
+	DefaultLogKeep    = 3
+)
+
+// logMaxSize is the size in bytes the log may reach before it is rotated,
+// or 0 to let it grow; logKeep is the number of rotated generations kept.
+var (
+	logMaxSize int64 = DefaultLogMaxSize
+	logKeep          = DefaultLogKeep
+)
+
+// logSize is the size of the log as last seen, or -1 until the first entry
+// of the run checks it.
+var logSize int64 = -1
+
+// runHeader is the first entry of the run, repeated at the top of the log
+// when the log is rotated mid-run so the run stays readable on its own.
+var runHeader string
+
+// SetLogRotation makes the log rotate to LogFile.1, LogFile.2, ... once it
+// would grow past maxSize bytes, keeping keep generations. A maxSize of 0
+// never rotates; a keep of 0 discards the old log instead.
+func SetLogRotation(maxSize int64, keep int) error {
+	if maxSize < 0 {
+		return fmt.Errorf("invalid log size limit %d", maxSize)
+	}
+	if keep < 0 {
+		return fmt.Errorf("invalid number of log generations %d", keep)
+	}
+	logMaxSize, logKeep = maxSize, keep
+	return nil
+}
+
+// rotateLogIfNeeded rotates the log before entry, written at now, is
+// appended if the entry would take it past the size limit, and returns what
+// to append. The first entry of the run rotates a log left too large by
+// earlier runs; a later entry rotates the log of a long run, which then
+// starts over with the run's header line.
+func rotateLogIfNeeded(now time.Time, entry string) string {
+	if logSize < 0 {
+		logSize = 0
+		if info, err := os.Stat(LogFile); err == nil {
+			logSize = info.Size()
+		}
+	}
+	firstEntry := runHeader == ""
+	if firstEntry {
+		runHeader = entry
+	}
+	if logMaxSize > 0 && logSize > 0 && logSize+int64(len(entry)) > logMaxSize {
+		// A failed rotation is retried once the log has grown by the limit again
+		logSize = 0
+		if err := rotateLog(); err != nil {
+			entry = formatLogEntry(now, "WARNING: Failed to rotate log - "+err.Error()) + entry
+		} else if !firstEntry {
+			note := "INFO: Log rotated, earlier entries of this run are in " + filepath.Base(LogFile) + ".1"
+			if logKeep == 0 {
+				note = "INFO: Log rotated, earlier entries of this run were discarded"
+			}
+			entry = runHeader + formatLogEntry(now, note) + entry
+		}
+	}
+	logSize += int64(len(entry))
+	return entry
+}
+
+// rotateLog shifts the rotated generations up by one, dropping the oldest,
+// and moves the log to LogFile.1.
+func rotateLog() error {
+	if logKeep == 0 {
+		if err := os.Remove(LogFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for generation := logKeep - 1; generation >= 1; generation-- {
+		older := fmt.Sprintf("%s.%d", LogFile, generation)
+		if err := os.Rename(older, fmt.Sprintf("%s.%d", LogFile, generation+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(LogFile, LogFile+".1")
+}
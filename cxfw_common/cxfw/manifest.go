@@ -0,0 +1,198 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type Manifest struct {
+	Version               string      `json:"version"`
+	SessionID             string      `json:"session_id,omitempty"`
+	Part                  int         `json:"part,omitempty"`
+	Of                    int         `json:"of,omitempty"`
+	StrictPermissions     bool        `json:"strict_permissions,omitempty"`
+	ServiceTemplate       string      `json:"service_template,omitempty"`
+	Reboot                bool        `json:"reboot,omitempty"`
+	PreCheck              string      `json:"pre_check,omitempty"`
+	PostCheck             string      `json:"post_check,omitempty"`
+	Target                *Target     `json:"target,omitempty"`
+	MinFirmwareVersion    string      `json:"min_firmware_version,omitempty"`
+	MaxFirmwareVersion    string      `json:"max_firmware_version,omitempty"`
+	AllowUnknownVersion   bool        `json:"allow_unknown_version,omitempty"`
+	DefaultTimeoutSeconds int         `json:"default_timeout_seconds,omitempty"`
+	Operations            []Operation `json:"operations"`
+
+	// VersionID is the filesystem-safe form of Version, set by
+	// NormalizeVersion. It names anything stored per patch version.
+	VersionID string `json:"-"`
+}
+
+// Target restricts operations to devices of the given architectures and
+// models. An empty list matches any device.
+type Target struct {
+	Arch  StringList `json:"arch,omitempty"`
+	Model StringList `json:"model,omitempty"`
+}
+
+// StringList is a manifest field given either as a single string or as a
+// list of strings.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or a list of strings, got %s", data)
+	}
+	*l = list
+	return nil
+}
+
+// BatchFile is one file of a batch add, installed into the operation's
+// path as Name, or as the base name of Source.
+type BatchFile struct {
+	Source   string `json:"source"`
+	Name     string `json:"name,omitempty"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+type Operation struct {
+	Operation         string                       `json:"operation"`
+	Path              string                       `json:"path,omitempty"`
+	Paths             []string                     `json:"paths,omitempty"`
+	Source            string                       `json:"source,omitempty"`
+	Checksum          string                       `json:"checksum,omitempty"`
+	Size              int64                        `json:"size,omitempty"`
+	Files             []BatchFile                  `json:"files,omitempty"`
+	Command           string                       `json:"command,omitempty"`
+	Argv              []string                     `json:"argv,omitempty"`
+	Script            string                       `json:"script_content,omitempty"`
+	ScriptBase64      string                       `json:"script_content_base64,omitempty"`
+	Entries           map[string]map[string]string `json:"entries,omitempty"`
+	KeepSource        bool                         `json:"keep_source,omitempty"`
+	BaseChecksum      string                       `json:"base_checksum,omitempty"`
+	Content           string                       `json:"content,omitempty"`
+	ContentBase64     string                       `json:"content_base64,omitempty"`
+	Mode              string                       `json:"mode,omitempty"`
+	Owner             string                       `json:"owner,omitempty"`
+	Group             string                       `json:"group,omitempty"`
+	Create            bool                         `json:"create,omitempty"`
+	Comment           string                       `json:"comment,omitempty"`
+	Condition         string                       `json:"condition,omitempty"`
+	Arch              StringList                   `json:"arch,omitempty"`
+	Model             StringList                   `json:"model,omitempty"`
+	Pattern           string                       `json:"pattern,omitempty"`
+	Replacement       string                       `json:"replacement,omitempty"`
+	Count             int                          `json:"count,omitempty"`
+	AllowNoMatch      bool                         `json:"allow_no_match,omitempty"`
+	Diff              string                       `json:"diff,omitempty"`
+	Name              string                       `json:"name,omitempty"`
+	Action            string                       `json:"action,omitempty"`
+	Icon              string                       `json:"icon,omitempty"`
+	Params            string                       `json:"params,omitempty"`
+	Entry             string                       `json:"entry,omitempty"`
+	User              string                       `json:"user,omitempty"`
+	UID               *int                         `json:"uid,omitempty"`
+	GID               *int                         `json:"gid,omitempty"`
+	Home              string                       `json:"home,omitempty"`
+	Shell             string                       `json:"shell,omitempty"`
+	Timeout           int                          `json:"timeout,omitempty"`
+	TimeoutSeconds    int                          `json:"timeout_seconds,omitempty"`
+	ExpectedExitCodes []int                        `json:"expected_exit_codes,omitempty"`
+	AllowFailure      bool                         `json:"allow_failure,omitempty"`
+	WorkingDir        string                       `json:"working_dir,omitempty"`
+	DelaySeconds      int                          `json:"delay_seconds,omitempty"`
+	Absent            bool                         `json:"absent,omitempty"`
+	Retries           int                          `json:"retries,omitempty"`
+	RetryDelaySeconds int                          `json:"retry_delay_seconds,omitempty"`
+	AllowInsecure     bool                         `json:"allow_insecure,omitempty"`
+	VerifyMount       bool                         `json:"verify_mount,omitempty"`
+	OlderThanDays     int                          `json:"older_than_days,omitempty"`
+	MaxDelete         int                          `json:"max_delete,omitempty"`
+}
+
+// StdinManifest is the manifest argument that reads the manifest from
+// standard input, for agents that generate manifests in memory.
+const StdinManifest = "-"
+
+// ManifestName returns path as logged, <stdin> for StdinManifest.
+func ManifestName(path string) string {
+	if path == StdinManifest {
+		return "<stdin>"
+	}
+	return path
+}
+
+// ReadManifest returns the bytes of the manifest at path, or of standard
+// input for StdinManifest.
+func ReadManifest(path string) ([]byte, error) {
+	if path != StdinManifest {
+		return os.ReadFile(path)
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest from standard input: %w", err)
+	}
+	return data, nil
+}
+
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ReadManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(data)
+}
+
+// ParseManifest parses manifest bytes, e.g. the exact bytes whose signature
+// was verified.
+func ParseManifest(data []byte) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// versionPattern is the documented manifest version format: MAJOR.MINOR with
+// an optional .PATCH, pre-release and build suffix, semver style, e.g.
+// "1.0", "2.3.1" or "2.3.1-hotfix.2+build7". Versions are lowercase and a
+// leading "v" is dropped during normalization.
+var versionPattern = regexp.MustCompile(`^\d+\.\d+(\.\d+)?(-[0-9a-z]+(\.[0-9a-z]+)*)?(\+[0-9a-z]+(\.[0-9a-z]+)*)?$`)
+
+// unsafeVersionChars matches runs of characters that are replaced when a
+// legacy version is turned into an identifier usable in file names.
+var unsafeVersionChars = regexp.MustCompile(`[^0-9a-z._-]+`)
+
+// NormalizeVersion validates manifest.Version and normalizes it to
+// lowercase without a leading "v". A version outside the documented format
+// is rejected unless allowLegacy is set; it then keeps its original string
+// and gets a sanitized VersionID derived from it. legacy reports whether
+// that fallback was used.
+func NormalizeVersion(manifest *Manifest, allowLegacy bool) (legacy bool, err error) {
+	version := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(manifest.Version)), "v")
+	if versionPattern.MatchString(version) {
+		manifest.Version = version
+		manifest.VersionID = version
+		return false, nil
+	}
+	if !allowLegacy {
+		return false, fmt.Errorf("invalid manifest version %q, expected MAJOR.MINOR[.PATCH][-PRERELEASE][+BUILD]", manifest.Version)
+	}
+
+	id := strings.Trim(unsafeVersionChars.ReplaceAllString(strings.ToLower(manifest.Version), "_"), "_.-")
+	if id == "" {
+		id = "legacy"
+	}
+	manifest.VersionID = id
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package cxfw
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// DefaultCopyBufferSize is the buffer used to copy and hash payloads unless
+// SetCopyBufferSize sets another size. Multi-hundred-megabyte payloads copy
+// measurably faster with it than with the 32 KiB of io.Copy.
+const DefaultCopyBufferSize = 1024 * 1024
+
+// CopyBufferSize is the buffer used to copy and hash payloads; a memory
+// budget set by SetMemoryBudget shrinks it.
+var CopyBufferSize = DefaultCopyBufferSize
+
+// SetCopyBufferSize makes size, between 4 KiB and 64 MiB, the size of the
+// copy buffer.
+func SetCopyBufferSize(size int) error {
+	if size < 4*1024 || size > 64*1024*1024 {
+		return fmt.Errorf("invalid copy buffer size %d KiB, expected 4 KiB to 64 MiB", size>>10)
+	}
+	CopyBufferSize = size
+	return nil
+}
+
+// memoryBudget is the memory, in bytes, the binary may use, or 0 when
+// unlimited.
+var memoryBudget int64
+
+// SetMemoryBudget caps CopyBufferSize for a budget of the given number of
+// bytes and sets it as the soft limit of the Go heap, so the collector runs
+// harder instead of growing past it. Scripts and commands run by the patch
+// are separate processes and need the rest of the RAM, which is why the
+// decrypted integrity databases are released after every flush once a
+// budget is set.
+func SetMemoryBudget(budget int64) {
+	memoryBudget = budget
+	CopyBufferSize = int(min(int64(CopyBufferSize), max(budget/256, 4*1024)))
+	debug.SetMemoryLimit(budget)
+}
+
+// NewCopyBuffer returns a buffer of CopyBufferSize for io.CopyBuffer.
+func NewCopyBuffer() []byte {
+	return make([]byte, CopyBufferSize)
+}
+
+// ReleaseMemory returns freed heap memory to the operating system when a
+// memory budget is set. Without a budget the runtime releases it lazily.
+func ReleaseMemory() {
+	if memoryBudget > 0 {
+		debug.FreeOSMemory()
+	}
+}
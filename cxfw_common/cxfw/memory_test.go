@@ -0,0 +1,75 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestIntegrityUpdateReleasesDecryptedDatabase(t *testing.T) {
+	dir := t.TempDir()
+	defer func(logFile, keyFile string) { LogFile, KeyFile = logFile, keyFile }(LogFile, KeyFile)
+	LogFile, KeyFile = filepath.Join(dir, "cxfw_patch.log"), filepath.Join(dir, "key.bin")
+	key := make([]byte, 32)
+	if err := os.WriteFile(KeyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// A database of some 10 MB of JSON, like that of a large app directory
+	entries := make([]IntegrityEntry, 50000)
+	for i := range entries {
+		entries[i] = IntegrityEntry{
+			Path:  filepath.Join(dir, fmt.Sprintf("lib/module_%06d.so", i)),
+			Hash:  fmt.Sprintf("%064x", i),
+			Size:  int64(i),
+			Mode:  "644",
+			MTime: "2025-04-01T12:00:00.123456789Z",
+		}
+	}
+	plaintext, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPath := filepath.Join(dir, ".db.json")
+	encrypted, err := EncryptFileFor(key, plaintext, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dbPath, encrypted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dbSize := uint64(len(plaintext))
+	entries, plaintext, encrypted = nil, nil, nil
+	installed := filepath.Join(dir, "installed.bin")
+	if err := os.WriteFile(installed, []byte("payload"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(size int) {
+		memoryBudget, CopyBufferSize = 0, size
+		debug.SetMemoryLimit(math.MaxInt64)
+	}(CopyBufferSize)
+	SetMemoryBudget(64 << 20)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if _, err := UpdateIntegrityEntries(dir, []IntegrityEntry{{Path: installed, Hash: fmt.Sprintf("%064x", 1)}}); err != nil {
+		t.Fatal(err)
+	}
+	// No collection here: the update itself must have dropped and freed
+	// the decrypted database and returned the memory to the system
+	runtime.ReadMemStats(&after)
+
+	if grown := int64(after.HeapAlloc) - int64(before.HeapAlloc); grown > int64(dbSize/4) {
+		t.Errorf("heap grew by %d bytes over an update of a %d byte database, want the decrypted database released", grown, dbSize)
+	}
+	if retained := after.HeapIdle - after.HeapReleased; retained > dbSize {
+		t.Errorf("%d bytes of idle heap kept from the system after an update of a %d byte database, want them released", retained, dbSize)
+	}
+}
@@ -0,0 +1,139 @@
+package cxfw
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultOutputLimit is how much output of one command or script goes into
+// the log unless SetOutputLimit sets another limit.
+const DefaultOutputLimit = 64 << 10
+
+// outputLimit is the number of bytes of output logged per command or script.
+var outputLimit int64 = DefaultOutputLimit
+
+// maxOutputLine is the length at which an unterminated line of output is
+// cut into a line of its own.
+const maxOutputLine = 4 << 10
+
+// outputTailLines is how many of the last lines of output a failed command
+// or script carries in its error, for the summary and the report.
+const outputTailLines = 5
+
+// SetOutputLimit makes limit the number of bytes of output logged for one
+// command or script. Output past it is dropped from the log, which notes
+// the truncation; 0 logs no output.
+func SetOutputLimit(limit int64) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid output limit %d", limit)
+	}
+	outputLimit = limit
+	return nil
+}
+
+// OutputCapture collects the standard output and standard error of a
+// command or script as lines prefixed CMD-OUT and CMD-ERR, in the order the
+// process wrote them, so that they can be written to the log.
+type OutputCapture struct {
+	mu        sync.Mutex
+	lines     []string
+	size      int64
+	truncated int64
+	streams   []*outputStream
+
+	// Stdout and Stderr are the writers to give the process.
+	Stdout, Stderr io.Writer
+}
+
+// outputStream is one stream of an OutputCapture, holding the line it has
+// not finished yet and its last lines.
+type outputStream struct {
+	capture *OutputCapture
+	prefix  string
+	pending []byte
+	tail    []string
+}
+
+// NewOutputCapture returns an empty capture.
+func NewOutputCapture() *OutputCapture {
+	c := &OutputCapture{}
+	stdout := &outputStream{capture: c, prefix: "CMD-OUT: "}
+	stderr := &outputStream{capture: c, prefix: "CMD-ERR: "}
+	c.Stdout, c.Stderr, c.streams = stdout, stderr, []*outputStream{stdout, stderr}
+	return c
+}
+
+func (s *outputStream) Write(p []byte) (int, error) {
+	s.capture.mu.Lock()
+	defer s.capture.mu.Unlock()
+	s.pending = append(s.pending, p...)
+	for {
+		line, rest, found := bytes.Cut(s.pending, []byte("\n"))
+		// A longer line is cut rather than held until the process exits
+		if !found && len(s.pending) <= maxOutputLine {
+			break
+		}
+		s.capture.add(s, strings.TrimRight(string(line), "\r"))
+		s.pending = rest
+		if !found {
+			s.pending = nil
+			break
+		}
+	}
+	return len(p), nil
+}
+
+// add records a line of stream, keeping it for the log while within the
+// limit and among the stream's tail always. The caller holds c.mu.
+func (c *OutputCapture) add(stream *outputStream, line string) {
+	line = stream.prefix + line
+	if c.size+int64(len(line)) <= outputLimit && c.truncated == 0 {
+		c.lines = append(c.lines, line)
+		c.size += int64(len(line))
+	} else {
+		c.truncated += int64(len(line))
+	}
+	stream.tail = append(stream.tail, line)
+	if len(stream.tail) > outputTailLines {
+		stream.tail = stream.tail[1:]
+	}
+}
+
+// Log finishes the unterminated last lines and writes the output to the log,
+// noting how much was left out.
+func (c *OutputCapture) Log() {
+	c.mu.Lock()
+	for _, stream := range c.streams {
+		if len(stream.pending) > 0 {
+			c.add(stream, string(stream.pending))
+			stream.pending = nil
+		}
+	}
+	lines, truncated := c.lines, c.truncated
+	c.lines = nil
+	c.mu.Unlock()
+
+	for _, line := range lines {
+		LogToFile(line)
+	}
+	if truncated > 0 {
+		LogToFile(fmt.Sprintf("WARNING: Output truncated, %d more bytes not logged", truncated))
+	}
+}
+
+// Tail returns the last lines of standard error, or of standard output if
+// the process wrote nothing to standard error, joined for an error message.
+// The two streams reach the capture through separate pipes, so the error
+// a process prints last may arrive before the output preceding it.
+func (c *OutputCapture) Tail() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stdout, stderr := c.streams[0], c.streams[1]
+	if len(stderr.tail) > 0 {
+		return strings.Join(stderr.tail, " | ")
+	}
+	return strings.Join(stdout.tail, " | ")
+}
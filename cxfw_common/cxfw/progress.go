@@ -0,0 +1,158 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// DefaultProgressFile is where the on-device UI polls the progress of a
+// run, of the executor or the rollback binary, unless --progress-file
+// names another file.
+const DefaultProgressFile = "/tmp/cxfw_patch_progress.json"
+
+// progressInterval limits how often byte progress rewrites the file.
+const progressInterval = 500 * time.Millisecond
+
+// ProgressPath is the progress file of the run, or empty for none.
+var ProgressPath string
+
+// progressFD receives every progress update as one JSON line, for a caller
+// that would rather read a pipe than poll the progress file. Nil for none.
+var progressFD *os.File
+
+// SetProgressFD streams progress updates to the open file descriptor fd,
+// which the caller passed to the run, e.g. the write end of a pipe. fd 0
+// means none. The descriptor is not inherited by commands and scripts, so
+// the reader sees end of file when the run exits.
+func SetProgressFD(fd int) error {
+	if fd == 0 {
+		return nil
+	}
+	var stat syscall.Stat_t
+	if fd < 0 || syscall.Fstat(fd, &stat) != nil {
+		return fmt.Errorf("invalid progress file descriptor %d", fd)
+	}
+	syscall.CloseOnExec(fd)
+	progressFD = os.NewFile(uintptr(fd), "progress-fd")
+	return nil
+}
+
+// progressState is the content of the progress file. Mode is the Mode of
+// RunReport, so the UI tells a rollback from a patch being applied. State
+// is running until the run ends succeeded or failed, when the UI can stop
+// polling.
+type progressState struct {
+	Mode        string    `json:"mode"`
+	State       string    `json:"state"`
+	Operation   int       `json:"operation"`
+	Total       int       `json:"total"`
+	Description string    `json:"description"`
+	Percent     int       `json:"percent"`
+	BytesDone   int64     `json:"bytes_done,omitempty"`
+	BytesTotal  int64     `json:"bytes_total,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// progress is the state last written, with Total zero until the first
+// operation starts.
+var (
+	progress        progressState
+	progressWritten time.Time
+)
+
+// StartProgress records that the operation at index of total is starting.
+// op is the operation as given in the manifest.
+func StartProgress(index, total int, op Operation) {
+	description := SanitizeComment(op.Comment)
+	if description == "" {
+		description = op.Operation
+		if op.Path != "" {
+			description += " " + op.Path
+		}
+	}
+	progress = progressState{
+		Mode:        RunReport.Mode,
+		State:       "running",
+		Operation:   index + 1,
+		Total:       total,
+		Description: description,
+		Percent:     index * 100 / total,
+	}
+	writeProgress()
+}
+
+// CopyProgress returns a callback recording the bytes copied so far of
+// size bytes by the current operation, for CopyFileProgress.
+func CopyProgress(size int64) func(written int64) {
+	return func(written int64) {
+		if progress.Total == 0 || size <= 0 {
+			return
+		}
+		progress.BytesDone, progress.BytesTotal = written, size
+		done := min(written, size)
+		progress.Percent = int((int64(progress.Operation-1)*size + done) * 100 / (int64(progress.Total) * size))
+		if written >= size || time.Since(progressWritten) >= progressInterval {
+			writeProgress()
+		}
+	}
+}
+
+// ProgressWriter reports the bytes written through it to a CopyProgress
+// callback.
+type ProgressWriter struct {
+	written  int64
+	Progress func(written int64)
+}
+
+func (w *ProgressWriter) Write(p []byte) (int, error) {
+	w.written += int64(len(p))
+	w.Progress(w.written)
+	return len(p), nil
+}
+
+// finishProgress marks the progress file complete with the outcome of the
+// run, once an operation has started.
+func finishProgress(code int) {
+	if progress.Total == 0 {
+		return
+	}
+	progress.State = StateSucceeded
+	if code != 0 {
+		progress.State = StateFailed
+	} else {
+		progress.Operation, progress.Percent = progress.Total, 100
+	}
+	progress.BytesDone, progress.BytesTotal = 0, 0
+	writeProgress()
+}
+
+// writeProgress replaces the progress file and streams the update to the
+// progress file descriptor. Failing to write either never fails the run.
+func writeProgress() {
+	if ProgressPath == "" && progressFD == nil {
+		return
+	}
+	progress.UpdatedAt = time.Now().UTC()
+	progressWritten = time.Now()
+	data, err := json.Marshal(progress)
+	if err != nil {
+		LogToFile("WARNING: Failed to marshal progress - " + err.Error())
+		return
+	}
+	data = append(data, '\n')
+	if ProgressPath != "" {
+		if err := WriteFileAtomic(ProgressPath, data, 0644); err != nil {
+			LogToFile(fmt.Sprintf("WARNING: Failed to write progress file %s - %v", ProgressPath, err))
+			ProgressPath = ""
+		}
+	}
+	if progressFD != nil {
+		if _, err := progressFD.Write(data); err != nil {
+			LogToFile("WARNING: Failed to write progress file descriptor - " + err.Error())
+			progressFD = nil
+		}
+	}
+}
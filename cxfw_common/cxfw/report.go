@@ -0,0 +1,213 @@
+package cxfw
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Run states of a Report. Real runs end succeeded or failed; --validate-only
+// runs end validated or would_fail.
+const (
+	StateSucceeded = "succeeded"
+	StateFailed    = "failed"
+	StateValidated = "validated"
+	StateWouldFail = "would_fail"
+)
+
+// Operation states of an OperationResult. Real runs use the first nine;
+// --validate-only runs predict one of the would_* states, or unchecked for
+// operations whose outcome cannot be predicted without running them.
+const (
+	OpSucceeded               = "succeeded"
+	OpFailed                  = "failed"
+	OpFailedAllowed           = "failed_allowed"
+	OpSkippedAlreadySatisfied = "skipped_already_satisfied"
+	OpSkippedCondition        = "skipped_condition"
+	OpSkippedTarget           = "skipped_target"
+	OpSkippedCompleted        = "skipped_completed"
+	OpSkippedByFlag           = "skipped_by_flag"
+	OpNotRun                  = "not_run"
+	OpWouldSucceed            = "would_succeed"
+	OpWouldSkip               = "would_skip"
+	OpWouldFail               = "would_fail"
+	OpUnchecked               = "unchecked"
+)
+
+// Failure reasons of a Report or OperationResult. The fleet server keys its
+// dashboards off these values: they are never renamed or removed, and new
+// ones are only added, so consumers should treat an unknown reason like
+// operation_failed.
+const (
+	ReasonInvalidArguments  = "invalid_arguments"
+	ReasonInvalidManifest   = "invalid_manifest"
+	ReasonInvalidPolicy     = "invalid_policy"
+	ReasonKeyUnavailable    = "key_unavailable"
+	ReasonInvalidOperation  = "invalid_operation"
+	ReasonMissingPayload    = "missing_payload"
+	ReasonChecksumMismatch  = "checksum_mismatch"
+	ReasonInsufficientSpace = "insufficient_space"
+	ReasonPolicyViolation   = "policy_violation"
+	ReasonIOError           = "io_error"
+	ReasonReadOnlyFS        = "read_only_filesystem"
+	ReasonOperationFailed   = "operation_failed"
+	ReasonPreCheckFailed    = "pre_check_failed"
+	ReasonPostCheckFailed   = "post_check_failed"
+	ReasonFirmwareMismatch  = "firmware_version_mismatch"
+	ReasonFirmwareUnknown   = "firmware_version_unknown"
+	ReasonSignatureInvalid  = "signature_invalid"
+	ReasonTimedOut          = "timed_out"
+	ReasonAlreadyRunning    = "already_running"
+	ReasonInterrupted       = "interrupted"
+)
+
+// Remediation tells support and the UI what to do about a failure: a
+// stable machine-readable code and a short hint for people.
+type Remediation struct {
+	Code string `json:"code"`
+	Hint string `json:"hint"`
+}
+
+// remediations maps each failure reason to its remediation. Codes follow
+// the same stability rule as reasons. A reason added above must be added
+// here too, which report_test.go checks.
+var remediations = map[string]Remediation{
+	ReasonInvalidArguments:  {"fix_invocation", "executor started with invalid arguments; check the install script"},
+	ReasonInvalidManifest:   {"rebuild_manifest", "manifest is malformed or has an unsupported version; rebuild it with the creator"},
+	ReasonInvalidPolicy:     {"restore_policy", "permission policy is unreadable or invalid; restore it from the firmware image"},
+	ReasonKeyUnavailable:    {"restore_key", "integrity key unavailable; restore .gems.jpeg from factory backup"},
+	ReasonInvalidOperation:  {"fix_manifest", "operation is malformed or unsupported by this executor; fix the manifest or update the executor"},
+	ReasonMissingPayload:    {"redownload_bundle", "payload missing from the bundle; re-download bundle"},
+	ReasonChecksumMismatch:  {"redownload_bundle", "payload corrupt in transit; re-download bundle"},
+	ReasonInsufficientSpace: {"free_space", "not enough free space on the target filesystem; free space and retry"},
+	ReasonPolicyViolation:   {"fix_manifest", "patch writes where the permission policy forbids; fix the manifest or the policy"},
+	ReasonIOError:           {"service_storage", "storage I/O error; device storage needs service"},
+	ReasonReadOnlyFS:        {"remount_rw", "target filesystem is read-only; add a remount operation before writing to it"},
+	ReasonOperationFailed:   {"check_log", "operation failed; see the executor log for the error"},
+	ReasonPreCheckFailed:    {"retry_later", "pre-check refused the patch and nothing was changed; retry when the device is idle"},
+	ReasonPostCheckFailed:   {"verify_device", "post-check failed after all operations; check the device and roll back if needed"},
+	ReasonFirmwareMismatch:  {"use_matching_patch", "patch does not support the installed firmware version; install the patch built for it"},
+	ReasonFirmwareUnknown:   {"restore_release_file", "installed firmware version unreadable; restore the release file or contact support"},
+	ReasonSignatureInvalid:  {"redownload_bundle", "manifest is unsigned or its signature does not verify; re-download bundle or check the signing key"},
+	ReasonTimedOut:          {"check_log", "operation did not finish in time and was killed; see the executor log for what it was waiting on"},
+	ReasonAlreadyRunning:    {"retry_later", "another patch run is in progress and nothing was changed; retry after it finishes"},
+	ReasonInterrupted:       {"resume_run", "run was stopped by a signal part way through; run the same manifest again with --resume"},
+}
+
+// RemediationFor returns the remediation for reason, or nil for no reason.
+// An insufficient_space hint names how much to free when shortfalls are
+// known. Unknown reasons get the operation_failed remediation.
+func RemediationFor(reason string, shortfalls []SpaceShortfall) *Remediation {
+	if reason == "" {
+		return nil
+	}
+	remediation, ok := remediations[reason]
+	if !ok {
+		remediation = remediations[ReasonOperationFailed]
+	}
+	if reason == ReasonInsufficientSpace && len(shortfalls) > 0 {
+		needs := make([]string, 0, len(shortfalls))
+		for _, shortfall := range shortfalls {
+			missing := (shortfall.RequiredBytes - shortfall.FreeBytes + 1<<20 - 1) >> 20
+			needs = append(needs, fmt.Sprintf("%d MB on the filesystem of %s", missing, shortfall.Path))
+		}
+		remediation.Hint = "free at least " + strings.Join(needs, " and ")
+	}
+	return &remediation
+}
+
+// LogRemediation logs the remediation for reason, if any.
+func LogRemediation(reason string, shortfalls []SpaceShortfall) {
+	if remediation := RemediationFor(reason, shortfalls); remediation != nil {
+		LogToFile("INFO: Remediation " + remediation.Code + " - " + remediation.Hint)
+	}
+}
+
+// Report is the machine-readable outcome of a run, written at the end of
+// every run to --report.
+// Real runs and --validate-only runs share the schema so that results from
+// a pre-screening sample and from the rollout aggregate the same way.
+type Report struct {
+	ManifestVersion  string            `json:"manifest_version"`
+	ExecutorVersion  string            `json:"executor_version"`
+	RunID            string            `json:"run_id"`
+	DeviceID         string            `json:"device_id,omitempty"`
+	Mode             string            `json:"mode"`
+	State            string            `json:"state"`
+	ExitCode         int               `json:"exit_code"`
+	Reason           string            `json:"reason,omitempty"`
+	Detail           string            `json:"detail,omitempty"`
+	Remediation      *Remediation      `json:"remediation,omitempty"`
+	StartedAt        time.Time         `json:"started_at"`
+	FinishedAt       time.Time         `json:"finished_at"`
+	DurationMs       int64             `json:"duration_ms"`
+	Operations       []OperationResult `json:"operations"`
+	SpaceShortfalls  []SpaceShortfall  `json:"space_shortfalls,omitempty"`
+	ClampedPaths     []string          `json:"clamped_paths,omitempty"`
+	Forced           bool              `json:"forced,omitempty"`
+	ForcedMismatches []string          `json:"forced_mismatches,omitempty"`
+}
+
+// OperationResult is the outcome, or predicted outcome, of one operation.
+type OperationResult struct {
+	Index       int          `json:"index"`
+	Operation   string       `json:"operation"`
+	Path        string       `json:"path,omitempty"`
+	Comment     string       `json:"comment,omitempty"`
+	State       string       `json:"state"`
+	Reason      string       `json:"reason,omitempty"`
+	Detail      string       `json:"detail,omitempty"`
+	Remediation *Remediation `json:"remediation,omitempty"`
+	DurationMs  int64        `json:"duration_ms"`
+}
+
+// SpaceShortfall is a filesystem without room for what the patch writes to
+// it, identified by a directory on it.
+type SpaceShortfall struct {
+	Path          string `json:"path"`
+	RequiredBytes int64  `json:"required_bytes"`
+	FreeBytes     int64  `json:"free_bytes"`
+}
+
+// ErrChecksumMismatch is wrapped by the errors of payloads, installed files
+// and restored backups whose checksum is not the expected one.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrUnknownOperation is wrapped by the error of an operation this build does
+// not know.
+var ErrUnknownOperation = errors.New("unknown operation")
+
+// ReasonForError maps an operation error to a failure reason.
+func ReasonForError(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownOperation):
+		return ReasonInvalidOperation
+	case errors.Is(err, ErrChecksumMismatch):
+		return ReasonChecksumMismatch
+	case errors.Is(err, ErrKeyUnavailable):
+		return ReasonKeyUnavailable
+	case errors.Is(err, syscall.ENOSPC):
+		return ReasonInsufficientSpace
+	case errors.Is(err, syscall.EIO):
+		return ReasonIOError
+	case errors.Is(err, syscall.EROFS):
+		return ReasonReadOnlyFS
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReasonTimedOut
+	default:
+		return ReasonOperationFailed
+	}
+}
+
+// WriteReport writes r to path atomically.
+func WriteReport(path string, r *Report) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	return WriteFileAtomic(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,93 @@
+package cxfw
+
+import (
+	"context"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// reasonConstants returns the value of every Reason* constant declared in
+// the package source, by name, so no hand-kept list can miss one.
+func reasonConstants(t *testing.T) map[string]string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]string)
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.CONST {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				value := spec.(*ast.ValueSpec)
+				for i, ident := range value.Names {
+					if !strings.HasPrefix(ident.Name, "Reason") || i >= len(value.Values) {
+						continue
+					}
+					literal, ok := value.Values[i].(*ast.BasicLit)
+					if !ok || literal.Kind != token.STRING {
+						t.Fatalf("%s is not a string literal", ident.Name)
+					}
+					reasons[ident.Name], _ = strconv.Unquote(literal.Value)
+				}
+			}
+		}
+	}
+	if len(reasons) == 0 {
+		t.Fatal("no Reason constants found")
+	}
+	return reasons
+}
+
+func TestEveryReasonHasARemediation(t *testing.T) {
+	for name, reason := range reasonConstants(t) {
+		remediation, ok := remediations[reason]
+		if !ok {
+			t.Errorf("no remediation for %s (%q)", name, reason)
+			continue
+		}
+		if remediation.Code == "" || remediation.Hint == "" {
+			t.Errorf("remediation for %s (%q) is %+v, want a code and a hint", name, reason, remediation)
+		}
+	}
+}
+
+func TestReasonForError(t *testing.T) {
+	defer func(keyFile string) { KeyFile = keyFile }(KeyFile)
+	KeyFile = filepath.Join(t.TempDir(), "missing.bin")
+	_, keyErr := ExtractKeyFromImage()
+
+	for _, test := range []struct {
+		err  error
+		want string
+	}{
+		{fmt.Errorf("failed to copy file: %w", syscall.ENOSPC), ReasonInsufficientSpace},
+		{fmt.Errorf("%w for /sda1/data/apps/app.bin: expected a, got b", ErrChecksumMismatch), ReasonChecksumMismatch},
+		{fmt.Errorf("failed to update integrity database: %w", keyErr), ReasonKeyUnavailable},
+		{fmt.Errorf("%w %q", ErrUnknownOperation, "frobnicate"), ReasonInvalidOperation},
+		{fmt.Errorf("command timed out: %w", context.DeadlineExceeded), ReasonTimedOut},
+		{fmt.Errorf("exit status 1"), ReasonOperationFailed},
+	} {
+		if got := ReasonForError(test.err); got != test.want {
+			t.Errorf("ReasonForError(%q) = %s, want %s", test.err, got, test.want)
+		}
+	}
+}
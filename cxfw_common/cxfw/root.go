@@ -0,0 +1,52 @@
+package cxfw
+
+import "path/filepath"
+
+// Root is the absolute prefix under which the filesystem being patched is
+// mounted, or empty when patching the live system. Manifests, integrity
+// databases and the backup index always hold in-image paths; HostPath and
+// ImagePath translate at the boundary.
+var Root string
+
+// HostPath maps an absolute in-image path to the path it is reachable at.
+// Relative paths and URLs are returned unchanged.
+func HostPath(path string) string {
+	if Root == "" || !filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(Root, path)
+}
+
+// HostOperation returns op with its paths and sources mapped by HostPath.
+func HostOperation(op Operation) Operation {
+	op.Path, op.Source = HostPath(op.Path), HostPath(op.Source)
+	if op.Paths != nil {
+		paths := make([]string, len(op.Paths))
+		for i, path := range op.Paths {
+			paths[i] = HostPath(path)
+		}
+		op.Paths = paths
+	}
+	if op.Files != nil {
+		files := make([]BatchFile, len(op.Files))
+		for i, file := range op.Files {
+			file.Source = HostPath(file.Source)
+			files[i] = file
+		}
+		op.Files = files
+	}
+	return op
+}
+
+// ImagePath maps a host path below Root back to its in-image path. Paths
+// outside Root are returned unchanged.
+func ImagePath(path string) string {
+	if Root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(Root, path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
@@ -0,0 +1,122 @@
+package cxfw
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReportFile is where the run report goes unless --report names
+// another file. The executor and the rollback binary share it, and the
+// report's mode tells their runs apart.
+const DefaultReportFile = "/var/log/cxfw_patch_report.json"
+
+// ReportPath is where the run report is written, or empty for none.
+var ReportPath string
+
+// RunReport collects the outcome of the run for --report. Mode is apply
+// for the executor, which sets validate for --validate-only, and rollback
+// for the rollback binary.
+var RunReport = Report{
+	Mode:            "apply",
+	ExecutorVersion: Version,
+	StartedAt:       RunStart.UTC(),
+	Operations:      []OperationResult{},
+}
+
+// OperationResultFor starts the report entry of the operation at index,
+// with the path as given in the manifest.
+func OperationResultFor(index int, op Operation) OperationResult {
+	return OperationResult{
+		Index:     index + 1,
+		Operation: op.Operation,
+		Path:      op.Path,
+		Comment:   SanitizeComment(op.Comment),
+	}
+}
+
+// ReportNotRun records the operations from index on as not run, after the
+// run stopped before them.
+func ReportNotRun(operations []Operation, index int) {
+	for j := index; j < len(operations); j++ {
+		skipped := OperationResultFor(j, operations[j])
+		skipped.State = OpNotRun
+		RunReport.Operations = append(RunReport.Operations, skipped)
+	}
+}
+
+// FinishHooks are the steps a binary adds to FinishRun.
+type FinishHooks struct {
+	// Cleanup runs first, to undo what the run changed temporarily and
+	// add its own fields to the report
+	Cleanup func(code int, reason string)
+	// Reported runs once the report is written, e.g. to publish it
+	Reported func(code int)
+	// Exiting runs after the exit code is logged, right before the exit
+	Exiting func(code int)
+}
+
+// finishHooks are the hooks set with SetFinishHooks.
+var finishHooks FinishHooks
+
+// SetFinishHooks sets the steps of the binary that FinishRun runs.
+func SetFinishHooks(hooks FinishHooks) {
+	finishHooks = hooks
+}
+
+// finishing is held by the goroutine finishing the run.
+var finishing sync.Mutex
+
+// FinishRun ends the run: it runs the Cleanup hook, releases the run
+// lock, marks the progress file complete, completes the run report with
+// the exit code and, for a failed run, the failure reason and its
+// remediation, writes it unless ReportPath is empty, logs the exit code
+// and exits. Only the first caller finishes the run, so a signal stopping
+// the run cannot race the main loop finishing it.
+func FinishRun(code int, reason, detail string) {
+	finishing.Lock()
+	ClearLogOperation()
+	if finishHooks.Cleanup != nil {
+		finishHooks.Cleanup(code, reason)
+	}
+	ReleaseRunLock()
+	finishProgress(code)
+	RunReport.ExitCode = code
+	RunReport.Reason, RunReport.Detail = reason, detail
+	RunReport.Remediation = RemediationFor(reason, RunReport.SpaceShortfalls)
+	for i := range RunReport.Operations {
+		result := &RunReport.Operations[i]
+		result.Remediation = RemediationFor(result.Reason, RunReport.SpaceShortfalls)
+	}
+	LogRemediation(reason, RunReport.SpaceShortfalls)
+	switch {
+	case RunReport.Mode == "validate" && code == 0:
+		RunReport.State = StateValidated
+	case RunReport.Mode == "validate":
+		RunReport.State = StateWouldFail
+	case code == 0:
+		RunReport.State = StateSucceeded
+	default:
+		RunReport.State = StateFailed
+	}
+	RunReport.RunID = RunID
+	RunReport.FinishedAt = time.Now().UTC()
+	RunReport.DurationMs = RunReport.FinishedAt.Sub(RunStart).Milliseconds()
+
+	if ReportPath != "" {
+		if err := WriteReport(ReportPath, &RunReport); err != nil {
+			LogToFile("WARNING: Failed to write report - " + err.Error())
+		} else {
+			LogToFile("INFO: Report written to " + ReportPath)
+		}
+	}
+	if finishHooks.Reported != nil {
+		finishHooks.Reported(code)
+	}
+	// The exit code is logged before a reboot can cut the log short
+	LogExit(code, reason)
+	if finishHooks.Exiting != nil {
+		finishHooks.Exiting(code)
+	}
+	os.Exit(code)
+}
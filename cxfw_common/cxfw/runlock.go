@@ -0,0 +1,89 @@
+package cxfw
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// DefaultLockFile serializes patch runs, of the executor and the rollback
+// binary alike. Two runs racing, e.g. when the management agent retries
+// while a long script is still running, would both read-modify-write the
+// encrypted .db.json files and corrupt them.
+const DefaultLockFile = "/var/run/cxfw_patch.lock"
+
+// runLock is the lock file held by this run, or nil.
+var runLock *os.File
+
+// AcquireRunLock takes an exclusive flock on path and records this
+// process's PID and manifests in it. The flock dies with its holder, so the
+// lock of a crashed run is simply taken over. Go opens files close-on-exec,
+// so no script a run starts inherits the flock: a lock that is held is
+// always held by a live run. held is true when another run holds the lock,
+// with its PID if recorded.
+func AcquireRunLock(path string, manifests []string) (held bool, holder int, err error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	previous := lockHolder(file)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return true, previous, nil
+	}
+	if err != nil {
+		file.Close()
+		return false, 0, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	if previous > 0 {
+		LogToFile(fmt.Sprintf("WARNING: Taking over the lock of an earlier run (pid %d) that did not exit cleanly", previous))
+	}
+	content := fmt.Sprintf("%d\n%s\n", os.Getpid(), strings.Join(manifests, " "))
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(content), 0)
+	}
+	runLock = file
+	return false, 0, nil
+}
+
+// lockHolder returns the PID recorded in the lock file, or 0.
+func lockHolder(file *os.File) int {
+	data := make([]byte, 64)
+	n, _ := file.ReadAt(data, 0)
+	line, _, _ := strings.Cut(string(data[:n]), "\n")
+	pid, _ := strconv.Atoi(strings.TrimSpace(line))
+	return pid
+}
+
+// ReleaseRunLock empties the lock file, so the next run does not take this
+// run for a crashed one. The flock itself is released when the process
+// exits.
+func ReleaseRunLock() {
+	if runLock != nil {
+		runLock.Truncate(0)
+	}
+}
+
+// LockRun takes the run lock at path for manifests, and finishes the run
+// with ExitAlreadyRunning, having changed nothing, when another run of
+// either binary holds it.
+func LockRun(path string, manifests []string) {
+	held, holder, err := AcquireRunLock(path, manifests)
+	if err != nil {
+		LogToFile("ERROR: Failed to take the run lock - " + err.Error())
+		FinishRun(ExitFailure, ReasonIOError, err.Error())
+	}
+	if held {
+		detail := "another patch run holds " + path
+		if holder > 0 {
+			detail = fmt.Sprintf("another patch run (pid %d) holds %s", holder, path)
+		}
+		LogToFile("ERROR: Another patch run is in progress, no changes made - " + detail)
+		fmt.Fprintln(os.Stderr, filepath.Base(os.Args[0])+": "+detail)
+		FinishRun(ExitAlreadyRunning, ReasonAlreadyRunning, detail)
+	}
+}
@@ -0,0 +1,69 @@
+package cxfw
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// interruptGrace is how long the operation in progress may run on after
+// SIGTERM or SIGINT before the run is stopped regardless. Commands,
+// scripts and other subprocesses are killed right away.
+const interruptGrace = 10 * time.Second
+
+// RunCtx is cancelled when the run receives SIGTERM or SIGINT.
+// Subprocesses of operations run under it, so they are killed at once.
+var RunCtx, cancelRun = context.WithCancel(context.Background())
+
+// interruptedBy is the signal that cancelled RunCtx.
+var interruptedBy os.Signal
+
+// HandleSignals stops the run on SIGTERM or SIGINT, e.g. from a watchdog
+// or an operator pressing Ctrl-C. The main loop stops before the next
+// operation. An operation still running after interruptGrace, or a second
+// signal, stops the run at once.
+func HandleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		interruptedBy = <-signals
+		LogToFile(fmt.Sprintf("WARNING: Received %s, stopping after the current operation", signalName(interruptedBy)))
+		cancelRun()
+		select {
+		case sig := <-signals:
+			LogToFile(fmt.Sprintf("WARNING: Received %s again, stopping now", signalName(sig)))
+		case <-time.After(interruptGrace):
+			LogToFile(fmt.Sprintf("WARNING: Current operation did not finish within %s, stopping now", interruptGrace))
+		}
+		StopInterrupted()
+	}()
+}
+
+// Interrupted reports whether a signal has asked the run to stop.
+func Interrupted() bool {
+	return RunCtx.Err() != nil
+}
+
+// StopInterrupted removes the temp files the run left behind and finishes
+// the run with ExitInterrupted.
+func StopInterrupted() {
+	for _, path := range RemoveTempFiles() {
+		LogToFile("INFO: Removed temp file " + path)
+	}
+	LogToFile("Execution interrupted by signal.")
+	FinishRun(ExitInterrupted, ReasonInterrupted, "interrupted by "+signalName(interruptedBy))
+}
+
+// signalName returns the conventional name of sig, e.g. SIGTERM.
+func signalName(sig os.Signal) string {
+	switch sig {
+	case syscall.SIGTERM:
+		return "SIGTERM"
+	case syscall.SIGINT:
+		return "SIGINT"
+	}
+	return fmt.Sprint(sig)
+}
@@ -0,0 +1,108 @@
+package cxfw
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ManifestSigningKey is the ed25519 public key manifests must be signed
+// with, baked in by the makefiles with -ldflags "-X
+// cxfw_common/cxfw.ManifestSigningKey=..." as the base64 body of the PEM
+// file. When empty, DefaultManifestKeyFile is read instead.
+var ManifestSigningKey = ""
+
+// DefaultManifestKeyFile holds the manifest signing public key on devices
+// whose executor was built without one.
+const DefaultManifestKeyFile = "/cxfw/manifest_signing_key.pem"
+
+// ErrUnsigned means a manifest has no detached signature file.
+var ErrUnsigned = errors.New("manifest is not signed")
+
+// ParseSigningKey parses an ed25519 public key given as PEM, as the base64
+// of its DER form, or as the base64 of the raw 32-byte key.
+func ParseSigningKey(data []byte) (ed25519.PublicKey, error) {
+	der := bytes.TrimSpace(data)
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(string(der)); err == nil {
+		der = decoded
+	} else {
+		return nil, fmt.Errorf("signing key is neither PEM nor base64")
+	}
+	if len(der) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(der), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %w", err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key is %T, not ed25519", key)
+	}
+	return public, nil
+}
+
+// LoadSigningKey returns the manifest signing key from path when given,
+// else the key built into the binary, else DefaultManifestKeyFile.
+func LoadSigningKey(path string) (ed25519.PublicKey, string, error) {
+	if path == "" && ManifestSigningKey != "" {
+		key, err := ParseSigningKey([]byte(ManifestSigningKey))
+		return key, "built-in key", err
+	}
+	if path == "" {
+		path = DefaultManifestKeyFile
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, path, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key, err := ParseSigningKey(data)
+	return key, path, err
+}
+
+// ManifestDigest returns the hex SHA256 of manifest bytes, logged with
+// signature failures for forensics.
+func ManifestDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyManifestSignature checks the detached signature in path+".sig"
+// over the exact bytes data of the manifest at path. The signature is the
+// raw 64 bytes written by "openssl pkeyutl -sign -rawin", or their base64.
+// A missing signature file returns ErrUnsigned.
+func VerifyManifestSignature(path string, data []byte, key ed25519.PublicKey) error {
+	return VerifySignature(path+".sig", data, key)
+}
+
+// VerifySignature checks the detached signature in the file sigPath over
+// data, e.g. for a manifest read from standard input. A missing signature
+// file returns ErrUnsigned.
+func VerifySignature(sigPath string, data []byte, key ed25519.PublicKey) error {
+	signature, err := os.ReadFile(sigPath)
+	if os.IsNotExist(err) {
+		return ErrUnsigned
+	} else if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return fmt.Errorf("malformed signature %s", sigPath)
+		}
+		signature = decoded
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return fmt.Errorf("signature does not match the manifest")
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package cxfw
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultBackupDir is the in-image directory holding backups for the
+// rollback, unless --backup-dir or CXFW_BACKUP_DIR name another.
+const DefaultBackupDir = "/sda1/data/cxfw/rollback"
+
+// BackupDir is the backup directory in use.
+var BackupDir = DefaultBackupDir
+
+// SetBackupDir makes dir, an absolute in-image path, the backup directory.
+func SetBackupDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("backup directory %q is not absolute", dir)
+	}
+	BackupDir = filepath.Clean(dir)
+	return nil
+}
+
+// snapshotSubdir holds the integrity snapshots below the backup directory,
+// one subdirectory per patch version, so they can be pruned per version.
+const snapshotSubdir = "snapshots"
+
+// snapshotIDPattern matches snapshot IDs, "<version id>/<name>".
+var snapshotIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._+-]*/[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// SnapshotFile is a file of a snapshotted directory.
+type SnapshotFile struct {
+	Path string `json:"path"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// IntegritySnapshot is the complete integrity state of one directory: its
+// files with their hashes and the raw, still encrypted, .db.json and folder
+// file. The snapshot itself is stored encrypted with the database key.
+type IntegritySnapshot struct {
+	ID         string         `json:"id"`
+	Dir        string         `json:"dir"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Files      []SnapshotFile `json:"files"`
+	Database   []byte         `json:"database,omitempty"`
+	FolderFile []byte         `json:"folder_file,omitempty"`
+}
+
+// SnapshotPath returns the file holding the snapshot id below backupDir.
+func SnapshotPath(backupDir, id string) (string, error) {
+	if !snapshotIDPattern.MatchString(id) || strings.Contains(id, "..") {
+		return "", fmt.Errorf("invalid snapshot id %q, expected <version>/<name>", id)
+	}
+	return filepath.Join(backupDir, snapshotSubdir, id+".snap"), nil
+}
+
+// folderFileOf is the folder file of dir, e.g. .apps.json for .../apps.
+func folderFileOf(dir string) string {
+	return filepath.Join(dir, "."+filepath.Base(dir)+".json")
+}
+
+// listSnapshotFiles hashes the regular files directly in dir, which is what
+// the directory's .db.json tracks, leaving out the databases themselves and
+// their lock files.
+func listSnapshotFiles(dir string) ([]SnapshotFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+	files := []SnapshotFile{}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.Type().IsRegular() || IsDatabaseFile(dir, entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := ComputeChecksum(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, SnapshotFile{Path: ImagePath(path), Hash: hash, Size: info.Size()})
+	}
+	return files, nil
+}
+
+// TakeSnapshot captures the integrity state of dir as snapshot id.
+func TakeSnapshot(dir, id string) (*IntegritySnapshot, error) {
+	files, err := listSnapshotFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &IntegritySnapshot{ID: id, Dir: ImagePath(dir), CreatedAt: time.Now().UTC(), Files: files}
+	if snapshot.Database, err = readIfExists(filepath.Join(dir, ".db.json")); err != nil {
+		return nil, err
+	}
+	if snapshot.FolderFile, err = readIfExists(folderFileOf(dir)); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// restoreDatabase puts the raw database data back at path under its lock,
+// removing the database if data is nil.
+func restoreDatabase(path string, data []byte) error {
+	unlock, err := lockDatabase(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if data == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+		return nil
+	}
+	if err := WriteFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", path, err)
+	}
+	return nil
+}
+
+func readIfExists(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// WriteSnapshot stores snapshot encrypted at path.
+func WriteSnapshot(path string, snapshot *IntegritySnapshot) error {
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return fmt.Errorf("failed to extract key: %w", err)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot: %w", err)
+	}
+	encrypted, err := EncryptFile(key, data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt snapshot: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create snapshot directory: %w", err)
+	}
+	return WriteFileAtomic(path, encrypted, 0600)
+}
+
+// LoadSnapshot reads and verifies the snapshot id stored at path. The
+// snapshot must decrypt, which authenticates it, carry the expected ID, and
+// hold databases that decrypt with the current key.
+func LoadSnapshot(path, id string) (*IntegritySnapshot, error) {
+	key, err := ExtractKeyFromImage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract key: %w", err)
+	}
+	encrypted, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	data, err := DecryptFile(key, encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt snapshot: %w", err)
+	}
+	var snapshot IntegritySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if snapshot.ID != id {
+		return nil, fmt.Errorf("snapshot at %s is %q, expected %q", path, snapshot.ID, id)
+	}
+	dir := HostPath(snapshot.Dir)
+	databases := map[string][]byte{filepath.Join(dir, ".db.json"): snapshot.Database, folderFileOf(dir): snapshot.FolderFile}
+	for dbPath, db := range databases {
+		if db == nil {
+			continue
+		}
+		name := filepath.Base(dbPath)
+		if _, err := DecryptFileFor(key, db, dbPath); err != nil {
+			return nil, fmt.Errorf("snapshot %s holds an unreadable %s: %w", id, name, err)
+		}
+	}
+	return &snapshot, nil
+}
+
+// RestoreSnapshot returns the directory of snapshot to its recorded state.
+// Files changed or removed since the snapshot are copied back from backups
+// in backupDir with the recorded hash, files added since are removed, and
+// the .db.json and folder file are put back byte for byte. Every file must
+// be recoverable before anything is changed.
+func RestoreSnapshot(snapshot *IntegritySnapshot, backupDir string) error {
+	dir := HostPath(snapshot.Dir)
+	current, err := listSnapshotFiles(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	currentHash := make(map[string]string)
+	for _, file := range current {
+		currentHash[file.Path] = file.Hash
+	}
+	wanted := make(map[string]bool)
+
+	// Step 1: Find a verified backup for every file that differs
+	records, err := LoadBackupIndex(backupDir)
+	if err != nil {
+		return err
+	}
+	restores := make(map[string]string)
+	var missing []string
+	for _, file := range snapshot.Files {
+		wanted[file.Path] = true
+		if currentHash[file.Path] == file.Hash {
+			continue
+		}
+		for i := len(records) - 1; i >= 0; i-- {
+			record := records[i]
+			if record.Path != file.Path || record.Checksum != file.Hash {
+				continue
+			}
+			if hash, err := ComputeChecksum(HostPath(record.Backup)); err == nil && hash == file.Hash {
+				restores[file.Path] = HostPath(record.Backup)
+				break
+			}
+		}
+		if restores[file.Path] == "" {
+			missing = append(missing, file.Path)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no backup with the snapshot content of %s", strings.Join(missing, ", "))
+	}
+
+	// Step 2: Put the files back and remove the ones added since
+	restored := make([]string, 0, len(restores))
+	for path := range restores {
+		restored = append(restored, path)
+	}
+	sort.Strings(restored)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	for _, path := range restored {
+		LogToFile("INFO: Restoring " + path + " from " + restores[path])
+		temp := HostPath(path) + ".restore.tmp"
+		TrackTempFile(temp)
+		err := CopyFile(restores[path], temp)
+		if err == nil {
+			err = os.Rename(temp, HostPath(path))
+		}
+		UntrackTempFile(temp)
+		if err != nil {
+			os.Remove(temp)
+			return fmt.Errorf("failed to restore %s: %w", path, err)
+		}
+	}
+	removed := 0
+	for _, file := range current {
+		if !wanted[file.Path] {
+			removed++
+			LogToFile("INFO: Removing " + file.Path + ", added after the snapshot")
+			if err := os.Remove(HostPath(file.Path)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove %s: %w", file.Path, err)
+			}
+		}
+	}
+
+	// Step 3: Put the databases back
+	for path, data := range map[string][]byte{filepath.Join(dir, ".db.json"): snapshot.Database, folderFileOf(dir): snapshot.FolderFile} {
+		if err := restoreDatabase(path, data); err != nil {
+			return err
+		}
+	}
+
+	// Step 4: Verify the directory matches the snapshot
+	after, err := listSnapshotFiles(dir)
+	if err != nil {
+		return err
+	}
+	if len(after) != len(snapshot.Files) {
+		return fmt.Errorf("%s holds %d files after restore, snapshot has %d", dir, len(after), len(snapshot.Files))
+	}
+	for _, file := range after {
+		if !wanted[file.Path] {
+			return fmt.Errorf("%s not in snapshot after restore", file.Path)
+		}
+	}
+	for _, file := range snapshot.Files {
+		hash, err := ComputeChecksum(HostPath(file.Path))
+		if err != nil || hash != file.Hash {
+			return fmt.Errorf("%s does not match the snapshot after restore", file.Path)
+		}
+	}
+	LogToFile(fmt.Sprintf("INFO: Restored %d files and removed %d files added after the snapshot", len(restored), removed))
+	return nil
+}
@@ -0,0 +1,43 @@
+package cxfw
+
+import (
+	"os"
+	"sync"
+)
+
+// tempFiles are the temp files of the run that are not renamed into place
+// or removed yet.
+var (
+	tempFilesMu sync.Mutex
+	tempFiles   = make(map[string]bool)
+)
+
+// TrackTempFile records path as a temp file for RemoveTempFiles until
+// UntrackTempFile is called for it.
+func TrackTempFile(path string) {
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	tempFiles[path] = true
+}
+
+// UntrackTempFile forgets path once it is renamed into place or removed.
+func UntrackTempFile(path string) {
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	delete(tempFiles, path)
+}
+
+// RemoveTempFiles deletes the temp files still tracked, e.g. when the run is
+// interrupted part way through writing one, and returns those it removed.
+func RemoveTempFiles() []string {
+	tempFilesMu.Lock()
+	defer tempFilesMu.Unlock()
+	var removed []string
+	for path := range tempFiles {
+		if err := os.Remove(path); err == nil {
+			removed = append(removed, path)
+		}
+		delete(tempFiles, path)
+	}
+	return removed
+}
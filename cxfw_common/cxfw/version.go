@@ -0,0 +1,6 @@
+package cxfw
+
+// Version identifies the build of the patch tooling. The makefiles set it
+// with -ldflags "-X cxfw_common/cxfw.Version=..."; both binaries print it
+// for --version.
+var Version = "dev"
@@ -0,0 +1,240 @@
+package cxfw
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Exit codes, so the management agent can tell why a run failed without
+// parsing the log. 0 is only used for a run that fully succeeded. ExitFailure
+// means an operation failed; the storage codes tell a full data partition
+// from failing flash. The codes are stable, like report reasons.
+const (
+	ExitFailure    = 1
+	ExitNoSpace    = 10
+	ExitIOError    = 11
+	ExitReadOnlyFS = 12
+)
+
+// ExitInvalidArguments means the tool was started with invalid flags or
+// arguments; nothing was modified. The flag package exits with the same
+// code for flags it cannot parse.
+const ExitInvalidArguments = 2
+
+// ExitInvalidManifest means a manifest could not be read or parsed, or is
+// invalid; nothing was modified.
+const ExitInvalidManifest = 3
+
+// ExitInvalidPolicy means the device's permission policy is unreadable or
+// invalid; nothing was modified.
+const ExitInvalidPolicy = 4
+
+// ExitValidationFailed means --validate-only or --dry-run predicted that an
+// operation would fail; nothing was modified.
+const ExitValidationFailed = 5
+
+// ExitRollbackFailed means an operation of a rollback manifest failed, so
+// the device may be only partly rolled back.
+const ExitRollbackFailed = 6
+
+// ExitKeyUnavailable means the integrity database key could not be extracted
+// during the pre-flight self-test; nothing was modified.
+const ExitKeyUnavailable = 13
+
+// ExitPreCheckFailed means the manifest's pre_check script refused the
+// patch before any operation ran; nothing was modified.
+const ExitPreCheckFailed = 14
+
+// ExitFirmwareMismatch means the installed firmware version is outside the
+// range the manifest supports, or could not be read; nothing was modified.
+const ExitFirmwareMismatch = 15
+
+// ExitSignatureInvalid means a manifest was unsigned or its signature did
+// not verify; nothing was modified.
+const ExitSignatureInvalid = 16
+
+// ExitPreflightFailed means the preflight pass found missing or corrupt
+// payloads or other problems before any operation ran; nothing was modified.
+const ExitPreflightFailed = 17
+
+// ExitAlreadyRunning means another executor run holds the lock; nothing was
+// modified.
+const ExitAlreadyRunning = 18
+
+// ExitInterrupted means SIGTERM or SIGINT stopped the run between or during
+// operations; the journal records the operations that completed.
+const ExitInterrupted = 19
+
+// WriteError describes a failed write that hit one of the storage error
+// classes worth surfacing on their own: ENOSPC, EIO and EROFS.
+type WriteError struct {
+	Path      string
+	Offset    int64
+	FreeBytes int64 // -1 when the filesystem could not be queried
+	Err       error
+}
+
+func (e *WriteError) Error() string {
+	msg := fmt.Sprintf("%v writing %s at offset %d", e.Err, e.Path, e.Offset)
+	if e.FreeBytes >= 0 {
+		msg += fmt.Sprintf(" (%d bytes free on filesystem)", e.FreeBytes)
+	}
+	return msg
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyWriteError wraps err in a WriteError when it is ENOSPC, EIO or
+// EROFS; any other error is returned unchanged.
+func ClassifyWriteError(path string, offset int64, err error) error {
+	for _, errno := range []syscall.Errno{syscall.ENOSPC, syscall.EIO, syscall.EROFS} {
+		if errors.Is(err, errno) {
+			return &WriteError{Path: path, Offset: offset, FreeBytes: FreeSpace(filepath.Dir(path)), Err: errno}
+		}
+	}
+	return err
+}
+
+// FreeSpace returns the bytes available to unprivileged users on the
+// filesystem holding dir, or -1 if it cannot be determined.
+func FreeSpace(dir string) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return -1
+	}
+	return int64(st.Bavail) * int64(st.Bsize)
+}
+
+// ExitCodeForError maps an operation error to the process exit code.
+func ExitCodeForError(err error) int {
+	switch {
+	case errors.Is(err, syscall.ENOSPC):
+		return ExitNoSpace
+	case errors.Is(err, syscall.EIO):
+		return ExitIOError
+	case errors.Is(err, syscall.EROFS):
+		return ExitReadOnlyFS
+	default:
+		return ExitFailure
+	}
+}
+
+// LogExit logs the exit code of the run, with its failure reason if any, as
+// the final line of the run's log, whatever the log level. The line is
+// printed to standard output as well unless Quiet is set.
+func LogExit(code int, reason string) {
+	message := fmt.Sprintf("Exit code %d", code)
+	if reason != "" {
+		message += fmt.Sprintf(" (%s)", reason)
+	}
+	writeLog(message)
+	if !Verbose && !Quiet {
+		os.Stdout.WriteString(formatLogEntry(time.Now(), message))
+	}
+}
+
+// CountingWriter counts the bytes written through it, to report how far a
+// streamed write got before failing.
+type CountingWriter struct {
+	N int64
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	c.N += int64(len(p))
+	return len(p), nil
+}
+
+// WriteFileAtomic writes data to a temp file next to path, syncs it and
+// renames it into place, so neither a failed write nor a power cut ever
+// leaves a truncated file at path.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tempFile := path + ".tmp"
+	TrackTempFile(tempFile)
+	defer UntrackTempFile(tempFile)
+	file, err := os.OpenFile(tempFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return ClassifyWriteError(tempFile, 0, err)
+	}
+
+	n, err := file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameSynced(tempFile, path)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return ClassifyWriteError(path, int64(n), err)
+	}
+	return nil
+}
+
+// CommitTempFile syncs the finished temp file to storage and renames it over
+// path, so path holds either its old content or all of the new content even
+// after a power cut. The temp file must be in the same directory as path.
+func CommitTempFile(tempFile, path string) error {
+	file, err := os.Open(tempFile)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ClassifyWriteError(tempFile, 0, err)
+	}
+	return renameSynced(tempFile, path)
+}
+
+// InstallAtomic installs a file at path through a temp file next to it:
+// write fills the temp file and verifies it, returning its checksum, and
+// only then is it synced and renamed over path. Neither a failure nor a
+// power cut leaves a partial file at path. The temp file is removed on
+// failure, and by RemoveTempFiles when the run is interrupted. Both binaries
+// install and restore files this way.
+func InstallAtomic(path string, write func(temp string) (string, error)) (string, error) {
+	temp := path + ".tmp"
+	TrackTempFile(temp)
+	defer UntrackTempFile(temp)
+	checksum, err := write(temp)
+	if err == nil {
+		if err = CommitTempFile(temp, path); err != nil {
+			LogToFile("ERROR: Failed to move copied file into place - " + err.Error())
+			err = fmt.Errorf("failed to move copied file into place: %w", err)
+		}
+	}
+	if err != nil {
+		os.Remove(temp)
+		return "", err
+	}
+	return checksum, nil
+}
+
+// renameSynced renames tempFile to path and syncs their directory, which
+// makes the rename itself survive a power cut.
+func renameSynced(tempFile, path string) error {
+	if err := os.Rename(tempFile, path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	// Some filesystems cannot sync a directory and order the rename anyway
+	if err := dir.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) {
+		return err
+	}
+	return nil
+}
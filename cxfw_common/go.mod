@@ -0,0 +1,3 @@
+module cxfw_common
+
+go 1.24.0
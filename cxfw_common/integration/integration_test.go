@@ -0,0 +1,293 @@
+// Package integration runs the executor and the rollback binary against the
+// same assertions, so the run lock, signal handling, report and progress file
+// they share through cxfw cannot drift apart.
+package integration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// binary is one of the two binaries under test.
+type binary struct {
+	name string
+	dir  string
+	mode string
+	// args are the flags the binary needs to run unprivileged in a temp dir
+	args func(dir string) []string
+	path string
+}
+
+var binaries = []*binary{
+	{name: "executor", dir: "cxfw_patch_executor", mode: "apply", args: func(dir string) []string {
+		return []string{"--root", filepath.Join(dir, "root"), "--allow-unsigned"}
+	}},
+	{name: "rollback", dir: "cxfw_patch_rollback", mode: "rollback", args: func(string) []string { return nil }},
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+// runTests builds both binaries into a temp dir and runs the tests.
+func runTests(m *testing.M) int {
+	if _, err := exec.LookPath("go"); err != nil {
+		fmt.Println("go tool not found, skipping integration tests")
+		return 0
+	}
+	binDir, err := os.MkdirTemp("", "cxfw-integration-")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(binDir)
+	for _, b := range binaries {
+		b.path = filepath.Join(binDir, b.name)
+		output, err := exec.Command("go", "build", "-C", filepath.Join("..", "..", b.dir), "-o", b.path, ".").CombinedOutput()
+		if err != nil {
+			fmt.Printf("failed to build %s: %v\n%s", b.dir, err, output)
+			return 1
+		}
+	}
+	return m.Run()
+}
+
+// run is one run of a binary in its own temp dir.
+type run struct {
+	cmd *exec.Cmd
+	dir string
+	// lock is the run lock the binary takes
+	lock string
+	// events is the read end of the pipe the binary streams progress to
+	events *os.File
+}
+
+// newRun prepares a run of b on a manifest of operations, with its log,
+// backups, report, progress file and lock kept in a temp dir.
+func newRun(t *testing.T, b *binary, operations ...cxfw.Operation) *run {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "root"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(cxfw.Manifest{Version: "1.0.0", Operations: operations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := os.WriteFile(manifest, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	events, eventsWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { events.Close() })
+	r := &run{dir: dir, lock: filepath.Join(dir, "cxfw_patch.lock"), events: events}
+	args := append(b.args(dir),
+		"--quiet",
+		"--log-file", filepath.Join(dir, "cxfw_patch.log"),
+		"--backup-dir", filepath.Join(dir, "backup"),
+		"--report", filepath.Join(dir, "report.json"),
+		"--progress-file", filepath.Join(dir, "progress.json"),
+		"--progress-fd", "3",
+		"--lock-file", r.lock,
+		manifest)
+	r.cmd = exec.Command(b.path, args...)
+	r.cmd.ExtraFiles = []*os.File{eventsWriter}
+	return r
+}
+
+// start starts the run.
+func (r *run) start(t *testing.T) {
+	t.Helper()
+	err := r.cmd.Start()
+	// Only the binary may hold the write end, so the read ends with it
+	r.cmd.ExtraFiles[0].Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wait waits for the run to exit and returns its exit code.
+func (r *run) wait(t *testing.T) int {
+	t.Helper()
+	err := r.cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+// report reads the report the run wrote.
+func (r *run) report(t *testing.T) cxfw.Report {
+	t.Helper()
+	var report cxfw.Report
+	readJSON(t, filepath.Join(r.dir, "report.json"), &report)
+	return report
+}
+
+// progress is the part of the progress file the tests check.
+type progress struct {
+	Mode    string `json:"mode"`
+	State   string `json:"state"`
+	Percent int    `json:"percent"`
+}
+
+// progress reads the progress file the run left.
+func (r *run) progress(t *testing.T) progress {
+	t.Helper()
+	var p progress
+	readJSON(t, filepath.Join(r.dir, "progress.json"), &p)
+	return p
+}
+
+// progressEvents reads the progress updates the run streamed to its
+// progress file descriptor, until the binary and everything it started
+// have closed it.
+func (r *run) progressEvents(t *testing.T) []progress {
+	t.Helper()
+	var events []progress
+	decoder := json.NewDecoder(r.events)
+	for {
+		var p progress
+		if err := decoder.Decode(&p); err == io.EOF {
+			return events
+		} else if err != nil {
+			t.Fatalf("progress fd: %v", err)
+		}
+		events = append(events, p)
+	}
+}
+
+func readJSON(t *testing.T, path string, v any) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+}
+
+// forEachBinary runs test against both binaries.
+func forEachBinary(t *testing.T, test func(t *testing.T, b *binary)) {
+	if testing.Short() {
+		t.Skip("builds and runs both binaries")
+	}
+	for _, b := range binaries {
+		t.Run(b.name, func(t *testing.T) {
+			t.Parallel()
+			test(t, b)
+		})
+	}
+}
+
+func command(c string) cxfw.Operation {
+	return cxfw.Operation{Operation: "command", Command: c}
+}
+
+func TestRunSucceeds(t *testing.T) {
+	forEachBinary(t, func(t *testing.T, b *binary) {
+		r := newRun(t, b, command("true"), command("true"))
+		r.start(t)
+		if code := r.wait(t); code != 0 {
+			t.Fatalf("exit code %d, want 0", code)
+		}
+		report := r.report(t)
+		if report.Mode != b.mode || report.State != cxfw.StateSucceeded || report.ExitCode != 0 {
+			t.Errorf("report mode %q state %q exit code %d, want %q %q 0", report.Mode, report.State, report.ExitCode, b.mode, cxfw.StateSucceeded)
+		}
+		if len(report.Operations) != 2 || report.Operations[1].State != cxfw.OpSucceeded {
+			t.Errorf("report operations %+v, want 2 succeeded", report.Operations)
+		}
+		if p := r.progress(t); p.Mode != b.mode || p.State != cxfw.StateSucceeded || p.Percent != 100 {
+			t.Errorf("progress %+v, want mode %q succeeded at 100%%", p, b.mode)
+		}
+		// One update as each operation starts, and the outcome
+		events := r.progressEvents(t)
+		if len(events) != 3 || events[0].State != "running" || events[2] != r.progress(t) {
+			t.Errorf("progress fd events %+v, want 2 running and the final progress", events)
+		}
+	})
+}
+
+func TestRunLockHeld(t *testing.T) {
+	forEachBinary(t, func(t *testing.T, b *binary) {
+		marker := filepath.Join(t.TempDir(), "ran")
+		r := newRun(t, b, command("touch "+marker))
+		file, err := os.Create(r.lock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			t.Fatal(err)
+		}
+
+		r.start(t)
+		if code := r.wait(t); code != cxfw.ExitAlreadyRunning {
+			t.Fatalf("exit code %d, want %d", code, cxfw.ExitAlreadyRunning)
+		}
+		if report := r.report(t); report.Mode != b.mode || report.Reason != cxfw.ReasonAlreadyRunning {
+			t.Errorf("report mode %q reason %q, want %q %q", report.Mode, report.Reason, b.mode, cxfw.ReasonAlreadyRunning)
+		}
+		if _, err := os.Stat(marker); !os.IsNotExist(err) {
+			t.Error("operation ran while another run held the lock")
+		}
+	})
+}
+
+func TestRunSIGTERM(t *testing.T) {
+	forEachBinary(t, func(t *testing.T, b *binary) {
+		started := filepath.Join(t.TempDir(), "started")
+		r := newRun(t, b, command("touch "+started+"; sleep 60"), command("true"))
+		r.start(t)
+		for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+			if _, err := os.Stat(started); err == nil {
+				break
+			} else if time.Now().After(deadline) {
+				r.cmd.Process.Kill()
+				t.Fatal("first operation did not start")
+			}
+		}
+		if err := r.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		begin := time.Now()
+		if code := r.wait(t); code != cxfw.ExitInterrupted {
+			t.Fatalf("exit code %d, want %d", code, cxfw.ExitInterrupted)
+		}
+		// The sleep is killed, not waited out for the grace period
+		if elapsed := time.Since(begin); elapsed > 5*time.Second {
+			t.Errorf("run took %s to stop after SIGTERM", elapsed)
+		}
+		report := r.report(t)
+		if report.Mode != b.mode || report.State != cxfw.StateFailed || report.Reason != cxfw.ReasonInterrupted {
+			t.Errorf("report mode %q state %q reason %q, want %q %q %q", report.Mode, report.State, report.Reason, b.mode, cxfw.StateFailed, cxfw.ReasonInterrupted)
+		}
+		if len(report.Operations) != 2 || report.Operations[0].Reason != cxfw.ReasonInterrupted || report.Operations[1].State != cxfw.OpNotRun {
+			t.Errorf("report operations %+v, want the first interrupted and the second not run", report.Operations)
+		}
+		if p := r.progress(t); p.Mode != b.mode || p.State != cxfw.StateFailed {
+			t.Errorf("progress %+v, want mode %q failed", p, b.mode)
+		}
+		if data, err := os.ReadFile(r.lock); err != nil || len(data) != 0 {
+			t.Errorf("lock file %q (%v), want it emptied on exit", data, err)
+		}
+	})
+}
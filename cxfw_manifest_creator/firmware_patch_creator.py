@@ -2,9 +2,18 @@
 import os
 import sys
 import json
+import base64
+import gzip
 import hashlib
+import io
 import argparse
+import shlex
+import shutil
+import subprocess
+import tarfile
+import tempfile
 from typing import List, Dict
+from urllib.parse import urlparse
 
 class FirmwarePatchCreator:
     """CLI tool for creating firmware update patch manifests."""
@@ -32,6 +41,11 @@ class FirmwarePatchCreator:
         except Exception:
             return "0" * 64  # Return placeholder hash on error
     
+    @staticmethod
+    def dump_json(data) -> str:
+        """Serialize data identically on every machine: sorted keys, ASCII only, trailing newline."""
+        return json.dumps(data, indent=2, sort_keys=True, ensure_ascii=True) + "\n"
+
     def is_valid_path(self, path: str) -> bool:
         """Check if the path is within the allowed firmware paths."""
         path = os.path.abspath(path)
@@ -39,12 +53,16 @@ class FirmwarePatchCreator:
     
     
 
-    def create_patch_manifest(self, add_files=None, add_dir=None, remove_files=None, commands=None, scripts=None, modify_defaults=None, manifest_name="patch_manifest.json"):
+    def create_patch_manifest(self, add_files=None, add_dir=None, remove_files=None, commands=None, scripts=None, modify_defaults=None, manifest_name="patch_manifest.json", replace_images=None, create_files=None, snapshot_dirs=None, reboot=False, pre_check=None, post_check=None, target=None, firmware_range=None):
         """
         Create a JSON manifest for firmware updates and a corresponding restore manifest.
         """
-        add_files = add_files or []
-        remove_files = remove_files or []
+        # File operations are sorted by target so the argument order does not change the output
+        add_files = sorted(set(add_files or []))
+        replace_images = sorted(set(replace_images or []))
+        create_files = sorted(set(create_files or []))
+        remove_files = sorted(set(remove_files or []))
+        snapshot_dirs = sorted(set(d.rstrip("/") for d in snapshot_dirs or []))
         commands = commands or []
         scripts = scripts or []
         modify_defaults = modify_defaults or {}
@@ -64,14 +82,41 @@ class FirmwarePatchCreator:
          # Define backup directory
         backup_dir = "/sda1/data/cxfw/rollback/"
 
+        # Snapshot directories before anything changes; the rollback restores them
+        # last, after the per-file operations. Snapshots are filed by version ID.
+        version_id = str(manifest.get("version", "")).strip().lower()
+        if version_id.startswith("v"):
+            version_id = version_id[1:]
+        restore_snapshots = []
+        for dir_path in snapshot_dirs:
+            # is_valid_path normalizes the trailing slash away, so compare the directory itself
+            if not any((os.path.abspath(dir_path) + "/").startswith(valid_path) for valid_path in self.valid_paths):
+                print(f"Warning: {dir_path} is not in a valid location, skipping.")
+                continue
+            name = dir_path.strip("/").replace("/", "_")
+            operations.append({"operation": "snapshot_integrity", "path": dir_path, "name": name})
+            restore_snapshots.append({"operation": "restore_integrity", "name": f"{version_id}/{name}"})
+
         # Remove operations first
-        for file_path in remove_files:
-            if self.is_valid_path(file_path):
-                operations.append({"operation": "remove", "path": file_path})
-                # Generate backup filename for restore
-                backup_filename = backup_dir + file_path.replace("/", "_")
-                # In restore, we assume the file should be restored (but without original content)
-                restore_operations.append({"operation": "add", "path": file_path, "source": backup_filename})
+        remove_files = [file_path for file_path in remove_files if self.is_valid_path(file_path)]
+        if len(remove_files) == 1:
+            file_path = remove_files[0]
+            operations.append({"operation": "remove", "path": file_path})
+            # Generate backup filename for restore
+            backup_filename = backup_dir + file_path.replace("/", "_")
+            # In restore, we assume the file should be restored (but without original content)
+            restore_operations.append({"operation": "add", "path": file_path, "source": backup_filename})
+        elif remove_files:
+            # One batch remove, restored by one batch add per directory from the backups
+            operations.append({"operation": "remove", "paths": remove_files})
+            by_dir = {}
+            for file_path in remove_files:
+                by_dir.setdefault(os.path.dirname(file_path), []).append(file_path)
+            for directory, paths in sorted(by_dir.items()):
+                restore_operations.append({"operation": "add", "path": directory, "files": [
+                    {"source": backup_dir + file_path.replace("/", "_"), "name": os.path.basename(file_path)}
+                    for file_path in paths
+                ]})
 
         # Add operations second
         if add_files and add_dir:
@@ -95,14 +140,72 @@ class FirmwarePatchCreator:
                     "size": file_size
                 })
 
-                # In restore, we need to remove the file that was added
-                restore_operations.append({"operation": "remove", "path": os.path.join(target_dir, os.path.basename(file_path))})
+                # In restore, remove the file that was added, then put back the version it
+                # replaced; the executor only backs up files that existed, and a batch add
+                # skips missing backups
+                dest_path = os.path.join(target_dir, os.path.basename(file_path))
+                restore_operations.append({"operation": "remove", "path": dest_path})
+                restore_operations.append({"operation": "add", "path": target_dir, "files": [
+                    {"source": backup_dir + dest_path.replace("/", "_"), "name": os.path.basename(dest_path)}
+                ]})
+
+        # Replace squashfs images; the executor backs up the old image for restore
+        if replace_images and add_dir:
+            for image_path in replace_images:
+                if not self.is_valid_path(image_path):
+                    print(f"Warning: {image_path} is not in a valid location, skipping.")
+                    continue
+                full_source_path = os.path.join(add_dir, os.path.basename(image_path))
+                if not os.path.exists(full_source_path):
+                    print(f"Warning: {full_source_path} not found, skipping.")
+                    continue
+
+                operations.append({
+                    "operation": "replace_image",
+                    "path": image_path,
+                    "source": "/tmp/patch/" + os.path.basename(image_path),
+                    "checksum": self.calculate_sha256(full_source_path),
+                    "size": os.path.getsize(full_source_path),
+                    "verify_mount": True
+                })
+                backup_filename = backup_dir + image_path.replace("/", "_")
+                restore_operations.append({"operation": "add", "path": image_path, "source": backup_filename})
+
+        # Small files travel inline instead of as staged payloads
+        for entry in create_files:
+            target_path, _, local_path = entry.partition("=")
+            if not local_path or not self.is_valid_path(target_path):
+                print(f"Warning: {entry} is not TARGET=LOCAL_FILE with a valid target, skipping.")
+                continue
+            if not os.path.isfile(local_path):
+                print(f"Warning: {local_path} not found, skipping.")
+                continue
+            with open(local_path, "rb") as f:
+                body = f.read()
+            operations.append({
+                "operation": "create_file",
+                "path": target_path,
+                "content_base64": base64.b64encode(body).decode("ascii"),
+                "checksum": hashlib.sha256(body).hexdigest(),
+                "mode": format(os.stat(local_path).st_mode & 0o777, "04o")
+            })
+            restore_operations.append({"operation": "remove", "path": target_path})
 
         # Add remaining operations (commands, scripts, modify_defaults)
         for command in commands:
             operations.append({"operation": "command", "command": command})
 
         for script in scripts:
+            if "source" in script:
+                # Shipped scripts run from the bundle, so their shebang is honoured
+                operations.append({
+                    "operation": "script",
+                    "script_name": script["script_name"],
+                    "source": "/tmp/patch/" + script["script_name"],
+                    "checksum": self.calculate_sha256(script["source"]),
+                    "size": os.path.getsize(script["source"])
+                })
+                continue
             operations.append({
                 "operation": "script",
                 "script_name": script["script_name"],
@@ -112,11 +215,30 @@ class FirmwarePatchCreator:
         if modify_defaults:
             operations.append({"operation": "modify_defaults", "entries": modify_defaults})
 
+        # The executor defers the reboot until every operation has succeeded
+        if reboot:
+            operations.append({"operation": "reboot"})
+
+        restore_operations.extend(restore_snapshots)
+
+        # Guard and verification scripts run before and after all operations
+        for key, script in (("pre_check", pre_check), ("post_check", post_check)):
+            if script is not None:
+                manifest[key] = script
+
+        # Restrict every operation to the given architectures and models
+        if target:
+            manifest["target"] = target
+
+        # Refuse devices whose installed firmware the patch was not built for
+        for key, value in (firmware_range or {}).items():
+            manifest[key] = value
+
         # Save patch_manifest.json
         manifest["operations"] = operations
         try:
-            with open(manifest_name, "w") as f:
-                json.dump(manifest, f, indent=2)
+            with open(manifest_name, "w", newline="\n") as f:
+                f.write(self.dump_json(manifest))
             print(f"Firmware patch manifest updated: {manifest_name}")
         except Exception as e:
             print(f"Error saving manifest: {e}")
@@ -127,8 +249,8 @@ class FirmwarePatchCreator:
         restore_manifest = {"version": "1.0", "operations": restore_operations}
 
         try:
-            with open(restore_manifest_name, "w") as f:
-                json.dump(restore_manifest, f, indent=2)
+            with open(restore_manifest_name, "w", newline="\n") as f:
+                f.write(self.dump_json(restore_manifest))
             print(f"Firmware rollback manifest created: {restore_manifest_name}")
         except Exception as e:
             print(f"Error saving rollback manifest: {e}")
@@ -154,13 +276,575 @@ class FirmwarePatchCreator:
     
         return parsed_defaults
 
+    def split_manifest(self, manifest_name: str, max_size: int = 5 * 1024 * 1024) -> List[str]:
+        """
+        Split a manifest into sequenced parts that each fit within max_size bytes.
+        Consecutive operations sharing a "group" are never separated.
+        """
+        try:
+            with open(manifest_name, "rb") as f:
+                raw = f.read()
+            manifest = json.loads(raw)
+        except Exception as e:
+            print(f"Error loading manifest: {e}")
+            sys.exit(1)
+
+        # Group consecutive operations that must stay together
+        chunks = []
+        for op in manifest.get("operations", []):
+            group = op.get("group")
+            if chunks and group and chunks[-1][0].get("group") == group:
+                chunks[-1].append(op)
+            else:
+                chunks.append([op])
+
+        # The session ID is derived from the manifest so re-splitting is stable
+        session_id = hashlib.sha256(raw).hexdigest()[:16]
+
+        # Manifest-level settings such as the target are carried into every part
+        header = {key: value for key, value in manifest.items()
+                  if key not in ("session_id", "part", "of", "operations")}
+        header.setdefault("version", "1.0")
+
+        def part_size(operations):
+            part = dict(header, session_id=session_id, part=999, of=999, operations=operations)
+            return len(self.dump_json(part).encode())
+
+        parts = [[]]
+        for chunk in chunks:
+            if part_size(chunk) > max_size:
+                print(f"Error: operation group starting with '{chunk[0].get('operation')}' exceeds {max_size} bytes on its own")
+                sys.exit(1)
+            if parts[-1] and part_size(parts[-1] + chunk) > max_size:
+                parts.append([])
+            parts[-1].extend(chunk)
+
+        stem = os.path.splitext(manifest_name)[0]
+        written = []
+        for index, operations in enumerate(parts, start=1):
+            part_name = f"{stem}.part{index}of{len(parts)}.json"
+            part = dict(header, session_id=session_id, part=index, of=len(parts), operations=operations)
+            try:
+                with open(part_name, "w", newline="\n") as f:
+                    f.write(self.dump_json(part))
+            except Exception as e:
+                print(f"Error saving manifest part: {e}")
+                sys.exit(1)
+            written.append(part_name)
+            print(f"Manifest part {index}/{len(parts)} created: {part_name} ({len(operations)} operations)")
+        return written
+
+    def sign_manifest(self, manifest_name: str, key_file: str) -> str:
+        """
+        Write a detached ed25519 signature over the exact manifest bytes to
+        manifest_name + ".sig". Sign last: any later edit invalidates it.
+        """
+        signature_name = manifest_name + ".sig"
+        result = subprocess.run(["openssl", "pkeyutl", "-sign", "-rawin", "-inkey", key_file,
+                                 "-in", manifest_name, "-out", signature_name],
+                                capture_output=True, text=True)
+        if result.returncode != 0:
+            print(f"Error signing {manifest_name}: {result.stderr.strip()}")
+            sys.exit(1)
+        print(f"Manifest signature created: {signature_name}")
+        return signature_name
+
+    @staticmethod
+    def source_date_epoch() -> int:
+        """Return the timestamp for bundle entries, SOURCE_DATE_EPOCH or 0."""
+        value = os.environ.get("SOURCE_DATE_EPOCH", "0")
+        if not value.isdigit():
+            print(f"Error: SOURCE_DATE_EPOCH must be a number of seconds, got {value!r}")
+            sys.exit(1)
+        return int(value)
+
+    @staticmethod
+    def bundle_entry(name: str, size: int, mode: int, mtime: int) -> tarfile.TarInfo:
+        """Return a tar header for a bundle entry that does not depend on the build machine."""
+        info = tarfile.TarInfo(name)
+        info.size, info.mode, info.mtime = size, mode, mtime
+        info.uid = info.gid = 0
+        info.uname = info.gname = "root"
+        return info
+
+    def create_bundle(self, manifest_name: str, payload_dir: str, bundle_name: str, key_file: str = None) -> str:
+        """
+        Pack a manifest and its payloads into a self-contained .cxfw bundle: a tar.gz
+        holding manifest.json, the payloads under payload/ and index.json with their
+        checksums. Payload sources are looked up by base name in payload_dir and
+        rewritten to their relative path inside the bundle. With key_file the bundle
+        also holds manifest.json.sig. The bundle is byte-identical for the same inputs,
+        with every timestamp set to SOURCE_DATE_EPOCH.
+        """
+        try:
+            with open(manifest_name, "r") as f:
+                manifest = json.load(f)
+        except Exception as e:
+            print(f"Error loading manifest: {e}")
+            sys.exit(1)
+
+        mtime = self.source_date_epoch()
+        payloads, origins = {}, {}
+        def bundled(source: str) -> str:
+            if not source or urlparse(source).scheme:
+                return source
+            name = "payload/" + os.path.basename(source)
+            if origins.setdefault(name, source) != source:
+                print(f"Error: payloads {origins[name]} and {source} share the base name {os.path.basename(source)}")
+                sys.exit(1)
+            local = os.path.join(payload_dir, os.path.basename(source))
+            if not os.path.isfile(local):
+                print(f"Error: payload {local} for {source} not found")
+                sys.exit(1)
+            payloads[name] = local
+            return name
+
+        for op in manifest.get("operations", []):
+            if "source" in op:
+                op["source"] = bundled(op["source"])
+            for file in op.get("files", []):
+                file["source"] = bundled(file.get("source", ""))
+
+        index = {"files": [{"path": name, "checksum": self.calculate_sha256(local), "size": os.path.getsize(local)}
+                           for name, local in sorted(payloads.items())]}
+        entries = [("manifest.json", self.dump_json(manifest).encode()), ("index.json", self.dump_json(index).encode())]
+        if key_file:
+            with tempfile.TemporaryDirectory() as temp_dir:
+                signed = os.path.join(temp_dir, "manifest.json")
+                with open(signed, "wb") as f:
+                    f.write(entries[0][1])
+                with open(self.sign_manifest(signed, key_file), "rb") as f:
+                    entries.insert(1, ("manifest.json.sig", f.read()))
+        try:
+            with open(bundle_name, "wb") as out, \
+                    gzip.GzipFile(filename="", mode="wb", fileobj=out, mtime=mtime) as compressed, \
+                    tarfile.open(fileobj=compressed, mode="w", format=tarfile.PAX_FORMAT) as bundle:
+                for name, data in entries:
+                    bundle.addfile(self.bundle_entry(name, len(data), 0o644, mtime), io.BytesIO(data))
+                for name, local in sorted(payloads.items()):
+                    mode = 0o755 if os.stat(local).st_mode & 0o100 else 0o644
+                    with open(local, "rb") as f:
+                        bundle.addfile(self.bundle_entry(name, os.path.getsize(local), mode, mtime), f)
+        except Exception as e:
+            print(f"Error creating bundle: {e}")
+            sys.exit(1)
+        print(f"Bundle created: {bundle_name} ({len(payloads)} payloads)")
+        return bundle_name
+
+    @staticmethod
+    def format_target(value) -> str:
+        """Render an arch or model restriction given as a string or a list."""
+        return value if isinstance(value, str) else ", ".join(value)
+
+    # Operations whose "path" names a directory rather than a file
+    DIRECTORY_OPERATIONS = {"add", "copy", "extract_tar", "download"}
+    # Operations that run arbitrary code or write raw devices
+    RISKY_OPERATIONS = {"command", "script", "flash"}
+
+    @staticmethod
+    def payload_sources(op: Dict) -> List[str]:
+        """Return the payload paths an operation reads, including those of a batch add."""
+        sources = [op.get("source", "")] + [f.get("source", "") for f in op.get("files", [])]
+        return [source for source in sources if source]
+
+    @staticmethod
+    def format_size(size: int) -> str:
+        """Render a byte count for humans."""
+        for unit in ("B", "KB", "MB"):
+            if size < 1024:
+                return f"{size:.0f} {unit}" if unit == "B" else f"{size:.1f} {unit}"
+            size /= 1024
+        return f"{size:.1f} GB"
+
+    def describe_operation(self, op: Dict) -> (str, str):
+        """Return the directory an operation belongs to and its one-line target description."""
+        kind = op.get("operation", "?")
+        path = op.get("path", "")
+        if kind in ("command", "script"):
+            target = op.get("command") or shlex.join(op.get("argv", [])) or op.get("script_name") or "inline script"
+            return "(commands and scripts)", target.splitlines()[0] if target else target
+        if kind == "service":
+            return "(services)", f"{op.get('action', '?')} {op.get('name', '?')}"
+        if kind == "self_update":
+            return "(patch tooling)", op.get("path") or "cxfw_patch_executor"
+        if kind == "kmod":
+            return "(kernel modules)", f"{op.get('action', '?')} {op.get('name', '?')}"
+        if kind == "reboot":
+            delay = op.get("delay_seconds")
+            return "(system)", f"after all operations, {delay}s delay" if delay else "after all operations"
+        if kind == "user":
+            return "(accounts)", f"{op.get('action', '?')} {op.get('name', '?')}"
+        if kind == "cron":
+            return "(cron)", f"{op.get('action', '?')} {op.get('user') or 'root'}: {op.get('entry', '?')}"
+        if kind == "install_cert":
+            return path or "/etc/ssl/certs", op.get("name") or os.path.basename(op.get("source", ""))
+        if kind == "cleanup":
+            return path, f"{op.get('pattern', '?')} (cleanup)"
+        if kind == "snapshot_integrity":
+            return path, "(integrity snapshot)"
+        if kind == "restore_integrity":
+            return "(integrity snapshots)", f"restore {op.get('name', '?')}"
+        if kind == "remove" and op.get("paths"):
+            directories = sorted({os.path.dirname(p) for p in op["paths"]})
+            if len(directories) == 1:
+                return directories[0], f"{len(op['paths'])} files: {', '.join(os.path.basename(p) for p in op['paths'])}"
+            return "(several directories)", f"{len(op['paths'])} files: {', '.join(op['paths'])}"
+        if kind == "remount":
+            return "(mounts)", f"{path or '?'} {op.get('mode', '?')}"
+        if kind == "launcher":
+            return "(launcher)", f"{op.get('action', '?')} {op.get('name', '?')}"
+        if kind == "modify_defaults":
+            keys = sum(len(v) if isinstance(v, dict) else 1 for v in op.get("entries", {}).values())
+            return os.path.dirname(self.default_values_path), f"{os.path.basename(self.default_values_path)} ({keys} keys)"
+        if kind in self.DIRECTORY_OPERATIONS:
+            if op.get("files"):
+                names = [f.get("name") or os.path.basename(f.get("source", "")) for f in op["files"]]
+                return path, f"{len(names)} files: {', '.join(names)}"
+            name = op.get("name") or os.path.basename(op.get("source", ""))
+            if kind == "extract_tar":
+                return path, name + " (archive)"
+            if kind == "download":
+                return path, os.path.basename(urlparse(op.get("source", "")).path)
+            return path, name
+        return os.path.dirname(path) or "/", os.path.basename(path) or path
+
+    def describe_manifest(self, manifest_name: str, fmt: str = "text") -> str:
+        """Render a manifest as a human-readable change summary for review."""
+        try:
+            with open(manifest_name, "r") as f:
+                manifest = json.load(f)
+        except Exception as e:
+            print(f"Error loading manifest: {e}")
+            sys.exit(1)
+
+        operations = manifest.get("operations", [])
+        groups = {}
+        counts = {}
+        total_size = 0
+        risky = []
+        for index, op in enumerate(operations, start=1):
+            kind = op.get("operation", "?")
+            directory, target = self.describe_operation(op)
+            size = op.get("size") or sum(f.get("size") or 0 for f in op.get("files", [])) or None
+            total_size += size or 0
+            counts[kind] = counts.get(kind, 0) + 1
+            for key in ("arch", "model"):
+                if op.get(key):
+                    target += f" [{key} {self.format_target(op[key])}]"
+            if op.get("condition"):
+                target += f" [if {op['condition']}]"
+            if op.get("expected_exit_codes"):
+                target += f" [exit {', '.join(str(code) for code in [0] + op['expected_exit_codes'])} ok]"
+            if op.get("allow_failure"):
+                target += " [may fail]"
+            groups.setdefault(directory, []).append((index, kind, target, size, op.get("comment", "")))
+            if kind in self.RISKY_OPERATIONS:
+                risky.append((f"#{index}", kind, target))
+        for hook in ("pre_check", "post_check"):
+            if manifest.get(hook):
+                code = [line for line in manifest[hook].splitlines() if line.strip() and not line.startswith("#")]
+                risky.append((hook, "script", code[0] if code else "(comments only)"))
+
+        markdown = fmt == "markdown"
+        lines = []
+        title = f"Patch {manifest.get('version', '?')}: {len(operations)} operations"
+        lines += [f"# {title}", ""] if markdown else [title, "=" * len(title), ""]
+        restrictions = [f"{key} {self.format_target(value)}" for key, value in manifest.get("target", {}).items() if value]
+        minimum, maximum = manifest.get("min_firmware_version"), manifest.get("max_firmware_version")
+        if minimum or maximum:
+            restrictions.append(f"firmware {minimum or 'any'} to {maximum or 'any'}")
+        if restrictions:
+            lines += [f"Only for devices with {' and '.join(restrictions)}", ""]
+
+        for directory in sorted(groups):
+            heading = directory if directory.startswith("(") else f"`{directory}`"
+            lines += [f"## {heading}", ""] if markdown else [directory]
+            for index, kind, target, size, comment in groups[directory]:
+                detail = f" ({self.format_size(size)})" if size else ""
+                purpose = f" - {comment}" if comment else ""
+                if markdown:
+                    lines.append(f"- #{index} **{kind}** `{target}`{detail}{purpose}")
+                else:
+                    lines.append(f"  - #{index} {kind} {target}{detail}{purpose}")
+            lines.append("")
+
+        summary = ", ".join(f"{counts[kind]} {kind}" for kind in sorted(counts))
+        lines += ["## Totals", ""] if markdown else ["Totals"]
+        prefix = "- " if markdown else "  "
+        lines.append(f"{prefix}Operations: {summary or 'none'}")
+        lines.append(f"{prefix}Payload size: {self.format_size(total_size)}")
+        lines.append("")
+
+        if risky:
+            lines += ["## Risk", ""] if markdown else ["RISK"]
+            lines.append(f"{prefix}{len(risky)} operations or checks run code or write devices and need careful review:")
+            for label, kind, target in risky:
+                lines.append(f"{prefix}  {label} {kind}: {target}" if not markdown else f"  - {label} {kind}: `{target}`")
+            lines.append("")
+
+        return "\n".join(lines)
+
+    # Operations that would run on the build host instead of the image
+    HOST_OPERATIONS = {"command", "script", "service", "flash", "kmod", "remount", "reboot"}
+    # Suffixes of executor temp files that must never survive a run
+    TEMP_SUFFIXES = (".tmp", ".new")
+    # Left out of simulation diffs: backups are expected side effects
+    SIMULATE_IGNORED_DIRS = ("/sda1/data/cxfw/rollback",)
+
+    def snapshot_tree(self, root: str) -> Dict[str, str]:
+        """Map every in-image path below root to a content fingerprint."""
+        snapshot = {}
+        for dirpath, dirnames, filenames in os.walk(root):
+            for name in dirnames + filenames:
+                full = os.path.join(dirpath, name)
+                path = "/" + os.path.relpath(full, root)
+                if os.path.islink(full):
+                    snapshot[path] = "symlink:" + os.readlink(full)
+                elif os.path.isdir(full):
+                    snapshot[path] = "dir"
+                else:
+                    snapshot[path] = self.calculate_sha256(full)
+        return snapshot
+
+    def is_integrity_file(self, path: str) -> bool:
+        """Integrity databases are re-encrypted with a fresh nonce on every write."""
+        name = os.path.basename(path)
+        return name == ".db.json" or name == "." + os.path.basename(os.path.dirname(path)) + ".json"
+
+    def simulate(self, manifest_name: str, reference: str, key_file: str, expected_dir: str = None,
+                 expected_checksums: str = None, payload_dir: str = None, executor: str = None,
+                 keep: bool = False) -> bool:
+        """
+        Apply a manifest to a copy of a reference root with the executor and
+        compare the outcome against an expected tree or declared checksums.
+        Returns True when the result matches exactly.
+        """
+        try:
+            with open(manifest_name, "r") as f:
+                manifest = json.load(f)
+            expected_sums = None
+            if expected_checksums:
+                with open(expected_checksums, "r") as f:
+                    expected_sums = json.load(f)
+        except Exception as e:
+            print(f"Error loading manifest: {e}")
+            sys.exit(1)
+
+        executor = executor or shutil.which("cxfw_patch_executor") or os.path.join(
+            os.path.dirname(os.path.abspath(__file__)), "..", "cxfw_patch_executor", "cxfw_patch_executor")
+        if not os.access(executor, os.X_OK):
+            print(f"Error: executor {executor} not found or not executable")
+            sys.exit(1)
+
+        # Commands, scripts and services cannot be confined to the copy
+        operations = []
+        for index, op in enumerate(manifest.get("operations", []), start=1):
+            if op.get("operation") in self.HOST_OPERATIONS:
+                print(f"Warning: operation #{index} ({op.get('operation')}) is not simulated")
+            else:
+                operations.append(op)
+
+        workdir = tempfile.mkdtemp(prefix="cxfw_simulate_")
+        root = os.path.join(workdir, "root")
+        log_file = os.path.join(workdir, "cxfw_patch.log")
+        try:
+            shutil.copytree(reference, root, symlinks=True)
+
+            # Stage payloads at their in-image source paths
+            staged = set()
+            for source in (s for op in operations for s in self.payload_sources(op)):
+                if not source.startswith("/") or os.path.lexists(root + source):
+                    continue
+                if payload_dir and os.path.exists(os.path.join(payload_dir, os.path.basename(source))):
+                    parent = os.path.dirname(source)
+                    while not os.path.exists(root + parent):
+                        staged.add(parent)
+                        parent = os.path.dirname(parent)
+                    os.makedirs(os.path.dirname(root + source), exist_ok=True)
+                    shutil.copy2(os.path.join(payload_dir, os.path.basename(source)), root + source)
+                    staged.add(source)
+                else:
+                    print(f"Warning: payload {source} not found in the reference root or payload directory")
+
+            before = self.snapshot_tree(root)
+            simulated = dict(manifest, operations=operations)
+            for hook in ("pre_check", "post_check"):
+                if simulated.pop(hook, None):
+                    print(f"Warning: {hook} is not simulated")
+            simulated_name = os.path.join(workdir, "manifest.json")
+            with open(simulated_name, "w") as f:
+                json.dump(simulated, f, indent=2)
+
+            # The simulated manifest is rewritten, so it cannot carry the signature
+            result = subprocess.run([executor, "--root", root, "--key-file", key_file, "--allow-unsigned",
+                                     "--log-file", log_file, "--report", "", "--metrics-file", "",
+                                     simulated_name])
+            after = self.snapshot_tree(root)
+            expected = self.snapshot_tree(expected_dir) if expected_dir else None
+        finally:
+            if keep:
+                print(f"Simulation tree kept at {root}, executor log at {log_file}")
+            else:
+                shutil.rmtree(workdir, ignore_errors=True)
+
+        reference_tree = {p: v for p, v in before.items() if p not in staged}
+        unexpected, missing, leftovers = [], [], []
+
+        def compared(path):
+            ignored = any(path == d or path.startswith(d + "/") or d.startswith(path + "/")
+                          for d in self.SIMULATE_IGNORED_DIRS)
+            return not ignored and path not in staged
+
+        def fingerprint(tree, path):
+            value = tree.get(path)
+            if value is not None and self.is_integrity_file(path):
+                return "present"
+            return value
+
+        if expected is not None:
+            for path in sorted(set(after) | set(expected)):
+                if not compared(path) or fingerprint(after, path) == fingerprint(expected, path):
+                    continue
+                if fingerprint(reference_tree, path) == fingerprint(expected, path):
+                    unexpected.append(path)
+                else:
+                    missing.append(path)
+        else:
+            for path, checksum in sorted(expected_sums.items()):
+                if after.get(path) != checksum:
+                    missing.append(path)
+            for path in sorted(set(after) | set(reference_tree)):
+                if path in expected_sums or not compared(path) or self.is_integrity_file(path):
+                    continue
+                if after.get(path) != reference_tree.get(path) and after.get(path) != "dir":
+                    unexpected.append(path)
+
+        for path in sorted(after):
+            if path not in reference_tree and path.endswith(self.TEMP_SUFFIXES):
+                leftovers.append(path)
+        for op in operations:
+            consumed = op.get("operation") in ("add", "extract_tar", "delta") and not op.get("keep_source")
+            for source in self.payload_sources(op):
+                if consumed and source in staged and source in after:
+                    leftovers.append(source)
+
+        print(f"Executor exit status: {result.returncode}")
+        for title, paths in (("Unexpected changes", unexpected), ("Missing changes", missing),
+                             ("Leftover temp artifacts", leftovers)):
+            print(f"{title}: {len(paths)}")
+            for path in paths:
+                print(f"  {path}")
+
+        ok = result.returncode == 0 and not unexpected and not missing and not leftovers
+        print("Simulation " + ("passed" if ok else "FAILED"))
+        return ok
+
+def describe_main(argv: List[str]):
+    parser = argparse.ArgumentParser(prog="firmware_patch_creator.py describe",
+                                     description="Render a manifest as a human-readable change summary")
+    parser.add_argument("manifest", help="Manifest file to describe")
+    parser.add_argument("--format", choices=["text", "markdown"], default="text", help="Output format")
+    parser.add_argument("--output", help="Write the summary to this file instead of stdout")
+    args = parser.parse_args(argv)
+
+    creator = FirmwarePatchCreator()
+    summary = creator.describe_manifest(args.manifest, fmt=args.format)
+    if args.output:
+        with open(args.output, "w", newline="\n") as f:
+            f.write(summary)
+        print(f"Change summary written: {args.output}")
+    else:
+        print(summary, end="")
+
+def split_main(argv: List[str]):
+    parser = argparse.ArgumentParser(prog="firmware_patch_creator.py split",
+                                     description="Split a manifest into sequenced parts")
+    parser.add_argument("manifest", help="Manifest file to split")
+    parser.add_argument("--max-size", type=int, default=5 * 1024 * 1024,
+                        help="Maximum size of each part in bytes (default 5 MB)")
+    args = parser.parse_args(argv)
+
+    creator = FirmwarePatchCreator()
+    creator.split_manifest(args.manifest, max_size=args.max_size)
+
+def sign_main(argv: List[str]):
+    parser = argparse.ArgumentParser(prog="firmware_patch_creator.py sign",
+                                     description="Write detached ed25519 signatures for manifests")
+    parser.add_argument("manifests", nargs="+", help="Manifest files or split parts to sign")
+    parser.add_argument("--key", required=True, help="PEM ed25519 private key")
+    args = parser.parse_args(argv)
+
+    creator = FirmwarePatchCreator()
+    for manifest_name in args.manifests:
+        creator.sign_manifest(manifest_name, args.key)
+
+def bundle_main(argv: List[str]):
+    parser = argparse.ArgumentParser(prog="firmware_patch_creator.py bundle",
+                                     description="Pack a manifest and its payloads into a .cxfw bundle")
+    parser.add_argument("manifest", help="Manifest file to bundle")
+    parser.add_argument("--payload-dir", required=True, help="Directory holding the payload files referenced by source paths")
+    parser.add_argument("--output", "-o", help="Bundle file to write, the manifest name with .cxfw by default")
+    parser.add_argument("--key", help="PEM ed25519 private key to sign the bundled manifest with, as manifest.json.sig")
+    args = parser.parse_args(argv)
+
+    creator = FirmwarePatchCreator()
+    creator.create_bundle(args.manifest, args.payload_dir, args.output or os.path.splitext(args.manifest)[0] + ".cxfw", args.key)
+
+def simulate_main(argv: List[str]):
+    parser = argparse.ArgumentParser(prog="firmware_patch_creator.py simulate",
+                                     description="Apply a manifest to a copy of a reference root and diff the result")
+    parser.add_argument("manifest", help="Manifest file to simulate")
+    parser.add_argument("--reference", required=True, help="Root directory of the pristine reference image")
+    parser.add_argument("--key-file", required=True, help="File holding the integrity database key of the image")
+    expected = parser.add_mutually_exclusive_group(required=True)
+    expected.add_argument("--expected", help="Root directory of the intended result")
+    expected.add_argument("--expected-checksums", help="JSON file mapping in-image paths to SHA256 (null for absent)")
+    parser.add_argument("--payload-dir", help="Directory holding the payload files referenced by source paths")
+    parser.add_argument("--executor", help="Path to the cxfw_patch_executor binary")
+    parser.add_argument("--keep", action="store_true", help="Keep the simulated tree for inspection")
+    args = parser.parse_args(argv)
+
+    creator = FirmwarePatchCreator()
+    ok = creator.simulate(args.manifest, args.reference, args.key_file, expected_dir=args.expected,
+                          expected_checksums=args.expected_checksums, payload_dir=args.payload_dir,
+                          executor=args.executor, keep=args.keep)
+    sys.exit(0 if ok else 1)
+
 def main():
+    if len(sys.argv) > 1 and sys.argv[1] == "split":
+        split_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "describe":
+        describe_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "sign":
+        sign_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "bundle":
+        bundle_main(sys.argv[2:])
+        return
+    if len(sys.argv) > 1 and sys.argv[1] == "simulate":
+        simulate_main(sys.argv[2:])
+        return
+
     parser = argparse.ArgumentParser(description="Firmware Update Patch Manifest Creator")
     parser.add_argument("--add", nargs="+", help="Files to add (target paths within valid locations)")
     parser.add_argument("--remove", nargs="+", help="Files to remove")
+    parser.add_argument("--create-file", nargs="+", metavar="TARGET=LOCAL_FILE", help="Small files to create from inline content (e.g. /sda1/data/apps/99-usb.rules=./99-usb.rules)")
+    parser.add_argument("--replace-image", nargs="+", help="Squashfs images to replace (target paths within valid locations)")
     parser.add_argument("--command", nargs="+", help="Bash commands to execute")
     parser.add_argument("--script", nargs="*", help="Path to script files to embed in the JSON manifest")
+    parser.add_argument("--script-file", nargs="+", help="Script files to ship in /tmp/patch and run from there instead of embedding them")
     parser.add_argument("--modify-defaults", nargs="*", help="Modify .defaultvalues file (formatted as [Section]:key=value or key=value)")
+    parser.add_argument("--snapshot-integrity", nargs="+", metavar="DIR", help="Directories whose integrity state is snapshotted before the patch and restored by the rollback")
+    parser.add_argument("--pre-check", metavar="SCRIPT", help="Script that must succeed before any operation runs, e.g. to check the UI is idle")
+    parser.add_argument("--post-check", metavar="SCRIPT", help="Script verifying the device after all operations; the patch fails if it fails")
+    parser.add_argument("--target-arch", nargs="+", metavar="ARCH", help="Only apply the patch on these architectures (e.g. arm64 or x86_64)")
+    parser.add_argument("--target-model", nargs="+", metavar="MODEL", help="Only apply the patch on these device models, as listed in /sda1/data/.model")
+    parser.add_argument("--min-firmware-version", metavar="VERSION", help="Oldest installed firmware the patch supports (e.g. 4.2)")
+    parser.add_argument("--max-firmware-version", metavar="VERSION", help="Newest installed firmware the patch supports; 4.2 covers every 4.2.x")
+    parser.add_argument("--allow-unknown-version", action="store_true", help="Apply the patch even if the installed firmware version cannot be read")
+    parser.add_argument("--reboot", action="store_true", help="Reboot the device once every operation has succeeded")
     parser.add_argument("--manifest", default="patch_manifest.json", help="Name of the manifest file")
     
     args = parser.parse_args()
@@ -185,13 +869,39 @@ def main():
             else:
                 print(f"Warning: Script {script_path} not found, skipping.")
 
+    for script_path in args.script_file or []:
+        if os.path.isfile(script_path):
+            scripts.append({"script_name": os.path.basename(script_path), "source": script_path})
+        else:
+            print(f"Warning: Script {script_path} not found, skipping.")
+
     add_dir = None
-    if args.add:
+    if args.add or args.replace_image:
         add_dir = input("Enter the local directory containing files to be added: ").strip()
         if not os.path.isdir(add_dir):
             print("Error: Provided add directory does not exist.")
             sys.exit(1)
     
+    checks = {}
+    for key, script_path in (("pre_check", args.pre_check), ("post_check", args.post_check)):
+        if script_path:
+            if not os.path.isfile(script_path):
+                print(f"Error: Script {script_path} not found.")
+                sys.exit(1)
+            with open(script_path, "r") as script_file:
+                checks[key] = script_file.read()
+
+    target = {}
+    for key, values in (("arch", args.target_arch), ("model", args.target_model)):
+        if values:
+            target[key] = values
+
+    firmware_range = {}
+    for key, value in (("min_firmware_version", args.min_firmware_version), ("max_firmware_version", args.max_firmware_version),
+                       ("allow_unknown_version", args.allow_unknown_version)):
+        if value:
+            firmware_range[key] = value
+
     modify_defaults = {}
     if args.modify_defaults:
         creator = FirmwarePatchCreator()
@@ -205,7 +915,14 @@ def main():
         commands=args.command,
         scripts=scripts,
         modify_defaults=modify_defaults,
-        manifest_name=args.manifest
+        manifest_name=args.manifest,
+        replace_images=args.replace_image,
+        create_files=args.create_file,
+        snapshot_dirs=args.snapshot_integrity,
+        reboot=args.reboot,
+        target=target,
+        firmware_range=firmware_range,
+        **checks
     )
 
 if __name__ == "__main__":
@@ -0,0 +1,106 @@
+#!/usr/bin/env python3
+"""
+Tests of firmware_patch_creator.py. Run them with
+python3 -m unittest test_firmware_patch_creator from this directory. Set
+UPDATE_GOLDEN=1 to rewrite the golden files in testdata/ after an intended
+change of the output, and review the diff.
+"""
+import contextlib
+import io
+import os
+import shutil
+import subprocess
+import tempfile
+import unittest
+
+from firmware_patch_creator import FirmwarePatchCreator
+
+TESTDATA = os.path.join(os.path.dirname(os.path.abspath(__file__)), "testdata")
+
+
+class DescribeTest(unittest.TestCase):
+    """The release notes describe renders, compared with golden files."""
+
+    def assert_golden(self, got: str, golden: str):
+        path = os.path.join(TESTDATA, golden)
+        if os.environ.get("UPDATE_GOLDEN"):
+            with open(path, "w", newline="\n") as f:
+                f.write(got)
+        with open(path, "r") as f:
+            self.assertEqual(got, f.read(), f"describe output differs from {golden}, see the module docstring to update it")
+
+    def test_text(self):
+        got = FirmwarePatchCreator().describe_manifest(os.path.join(TESTDATA, "describe_manifest.json"))
+        self.assert_golden(got, "describe.txt")
+
+    def test_markdown(self):
+        got = FirmwarePatchCreator().describe_manifest(os.path.join(TESTDATA, "describe_manifest.json"), fmt="markdown")
+        self.assert_golden(got, "describe.md")
+
+
+class ReproducibleBuildTest(unittest.TestCase):
+    """The same inputs build byte-identical manifests, parts and bundles."""
+
+    ADD = ["/sda1/data/apps/bin/agent", "/sda1/data/apps/lib/libagent.so", "/sda1/data/core/etc/agent.conf"]
+    REMOVE = ["/sda1/data/apps/bin/old_agent", "/sda1/data/apps/lib/libold.so"]
+
+    def setUp(self):
+        self.temp_dir = tempfile.mkdtemp()
+        self.addCleanup(shutil.rmtree, self.temp_dir)
+        self.addCleanup(os.chdir, os.getcwd())
+        self.key_file = None
+        if shutil.which("openssl"):
+            self.key_file = os.path.join(self.temp_dir, "signing.pem")
+            subprocess.run(["openssl", "genpkey", "-algorithm", "ed25519", "-out", self.key_file], check=True)
+
+    def build(self, name: str, order: slice, mtime: int) -> str:
+        """
+        Build a manifest, its rollback manifest, split parts and a bundle in a
+        fresh directory, from payloads written at mtime, giving the arguments in
+        the given order. Returns the directory.
+        """
+        out = os.path.join(self.temp_dir, name)
+        payload_dir = os.path.join(out, "payload")
+        os.makedirs(payload_dir)
+        for target in self.ADD:
+            local = os.path.join(payload_dir, os.path.basename(target))
+            with open(local, "w") as f:
+                f.write(f"payload for {target}\n" * 100)
+            os.chmod(local, 0o755 if "/bin/" in target else 0o644)
+            os.utime(local, (mtime, mtime))
+        rules = os.path.join(out, "99-agent.rules")
+        with open(rules, "w") as f:
+            f.write('ACTION=="add", RUN+="/sda1/data/apps/bin/agent"\n')
+        os.chmod(rules, 0o644)
+
+        os.chdir(out)
+        creator = FirmwarePatchCreator()
+        with contextlib.redirect_stdout(io.StringIO()):
+            creator.create_patch_manifest(
+                add_files=self.ADD[order], add_dir=payload_dir, remove_files=self.REMOVE[order],
+                commands=["systemctl stop agent", "systemctl start agent"],
+                create_files=["/sda1/data/apps/etc/99-agent.rules=" + rules],
+                modify_defaults=creator.parse_modify_defaults(["[agent]:enabled=1"]),
+                target={"arch": ["arm64"]})
+            creator.split_manifest("patch_manifest.json", max_size=1024)
+            creator.create_bundle("patch_manifest.json", payload_dir, "patch.cxfw", self.key_file)
+        shutil.rmtree(payload_dir)
+        os.remove(rules)
+        return out
+
+    def test_build_twice(self):
+        first = self.build("first", slice(None), 1000000000)
+        second = self.build("second", slice(None, None, -1), 2000000000)
+        names = sorted(os.listdir(first))
+        self.assertEqual(names, sorted(os.listdir(second)))
+        self.assertIn("patch.cxfw", names)
+        self.assertIn("patch_rollback_manifest.json", names)
+        self.assertTrue(any(".part" in name for name in names), f"no split parts in {names}")
+        for name in names:
+            with open(os.path.join(first, name), "rb") as a, open(os.path.join(second, name), "rb") as b:
+                if a.read() != b.read():
+                    self.fail(f"{name} differs between two builds of the same inputs")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+
+	"cxfw_common/cxfw"
+)
+
+// provisionUser adds or removes the system user op.Name in /etc/passwd,
+// /etc/group and /etc/shadow. Adding an identical user again and removing
+// an absent one are no-ops, so the operation can be re-run.
+func provisionUser(op cxfw.Operation) error {
+	changed, err := cxfw.ApplyAccountChange(op)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to " + op.Action + " user " + op.Name + " - " + err.Error())
+		return fmt.Errorf("failed to %s user %s: %w", op.Action, op.Name, err)
+	}
+	switch {
+	case !changed && op.Action == "add":
+		cxfw.LogToFile("INFO: User " + op.Name + " already present, skipped")
+	case !changed:
+		cxfw.LogToFile("INFO: User " + op.Name + " not present, nothing to remove")
+	case op.Action == "add":
+		cxfw.LogToFile("SUCCESS: User " + op.Name + " added")
+	default:
+		cxfw.LogToFile("SUCCESS: User " + op.Name + " removed")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultWritableRoots are the directories add, copy, remove, remove_dir,
+// cleanup, download, create_file and extract_tar operations may write below unless --writable-roots or
+// --unrestricted say otherwise.
+const defaultWritableRoots = "/sda1/data,/tmp/patch_staging"
+
+// writableRoots holds the in-image writable roots, or nil when the
+// executor runs with --unrestricted.
+var writableRoots []string
+
+// parseWritableRoots parses the comma-separated --writable-roots value.
+func parseWritableRoots(value string) ([]string, error) {
+	var roots []string
+	for _, root := range strings.Split(value, ",") {
+		root = strings.TrimSpace(root)
+		if root == "" {
+			continue
+		}
+		if !filepath.IsAbs(root) {
+			return nil, fmt.Errorf("writable root %q is not absolute", root)
+		}
+		roots = append(roots, filepath.Clean(root))
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no writable roots given, use --unrestricted to allow writes anywhere")
+	}
+	return roots, nil
+}
+
+// writtenPaths returns the host paths op creates, overwrites or removes,
+// for the operations confined to the writable roots.
+func writtenPaths(op cxfw.Operation) []string {
+	switch op.Operation {
+	case "add", "copy":
+		if len(op.Files) == 0 {
+			dest, _ := addDestination(op)
+			return []string{dest}
+		}
+		var paths []string
+		for _, file := range op.Files {
+			_, dest, _ := batchEntry(op, file)
+			paths = append(paths, dest)
+		}
+		return paths
+	case "remove":
+		if op.Path != "" {
+			return []string{op.Path}
+		}
+		return op.Paths
+	case "create_file", "extract_tar", "remove_dir":
+		return []string{op.Path}
+	case "download":
+		// The file is staged and installed in the directory op.Path
+		if op.Path == "" {
+			return nil
+		}
+		name := op.Source
+		if u, err := url.Parse(op.Source); err == nil {
+			name = u.Path
+		}
+		return []string{filepath.Join(op.Path, path.Base(name))}
+	case "cleanup":
+		// The files deleted are the matches of op.Pattern in op.Path
+		if op.Path == "" {
+			return nil
+		}
+		return []string{filepath.Join(op.Path, op.Pattern)}
+	}
+	return nil
+}
+
+// checkWritablePaths reports an error if op writes outside the writable
+// roots, either by its path itself or through a symlinked parent directory
+// that resolves outside them.
+func checkWritablePaths(op cxfw.Operation) error {
+	if writableRoots == nil {
+		return nil
+	}
+	for _, path := range writtenPaths(op) {
+		if path == "" {
+			continue
+		}
+		image := filepath.Clean(cxfw.ImagePath(path))
+		if !withinWritableRoots(image) {
+			return fmt.Errorf("%s is outside the writable roots %s", image, strings.Join(writableRoots, ", "))
+		}
+		parent := filepath.Dir(filepath.Clean(path))
+		existing, _, ok := existingAncestor(parent)
+		if !ok {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err != nil {
+			return fmt.Errorf("cannot resolve %s: %w", cxfw.ImagePath(existing), err)
+		}
+		rest, _ := filepath.Rel(existing, path)
+		if real := cxfw.ImagePath(filepath.Join(resolved, rest)); !withinWritableRoots(real) {
+			return fmt.Errorf("%s resolves to %s, outside the writable roots %s", image, real, strings.Join(writableRoots, ", "))
+		}
+	}
+	return nil
+}
+
+func withinWritableRoots(path string) bool {
+	for _, root := range writableRoots {
+		if isWithin(path, root) && path != root {
+			return true
+		}
+	}
+	return false
+}
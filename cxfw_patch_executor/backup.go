@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cxfw_common/cxfw"
+)
+
+// backupPathFor picks the backup file for path, whose content has the given
+// checksum. It returns the flattened name unless that name already holds a
+// different file, in which case the first free or matching ".N" variant is
+// used. existing is true when an identical backup of the same path is
+// already in place and no copy is needed.
+func backupPathFor(path, checksum string) (backupPath string, existing bool, err error) {
+	hostBackupDir := cxfw.HostPath(cxfw.BackupDir)
+	records, err := cxfw.LoadBackupIndex(hostBackupDir)
+	if err != nil {
+		return "", false, err
+	}
+	owner := make(map[string]string)
+	for _, record := range records {
+		owner[cxfw.HostPath(record.Backup)] = record.Path
+	}
+
+	imagePath := cxfw.ImagePath(path)
+	base := filepath.Join(hostBackupDir, strings.ReplaceAll(imagePath, "/", "_"))
+	for i := 0; ; i++ {
+		candidate := base
+		if i > 0 {
+			candidate = fmt.Sprintf("%s.%d", base, i)
+		}
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate, false, nil
+		} else if err != nil {
+			return "", false, err
+		}
+
+		// Backups written before the index existed have no owner recorded
+		if recordedPath, known := owner[candidate]; known && recordedPath != imagePath {
+			continue
+		}
+		candidateChecksum, err := cxfw.ComputeChecksum(candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if candidateChecksum == checksum {
+			return candidate, true, nil
+		}
+	}
+}
+
+// backupFile copies the existing file at path to the backup directory, so a
+// rollback manifest can restore it, and returns the backup path.
+func backupFile(path string) (string, error) {
+	if err := os.MkdirAll(cxfw.HostPath(cxfw.BackupDir), 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create backup directory - " + err.Error())
+		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	originalChecksum, err := cxfw.ComputeChecksum(path)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to compute original checksum - " + err.Error())
+		return "", fmt.Errorf("failed to compute original checksum: %w", err)
+	}
+
+	// Never overwrite a backup holding different content
+	backupPath, existing, err := backupPathFor(path, originalChecksum)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to choose backup path - " + err.Error())
+		return "", fmt.Errorf("failed to choose backup path: %w", err)
+	}
+	if existing {
+		cxfw.LogToFile("INFO: Identical backup already exists - " + backupPath)
+		cxfw.LogToFile("SUCCESS: File backed up successfully - " + backupPath)
+		return backupPath, nil
+	}
+	if canonical := filepath.Join(cxfw.HostPath(cxfw.BackupDir), strings.ReplaceAll(cxfw.ImagePath(path), "/", "_")); backupPath != canonical {
+		cxfw.LogToFile("WARNING: Backup " + canonical + " already holds different content, using " + backupPath)
+	}
+	cxfw.LogToFile("DEBUG: Copying file to backup: " + path + " -> " + backupPath)
+	if err := cxfw.CopyFile(path, backupPath); err != nil {
+		cxfw.LogToFile("ERROR: Failed to copy file to backup - " + err.Error())
+		return "", fmt.Errorf("failed to copy file to backup: %w", err)
+	}
+
+	// Verify checksum of copied file
+	backupChecksum, err := cxfw.ComputeChecksum(backupPath)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to compute backup checksum - " + err.Error())
+		return "", fmt.Errorf("failed to compute backup checksum: %w", err)
+	}
+	if backupChecksum != originalChecksum {
+		cxfw.LogToFile("ERROR: Backup checksum mismatch for " + backupPath)
+		return "", fmt.Errorf("backup checksum mismatch for %s", backupPath)
+	}
+
+	err = cxfw.RecordBackup(cxfw.HostPath(cxfw.BackupDir), cxfw.BackupRecord{Path: path, Backup: backupPath, Checksum: backupChecksum})
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to record backup - " + err.Error())
+		return "", fmt.Errorf("failed to record backup: %w", err)
+	}
+	cxfw.LogToFile("SUCCESS: File backed up successfully - " + backupPath)
+	return backupPath, nil
+}
+
+// backedUpThisRun are the paths backupOnce has already handled in this run.
+var backedUpThisRun = make(map[string]bool)
+
+// backupOnce backs up path before the first change a run makes to it. Files
+// edited by several operations, like the launcher index or a crontab, are
+// then backed up with their pre-patch content, which is what the rollback
+// restores. A path that did not exist before the run is not backed up.
+func backupOnce(path string) error {
+	if backedUpThisRun[path] {
+		return nil
+	}
+	if _, err := os.Stat(path); err == nil {
+		if _, err := backupFile(path); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		cxfw.LogToFile("ERROR: Failed to check file existence - " + err.Error())
+		return fmt.Errorf("failed to check file existence: %w", err)
+	}
+	backedUpThisRun[path] = true
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"cxfw_common/cxfw"
+)
+
+func TestBackupFileKeepsBothSidesOfANameCollision(t *testing.T) {
+	root := t.TempDir()
+	defer func(logFile, rootDir string) { cxfw.LogFile, cxfw.Root = logFile, rootDir }(cxfw.LogFile, cxfw.Root)
+	cxfw.LogFile, cxfw.Root = filepath.Join(root, "cxfw_patch.log"), root
+
+	// Both paths flatten to _sda1_data_a_b_file in the backup directory
+	paths := []string{cxfw.HostPath("/sda1/data/a_b/file"), cxfw.HostPath("/sda1/data/a/b_file")}
+	backups := make(map[string]string)
+	for _, path := range paths {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("content of "+cxfw.ImagePath(path)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		backup, err := backupFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backups[path] = backup
+	}
+	if backups[paths[0]] == backups[paths[1]] {
+		t.Fatalf("both files backed up to %s", backups[paths[0]])
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(backups[path])
+		if err != nil || string(data) != "content of "+cxfw.ImagePath(path) {
+			t.Errorf("backup %s of %s holds %q (%v)", backups[path], path, data, err)
+		}
+		// A later patch backing up the same content reuses the backup
+		if again, err := backupFile(path); err != nil || again != backups[path] {
+			t.Errorf("second backup of %s = %s (%v), want %s", path, again, err, backups[path])
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// bsdiffMagic identifies patches produced by bsdiff 4.x.
+const bsdiffMagic = "BSDIFF40"
+
+// bspatchChunk bounds the memory used while applying a patch; the old file
+// is read with ReadAt instead of being loaded whole, since app binaries can
+// be larger than the free RAM on some models.
+const bspatchChunk = 64 * 1024
+
+// applyBsdiff reconstructs the new file from oldFile and a BSDIFF40 patch,
+// writing the result to out.
+//
+// Patch layout: 32-byte header ("BSDIFF40", control block length, diff block
+// length, new file size) followed by three bzip2 streams: control tuples,
+// diff bytes (added to old bytes) and extra bytes (copied verbatim).
+func applyBsdiff(oldFile *os.File, patch []byte, out io.Writer) error {
+	if len(patch) < 32 || string(patch[:8]) != bsdiffMagic {
+		return fmt.Errorf("not a BSDIFF40 patch")
+	}
+	ctrlLen := offtin(patch[8:16])
+	diffLen := offtin(patch[16:24])
+	newSize := offtin(patch[24:32])
+	if ctrlLen < 0 || diffLen < 0 || newSize < 0 || 32+ctrlLen+diffLen > int64(len(patch)) {
+		return fmt.Errorf("corrupt patch header")
+	}
+
+	ctrl := bzip2.NewReader(bytes.NewReader(patch[32 : 32+ctrlLen]))
+	diff := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen : 32+ctrlLen+diffLen]))
+	extra := bzip2.NewReader(bytes.NewReader(patch[32+ctrlLen+diffLen:]))
+
+	oldInfo, err := oldFile.Stat()
+	if err != nil {
+		return err
+	}
+	oldSize := oldInfo.Size()
+
+	buf := make([]byte, bspatchChunk)
+	oldBuf := make([]byte, bspatchChunk)
+	var ctrlBuf [24]byte
+	var oldPos, newPos int64
+
+	for newPos < newSize {
+		if _, err := io.ReadFull(ctrl, ctrlBuf[:]); err != nil {
+			return fmt.Errorf("corrupt control block: %w", err)
+		}
+		addLen := offtin(ctrlBuf[0:8])
+		copyLen := offtin(ctrlBuf[8:16])
+		seek := offtin(ctrlBuf[16:24])
+		if addLen < 0 || copyLen < 0 || newPos+addLen+copyLen > newSize {
+			return fmt.Errorf("corrupt control tuple")
+		}
+
+		// Diff bytes are added to the old file's bytes at the same offset
+		for remaining := addLen; remaining > 0; {
+			n := min(remaining, bspatchChunk)
+			if _, err := io.ReadFull(diff, buf[:n]); err != nil {
+				return fmt.Errorf("corrupt diff block: %w", err)
+			}
+			clear(oldBuf[:n])
+			if oldPos < oldSize && oldPos+n > 0 {
+				start := max(oldPos, 0)
+				end := min(oldPos+n, oldSize)
+				if _, err := oldFile.ReadAt(oldBuf[start-oldPos:end-oldPos], start); err != nil && err != io.EOF {
+					return err
+				}
+			}
+			for i := int64(0); i < n; i++ {
+				buf[i] += oldBuf[i]
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			oldPos += n
+			newPos += n
+			remaining -= n
+		}
+
+		// Extra bytes are copied verbatim
+		if _, err := io.CopyN(out, extra, copyLen); err != nil {
+			return fmt.Errorf("corrupt extra block: %w", err)
+		}
+		newPos += copyLen
+		oldPos += seek
+	}
+	return nil
+}
+
+// offtin decodes bsdiff's sign-magnitude little-endian 64-bit integer.
+func offtin(b []byte) int64 {
+	v := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"cxfw_common/cxfw"
+)
+
+// A patch bundle (.cxfw) is a tar.gz holding manifest.json, index.json and
+// the payload files. Relative source fields of the manifest name payloads
+// inside the bundle. A detached manifest.json.sig is verified like the
+// signature next to a manifest file.
+const (
+	bundleManifest  = "manifest.json"
+	bundleSignature = "manifest.json.sig"
+	bundleIndex     = "index.json"
+)
+
+// bundleStagingParent is the in-image directory bundles are extracted below.
+const bundleStagingParent = "/tmp"
+
+// bundleIndexFile lists every payload of a bundle with its checksum.
+type bundleIndexFile struct {
+	Files []bundleIndexEntry `json:"files"`
+}
+
+// bundleIndexEntry is one payload of a bundle.
+type bundleIndexEntry struct {
+	Path     string `json:"path"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+}
+
+// bundleStaging is the host directory the bundle of this run is extracted
+// to, removed when the run finishes.
+var bundleStaging string
+
+// errBundleMismatch marks a payload that does not match the bundle index.
+var errBundleMismatch = errors.New("payload does not match the bundle index")
+
+// stageBundle extracts the bundle at bundlePath to a staging directory and
+// verifies every payload against its index before anything runs. It returns
+// the path of the bundled manifest, or ends the run if the bundle is
+// unusable.
+func stageBundle(bundlePath string) string {
+	cxfw.LogToFile("Loading bundle: " + bundlePath)
+	checksum, err := cxfw.ComputeChecksum(bundlePath)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to read bundle - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Bundle %s (sha256 %s)", bundlePath, checksum))
+
+	parent := cxfw.HostPath(bundleStagingParent)
+	if err := os.MkdirAll(parent, 0755); err == nil {
+		bundleStaging, err = os.MkdirTemp(parent, "cxfw_bundle.")
+	}
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to create bundle staging directory - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+	}
+
+	count, err := extractBundle(bundlePath, bundleStaging)
+	switch {
+	case errors.Is(err, errBundleMismatch):
+		cxfw.LogToFile("ERROR: Bundle verification failed, no changes made - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitPreflightFailed, cxfw.ReasonChecksumMismatch, err.Error())
+	case err != nil && cxfw.ExitCodeForError(err) != cxfw.ExitFailure:
+		cxfw.LogToFile("ERROR: Failed to extract bundle - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+	case err != nil:
+		cxfw.LogToFile("ERROR: Invalid bundle - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Bundle extracted to %s, %d payloads verified", cxfw.ImagePath(bundleStaging), count))
+	return filepath.Join(bundleStaging, bundleManifest)
+}
+
+// extractBundle extracts the bundle at bundlePath into dir and checks its
+// files against the index: every payload listed must be present with its
+// checksum and size, and every file other than the manifest, its signature
+// and the index must be listed. It returns the number of payloads.
+func extractBundle(bundlePath, dir string) (int, error) {
+	// Step 1: Extract, hashing every regular file as it is written
+	extracted := make(map[string]bundleIndexEntry)
+	err := walkTar(bundlePath, func(header *tar.Header, content io.Reader) error {
+		if err := validateTarEntry(header); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.Clean(header.Name))
+		if header.Typeflag == tar.TypeDir {
+			return os.MkdirAll(target, 0755)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(header.Mode).Perm()&0755)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		hash := sha256.New()
+		n, err := io.CopyBuffer(io.MultiWriter(file, hash), content, cxfw.NewCopyBuffer())
+		if err != nil {
+			return cxfw.ClassifyWriteError(target, n, err)
+		}
+		name := filepath.ToSlash(filepath.Clean(header.Name))
+		extracted[name] = bundleIndexEntry{Path: name, Checksum: hex.EncodeToString(hash.Sum(nil)), Size: n}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to extract bundle: %w", err)
+	}
+
+	// Step 2: Read the index
+	if _, ok := extracted[bundleManifest]; !ok {
+		return 0, fmt.Errorf("bundle holds no %s", bundleManifest)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, bundleIndex))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read bundle index: %w", err)
+	}
+	var index bundleIndexFile
+	if err := json.Unmarshal(data, &index); err != nil {
+		return 0, fmt.Errorf("failed to parse bundle index: %w", err)
+	}
+
+	// Step 3: Verify every payload against the index
+	listed := make(map[string]bool)
+	for _, entry := range index.Files {
+		name := path.Clean(entry.Path)
+		if !filepath.IsLocal(name) || entry.Checksum == "" {
+			return 0, fmt.Errorf("invalid bundle index entry %q", entry.Path)
+		}
+		listed[name] = true
+		file, ok := extracted[name]
+		switch {
+		case !ok:
+			return 0, fmt.Errorf("%w: %s is missing", errBundleMismatch, name)
+		case file.Checksum != entry.Checksum:
+			return 0, fmt.Errorf("%w: checksum of %s is %s, expected %s", errBundleMismatch, name, file.Checksum, entry.Checksum)
+		case file.Size != entry.Size:
+			return 0, fmt.Errorf("%w: size of %s is %d, expected %d", errBundleMismatch, name, file.Size, entry.Size)
+		}
+	}
+	for name := range extracted {
+		if name != bundleManifest && name != bundleSignature && name != bundleIndex && !listed[name] {
+			return 0, fmt.Errorf("%w: %s is not listed", errBundleMismatch, name)
+		}
+	}
+	return len(index.Files), nil
+}
+
+// rewriteBundleSources points the relative source fields of manifest at
+// the staged payloads, as in-image paths so --root and --chroot runs find
+// them too. Absolute sources and URLs are left alone.
+func rewriteBundleSources(manifest *cxfw.Manifest) {
+	staging := cxfw.ImagePath(bundleStaging)
+	rewrite := func(source string) string {
+		if source == "" || filepath.IsAbs(source) || strings.Contains(source, "://") {
+			return source
+		}
+		return filepath.Join(staging, source)
+	}
+	for i := range manifest.Operations {
+		op := &manifest.Operations[i]
+		op.Source = rewrite(op.Source)
+		for j := range op.Files {
+			op.Files[j].Source = rewrite(op.Files[j].Source)
+		}
+	}
+}
+
+// removeBundleStaging removes the staged bundle of this run, if any.
+func removeBundleStaging() {
+	if bundleStaging == "" {
+		return
+	}
+	if err := os.RemoveAll(bundleStaging); err != nil {
+		cxfw.LogToFile("WARNING: Failed to remove bundle staging directory - " + err.Error())
+	} else {
+		cxfw.LogToFile("INFO: Removed bundle staging directory " + cxfw.ImagePath(bundleStaging))
+	}
+	bundleStaging = ""
+}
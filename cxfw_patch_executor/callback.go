@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultDeviceIDFile identifies the device in the report unless
+// --device-id-file names another file.
+const defaultDeviceIDFile = "/etc/machine-id"
+
+// reportAttempts is how often the report is posted before giving up, and
+// reportRetryDelay the wait before the first retry, each later retry
+// waiting one delay longer.
+const (
+	reportAttempts   = 3
+	reportRetryDelay = 2 * time.Second
+	reportTimeout    = 15 * time.Second
+)
+
+// reportURL is where the finished run posts the report, or empty for nowhere;
+// reportToken is sent as a bearer token if set.
+var reportURL, reportToken string
+
+// reportClient posts the report; --report-insecure turns off its TLS
+// verification.
+var reportClient = &http.Client{
+	Timeout: reportTimeout,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: reportTimeout}).DialContext,
+		TLSHandshakeTimeout: reportTimeout,
+	},
+}
+
+// setReportURL checks the --report-url flag: the report goes over https
+// unless insecure, which also accepts any server certificate, for lab
+// setups.
+func setReportURL(rawURL string, insecure bool) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid report URL: %w", err)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && insecure:
+	default:
+		return fmt.Errorf("refusing to post the report to %s: only https is allowed without --report-insecure", rawURL)
+	}
+	if insecure {
+		reportClient.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	reportURL = rawURL
+	return nil
+}
+
+// loadDeviceID puts the device identifier from path into the report. A
+// missing file leaves it out.
+func loadDeviceID(path string) {
+	data, err := os.ReadFile(cxfw.HostPath(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			cxfw.LogToFile("WARNING: Failed to read device ID - " + err.Error())
+		}
+		return
+	}
+	cxfw.RunReport.DeviceID = strings.TrimSpace(string(data))
+}
+
+// postReport posts the report to reportURL, retrying with backoff. Failing
+// to deliver it is logged and never changes the exit code.
+func postReport() {
+	if reportURL == "" {
+		return
+	}
+	data, err := json.Marshal(&cxfw.RunReport)
+	if err != nil {
+		cxfw.LogToFile("WARNING: Failed to marshal report for posting - " + err.Error())
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err = sendReport(data)
+		if err == nil {
+			cxfw.LogToFile("INFO: Report posted to " + reportURL)
+			return
+		}
+		if attempt == reportAttempts {
+			cxfw.LogToFile(fmt.Sprintf("WARNING: Failed to post report after %d attempts - %v", attempt, err))
+			return
+		}
+		delay := time.Duration(attempt) * reportRetryDelay
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Attempt %d/%d to post report failed, retrying in %s - %v", attempt, reportAttempts, delay, err))
+		time.Sleep(delay)
+	}
+}
+
+// sendReport makes one attempt to post data to reportURL.
+func sendReport(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reportURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if reportToken != "" {
+		req.Header.Set("Authorization", "Bearer "+reportToken)
+	}
+	resp, err := reportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultCertDir is where install_cert places certificates when the
+// operation does not give a path.
+const defaultCertDir = "/etc/ssl/certs"
+
+// certBundleName is the combined CA bundle in the cert directory that
+// install_cert updates unless the operation gives a rehash command.
+const certBundleName = "ca-certificates.crt"
+
+// defaultRehashTimeout bounds the rehash command when the operation does
+// not set timeout.
+const defaultRehashTimeout = 60 * time.Second
+
+// installCert installs the PEM certificates in op.Source into the cert
+// directory op.Path as op.Name, or the source's base name, and makes them
+// trusted: op.Command, when given, is run to rehash the directory;
+// otherwise the certificates are merged into the directory's combined
+// bundle, replacing copies with the same fingerprint.
+func installCert(op cxfw.Operation) error {
+	if op.Source == "" {
+		cxfw.LogToFile("ERROR: Invalid install_cert operation, missing source")
+		return fmt.Errorf("invalid install_cert operation, missing source")
+	}
+	if op.Command != "" && cxfw.Root != "" {
+		cxfw.LogToFile("ERROR: Rehash commands run on the live system and cannot be applied with --root")
+		return fmt.Errorf("install_cert rehash commands cannot be applied with --root")
+	}
+	dir := op.Path
+	if dir == "" {
+		dir = cxfw.HostPath(defaultCertDir)
+	}
+	name := op.Name
+	if name == "" {
+		name = filepath.Base(op.Source)
+	}
+	if name != filepath.Base(name) || name == certBundleName {
+		cxfw.LogToFile("ERROR: Invalid certificate name - " + name)
+		return fmt.Errorf("invalid certificate name %q", name)
+	}
+	dest := filepath.Join(dir, name)
+
+	// Step 1: Verify the payload holds only valid, current certificates
+	data, err := os.ReadFile(op.Source)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to read certificate - " + err.Error())
+		return fmt.Errorf("failed to read certificate: %w", err)
+	}
+	if op.Checksum != "" {
+		sum := sha256.Sum256(data)
+		if checksum := hex.EncodeToString(sum[:]); checksum != op.Checksum {
+			cxfw.LogToFile("ERROR: Checksum mismatch for certificate " + op.Source)
+			return fmt.Errorf("%w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Source, op.Checksum, checksum)
+		}
+	}
+	certs, err := parseCertificates(data, time.Now())
+	if err != nil {
+		cxfw.LogToFile("ERROR: Rejected certificate " + op.Source + " - " + err.Error())
+		return fmt.Errorf("rejected certificate %s: %w", op.Source, err)
+	}
+	for _, cert := range certs {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Certificate %s, SHA256 fingerprint %s, valid until %s",
+			cert.Subject, certFingerprint(cert), cert.NotAfter.UTC().Format(time.RFC3339)))
+	}
+
+	// Step 2: Install the certificate file
+	if _, err := os.Stat(dest); err == nil {
+		if _, err := backupFile(dest); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + dir)
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := cxfw.WriteFileAtomic(dest, data, 0644); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write certificate - " + err.Error())
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	cxfw.LogToFile("INFO: Installed certificate " + dest)
+
+	// Step 3: Make the certificate trusted
+	if op.Command != "" {
+		timeout := operationTimeout(op, defaultRehashTimeout)
+		ctx, cancel := context.WithTimeout(cxfw.RunCtx, timeout)
+		defer cancel()
+		cxfw.LogToFile("DEBUG: Running rehash command: " + op.Command)
+		if output, err := runCaptured(ctx, op.Command); err != nil {
+			cxfw.LogToFile("ERROR: Rehash command failed - " + err.Error())
+			logCommandOutput(output)
+			return fmt.Errorf("rehash command failed: %w", err)
+		}
+	} else if err := mergeIntoBundle(filepath.Join(dir, certBundleName), certs); err != nil {
+		cxfw.LogToFile("ERROR: Failed to update CA bundle - " + err.Error())
+		return fmt.Errorf("failed to update CA bundle: %w", err)
+	}
+
+	if !op.KeepSource {
+		if err := os.Remove(op.Source); err != nil {
+			cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
+			return fmt.Errorf("failed to remove source file: %w", err)
+		}
+	}
+	cxfw.LogToFile("SUCCESS: Certificate installed successfully - " + dest)
+	return nil
+}
+
+// parseCertificates decodes data as one or more PEM certificates that are
+// valid at now. Anything else in the file, such as a private key, is an
+// error rather than being installed into the trust store.
+func parseCertificates(data []byte, now time.Time) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate: %w", err)
+		}
+		if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+			return nil, fmt.Errorf("certificate %s is only valid from %s to %s", cert.Subject,
+				cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+		}
+		certs = append(certs, cert)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("trailing data after the last PEM block")
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// certFingerprint is the SHA256 of the certificate's DER encoding, as
+// openssl x509 -fingerprint -sha256 prints it.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// mergeIntoBundle rewrites the CA bundle with certs appended, dropping any
+// certificate already in it with the same fingerprint, along with the text
+// preceding it. The rest of the bundle is kept byte for byte.
+func mergeIntoBundle(bundle string, certs []*x509.Certificate) error {
+	existing, err := os.ReadFile(bundle)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := backupOnce(bundle); err != nil {
+		return err
+	}
+
+	replaced := make(map[string]bool)
+	for _, cert := range certs {
+		replaced[certFingerprint(cert)] = true
+	}
+	var merged bytes.Buffer
+	for offset := 0; ; {
+		block, rest := pem.Decode(existing[offset:])
+		if block == nil {
+			merged.Write(existing[offset:])
+			break
+		}
+		end := len(existing) - len(rest)
+		keep := true
+		if block.Type == "CERTIFICATE" {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			keep = err != nil || !replaced[certFingerprint(cert)]
+		}
+		if keep {
+			merged.Write(existing[offset:end])
+		}
+		offset = end
+	}
+	if merged.Len() > 0 && !bytes.HasSuffix(merged.Bytes(), []byte("\n")) {
+		merged.WriteByte('\n')
+	}
+	for _, cert := range certs {
+		pem.Encode(&merged, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	if err := cxfw.WriteFileAtomic(bundle, merged.Bytes(), 0644); err != nil {
+		return err
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Updated CA bundle %s with %d certificates", bundle, len(certs)))
+	return nil
+}
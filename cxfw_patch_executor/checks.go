@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// checkTimeout bounds the manifest's pre_check and post_check scripts.
+const checkTimeout = 5 * time.Minute
+
+// runCheck runs the manifest's pre_check or post_check script, named by
+// kind, and copies its output into the patch log. A non-zero exit status
+// is an error.
+func runCheck(kind, script string) error {
+	cxfw.LogToFile("INFO: Running " + kind)
+	ctx, cancel := context.WithTimeout(cxfw.RunCtx, checkTimeout)
+	defer cancel()
+	output, err := runCaptured(ctx, script)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + kind + " failed - " + err.Error())
+		logCommandOutput(output)
+		return fmt.Errorf("%s failed: %w", kind, err)
+	}
+	if output = strings.TrimRight(output, "\n"); output != "" {
+		for _, line := range strings.Split(output, "\n") {
+			cxfw.LogToFile("INFO:   " + line)
+		}
+	}
+	cxfw.LogToFile("SUCCESS: " + kind + " passed")
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// cleanupCandidates lists the regular files directly in op.Path whose name
+// matches the glob op.Pattern and, with op.OlderThanDays set, that were last
+// modified more than that many days ago. Symlinks are never followed or
+// removed, and the directory's integrity database and folder file are never
+// candidates.
+func cleanupCandidates(op cxfw.Operation) ([]string, error) {
+	if op.Path == "" || op.Pattern == "" {
+		return nil, fmt.Errorf("invalid cleanup operation, missing path or pattern")
+	}
+	if strings.Contains(op.Pattern, "/") {
+		return nil, fmt.Errorf("invalid cleanup pattern %q, must match names within the directory", op.Pattern)
+	}
+	if _, err := filepath.Match(op.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid cleanup pattern %q: %w", op.Pattern, err)
+	}
+	if op.OlderThanDays < 0 || op.MaxDelete < 0 {
+		return nil, fmt.Errorf("invalid cleanup operation, negative older_than_days or max_delete")
+	}
+
+	dir := filepath.Clean(op.Path)
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to check directory: %w", err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list directory: %w", err)
+	}
+	cutoff := time.Now().AddDate(0, 0, -op.OlderThanDays)
+	var candidates []string
+	for _, entry := range entries {
+		if matched, _ := filepath.Match(op.Pattern, entry.Name()); !matched || cxfw.IsDatabaseFile(dir, entry.Name()) {
+			continue
+		}
+		if !entry.Type().IsRegular() {
+			cxfw.LogToFile("INFO: Cleanup skipped non-regular file " + filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if op.OlderThanDays > 0 {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s: %w", entry.Name(), err)
+			}
+			if !info.ModTime().Before(cutoff) {
+				continue
+			}
+		}
+		candidates = append(candidates, filepath.Join(dir, entry.Name()))
+	}
+	if op.MaxDelete > 0 && len(candidates) > op.MaxDelete {
+		return nil, fmt.Errorf("cleanup of %s in %s matches %d files, more than max_delete %d", op.Pattern, dir, len(candidates), op.MaxDelete)
+	}
+	return candidates, nil
+}
+
+// cleanupFiles deletes the files selected by cleanupCandidates. Nothing is
+// deleted when the match count exceeds op.MaxDelete. Deleted files tracked
+// in the directory's integrity database are dropped from it first.
+func cleanupFiles(op cxfw.Operation) error {
+	// Step 1: Select the files to delete
+	candidates, err := cleanupCandidates(op)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	dir := filepath.Clean(op.Path)
+	if len(candidates) == 0 {
+		cxfw.LogToFile("INFO: Cleanup found nothing to delete in " + dir)
+		return nil
+	}
+
+	// Step 2: Drop tracked files from the integrity database
+	removed, dbHash, err := cxfw.PruneIntegrityDatabase(dir, candidates)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
+	}
+	if removed > 0 {
+		if err := cxfw.UpdateFolderFile(dir, dbHash); err != nil {
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+			return fmt.Errorf("failed to update folder file: %w", err)
+		}
+	}
+
+	// Step 3: Delete the files
+	for _, path := range candidates {
+		cxfw.LogToFile("INFO: Deleting " + path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			cxfw.LogToFile("ERROR: Failed to delete file - " + err.Error())
+			return fmt.Errorf("failed to delete %s: %w", path, err)
+		}
+	}
+
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: Cleanup deleted %d files from %s, %d tracked in the integrity database", len(candidates), dir, removed))
+	return nil
+}
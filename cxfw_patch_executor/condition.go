@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// conditionTimeout bounds an operation's condition.
+const conditionTimeout = time.Minute
+
+// conditionMet runs op.Condition through sh -c and reports whether it
+// exited zero. An operation without a condition always runs. A condition
+// that cannot be evaluated, e.g. because it timed out, is an error rather
+// than a skip.
+func conditionMet(op cxfw.Operation) (bool, error) {
+	if op.Condition == "" {
+		return true, nil
+	}
+	ctx, cancel := context.WithTimeout(cxfw.RunCtx, conditionTimeout)
+	defer cancel()
+	output, err := runCaptured(ctx, op.Condition)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &exitErr) && ctx.Err() == nil:
+		return false, nil
+	default:
+		cxfw.LogToFile("ERROR: Failed to evaluate condition " + op.Condition + " - " + err.Error())
+		logCommandOutput(output)
+		return false, fmt.Errorf("failed to evaluate condition: %w", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+
+	"cxfw_common/cxfw"
+)
+
+// cronSpoolDir holds one crontab per user, as read by crond.
+const cronSpoolDir = "/var/spool/cron/crontabs"
+
+// cronUpdateFile in the spool directory tells busybox crond which users'
+// crontabs changed; crontab(1) appends to it the same way.
+const cronUpdateFile = "cron.update"
+
+// cronUserPattern matches user names that are safe as crontab file names.
+var cronUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// updateCrontab adds op.Entry to the crontab of op.User, root by default,
+// unless an identical line is already there, or removes every line
+// identical to it. Lines are compared with surrounding whitespace trimmed.
+func updateCrontab(op cxfw.Operation) error {
+	entry := strings.TrimSpace(op.Entry)
+	if entry == "" || op.Action == "" {
+		cxfw.LogToFile("ERROR: Invalid cron operation, missing entry or action")
+		return fmt.Errorf("invalid cron operation, missing entry or action")
+	}
+	if strings.ContainsAny(entry, "\r\n") {
+		cxfw.LogToFile("ERROR: Invalid cron entry, must be a single line")
+		return fmt.Errorf("invalid cron entry, must be a single line")
+	}
+	if op.Action != "add" && op.Action != "remove" {
+		cxfw.LogToFile("ERROR: Invalid cron action - " + op.Action)
+		return fmt.Errorf("invalid cron action %q, expected add or remove", op.Action)
+	}
+	user := op.User
+	if user == "" {
+		user = "root"
+	}
+	if !cronUserPattern.MatchString(user) {
+		cxfw.LogToFile("ERROR: Invalid cron user - " + user)
+		return fmt.Errorf("invalid cron user %q", user)
+	}
+	spoolDir := cxfw.HostPath(cronSpoolDir)
+	crontab := filepath.Join(spoolDir, user)
+
+	// Step 1: Read the current crontab, keeping its owner and mode
+	mode, uid, gid := os.FileMode(0600), -1, -1
+	if info, err := os.Stat(crontab); err == nil {
+		mode = info.Mode().Perm()
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+	data, err := os.ReadFile(crontab)
+	if err != nil && !os.IsNotExist(err) {
+		cxfw.LogToFile("ERROR: Failed to read crontab - " + err.Error())
+		return fmt.Errorf("failed to read crontab: %w", err)
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	matches := func(line string) bool { return strings.TrimSpace(line) == entry }
+
+	// Step 2: Add or remove the entry
+	if op.Action == "add" {
+		if slices.ContainsFunc(lines, matches) {
+			cxfw.LogToFile("INFO: Cron entry already present for " + user + ", skipped - " + entry)
+			return nil
+		}
+		lines = append(lines, entry)
+	} else {
+		remaining := slices.DeleteFunc(slices.Clone(lines), matches)
+		if len(remaining) == len(lines) {
+			cxfw.LogToFile("INFO: Cron entry not present for " + user + ", nothing to remove - " + entry)
+			return nil
+		}
+		lines = remaining
+	}
+
+	// Step 3: Back up the original crontab and write the new one
+	if err := backupOnce(crontab); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(spoolDir, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + spoolDir)
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	content := ""
+	if len(lines) > 0 {
+		content = strings.Join(lines, "\n") + "\n"
+	}
+	if err := cxfw.WriteFileAtomic(crontab, []byte(content), mode); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write crontab - " + err.Error())
+		return fmt.Errorf("failed to write crontab: %w", err)
+	}
+	if err := os.Chown(crontab, uid, gid); err != nil {
+		cxfw.LogToFile("ERROR: Failed to restore crontab owner - " + err.Error())
+		return fmt.Errorf("failed to restore crontab owner: %w", err)
+	}
+	if err := notifyCrond(spoolDir, user); err != nil {
+		cxfw.LogToFile("WARNING: Failed to notify crond, changes apply once it rescans - " + err.Error())
+	}
+
+	cxfw.LogToFile("SUCCESS: Cron entry " + strings.TrimSuffix(op.Action, "e") + "ed for " + user + " - " + entry)
+	return nil
+}
+
+// notifyCrond records user in the spool directory's update file.
+func notifyCrond(spoolDir, user string) error {
+	file, err := os.OpenFile(filepath.Join(spoolDir, cronUpdateFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(user + "\n")
+	return err
+}
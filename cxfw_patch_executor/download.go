@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// downloadStallTimeout aborts a transfer that has not received any data for
+// this long; a slow but progressing download is never cut off.
+const downloadStallTimeout = 60 * time.Second
+
+var downloadClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: downloadStallTimeout,
+	},
+}
+
+// downloadFile fetches op.Source into a staging directory below op.Path and
+// installs it with addFile, so the result is verified and recorded in the
+// integrity database exactly like a shipped payload.
+func downloadFile(op cxfw.Operation) error {
+	if op.Source == "" || op.Path == "" || op.Checksum == "" || op.Size <= 0 {
+		cxfw.LogToFile("ERROR: Invalid download operation, missing source, path, checksum or size")
+		return fmt.Errorf("invalid download operation, missing source, path, checksum or size")
+	}
+
+	u, err := url.Parse(op.Source)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Invalid download URL - " + err.Error())
+		return fmt.Errorf("invalid download URL: %w", err)
+	}
+	switch {
+	case u.Scheme == "https":
+	case u.Scheme == "http" && op.AllowInsecure:
+		cxfw.LogToFile("WARNING: Downloading over plain http, allowed by allow_insecure - " + op.Source)
+	default:
+		cxfw.LogToFile("ERROR: Refusing to download from " + op.Source + ", only https is allowed")
+		return fmt.Errorf("refusing to download from %s: only https is allowed", op.Source)
+	}
+	name := path.Base(u.Path)
+	if name == "/" || name == "." {
+		cxfw.LogToFile("ERROR: Download URL does not name a file - " + op.Source)
+		return fmt.Errorf("download URL does not name a file: %s", op.Source)
+	}
+
+	// Step 1: Download to a staging directory on the destination filesystem
+	if err := os.MkdirAll(op.Path, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + op.Path)
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	stagingDir, err := os.MkdirTemp(op.Path, ".cxfw_download_")
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to create staging directory - " + err.Error())
+		return fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(stagingDir)
+	stagedFile := filepath.Join(stagingDir, name)
+
+	attempts := 1 + max(op.Retries, 0)
+	for attempt := 1; ; attempt++ {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Downloading %s (%d bytes), attempt %d/%d", op.Source, op.Size, attempt, attempts))
+		err = fetch(op, stagedFile)
+		if err == nil {
+			break
+		}
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Download attempt %d/%d failed - %v", attempt, attempts, err))
+		if attempt == attempts {
+			cxfw.LogToFile("ERROR: Failed to download " + op.Source)
+			return fmt.Errorf("failed to download %s: %w", op.Source, err)
+		}
+		time.Sleep(retryBackoff(op, attempt))
+	}
+	cxfw.LogToFile("INFO: Download verified - " + op.Source)
+
+	// Step 2: Install the staged file like an add operation
+	return addFile(cxfw.Operation{Operation: "add", Path: op.Path, Source: stagedFile, Checksum: op.Checksum})
+}
+
+// fetch downloads op.Source to dest, enforcing op.Size exactly and verifying
+// op.Checksum while streaming.
+func fetch(op cxfw.Operation, dest string) error {
+	ctx, cancel := context.WithCancel(cxfw.RunCtx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, op.Source, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	if resp.ContentLength > op.Size {
+		return fmt.Errorf("server announced %d bytes, limit is %d", resp.ContentLength, op.Size)
+	}
+
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return cxfw.ClassifyWriteError(dest, 0, err)
+	}
+	defer file.Close()
+
+	// Cancel the request when no data arrives for downloadStallTimeout
+	stall := time.AfterFunc(downloadStallTimeout, cancel)
+	defer stall.Stop()
+	body := &stallReader{r: resp.Body, timer: stall}
+
+	hash := sha256.New()
+	n, err := io.CopyBuffer(io.MultiWriter(file, hash), io.LimitReader(body, op.Size+1), cxfw.NewCopyBuffer())
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("transfer stalled for %s after %d bytes", downloadStallTimeout, n)
+		}
+		return cxfw.ClassifyWriteError(dest, n, err)
+	}
+	if n > op.Size {
+		return fmt.Errorf("payload exceeds the declared size of %d bytes", op.Size)
+	}
+	if n < op.Size {
+		return fmt.Errorf("size mismatch: expected %d bytes, got %d", op.Size, n)
+	}
+	if err := file.Close(); err != nil {
+		return cxfw.ClassifyWriteError(dest, n, err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != op.Checksum {
+		return fmt.Errorf("%w: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Checksum, checksum)
+	}
+	return nil
+}
+
+// stallReader restarts the stall timer whenever data arrives.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(downloadStallTimeout)
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cxfw_common/cxfw"
+)
+
+// dryRun is set by --dry-run, which validates like --validate-only and also
+// logs what every operation would do.
+var dryRun bool
+
+// describeOperation lists the steps op would take, in the words support
+// staff use, e.g. "would copy /tmp/patch/app to /sda1/data/apps/app". Paths
+// are given as on the device.
+func describeOperation(op cxfw.Operation) []string {
+	image := cxfw.ImagePath
+	switch op.Operation {
+	case "add", "copy", "download":
+		single := []cxfw.Operation{op}
+		if len(op.Files) > 0 {
+			single = single[:0]
+			for _, file := range op.Files {
+				entry, _, _ := batchEntry(op, file)
+				single = append(single, entry)
+			}
+		}
+		var steps []string
+		for _, entry := range single {
+			dest, err := addDestination(entry)
+			if err != nil {
+				continue
+			}
+			if alreadyInstalled(entry, dest) {
+				steps = append(steps, fmt.Sprintf("would skip %s, already installed", image(dest)))
+				continue
+			}
+			verb := "copy"
+			if op.Operation == "download" {
+				verb = "download"
+			}
+			if _, err := os.Stat(dest); err == nil {
+				steps = append(steps, fmt.Sprintf("would back up %s to %s", image(dest), cxfw.BackupDir))
+			}
+			steps = append(steps, fmt.Sprintf("would %s %s to %s and verify checksum %s", verb, image(entry.Source), image(dest), entry.Checksum))
+			if entry.Mode != "" || entry.Owner != "" || entry.Group != "" {
+				steps = append(steps, fmt.Sprintf("would set mode %q, owner %q, group %q on %s", entry.Mode, entry.Owner, entry.Group, image(dest)))
+			}
+		}
+		steps = append(steps, "would record the checksums in the integrity database of "+image(op.Path))
+		return steps
+	case "remove":
+		paths := op.Paths
+		if op.Path != "" {
+			paths = []string{op.Path}
+		}
+		var steps []string
+		for _, path := range paths {
+			if _, err := os.Stat(path); err != nil {
+				steps = append(steps, fmt.Sprintf("would skip %s, does not exist", image(path)))
+				continue
+			}
+			steps = append(steps, fmt.Sprintf("would back up %s to %s and remove it", image(path), cxfw.BackupDir))
+		}
+		return steps
+	case "remove_dir":
+		return []string{"would archive and remove the directory " + image(op.Path)}
+	case "cleanup":
+		return []string{fmt.Sprintf("would delete files matching %q in %s", op.Pattern, image(op.Path))}
+	case "extract_tar":
+		return []string{fmt.Sprintf("would extract %s into %s and verify checksum %s", image(op.Source), image(op.Path), op.Checksum)}
+	case "delta":
+		return []string{fmt.Sprintf("would apply the delta %s to %s", image(op.Source), image(op.Path))}
+	case "replace_image", "flash", "self_update":
+		return []string{fmt.Sprintf("would write %s over %s and verify checksum %s", image(op.Source), image(op.Path), op.Checksum)}
+	case "create_file":
+		return []string{fmt.Sprintf("would write %s and verify checksum %s", image(op.Path), op.Checksum)}
+	case "append", "replace_text", "patch":
+		return []string{fmt.Sprintf("would edit %s (%s)", image(op.Path), op.Operation)}
+	case "modify_defaults":
+		return []string{fmt.Sprintf("would set %d sections of default values", len(op.Entries))}
+	case "command":
+		command := op.Command
+		if len(op.Argv) > 0 {
+			command = strings.Join(op.Argv, " ")
+		}
+		return []string{"would run command: " + command}
+	case "script":
+		if op.Source != "" {
+			return []string{"would run the script " + image(op.Source)}
+		}
+		return []string{"would run an embedded script"}
+	case "reboot":
+		return []string{"would reboot after every other operation has succeeded"}
+	}
+	if op.Path != "" {
+		return []string{fmt.Sprintf("would run %s on %s", op.Operation, image(filepath.Clean(op.Path)))}
+	}
+	return []string{"would run " + op.Operation}
+}
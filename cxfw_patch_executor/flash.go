@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"cxfw_common/cxfw"
+)
+
+// blkflsbuf is the BLKFLSBUF ioctl, which drops the buffer cache of a block
+// device so the read-back comes from the device rather than from memory.
+const blkflsbuf = 0x1261
+
+// flashPartition writes the image op.Source to the block device op.Path,
+// hashing the image as it is written, and reads the written range back to
+// verify it. Bootloader and kernel partitions are not part of any
+// filesystem, so there is no integrity database to update and no backup is
+// taken.
+func flashPartition(op cxfw.Operation) error {
+	if op.Source == "" || op.Path == "" || op.Checksum == "" || op.Size <= 0 {
+		cxfw.LogToFile("ERROR: Invalid flash operation, missing source, path, checksum or size")
+		return fmt.Errorf("invalid flash operation, missing source, path, checksum or size")
+	}
+	if cxfw.Root != "" {
+		cxfw.LogToFile("ERROR: Flash operations write host devices and cannot be applied with --root")
+		return fmt.Errorf("flash operations cannot be applied with --root")
+	}
+
+	// Step 1: Check the image size; preflight has verified its checksum, and
+	// it is hashed again as it is written
+	info, err := os.Stat(op.Source)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to read image - " + err.Error())
+		return fmt.Errorf("failed to read image: %w", err)
+	}
+	if info.Size() != op.Size {
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Image %s is %d bytes, expected %d", op.Source, info.Size(), op.Size))
+		return fmt.Errorf("image %s is %d bytes, expected %d", op.Source, info.Size(), op.Size)
+	}
+
+	// Step 2: Open the target exclusively and confirm it is large enough
+	device, err := openFlashTarget(op.Path)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Device left untouched - " + err.Error())
+		return err
+	}
+	defer device.Close()
+	deviceSize, err := device.Seek(0, io.SeekEnd)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to determine device size - " + err.Error())
+		return fmt.Errorf("failed to determine device size: %w", err)
+	}
+	if deviceSize < op.Size {
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Device %s holds %d bytes, image needs %d", op.Path, deviceSize, op.Size))
+		return fmt.Errorf("device %s holds %d bytes, image needs %d", op.Path, deviceSize, op.Size)
+	}
+
+	// Step 3: Write the image, hashing it on the way, and sync it to the device
+	image, err := os.Open(op.Source)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to open image - " + err.Error())
+		return fmt.Errorf("failed to open image: %w", err)
+	}
+	defer image.Close()
+	if _, err := device.Seek(0, io.SeekStart); err != nil {
+		cxfw.LogToFile("ERROR: Failed to seek target device - " + err.Error())
+		return fmt.Errorf("failed to seek target device: %w", err)
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Writing %s to %s (%d bytes)", op.Source, op.Path, op.Size))
+	written := sha256.New()
+	if n, err := io.CopyBuffer(io.MultiWriter(device, written), io.LimitReader(image, op.Size), cxfw.NewCopyBuffer()); err != nil || n != op.Size {
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Failed to write device after %d bytes - %v", n, err))
+		return fmt.Errorf("failed to write device after %d bytes: %w", n, err)
+	}
+	if checksum := hex.EncodeToString(written.Sum(nil)); checksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Image " + op.Source + " changed since preflight, " + op.Path + " needs reflashing")
+		return fmt.Errorf("%w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Source, op.Checksum, checksum)
+	}
+	if err := device.Sync(); err != nil {
+		cxfw.LogToFile("ERROR: Failed to sync device - " + err.Error())
+		return fmt.Errorf("failed to sync device: %w", err)
+	}
+
+	// Step 4: Read back the written range and verify it
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, device.Fd(), blkflsbuf, 0); errno != 0 {
+		cxfw.LogToFile("WARNING: Failed to drop device buffer cache, read-back may be served from memory - " + errno.Error())
+	}
+	if _, err := device.Seek(0, io.SeekStart); err != nil {
+		cxfw.LogToFile("ERROR: Failed to seek target device - " + err.Error())
+		return fmt.Errorf("failed to seek target device: %w", err)
+	}
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(hash, io.LimitReader(device, op.Size), cxfw.NewCopyBuffer()); err != nil {
+		cxfw.LogToFile("ERROR: Failed to read back device - " + err.Error())
+		return fmt.Errorf("failed to read back device: %w", err)
+	}
+	if readBack := hex.EncodeToString(hash.Sum(nil)); readBack != op.Checksum {
+		cxfw.LogToFile("ERROR: Read-back checksum mismatch on " + op.Path + ", device needs reflashing")
+		return fmt.Errorf("read-back checksum mismatch on %s: expected %s, got %s", op.Path, op.Checksum, readBack)
+	}
+
+	cxfw.LogToFile("SUCCESS: Image flashed and verified successfully - " + op.Path)
+	return nil
+}
+
+// openFlashTarget opens the block device path for a flash operation. It is
+// opened with O_EXCL, so the kernel refuses a device that is mounted or held
+// by another exclusive user with EBUSY. Whole disks that carry partitions
+// are refused too: flashing one would overwrite its partition table.
+func openFlashTarget(path string) (*os.File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat target device: %w", err)
+	}
+	if info.Mode()&os.ModeDevice == 0 || info.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("target %s is not a block device", path)
+	}
+	partitions, err := diskPartitions(info)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read partitions of %s: %w", path, err)
+	}
+	if len(partitions) > 0 {
+		return nil, fmt.Errorf("target %s is a whole disk with partitions (%s), flash one of them instead", path, strings.Join(partitions, ", "))
+	}
+	device, err := os.OpenFile(path, os.O_RDWR|syscall.O_EXCL, 0)
+	if errors.Is(err, syscall.EBUSY) {
+		return nil, fmt.Errorf("target %s is mounted or in use", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open target device: %w", err)
+	}
+	return device, nil
+}
+
+// diskPartitions returns the partitions sysfs lists for the whole-disk block
+// device info, or none when the device is itself a partition.
+func diskPartitions(info os.FileInfo) ([]string, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("no device number")
+	}
+	rdev := uint64(stat.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	dir := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var partitions []string
+	for _, entry := range entries {
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), "partition")); err == nil {
+			partitions = append(partitions, entry.Name())
+		}
+	}
+	return partitions, nil
+}
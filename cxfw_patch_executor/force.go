@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"cxfw_common/cxfw"
+)
+
+// force is set by --force. Checksum and size mismatches of add and copy
+// payloads, and base checksum mismatches of delta operations, are then
+// logged as warnings instead of failing the operation. It is meant for
+// recovering a device whose payloads were regenerated after the manifest
+// was built; the checksum actually installed is recorded in .db.json.
+var force bool
+
+// forcedMismatches lists the mismatches --force let through, for the
+// summary at the end of the run and the report.
+var forcedMismatches []string
+
+// forceable reports whether --force lets mismatches of op through.
+func forceable(op cxfw.Operation) bool {
+	switch op.Operation {
+	case "add", "copy", "delta":
+		return true
+	}
+	return false
+}
+
+// forceMismatch reports whether --force lets the mismatch of what at path
+// through, and logs it prominently if so.
+func forceMismatch(what, path, expected, actual string) bool {
+	if !force {
+		return false
+	}
+	cxfw.LogToFile(fmt.Sprintf("WARNING: FORCED: %s mismatch for %s ignored because of --force - expected %s, got %s", what, path, expected, actual))
+	forcedMismatches = append(forcedMismatches, fmt.Sprintf("%s %s (expected %s, got %s)", cxfw.ImagePath(path), what, expected, actual))
+	return true
+}
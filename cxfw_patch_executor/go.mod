@@ -1,3 +1,7 @@
 module cxfw_patch_executor
 
 go 1.24.1
+
+require cxfw_common v0.0.0
+
+replace cxfw_common => ../cxfw_common
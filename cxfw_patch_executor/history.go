@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultHistoryFile records every patch run that changed the device,
+// encrypted with the integrity database key, so a manifest the management
+// server pushes again is not applied twice.
+const defaultHistoryFile = "/sda1/data/.patch_history.json"
+
+// historyEntry is one run recorded in the history file.
+type historyEntry struct {
+	Version          string    `json:"version"`
+	ManifestChecksum string    `json:"manifest_checksum"`
+	AppliedAt        time.Time `json:"applied_at"`
+	Outcome          string    `json:"outcome"`
+	Reason           string    `json:"reason,omitempty"`
+	RunID            string    `json:"run_id,omitempty"`
+}
+
+// outcomePartial is the outcome recorded for a successful run of only
+// the operations --only and --skip selected. It does not count as applied.
+const outcomePartial = "partial"
+
+// pendingHistory is the entry the finished run records once the operations of
+// this run have started, or nil.
+var pendingHistory *historyEntry
+
+// readHistory decrypts the history file at path. A missing file is an
+// empty history.
+func readHistory(path string) ([]historyEntry, error) {
+	encryptedData, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+	key, err := cxfw.ExtractKeyFromImage()
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract key: %w", err)
+	}
+	decryptedData, err := cxfw.DecryptFile(key, encryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt history file: %w", err)
+	}
+	var entries []historyEntry
+	if err := json.Unmarshal(decryptedData, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal history: %w", err)
+	}
+	return entries, nil
+}
+
+// lastApplied returns the latest successful run of the manifest with
+// checksum in entries, or nil.
+func lastApplied(entries []historyEntry, checksum string) *historyEntry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ManifestChecksum == checksum && entries[i].Outcome == cxfw.StateSucceeded {
+			return &entries[i]
+		}
+	}
+	return nil
+}
+
+// appendHistory adds entry to the history file at path. A history that
+// cannot be decrypted is left alone rather than replaced.
+func appendHistory(path string, entry historyEntry) error {
+	entries, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, entry)
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+	key, err := cxfw.ExtractKeyFromImage()
+	if err != nil {
+		return fmt.Errorf("failed to extract key: %w", err)
+	}
+	encryptedData, err := cxfw.EncryptFile(key, data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt history: %w", err)
+	}
+	if err := cxfw.WriteFileAtomic(path, encryptedData, 0644); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	return nil
+}
+
+// recordHistory appends the outcome of this run to the history, once its
+// operations have started.
+func recordHistory(code int, reason string) {
+	if pendingHistory == nil {
+		return
+	}
+	entry := *pendingHistory
+	pendingHistory = nil
+	entry.Outcome = cxfw.StateSucceeded
+	if len(deselected) > 0 {
+		entry.Outcome = outcomePartial
+	}
+	if code != 0 {
+		entry.Outcome, entry.Reason = cxfw.StateFailed, reason
+	}
+	if err := appendHistory(cxfw.HostPath(defaultHistoryFile), entry); err != nil {
+		cxfw.LogToFile("WARNING: Failed to record the run in the patch history - " + err.Error())
+		return
+	}
+	cxfw.LogToFile("INFO: Run recorded in the patch history")
+}
+
+// printHistory writes the decrypted history file at path to w.
+func printHistory(path string, w io.Writer) error {
+	entries, err := readHistory(path)
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []historyEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal history: %w", err)
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
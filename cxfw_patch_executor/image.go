@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// squashfsMagic opens the superblock of every squashfs image.
+const squashfsMagic = "hsqs"
+
+// imageMountTimeout bounds the trial mount and unmount of a new image.
+const imageMountTimeout = 30 * time.Second
+
+// replaceImage replaces the squashfs image at op.Path with op.Source. The new
+// image is staged as op.Path + ".new" and verified before it is renamed over
+// the old one, so the old image stays in place until the last moment; the
+// old image is kept in the backup directory for the rollback manifest.
+func replaceImage(op cxfw.Operation) error {
+	if op.Source == "" || op.Path == "" || op.Checksum == "" {
+		cxfw.LogToFile("ERROR: Invalid replace_image operation, missing source, path or checksum")
+		return fmt.Errorf("invalid replace_image operation, missing source, path or checksum")
+	}
+	if done, err := alreadySatisfied(op, op.Path); done || err != nil {
+		return err
+	}
+
+	// Step 1: Copy the new image next to the old one
+	dir := filepath.Dir(op.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + dir)
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	staged := op.Path + ".new"
+	cxfw.TrackTempFile(staged)
+	defer cxfw.UntrackTempFile(staged)
+	cxfw.LogToFile("DEBUG: Copying image from " + op.Source + " to " + staged)
+	if err := cxfw.CopyFile(op.Source, staged); err != nil {
+		cxfw.LogToFile("ERROR: Failed to copy image - " + err.Error())
+		return fmt.Errorf("failed to copy image: %w", err)
+	}
+	installed := false
+	defer func() {
+		if !installed {
+			os.Remove(staged)
+		}
+	}()
+	if err := enforcePermissionPolicy(staged); err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+
+	// Step 2: Verify checksum of the staged image
+	checksum, err := cxfw.ComputeChecksum(staged)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to compute checksum of staged image - " + err.Error())
+		return fmt.Errorf("failed to compute checksum of staged image: %w", err)
+	}
+	if checksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for staged image " + staged)
+		return fmt.Errorf("%w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, staged, op.Checksum, checksum)
+	}
+
+	// Step 3: Confirm the staged image is a squashfs image
+	if err := checkSquashfs(staged); err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	if op.VerifyMount {
+		if err := trialMount(staged); err != nil {
+			cxfw.LogToFile("ERROR: " + err.Error())
+			return err
+		}
+	}
+
+	// Step 4: Back up the current image
+	if _, err := os.Stat(op.Path); err == nil {
+		if _, err := backupFile(op.Path); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		cxfw.LogToFile("WARNING: Image does not exist, installing without backup - " + op.Path)
+	} else {
+		cxfw.LogToFile("ERROR: Failed to check image existence - " + err.Error())
+		return fmt.Errorf("failed to check image existence: %w", err)
+	}
+
+	// Step 5: Atomically replace the old image
+	cxfw.LogToFile("INFO: Renaming " + staged + " to " + op.Path)
+	if err := os.Rename(staged, op.Path); err != nil {
+		cxfw.LogToFile("ERROR: Failed to replace image - " + err.Error())
+		return fmt.Errorf("failed to replace image: %w", err)
+	}
+	installed = true
+
+	// Step 6: Update integrity database and folder-specific JSON file
+	dbHash, err := cxfw.UpdateIntegrityDatabase(op.Path, checksum)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
+	}
+	if err := cxfw.UpdateFolderFile(dir, dbHash); err != nil {
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+		return fmt.Errorf("failed to update folder file: %w", err)
+	}
+
+	// Step 7: Remove source image unless another operation still needs it
+	if op.KeepSource {
+		cxfw.LogToFile("DEBUG: Keeping source file - " + op.Source)
+	} else if err := os.Remove(op.Source); err != nil {
+		cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
+		return fmt.Errorf("failed to remove source file: %w", err)
+	}
+
+	cxfw.LogToFile("SUCCESS: Image replaced and verified successfully - " + op.Path)
+	return nil
+}
+
+// checkSquashfs reports an error unless path starts with a squashfs
+// superblock.
+func checkSquashfs(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(squashfsMagic))
+	if _, err := io.ReadFull(file, magic); err != nil || string(magic) != squashfsMagic {
+		return fmt.Errorf("%s is not a squashfs image", path)
+	}
+	return nil
+}
+
+// trialMount mounts the image at path read-only on a temporary loop mount
+// and unmounts it again, proving the kernel accepts it.
+func trialMount(path string) error {
+	mountPoint, err := os.MkdirTemp("", "cxfw_image_")
+	if err != nil {
+		return fmt.Errorf("failed to create mount point: %w", err)
+	}
+	defer os.Remove(mountPoint)
+
+	ctx, cancel := context.WithTimeout(context.Background(), imageMountTimeout)
+	defer cancel()
+
+	cxfw.LogToFile("INFO: Trial mounting image " + path)
+	output, err := exec.CommandContext(ctx, "mount", "-t", "squashfs", "-o", "loop,ro", path, mountPoint).CombinedOutput()
+	if err != nil {
+		logCommandOutput(string(output))
+		return fmt.Errorf("image %s failed to mount: %w", path, err)
+	}
+	if output, err := exec.CommandContext(ctx, "umount", mountPoint).CombinedOutput(); err != nil {
+		logCommandOutput(string(output))
+		return fmt.Errorf("failed to unmount trial mount of %s: %w", path, err)
+	}
+	cxfw.LogToFile("INFO: Image mounted successfully - " + path)
+	return nil
+}
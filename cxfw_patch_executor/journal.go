@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultJournalFile records the progress of a run, so a run interrupted by
+// a power loss can be resumed with --resume instead of repeating operations
+// such as appends and scripts that are not idempotent.
+const defaultJournalFile = "/sda1/data/.cxfw_patch_journal.json"
+
+// journal is the content of the journal file.
+type journal struct {
+	ManifestChecksum string         `json:"manifest_checksum"`
+	Completed        []journalEntry `json:"completed"`
+}
+
+// journalEntry is one operation the journalled run completed. A
+// self_update also records the binary it staged, whose source it removed.
+type journalEntry struct {
+	Index     int    `json:"index"`
+	Operation string `json:"operation"`
+	State     string `json:"state"`
+	Staged    string `json:"staged,omitempty"`
+	Checksum  string `json:"checksum,omitempty"`
+	Version   string `json:"version,omitempty"`
+}
+
+// runJournal is the journal of this run and journalPath its host path, or
+// nil in validation runs.
+var (
+	runJournal  *journal
+	journalPath string
+)
+
+// heldJournal holds the entries of operations whose integrity database
+// entries are still deferred. They are journalled once the databases are
+// flushed, so --resume runs them again after a power loss and they record
+// their hashes. journalMu guards them and runJournal, since a run stopped by
+// a signal flushes from another goroutine.
+var (
+	heldJournal []journalEntry
+	journalMu   sync.Mutex
+)
+
+// replayedOperations are never journalled and run again on resume: a
+// remount does not survive the power loss, and a reboot only arranges for
+// something to happen at the end of the run.
+var replayedOperations = []string{"remount", "reboot"}
+
+// resumedStages are the journal entries of the self_update operations of
+// the resumed run by staged path. A self_update defers its swap to the end
+// of the run, so it runs again on resume, reusing the staged binary.
+var resumedStages = make(map[string]journalEntry)
+
+// loadJournal prepares the journal of the run of the manifest with checksum
+// at path and returns the indexes of the operations to skip. With resume
+// and a journal of the same manifest, these are the operations it records
+// as completed; otherwise a journal left by an earlier run is replaced once
+// the first operation starts.
+func loadJournal(path, checksum string, resume bool) map[int]bool {
+	journalPath = path
+	completed := make(map[int]bool)
+	var previous journal
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		if resume {
+			cxfw.LogToFile("INFO: No journal to resume, starting from the first operation")
+		}
+	case err != nil:
+		cxfw.LogToFile("WARNING: Failed to read journal, starting from the first operation - " + err.Error())
+	case json.Unmarshal(data, &previous) != nil:
+		cxfw.LogToFile("WARNING: Journal " + path + " is corrupt, starting from the first operation")
+	case !resume:
+		cxfw.LogToFile("WARNING: Found the journal of an interrupted run, starting from the first operation; use --resume to continue it instead")
+	case previous.ManifestChecksum != checksum:
+		cxfw.LogToFile("WARNING: Journal belongs to a different manifest, starting from the first operation")
+	default:
+		kept := []journalEntry{}
+		for _, entry := range previous.Completed {
+			if entry.Operation == "self_update" {
+				resumedStages[entry.Staged] = entry
+				continue
+			}
+			completed[entry.Index] = true
+			kept = append(kept, entry)
+		}
+		previous.Completed = kept
+		runJournal = &previous
+		cxfw.LogToFile(fmt.Sprintf("INFO: Resuming from the journal, %d operations already completed", len(completed)))
+	}
+	if runJournal == nil {
+		runJournal = &journal{ManifestChecksum: checksum, Completed: []journalEntry{}}
+	}
+	return completed
+}
+
+// startJournal writes the journal before the first operation runs.
+func startJournal() {
+	if err := writeJournal(); err != nil {
+		cxfw.LogToFile("WARNING: Failed to write journal - " + err.Error())
+	}
+}
+
+// journalOperation records the operation at index as completed with state
+// and syncs the journal to disk before the next operation starts. An
+// install whose integrity database entries are still deferred is held back
+// until flushIntegrity writes them.
+func journalOperation(index int, op cxfw.Operation, state string) {
+	if runJournal == nil || slices.Contains(replayedOperations, op.Operation) {
+		return
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	entry := journalEntry{Index: index, Operation: op.Operation, State: state}
+	if op.Operation == "self_update" {
+		target, _ := selfUpdateTarget(op)
+		entry.Staged, entry.Checksum = target+".new", op.Checksum
+		entry.Version = resumedStages[entry.Staged].Version
+		for _, swap := range pendingSwaps {
+			if swap.staged == entry.Staged {
+				entry.Version = swap.version
+			}
+		}
+	}
+	if cxfw.IntegrityPending() {
+		heldJournal = append(heldJournal, entry)
+		return
+	}
+	runJournal.Completed = append(runJournal.Completed, entry)
+	if err := writeJournal(); err != nil {
+		cxfw.LogToFile("WARNING: Failed to write journal - " + err.Error())
+	}
+}
+
+// flushIntegrity writes the integrity database entries deferred by the
+// installs since the last flush, then journals those installs.
+func flushIntegrity() error {
+	if err := cxfw.FlushIntegrityDatabases(); err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	if runJournal == nil || len(heldJournal) == 0 {
+		return nil
+	}
+	runJournal.Completed = append(runJournal.Completed, heldJournal...)
+	heldJournal = nil
+	if err := writeJournal(); err != nil {
+		cxfw.LogToFile("WARNING: Failed to write journal - " + err.Error())
+	}
+	return nil
+}
+
+// writeJournal replaces the journal file atomically and syncs both the file
+// and its directory, so the journal survives a power loss.
+func writeJournal() error {
+	data, err := json.MarshalIndent(runJournal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %w", err)
+	}
+	tempFile := journalPath + ".tmp"
+	cxfw.TrackTempFile(tempFile)
+	defer cxfw.UntrackTempFile(tempFile)
+	file, err := os.OpenFile(tempFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFile, journalPath)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(journalPath)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// removeJournal deletes the journal once the run has completed.
+func removeJournal() {
+	if runJournal == nil {
+		return
+	}
+	if err := os.Remove(journalPath); err != nil && !os.IsNotExist(err) {
+		cxfw.LogToFile("WARNING: Failed to remove journal - " + err.Error())
+	}
+	runJournal = nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultKmodTimeout bounds a load or unload plus the wait for /proc/modules
+// to reflect it, when the operation does not set timeout. Some modules take
+// a moment to release their devices after rmmod returns.
+const defaultKmodTimeout = 10 * time.Second
+
+// kmodCheckInterval is the delay between /proc/modules checks.
+const kmodCheckInterval = 250 * time.Millisecond
+
+// dmesgTailLines is how much of the kernel log is kept with a failure.
+const dmesgTailLines = 20
+
+// moduleNamePattern matches kernel module names as modprobe accepts them.
+var moduleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// controlModule loads or unloads the kernel module op.Name. op.Params holds
+// module parameters passed to modprobe on load, e.g. "debug=1 mode=fast".
+func controlModule(op cxfw.Operation) error {
+	if op.Name == "" || op.Action == "" {
+		cxfw.LogToFile("ERROR: Invalid kmod operation, missing name or action")
+		return fmt.Errorf("invalid kmod operation, missing name or action")
+	}
+	if !moduleNamePattern.MatchString(op.Name) {
+		cxfw.LogToFile("ERROR: Invalid module name - " + op.Name)
+		return fmt.Errorf("invalid module name %q", op.Name)
+	}
+	if op.Action != "load" && op.Action != "unload" {
+		cxfw.LogToFile("ERROR: Invalid kmod action - " + op.Action)
+		return fmt.Errorf("invalid kmod action %q, expected load or unload", op.Action)
+	}
+	if cxfw.Root != "" {
+		cxfw.LogToFile("ERROR: Kernel module operations act on the running kernel and cannot be applied with --root")
+		return fmt.Errorf("kmod operations cannot be applied with --root")
+	}
+
+	load := op.Action == "load"
+	loaded, err := moduleLoaded(op.Name)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to read /proc/modules - " + err.Error())
+		return fmt.Errorf("failed to read /proc/modules: %w", err)
+	}
+	if loaded == load {
+		cxfw.LogToFile("INFO: Module " + op.Name + " already " + op.Action + "ed, skipped")
+		return nil
+	}
+
+	timeout := operationTimeout(op, defaultKmodTimeout)
+	ctx, cancel := context.WithTimeout(cxfw.RunCtx, timeout)
+	defer cancel()
+
+	// Step 1: Run modprobe or rmmod
+	args := []string{"rmmod", op.Name}
+	if load {
+		args = append([]string{"modprobe", op.Name}, strings.Fields(op.Params)...)
+	}
+	cxfw.LogToFile("DEBUG: Running " + strings.Join(args, " "))
+	if output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput(); err != nil {
+		cxfw.LogToFile("ERROR: Module " + op.Action + " failed for " + op.Name + " - " + err.Error())
+		logCommandOutput(string(output))
+		logDmesgTail()
+		return fmt.Errorf("module %s failed for %s: %w", op.Action, op.Name, err)
+	}
+
+	// Step 2: Wait for /proc/modules to reflect the change
+	for {
+		loaded, err := moduleLoaded(op.Name)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to read /proc/modules - " + err.Error())
+			return fmt.Errorf("failed to read /proc/modules: %w", err)
+		}
+		if loaded == load {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			cxfw.LogToFile(fmt.Sprintf("ERROR: Module %s not %sed after %s", op.Name, op.Action, timeout))
+			logDmesgTail()
+			return fmt.Errorf("module %s not %sed after %s", op.Name, op.Action, timeout)
+		case <-time.After(kmodCheckInterval):
+		}
+	}
+
+	cxfw.LogToFile("SUCCESS: Module " + op.Action + "ed and verified - " + op.Name)
+	return nil
+}
+
+// moduleLoaded reports whether /proc/modules lists name. The kernel lists
+// modules with underscores, while modprobe also accepts dashes.
+func moduleLoaded(name string) (bool, error) {
+	data, err := os.ReadFile("/proc/modules")
+	if err != nil {
+		return false, err
+	}
+	name = strings.ReplaceAll(name, "-", "_")
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// logDmesgTail logs the end of the kernel log, where drivers report why they
+// refused to load or unload.
+func logDmesgTail() {
+	output, err := exec.Command("dmesg").Output()
+	if err != nil {
+		cxfw.LogToFile("WARNING: Failed to read kernel log - " + err.Error())
+		return
+	}
+	lines := strings.Split(strings.TrimRight(string(output), "\n"), "\n")
+	if len(lines) > dmesgTailLines {
+		lines = lines[len(lines)-dmesgTailLines:]
+	}
+	cxfw.LogToFile("ERROR: Kernel log tail:")
+	logCommandOutput(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"cxfw_common/cxfw"
+)
+
+// launcherIndex lists the applications the UI offers, as an unencrypted JSON
+// array of {"name", "path", "icon"} objects. Entries may carry further fields
+// written by other tools; they are kept as they are.
+const launcherIndex = "/sda1/data/.launcher.json"
+
+// updateLauncher adds, removes or updates the launcher entry named op.Name.
+// op.Path and op.Icon are the binary and icon of the entry; both must exist
+// when the operation runs, so a binary installed by an earlier operation of
+// the same manifest is accepted.
+func updateLauncher(op cxfw.Operation) error {
+	if op.Name == "" {
+		cxfw.LogToFile("ERROR: Invalid launcher operation, missing name")
+		return fmt.Errorf("invalid launcher operation, missing name")
+	}
+	switch op.Action {
+	case "add":
+		if op.Path == "" || op.Icon == "" {
+			cxfw.LogToFile("ERROR: Invalid launcher operation, add needs path and icon")
+			return fmt.Errorf("invalid launcher operation, add needs path and icon")
+		}
+	case "update":
+		if op.Path == "" && op.Icon == "" {
+			cxfw.LogToFile("ERROR: Invalid launcher operation, update needs path or icon")
+			return fmt.Errorf("invalid launcher operation, update needs path or icon")
+		}
+	case "remove":
+	default:
+		cxfw.LogToFile("ERROR: Invalid launcher action " + op.Action + ", expected add, remove or update")
+		return fmt.Errorf("invalid launcher action %q, expected add, remove or update", op.Action)
+	}
+
+	// Step 1: Check the referenced binary and icon
+	icon := cxfw.HostPath(op.Icon)
+	for _, path := range []string{op.Path, icon} {
+		if path == "" || op.Action == "remove" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			cxfw.LogToFile("ERROR: Launcher entry " + op.Name + " references a missing file - " + path)
+			return fmt.Errorf("launcher entry %s references a missing file: %w", op.Name, err)
+		}
+	}
+
+	// Step 2: Load the index
+	indexPath := cxfw.HostPath(launcherIndex)
+	var entries []map[string]json.RawMessage
+	data, err := os.ReadFile(indexPath)
+	if err == nil {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			cxfw.LogToFile("ERROR: Failed to parse launcher index - " + err.Error())
+			return fmt.Errorf("failed to parse launcher index: %w", err)
+		}
+	} else if !os.IsNotExist(err) || op.Action == "update" {
+		cxfw.LogToFile("ERROR: Failed to read launcher index - " + err.Error())
+		return fmt.Errorf("failed to read launcher index: %w", err)
+	}
+
+	index := -1
+	for i, entry := range entries {
+		var name string
+		if json.Unmarshal(entry["name"], &name) == nil && name == op.Name {
+			index = i
+			break
+		}
+	}
+
+	// Step 3: Apply the change
+	fields := map[string]string{"path": cxfw.ImagePath(op.Path), "icon": op.Icon}
+	switch op.Action {
+	case "add":
+		if index >= 0 {
+			if entryMatches(entries[index], fields) {
+				cxfw.LogToFile("INFO: Launcher entry already present, skipped - " + op.Name)
+				return nil
+			}
+			cxfw.LogToFile("ERROR: Launcher entry " + op.Name + " already exists with different values, use update")
+			return fmt.Errorf("launcher entry %s already exists with different values", op.Name)
+		}
+		entry := map[string]json.RawMessage{}
+		fields["name"] = op.Name
+		setEntryFields(entry, fields)
+		entries = append(entries, entry)
+	case "update":
+		if index < 0 {
+			cxfw.LogToFile("ERROR: Launcher entry to update does not exist - " + op.Name)
+			return fmt.Errorf("launcher entry to update does not exist: %s", op.Name)
+		}
+		setEntryFields(entries[index], fields)
+	case "remove":
+		if index < 0 {
+			cxfw.LogToFile("WARNING: Launcher entry does not exist, skipping removal - " + op.Name)
+			return nil
+		}
+		entries = append(entries[:index], entries[index+1:]...)
+	}
+
+	// Step 4: Back up the original index and write the new one
+	if err := backupOnce(indexPath); err != nil {
+		return err
+	}
+	if entries == nil {
+		entries = []map[string]json.RawMessage{}
+	}
+	updated, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal launcher index: %w", err)
+	}
+	if err := cxfw.WriteFileAtomic(indexPath, append(updated, '\n'), 0644); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write launcher index - " + err.Error())
+		return fmt.Errorf("failed to write launcher index: %w", err)
+	}
+
+	cxfw.LogToFile("SUCCESS: Launcher index updated - " + op.Action + " " + op.Name)
+	return nil
+}
+
+// setEntryFields stores the non-empty fields in entry, leaving all other
+// fields of entry untouched.
+func setEntryFields(entry map[string]json.RawMessage, fields map[string]string) {
+	for key, value := range fields {
+		if value == "" {
+			continue
+		}
+		encoded, _ := json.Marshal(value)
+		entry[key] = encoded
+	}
+}
+
+// entryMatches reports whether entry already holds the non-empty fields.
+func entryMatches(entry map[string]json.RawMessage, fields map[string]string) bool {
+	for key, value := range fields {
+		var current string
+		if value != "" && (json.Unmarshal(entry[key], &current) != nil || current != value) {
+			return false
+		}
+	}
+	return true
+}
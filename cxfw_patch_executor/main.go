@@ -1,661 +1,2169 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"archive/tar"
+	"compress/gzip"
+	"context"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// permissionPolicyFile is the device-side policy mapping path prefixes to the
+// maximum mode bits allowed for anything the executor installs below them,
+// e.g. {"/sda1/data": "0755"}. The most specific prefix wins.
+const permissionPolicyFile = "/sda1/data/.cxfw_permission_policy.json"
+
+var (
+	permissionPolicy  map[string]os.FileMode
+	strictPermissions bool
+	clampedPaths      []string
+	satisfiedPaths    []string
 )
 
-type Manifest struct {
-	Version    string      `json:"version"`
-	Operations []Operation `json:"operations"`
+func main() {
+	allowLegacyVersion := flag.Bool("allow-legacy-version", false, "accept a manifest version outside the MAJOR.MINOR[.PATCH] format")
+	root := flag.String("root", "", "apply the patch to the filesystem mounted at this prefix instead of the live system")
+	flag.BoolVar(&chroot, "chroot", false, "run command and script operations chrooted into --root")
+	flag.StringVar(&cxfw.KeyFile, "key-file", "", "read the integrity database key from this file instead of the device image")
+	flag.BoolVar(&cxfw.RebuildDatabases, "rebuild-db", false, "regenerate an integrity database that neither it nor its .db.json.bak backup decrypts by hashing the files in its directory")
+	watchdogPath := flag.String("watchdog", "", "feed this hardware watchdog device, e.g. /dev/watchdog, for the duration of the run")
+	watchdogInterval := flag.Int("watchdog-interval", int(defaultWatchdogInterval/time.Second), "feed the --watchdog device every this many seconds")
+	reserve := flag.Int64("space-reserve", defaultSpaceReserve, "fail preflight if the patch would leave less than this many MiB free on a filesystem it writes to")
+	copyBuffer := flag.Int("copy-buffer", cxfw.DefaultCopyBufferSize>>10, "copy and hash payloads through a buffer of this many KiB")
+	memoryBudget := flag.Int("memory-budget", 0, "keep the executor's own memory use within this many MiB, leaving the rest to scripts (0 for no limit)")
+	validateOnly := flag.Bool("validate-only", false, "check the patch against this device and predict the outcome without changing anything")
+	flag.BoolVar(&dryRun, "dry-run", false, "like --validate-only, and also log what every operation would do")
+	resume := flag.Bool("resume", false, "skip the operations the journal of an interrupted run of the same manifest records as completed")
+	flag.BoolVar(&verifyReadback, "verify-readback", false, "verify installed files by reading them back from storage instead of hashing them while copying")
+	flag.BoolVar(&force, "force", false, "accept checksum and size mismatches of add and copy payloads and base checksum mismatches of delta operations, for recovery")
+	readStdin := flag.Bool("stdin", false, "read the manifest from standard input, like the manifest argument -")
+	flag.StringVar(&stdinSignature, "signature", "", "verify a manifest read from standard input against this detached signature file")
+	bundlePath := flag.String("bundle", "", "run the manifest of this .cxfw patch bundle, staging its payloads in a temp directory")
+	only := flag.String("only", "", "run only these operations, by 1-based index or range, e.g. 4 or 2-5,9")
+	skip := flag.String("skip", "", "leave out these operations, by 1-based index or range, e.g. 7")
+	reapply := flag.Bool("reapply", false, "apply a manifest even if the patch history records it as applied")
+	showHistory := flag.Bool("history", false, "print the decrypted patch history and exit")
+	archOverride := flag.String("arch", "", "match operations against this architecture instead of the device's, e.g. when patching an image with --root")
+	modelFile := flag.String("model-file", defaultModelFile, "read the device model from this file")
+	firmwareVersionFile := flag.String("firmware-version-file", cxfw.DefaultFirmwareVersionFile, "read the installed firmware version from this file")
+	firmwareVersionKey := flag.String("firmware-version-key", "", "read the firmware version from this key of a key=value file such as .defaultvalues, instead of the first line")
+	flag.StringVar(&cxfw.ReportPath, "report", cxfw.DefaultReportFile, "write a JSON report of the run to this file, empty for none")
+	reportURLFlag := flag.String("report-url", "", "also post the JSON report of the run to this https URL, e.g. of the fleet server")
+	flag.StringVar(&reportToken, "report-token", cxfw.EnvDefault("CXFW_REPORT_TOKEN", ""), "send this bearer token with the posted report, defaults to $CXFW_REPORT_TOKEN if set")
+	reportInsecure := flag.Bool("report-insecure", false, "post the report over plain http or without verifying the server certificate, for lab setups")
+	deviceIDFile := flag.String("device-id-file", defaultDeviceIDFile, "identify the device in the report with the content of this file")
+	var mqttSettings mqttConfig
+	flag.StringVar(&mqttSettings.Broker, "mqtt-broker", "", "publish the status of the run to this MQTT broker, an mqtt:// or mqtts:// URL")
+	flag.StringVar(&mqttSettings.TopicPrefix, "mqtt-topic-prefix", defaultMQTTTopicPrefix, "publish the retained status message to this prefix followed by /status")
+	flag.StringVar(&mqttSettings.CACert, "mqtt-ca-cert", "", "verify an mqtts:// broker against the CA certificates in this PEM file instead of the system ones")
+	flag.StringVar(&mqttSettings.ClientCert, "mqtt-client-cert", "", "authenticate to an mqtts:// broker with this client certificate PEM file")
+	flag.StringVar(&mqttSettings.ClientKey, "mqtt-client-key", "", "the key of --mqtt-client-cert")
+	flag.StringVar(&metricsPath, "metrics-file", defaultMetricsFile, "write Prometheus metrics of the run to this file for node_exporter's textfile collector, empty for none")
+	lockPath := flag.String("lock-file", cxfw.DefaultLockFile, "serialize patch and rollback runs with a lock on this file; runs with --root only take a lock named explicitly")
+	flag.StringVar(&cxfw.ProgressPath, "progress-file", cxfw.DefaultProgressFile, "keep the progress of the run in this JSON file for the on-device UI, empty for none")
+	progressFD := flag.Int("progress-fd", 0, "also write every progress update as a JSON line to this inherited file descriptor, 0 for none")
+	allowUnsigned := flag.Bool("allow-unsigned", false, "execute manifests without a signature file, or without a signing key to verify them")
+	manifestKey := flag.String("manifest-key", "", "verify manifest signatures with this ed25519 public key file instead of the built-in key or "+cxfw.DefaultManifestKeyFile)
+	rootsFlag := flag.String("writable-roots", defaultWritableRoots, "comma-separated directories that add, remove, create_file and extract_tar operations may write below")
+	unrestricted := flag.Bool("unrestricted", false, "let manifests write anywhere, for factory use")
+	logFile := flag.String("log-file", cxfw.EnvDefault("CXFW_LOG_FILE", cxfw.DefaultLogFile), "write the log to this file, defaults to $CXFW_LOG_FILE if set")
+	backupDirFlag := flag.String("backup-dir", cxfw.EnvDefault("CXFW_BACKUP_DIR", cxfw.DefaultBackupDir), "keep backups for the rollback in this directory, below --root if given; defaults to $CXFW_BACKUP_DIR if set")
+	requireLog := flag.Bool("require-log", false, "fail at startup if the log file cannot be written, instead of logging to standard error")
+	runID := flag.String("run-id", "", "stamp the log, the report and the patch history with this run ID, e.g. one given by the management server; a random ID by default")
+	logFormat := flag.String("log-format", cxfw.LogFormatPlain, "write log entries as plain lines or as json objects, one per line")
+	logLevel := flag.String("log-level", cxfw.EnvDefault("CXFW_LOG_LEVEL", "info"), "write log entries of this level and above: debug, info, warn or error; defaults to $CXFW_LOG_LEVEL if set")
+	logMaxSize := flag.Int64("log-max-size", cxfw.DefaultLogMaxSize>>10, "rotate the log once it would grow past this many KiB, 0 to never rotate")
+	logKeep := flag.Int("log-keep", cxfw.DefaultLogKeep, "keep this many rotated logs, 0 to discard the old log on rotation")
+	outputLimit := flag.Int64("output-limit", cxfw.DefaultOutputLimit>>10, "log at most this many KiB of the output of each command or script")
+	flag.BoolVar(&cxfw.Verbose, "verbose", false, "mirror every log entry to standard output")
+	flag.BoolVar(&cxfw.Quiet, "quiet", false, "print nothing to standard output, not even the final exit code line")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: ./firmware_patch_executor [options] <manifest.json> [<manifest_part.json> ...]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       ./firmware_patch_executor [options] --bundle <patch.cxfw>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       A manifest argument of - or --stdin without arguments reads the manifest from standard input.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cxfw.SetFinishHooks(cxfw.FinishHooks{Cleanup: finishCleanup, Reported: finishReported, Exiting: performDeferredReboot})
+	if *showVersion {
+		fmt.Println(cxfw.Version)
+		return
+	}
+	if *showHistory {
+		if *root != "" {
+			cxfw.Root, _ = filepath.Abs(*root)
+		}
+		if err := printHistory(cxfw.HostPath(defaultHistoryFile), os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+			os.Exit(cxfw.ExitFailure)
+		}
+		return
+	}
+	manifestPaths := flag.Args()
+	if *readStdin && len(manifestPaths) == 0 {
+		manifestPaths = []string{cxfw.StdinManifest}
+	}
+	// Standard input holds a single manifest
+	fromStdin := 0
+	for _, path := range manifestPaths {
+		if path == cxfw.StdinManifest {
+			fromStdin++
+		}
+	}
+	// A bundle brings its own manifest
+	if *bundlePath != "" && len(manifestPaths) > 0 {
+		flag.Usage()
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if (len(manifestPaths) < 1 && *bundlePath == "") || (*readStdin && flag.NArg() > 0) || fromStdin > 1 || (cxfw.Verbose && cxfw.Quiet) {
+		flag.Usage()
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+
+	if err := cxfw.SetRunID(*runID); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetLogFormat(*logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetLogLevel(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetLogRotation(*logMaxSize<<10, *logKeep); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetOutputLimit(*outputLimit << 10); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetProgressFD(*progressFD); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	// The log directory is only created for an explicit log file
+	if *logFile != cxfw.DefaultLogFile {
+		if err := cxfw.SetLogFile(*logFile); err != nil {
+			fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+		}
+	}
+	if *requireLog {
+		if err := cxfw.CheckLogFile(); err != nil {
+			fmt.Fprintln(os.Stderr, "cxfw_patch_executor: "+err.Error())
+			// A full or read-only log filesystem keeps its storage exit code
+			code, reason := cxfw.ExitCodeForError(err), cxfw.ReasonForError(err)
+			if code == cxfw.ExitFailure {
+				code, reason = cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments
+			}
+			cxfw.FinishRun(code, reason, err.Error())
+		}
+	}
+	cxfw.LogToFile("========== CloudX Firmware Patch Execution Started ==========")
+	cxfw.HandleSignals()
+	if *watchdogPath != "" {
+		if *watchdogInterval <= 0 {
+			cxfw.LogToFile(fmt.Sprintf("ERROR: Invalid watchdog interval %d seconds", *watchdogInterval))
+			cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, fmt.Sprintf("invalid watchdog interval %d seconds", *watchdogInterval))
+		}
+		startWatchdog(*watchdogPath, time.Duration(*watchdogInterval)*time.Second)
+	}
+	if *reportURLFlag != "" {
+		if err := setReportURL(*reportURLFlag, *reportInsecure); err != nil {
+			cxfw.LogToFile("ERROR: Invalid report URL - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+		}
+		if *reportInsecure {
+			cxfw.LogToFile("WARNING: Posting the report without TLS verification, allowed by --report-insecure")
+		}
+	}
+	if mqttSettings.Broker != "" {
+		if err := setMQTT(mqttSettings); err != nil {
+			cxfw.LogToFile("ERROR: Invalid MQTT settings - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+		}
+	}
+	if err := cxfw.SetBackupDir(*backupDirFlag); err != nil {
+		cxfw.LogToFile("ERROR: Invalid backup directory - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+	}
+	if dryRun {
+		*validateOnly = true
+		cxfw.LogToFile("INFO: Dry run, no changes will be made")
+	}
+	if *validateOnly {
+		cxfw.RunReport.Mode = "validate"
+		if !dryRun {
+			cxfw.LogToFile("INFO: Validating only, no changes will be made")
+		}
+	}
+
+	if *root != "" {
+		info, err := os.Stat(*root)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("not a directory")
+		}
+		if err != nil {
+			cxfw.LogToFile("ERROR: Invalid root " + *root + " - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, "invalid root "+*root+": "+err.Error())
+		}
+		cxfw.Root, _ = filepath.Abs(*root)
+		cxfw.LogToFile("INFO: Applying to filesystem mounted at " + cxfw.Root)
+	}
+	if chroot && cxfw.Root == "" {
+		cxfw.LogToFile("ERROR: --chroot needs --root")
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, "--chroot needs --root")
+	} else if chroot {
+		cxfw.LogToFile("INFO: Running commands and scripts chrooted into " + cxfw.Root)
+	}
+	loadDeviceID(*deviceIDFile)
+
+	// Only runs on the live system can race each other, unless runs on
+	// an image are given a lock of their own
+	if !*validateOnly && (cxfw.Root == "" || *lockPath != cxfw.DefaultLockFile) {
+		locked := manifestPaths
+		if *bundlePath != "" {
+			locked = []string{*bundlePath}
+		}
+		cxfw.LockRun(*lockPath, locked)
+	}
+	if cxfw.BackupDir != cxfw.DefaultBackupDir {
+		cxfw.LogToFile("INFO: Keeping backups in " + cxfw.BackupDir)
+		if !*validateOnly {
+			if err := os.MkdirAll(cxfw.HostPath(cxfw.BackupDir), 0755); err != nil {
+				cxfw.LogToFile("ERROR: Failed to create backup directory - " + err.Error())
+				cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+			}
+		}
+	}
+
+	if force {
+		cxfw.LogToFile("WARNING: FORCED: --force given, checksum mismatches of add and copy payloads and delta bases are accepted")
+		cxfw.RunReport.Forced = true
+	}
+	if *unrestricted {
+		cxfw.LogToFile("WARNING: Unrestricted, manifests may write anywhere")
+	} else {
+		roots, err := parseWritableRoots(*rootsFlag)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Invalid writable roots - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+		}
+		writableRoots = roots
+	}
+
+	if *reserve < 0 {
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Invalid space reserve %d MiB", *reserve))
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, fmt.Sprintf("invalid space reserve %d MiB", *reserve))
+	}
+	spaceReserve = *reserve << 20
+	if *memoryBudget < 0 {
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Invalid memory budget %d MiB", *memoryBudget))
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, fmt.Sprintf("invalid memory budget %d MiB", *memoryBudget))
+	}
+	if err := cxfw.SetCopyBufferSize(*copyBuffer << 10); err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+	}
+	if *memoryBudget > 0 {
+		cxfw.SetMemoryBudget(int64(*memoryBudget) << 20)
+		cxfw.LogToFile(fmt.Sprintf("INFO: Memory budget %d MiB, copy buffer %d KiB", *memoryBudget, cxfw.CopyBufferSize>>10))
+	}
+
+	if *bundlePath != "" {
+		manifestPaths = []string{stageBundle(*bundlePath)}
+	}
+
+	// Manifests run as root, so only signed ones are executed
+	signingKey, keySource := loadManifestKey(*manifestKey, *allowUnsigned)
+	var manifests []*cxfw.Manifest
+	var manifestData []byte
+	for _, manifestPath := range manifestPaths {
+		cxfw.LogToFile("Loading manifest: " + cxfw.ManifestName(manifestPath))
+		data, err := cxfw.ReadManifest(manifestPath)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to load manifest - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+		}
+		if manifestPath == cxfw.StdinManifest {
+			cxfw.LogToFile(fmt.Sprintf("INFO: Received %d bytes of manifest on standard input (sha256 %s)", len(data), cxfw.ManifestDigest(data)))
+		}
+		checkManifestSignature(manifestPath, data, signingKey, keySource, *allowUnsigned)
+		manifestData = append(manifestData, data...)
+		manifest, err := cxfw.ParseManifest(data)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to load manifest - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+		}
+		if *bundlePath != "" {
+			rewriteBundleSources(manifest)
+		}
+		legacy, err := cxfw.NormalizeVersion(manifest, *allowLegacyVersion)
+		if err != nil {
+			cxfw.LogToFile("ERROR: " + err.Error())
+			cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+		}
+		if legacy {
+			cxfw.LogToFile(fmt.Sprintf("WARNING: Accepted legacy manifest version %q, using identifier %s", manifest.Version, manifest.VersionID))
+		}
+		manifests = append(manifests, manifest)
+	}
+
+	// Split manifests must be complete and are applied in part order
+	manifest, err := mergeManifestParts(manifests)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Invalid manifest set - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+	}
+	cxfw.RunReport.ManifestVersion = manifest.Version
+	patchVersionID = manifest.VersionID
+	rebootRequested = manifest.Reboot
+	manifestTarget = manifest.Target
+	if manifest.DefaultTimeoutSeconds > 0 {
+		defaultOperationTimeout = time.Duration(manifest.DefaultTimeoutSeconds) * time.Second
+	}
+	detectDevice(manifest, *archOverride, *modelFile)
+	if err := cxfw.ValidateFirmwareRange(manifest); err != nil {
+		cxfw.LogToFile("ERROR: Invalid manifest - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+	}
+	checkFirmwareVersion(manifest, *firmwareVersionFile, *firmwareVersionKey)
+	if err := selectOperations(*only, *skip, len(manifest.Operations)); err != nil {
+		cxfw.LogToFile("ERROR: Invalid operation selection - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+	}
+	if len(deselected) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Running %d of %d operations selected by --only and --skip", len(manifest.Operations)-len(deselected), len(manifest.Operations)))
+	}
+
+	permissionPolicy, err = loadPermissionPolicy(cxfw.HostPath(permissionPolicyFile))
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to load permission policy - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidPolicy, cxfw.ReasonInvalidPolicy, err.Error())
+	}
+	strictPermissions = manifest.StrictPermissions
+	if manifest.ServiceTemplate != "" {
+		if strings.Count(manifest.ServiceTemplate, "%s") != 2 || strings.Count(manifest.ServiceTemplate, "%") != 2 {
+			cxfw.LogToFile("ERROR: Invalid service_template, expected two %s placeholders - " + manifest.ServiceTemplate)
+			cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, "invalid service_template "+manifest.ServiceTemplate)
+		}
+		serviceTemplate = manifest.ServiceTemplate
+	}
+
+	// Fail before any modification if the database key cannot be extracted
+	if slices.ContainsFunc(manifest.Operations, operationNeedsKey) {
+		if _, err := cxfw.ExtractKeyFromImage(); err != nil {
+			cxfw.LogToFile("ERROR: Key self-test failed, no changes made - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitKeyUnavailable, cxfw.ReasonKeyUnavailable, err.Error())
+		}
+		cxfw.LogToFile("INFO: Key self-test passed")
+	}
+
+	if *validateOnly {
+		if manifest.PreCheck != "" || manifest.PostCheck != "" {
+			cxfw.LogToFile("INFO: pre_check and post_check are not run with --validate-only")
+		}
+		if reason := validateOperations(manifest.Operations); reason != "" {
+			cxfw.LogToFile("========== CloudX Firmware Patch Validation Failed ==========")
+			cxfw.FinishRun(cxfw.ExitValidationFailed, reason, "one or more operations would fail")
+		}
+		cxfw.LogToFile("========== CloudX Firmware Patch Validation Passed ==========")
+		cxfw.FinishRun(0, "", "")
+	}
+
+	// A manifest the management server pushes again is not applied twice
+	manifestChecksum := cxfw.ManifestDigest(manifestData)
+	history, err := readHistory(cxfw.HostPath(defaultHistoryFile))
+	if err != nil {
+		cxfw.LogToFile("WARNING: Failed to read the patch history, cannot check for an earlier application - " + err.Error())
+	}
+	if applied := lastApplied(history, manifestChecksum); applied != nil {
+		when := applied.AppliedAt.Format(time.RFC3339)
+		if !*reapply && len(deselected) == 0 {
+			cxfw.LogToFile(fmt.Sprintf("INFO: Patch %s already applied at %s, nothing to do; use --reapply to apply it again", manifest.Version, when))
+			cxfw.LogToFile("========== CloudX Firmware Patch Execution Completed ==========")
+			cxfw.FinishRun(0, "", "already applied at "+when)
+		}
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Patch %s already applied at %s, applying it again because of --reapply, --only or --skip", manifest.Version, when))
+	}
+
+	// Operations an interrupted run completed are skipped with --resume
+	completed := loadJournal(cxfw.HostPath(defaultJournalFile), manifestChecksum, *resume)
+
+	// Check every payload before the first change
+	if problems := preflightOperations(manifest.Operations, completed); len(problems) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Preflight found %d problems, no changes made:", len(problems)))
+		cxfw.ReportNotRun(manifest.Operations, 0)
+		details := make([]string, 0, len(problems))
+		for _, problem := range problems {
+			op := manifest.Operations[problem.index]
+			detail := fmt.Sprintf("operation %d/%d (%s): %s", problem.index+1, len(manifest.Operations), op.Operation, problem.detail)
+			cxfw.LogToFile(fmt.Sprintf("ERROR:   %s - %s", detail, problem.reason))
+			cxfw.RunReport.Operations[problem.index].Reason = problem.reason
+			cxfw.RunReport.Operations[problem.index].Detail = problem.detail
+			details = append(details, detail)
+		}
+		cxfw.FinishRun(cxfw.ExitPreflightFailed, problems[0].reason, strings.Join(details, "; "))
+	}
+	cxfw.LogToFile("INFO: Preflight passed")
+
+	if manifest.PreCheck != "" {
+		if err := runCheck("pre_check", manifest.PreCheck); err != nil {
+			cxfw.ReportNotRun(manifest.Operations, 0)
+			if cxfw.Interrupted() {
+				cxfw.StopInterrupted()
+			}
+			cxfw.LogToFile("Execution aborted by pre_check, no changes made.")
+			cxfw.FinishRun(cxfw.ExitPreCheckFailed, cxfw.ReasonPreCheckFailed, err.Error())
+		}
+	}
+
+	startJournal()
+	publishStart(len(manifest.Operations))
+	pendingHistory = &historyEntry{Version: manifest.Version, ManifestChecksum: manifestChecksum, AppliedAt: cxfw.RunStart.UTC(), RunID: cxfw.RunID}
+	for i, op := range manifest.Operations {
+		if cxfw.Interrupted() {
+			cxfw.ReportNotRun(manifest.Operations, i)
+			cxfw.StopInterrupted()
+		}
+		cxfw.SetLogOperation(i, op)
+		cxfw.LogToFile(cxfw.OperationStartMessage(i, len(manifest.Operations), op))
+		cxfw.StartProgress(i, len(manifest.Operations), op)
+		result := cxfw.OperationResultFor(i, op)
+		op = cxfw.HostOperation(op)
+		if deselected[i] {
+			cxfw.LogToFile("SKIPPED-BY-FLAG: Not selected by --only or --skip")
+			result.State, result.Detail = cxfw.OpSkippedByFlag, "not selected by --only or --skip"
+			addOperationResult(result)
+			continue
+		}
+		if completed[i] {
+			cxfw.LogToFile("SKIPPED: Completed by the interrupted run")
+			result.State, result.Detail = cxfw.OpSkippedCompleted, "completed by the interrupted run"
+			addOperationResult(result)
+			continue
+		}
+
+		// Installs defer their integrity database entries, so that a run of
+		// them shares one rewrite per directory; any other operation, and
+		// the scripts and commands it may run, sees the databases written
+		deferred := op.Operation == "add" || op.Operation == "copy"
+		cxfw.DeferIntegrityUpdates(deferred)
+		if !deferred {
+			if err := flushIntegrity(); err != nil {
+				cxfw.ReportNotRun(manifest.Operations, i)
+				cxfw.LogToFile("Execution stopped due to error.")
+				cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+			}
+		}
+
+		satisfied := len(satisfiedPaths)
+		opStart := time.Now()
+		if mismatch := operationTargetMismatch(op); mismatch != "" {
+			skipOperation(i, op, result, cxfw.OpSkippedTarget, "Operation "+mismatch)
+			continue
+		}
+		met, err := conditionMet(op)
+		if err == nil && !met {
+			skipOperation(i, op, result, cxfw.OpSkippedCondition, "Condition not met - "+op.Condition)
+			continue
+		}
+		if err == nil {
+			err = runWithRetries(op)
+		}
+		result.DurationMs = time.Since(opStart).Milliseconds()
+		logOperationTime(i, manifest.Operations[i], time.Since(opStart), err)
+		result.State = cxfw.OpSucceeded
+		if len(satisfiedPaths) > satisfied {
+			result.State = cxfw.OpSkippedAlreadySatisfied
+		}
+		if err != nil {
+			result.State, result.Reason, result.Detail = cxfw.OpFailed, cxfw.ReasonForError(err), err.Error()
+		}
+		if err != nil && cxfw.Interrupted() {
+			result.Reason = cxfw.ReasonInterrupted
+		}
+		if err != nil && result.Reason != cxfw.ReasonInterrupted && failureAllowed(op, err) {
+			cxfw.LogToFile("WARNING: Operation failed, continuing because allow_failure is set - " + err.Error())
+			result.State = cxfw.OpFailedAllowed
+			allowedFailures = append(allowedFailures, fmt.Sprintf("#%d %s (%v)", i+1, op.Operation, err))
+			err = nil
+		}
+		addOperationResult(result)
+		if err == nil {
+			journalOperation(i, op, result.State)
+		}
+		if err != nil {
+			cxfw.ReportNotRun(manifest.Operations, i+1)
+			cxfw.LogToFile("ERROR: Failed to execute operation - " + op.Operation)
+			if result.Reason == cxfw.ReasonInterrupted {
+				cxfw.StopInterrupted()
+			}
+			if errors.Is(err, syscall.EIO) {
+				// Stop writing to the failing filesystem and ask for a technician
+				cxfw.LogToFile("ERROR: Storage I/O error, no further writes attempted - device needs service")
+			}
+			cxfw.LogToFile("Execution stopped due to error.")
+			cxfw.FinishRun(cxfw.ExitCodeForError(err), result.Reason, result.Detail)
+		}
+	}
+	cxfw.ClearLogOperation()
+	cxfw.DeferIntegrityUpdates(false)
+	if err := flushIntegrity(); err != nil {
+		cxfw.LogToFile("Execution stopped due to error.")
+		cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+	}
+	if len(skippedOperations) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("INFO: %d operations were skipped on this device:", len(skippedOperations)))
+		for _, skipped := range skippedOperations {
+			cxfw.LogToFile("INFO:   " + skipped)
+		}
+	}
+	if len(allowedFailures) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: %d operations failed but were allowed to:", len(allowedFailures)))
+		for _, failure := range allowedFailures {
+			cxfw.LogToFile("WARNING:   " + failure)
+		}
+	}
+	if len(satisfiedPaths) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("INFO: %d operations were already satisfied by an earlier run:", len(satisfiedPaths)))
+		for _, path := range satisfiedPaths {
+			cxfw.LogToFile("INFO:   " + path)
+		}
+	}
+	if len(forcedMismatches) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: FORCED: --force accepted %d mismatches:", len(forcedMismatches)))
+		for _, mismatch := range forcedMismatches {
+			cxfw.LogToFile("WARNING:   " + mismatch)
+		}
+	}
+	if len(clampedPaths) > 0 {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Permission policy clamped the mode of %d installed paths:", len(clampedPaths)))
+		for _, path := range clampedPaths {
+			cxfw.LogToFile("WARNING:   " + path)
+		}
+	}
+	if manifest.PostCheck != "" {
+		if err := runCheck("post_check", manifest.PostCheck); err != nil {
+			if cxfw.Interrupted() {
+				cxfw.StopInterrupted()
+			}
+			cxfw.LogToFile("Execution stopped due to error.")
+			cxfw.FinishRun(cxfw.ExitFailure, cxfw.ReasonPostCheckFailed, err.Error())
+		}
+	}
+	// Swapping the tooling binaries is the very last change of a run
+	if err := finishSelfUpdates(); err != nil {
+		cxfw.LogToFile("Execution stopped due to error.")
+		cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+	}
+	restoreReadOnly()
+	removeJournal()
+	cxfw.LogToFile("Total execution time: " + time.Since(cxfw.RunStart).Round(time.Millisecond).String())
+	cxfw.LogToFile("========== CloudX Firmware Patch Execution Completed ==========")
+	cxfw.FinishRun(0, "", "")
 }
 
-type Operation struct {
-	Operation string                       `json:"operation"`
-	Path      string                       `json:"path,omitempty"`
-	Source    string                       `json:"source,omitempty"`
-	Checksum  string                       `json:"checksum,omitempty"`
-	Size      int64                        `json:"size,omitempty"`
-	Command   string                       `json:"command,omitempty"`
-	Script    string                       `json:"script_content,omitempty"`
-	Entries   map[string]map[string]string `json:"entries,omitempty"`
+// dispatchOperation runs op with the handler for its operation type.
+func dispatchOperation(op cxfw.Operation) error {
+	switch op.Operation {
+	case "add", "copy":
+		return addFile(op)
+	case "remove":
+		return removeFile(op)
+	case "remove_dir":
+		return removeDir(op)
+	case "cleanup":
+		return cleanupFiles(op)
+	case "extract_tar":
+		return extractTar(op)
+	case "delta":
+		return applyDelta(op)
+	case "create_file":
+		return createFile(op)
+	case "append":
+		return appendToFile(op)
+	case "replace_text":
+		return replaceText(op)
+	case "patch":
+		return patchFile(op)
+	case "command":
+		return executeCommand(op)
+	case "script":
+		return executeScript(op)
+	case "modify_defaults":
+		return modifyDefaults(op)
+	case "service":
+		return controlService(op)
+	case "launcher":
+		return updateLauncher(op)
+	case "kmod":
+		return controlModule(op)
+	case "self_update":
+		return stageSelfUpdate(op)
+	case "verify":
+		return verifyPath(op)
+	case "download":
+		return downloadFile(op)
+	case "replace_image":
+		return replaceImage(op)
+	case "flash":
+		return flashPartition(op)
+	case "remount":
+		return remountPath(op)
+	case "install_cert":
+		return installCert(op)
+	case "cron":
+		return updateCrontab(op)
+	case "reboot":
+		return requestReboot(op)
+	case "user":
+		return provisionUser(op)
+	case "snapshot_integrity":
+		return snapshotIntegrity(op)
+	case "restore_integrity":
+		return restoreIntegrity(op)
+	default:
+		cxfw.LogToFile("ERROR: Unknown operation - " + op.Operation)
+		return fmt.Errorf("%w %q", cxfw.ErrUnknownOperation, op.Operation)
+	}
 }
 
-// Structure for integrity database entries
-type IntegrityEntry struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
+// mergeManifestParts combines the manifests given on the command line into a
+// single manifest. Parts produced by the creator's split subcommand carry a
+// session ID and part/of numbers; the whole session must be present before
+// anything is applied. Manifests without session metadata are applied in the
+// order given.
+func mergeManifestParts(manifests []*cxfw.Manifest) (*cxfw.Manifest, error) {
+	if len(manifests) == 1 && manifests[0].SessionID == "" {
+		return manifests[0], nil
+	}
+
+	sessionID := manifests[0].SessionID
+	total := manifests[0].Of
+	for _, m := range manifests {
+		if m.SessionID != sessionID {
+			return nil, fmt.Errorf("manifests belong to different sessions: %q and %q", sessionID, m.SessionID)
+		}
+		if m.Of != total {
+			return nil, fmt.Errorf("inconsistent part count in session %s: %d and %d", sessionID, total, m.Of)
+		}
+	}
+
+	// Manifest-level settings are taken from the first manifest
+	merged := *manifests[0]
+	merged.Part, merged.Of, merged.Operations = 0, 0, nil
+	if sessionID == "" {
+		for _, m := range manifests {
+			merged.Operations = append(merged.Operations, m.Operations...)
+		}
+		return &merged, nil
+	}
+
+	if total < 1 {
+		return nil, fmt.Errorf("session %s has invalid part count %d", sessionID, total)
+	}
+	parts := make(map[int]*cxfw.Manifest)
+	var duplicate, outOfRange []string
+	for _, m := range manifests {
+		if m.Part < 1 || m.Part > total {
+			outOfRange = append(outOfRange, strconv.Itoa(m.Part))
+			continue
+		}
+		if _, exists := parts[m.Part]; exists {
+			duplicate = append(duplicate, strconv.Itoa(m.Part))
+			continue
+		}
+		parts[m.Part] = m
+	}
+
+	var missing []string
+	for i := 1; i <= total; i++ {
+		if _, exists := parts[i]; !exists {
+			missing = append(missing, strconv.Itoa(i))
+		}
+	}
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing parts "+strings.Join(missing, ","))
+	}
+	if len(duplicate) > 0 {
+		problems = append(problems, "duplicate parts "+strings.Join(duplicate, ","))
+	}
+	if len(outOfRange) > 0 {
+		problems = append(problems, "parts out of range "+strings.Join(outOfRange, ","))
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("session %s (%d parts): %s", sessionID, total, strings.Join(problems, "; "))
+	}
+
+	for i := 1; i <= total; i++ {
+		if parts[i].Version != merged.Version {
+			return nil, fmt.Errorf("part %d has version %q, expected %q", i, parts[i].Version, merged.Version)
+		}
+		merged.Operations = append(merged.Operations, parts[i].Operations...)
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Session %s complete, %d parts with %d operations", sessionID, total, len(merged.Operations)))
+	return &merged, nil
 }
 
-// Structure for folder-specific JSON content (e.g., .apps.json, .basic.json)
-type FolderEntry struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
+func addFile(op cxfw.Operation) error {
+	if op.Path == "" || (op.Source == "") == (len(op.Files) == 0) {
+		cxfw.LogToFile("ERROR: Invalid add operation, expected a path and either source or files")
+		return fmt.Errorf("invalid add operation, expected a path and either source or files")
+	}
+	if len(op.Files) > 0 {
+		return addFiles(op)
+	}
+
+	// Step 1: Copy file to destination and verify its checksum
+	destFile, err := addDestination(op)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Invalid add operation, " + err.Error())
+		return fmt.Errorf("invalid add operation, %w", err)
+	}
+	if done, err := alreadySatisfied(op, destFile); done || err != nil {
+		return err
+	}
+	if err := prepareAddDir(op.Path); err != nil {
+		return err
+	}
+	installedChecksum := op.Checksum
+	if alreadyInstalled(op, destFile) {
+		cxfw.LogToFile("INFO: " + destFile + " already installed, skipped")
+	} else if installedChecksum, err = installFile(op, destFile); err != nil {
+		return err
+	}
+
+	// Step 2: Update integrity database and get encrypted .db.json hash
+	dbHash, err := cxfw.UpdateIntegrityDatabase(destFile, installedChecksum)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
+	}
+
+	// Step 3: Update folder-specific JSON file (e.g., .apps.json, .basic.json)
+	err = cxfw.UpdateFolderFile(op.Path, dbHash)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+		return fmt.Errorf("failed to update folder file: %w", err)
+	}
+
+	// Step 4: Remove source file unless another operation still needs it
+	if op.Operation == "copy" || op.KeepSource {
+		cxfw.LogToFile("DEBUG: Keeping source file - " + op.Source)
+		cxfw.LogToFile("SUCCESS: File copied and verified successfully - " + destFile)
+		return nil
+	}
+	err = os.Remove(op.Source)
+	if err != nil {
+		cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
+		return fmt.Errorf("failed to remove source file: %w", err)
+	}
+
+	cxfw.LogToFile("SUCCESS: File added and verified successfully - " + destFile)
+	return nil
 }
 
-const logFile = "/newroot/var/log/cxfw_patch.log"
-const backupDir = "/sda1/data/cxfw/rollback"
+// prepareAddDir creates the destination directory of an add, applying the
+// permission policy to it when it is new.
+func prepareAddDir(dir string) error {
+	_, statErr := os.Stat(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + dir)
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if os.IsNotExist(statErr) {
+		if err := enforcePermissionPolicy(dir); err != nil {
+			cxfw.LogToFile("ERROR: " + err.Error())
+			return err
+		}
+	}
+	return nil
+}
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: ./firmware_patch_executor <manifest.json>")
-		os.Exit(1)
+// replacedFiles holds the destinations installFile has backed up in this
+// run, so a retry does not back up the copy a failed attempt left behind.
+var replacedFiles = make(map[string]bool)
+
+// verifyReadback is set by --verify-readback: installed files are then
+// read back from storage to be verified, instead of verifying the data as
+// it is written.
+var verifyReadback bool
+
+// installFile copies op.Source to a temp file next to dest, applies the
+// mode, owner and group op gives, and verifies the copy against op.Size and
+// op.Checksum. The size is checked first, so a copy truncated by a full
+// partition is reported as such rather than as a checksum mismatch. Only a
+// verified copy is synced and renamed over dest, so neither a failure nor a
+// power cut leaves a partial file at dest. A file already at dest is backed
+// up first, so a rollback can restore it. It returns the checksum of the
+// installed file, which differs from op.Checksum only with --force.
+func installFile(op cxfw.Operation, dest string) (string, error) {
+	if _, err := os.Stat(dest); err == nil && !replacedFiles[dest] {
+		backupPath, err := backupFile(dest)
+		if err != nil {
+			return "", err
+		}
+		cxfw.LogToFile("INFO: Existing " + dest + " backed up to " + backupPath)
+		replacedFiles[dest] = true
+	} else if err != nil && !os.IsNotExist(err) {
+		cxfw.LogToFile("ERROR: Failed to check destination - " + err.Error())
+		return "", fmt.Errorf("failed to check destination: %w", err)
 	}
 
-	manifestPath := os.Args[1]
-	logToFile("========== CloudX Firmware Patch Execution Started ==========")
-	logToFile("Loading manifest: " + manifestPath)
+	return cxfw.InstallAtomic(dest, func(temp string) (string, error) {
+		return copyVerified(op, temp, dest)
+	})
+}
 
-	manifest, err := loadManifest(manifestPath)
+// copyVerified is the copy and verification of installFile, into temp. The
+// permission policy and log messages go by dest, where temp is installed.
+func copyVerified(op cxfw.Operation, temp, dest string) (string, error) {
+	source, checksum := op.Source, op.Checksum
+	cxfw.LogToFile("DEBUG: Copying file from " + source + " to " + dest)
+	size := op.Size
+	if info, err := os.Stat(source); err == nil {
+		size = info.Size()
+	}
+	// With --verify-readback the copy is read back, so it can stay in the kernel
+	var copiedChecksum string
+	var err error
+	if verifyReadback {
+		err = cxfw.CopyFileProgress(source, temp, cxfw.CopyProgress(size))
+	} else {
+		copiedChecksum, err = cxfw.CopyFileChecksum(source, temp, cxfw.CopyProgress(size))
+	}
 	if err != nil {
-		logToFile("ERROR: Failed to load manifest - " + err.Error())
-		os.Exit(1)
+		cxfw.LogToFile("ERROR: Failed to copy file - " + err.Error())
+		return "", fmt.Errorf("failed to copy file: %w", err)
+	}
+	if op.Size > 0 {
+		info, err := os.Stat(temp)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to stat copied file - " + err.Error())
+			return "", fmt.Errorf("failed to stat copied file: %w", err)
+		}
+		if info.Size() != op.Size && !forceMismatch("size", dest, strconv.FormatInt(op.Size, 10), strconv.FormatInt(info.Size(), 10)) {
+			cxfw.LogToFile(fmt.Sprintf("ERROR: Size mismatch for copied file %s - expected %d bytes, got %d", dest, op.Size, info.Size()))
+			return "", fmt.Errorf("size mismatch for %s: expected %d bytes, got %d", dest, op.Size, info.Size())
+		}
+	}
+	if err := applyFileAttributes(op, temp); err != nil {
+		cxfw.LogToFile("ERROR: Failed to set file attributes - " + err.Error())
+		return "", fmt.Errorf("failed to set file attributes: %w", err)
+	}
+	if err := enforcePermissionPolicyAs(temp, dest); err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return "", err
+	}
+	if op.Mode != "" || op.Owner != "" || op.Group != "" {
+		if info, err := os.Stat(temp); err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				cxfw.LogToFile(fmt.Sprintf("INFO: Applied mode %04o, owner %d, group %d to %s", info.Mode().Perm(), st.Uid, st.Gid, dest))
+			}
+		}
 	}
 
-	for _, op := range manifest.Operations {
-		var err error
-		switch op.Operation {
-		case "add":
-			err = addFile(op)
-		case "remove":
-			err = removeFile(op)
-		case "command":
-			err = executeCommand(op)
-		case "script":
-			err = executeScript(op)
-		case "modify_defaults":
-			err = modifyDefaults(op)
-		default:
-			logToFile("ERROR: Unknown operation - " + op.Operation)
+	// The copy hashed what it wrote; reading it back also catches bad storage
+	if verifyReadback {
+		if copiedChecksum, err = cxfw.ComputeChecksum(temp); err != nil {
+			cxfw.LogToFile("ERROR: Failed to compute checksum of copied file - " + err.Error())
+			return "", fmt.Errorf("failed to compute checksum of copied file: %w", err)
+		}
+	}
+	if copiedChecksum != checksum && !forceMismatch("checksum", dest, checksum, copiedChecksum) {
+		cxfw.LogToFile("ERROR: Checksum mismatch for copied file " + dest)
+		return "", fmt.Errorf("%w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, dest, checksum, copiedChecksum)
+	}
+	return copiedChecksum, nil
+}
+
+// batchEntry returns the single-file add that file of the batch op stands
+// for, and its destination.
+func batchEntry(op cxfw.Operation, file cxfw.BatchFile) (cxfw.Operation, string, error) {
+	if file.Source == "" || file.Checksum == "" {
+		return op, "", fmt.Errorf("invalid batch entry, expected a source and a checksum")
+	}
+	op.Source, op.Name, op.Checksum, op.Size, op.Files = file.Source, file.Name, file.Checksum, file.Size, nil
+	dest, err := addDestination(op)
+	return op, dest, err
+}
+
+// addDestination is the file an add installs: op.Name, or the base name of
+// the staged op.Source, in the directory op.Path. Checksums, the integrity
+// database and the folder file all refer to it.
+func addDestination(op cxfw.Operation) (string, error) {
+	name := op.Name
+	if name == "" {
+		name = filepath.Base(op.Source)
+	}
+	if name != filepath.Base(name) || name == "." || name == ".." || name == "/" {
+		return "", fmt.Errorf("name %q is not a plain file name", name)
+	}
+	return filepath.Join(op.Path, name), nil
+}
+
+// addFiles installs every file of a batch add into op.Path, then records
+// them in the integrity database and folder file with one rewrite each
+// instead of one per file. The batch stops at the first file that fails;
+// the files installed before it are still recorded, so the database matches
+// the disk, and the error names the failing file.
+func addFiles(op cxfw.Operation) error {
+	if err := prepareAddDir(op.Path); err != nil {
+		return err
+	}
+
+	// Step 1: Copy and verify each file
+	satisfied := len(satisfiedPaths)
+	var installed []cxfw.IntegrityEntry
+	var sources []string
+	var failure error
+	for i, file := range op.Files {
+		single, dest, err := batchEntry(op, file)
+		done := false
+		if err == nil {
+			done, err = alreadySatisfied(single, dest)
+		}
+		installedChecksum := file.Checksum
+		if err == nil && !done {
+			if alreadyInstalled(single, dest) {
+				cxfw.LogToFile("INFO: " + dest + " already installed, skipped")
+			} else {
+				installedChecksum, err = installFile(single, dest)
+			}
 		}
 		if err != nil {
-			logToFile("ERROR: Failed to execute operation - " + op.Operation)
-			logToFile("Execution stopped due to error.")
-			os.Exit(1)
+			cxfw.LogToFile(fmt.Sprintf("ERROR: Batch add stopped at file %d/%d - %s", i+1, len(op.Files), file.Source))
+			failure = fmt.Errorf("file %d/%d %s: %w", i+1, len(op.Files), file.Source, err)
+			break
+		}
+		if !done {
+			installed = append(installed, cxfw.IntegrityEntry{Path: dest, Hash: installedChecksum})
+			sources = append(sources, file.Source)
+		}
+	}
+
+	// Only a batch that was entirely installed by an earlier run counts as
+	// satisfied
+	skipped := len(satisfiedPaths) - satisfied
+	satisfiedPaths = satisfiedPaths[:satisfied]
+	if failure == nil && skipped == len(op.Files) {
+		satisfiedPaths = append(satisfiedPaths, op.Path)
+		return nil
+	}
+
+	// Step 2: Update integrity database and folder-specific JSON file once
+	if len(installed) > 0 {
+		dbHash, err := cxfw.UpdateIntegrityEntries(op.Path, installed)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+			return errors.Join(failure, fmt.Errorf("failed to update integrity database: %w", err))
+		}
+		if err := cxfw.UpdateFolderFile(op.Path, dbHash); err != nil {
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+			return errors.Join(failure, fmt.Errorf("failed to update folder file: %w", err))
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+
+	// Step 3: Remove source files unless another operation still needs them
+	if op.Operation == "copy" || op.KeepSource {
+		cxfw.LogToFile("DEBUG: Keeping source files")
+		cxfw.LogToFile(fmt.Sprintf("SUCCESS: %d files copied and verified successfully - %s", len(installed), op.Path))
+		return nil
+	}
+	for _, source := range sources {
+		if err := os.Remove(source); err != nil {
+			cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
+			return fmt.Errorf("failed to remove source file: %w", err)
 		}
 	}
-	logToFile("========== CloudX Firmware Patch Execution Completed ==========")
+
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: %d files added and verified successfully - %s", len(installed), op.Path))
+	return nil
+}
+
+// alreadySatisfied reports whether an earlier run of the same manifest
+// completed op: its source is gone and dest matches op.Checksum. Sources are
+// deleted only after the integrity database has been updated, so a re-run
+// after a crash later in the run skips such operations instead of failing on
+// the missing source. A missing source with a mismatching destination is an
+// error.
+func alreadySatisfied(op cxfw.Operation, dest string) (bool, error) {
+	if op.Checksum == "" {
+		return false, nil
+	}
+	if _, err := os.Stat(op.Source); !os.IsNotExist(err) {
+		return false, nil
+	}
+	checksum, err := cxfw.ComputeChecksum(dest)
+	if err != nil || checksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Source file " + op.Source + " is missing and " + dest + " does not hold the expected content")
+		return false, fmt.Errorf("source file %s is missing and %s does not hold the expected content", op.Source, dest)
+	}
+	cxfw.LogToFile("INFO: Operation already satisfied, skipped - source consumed and " + dest + " matches checksum")
+
+	// A run cut off before the hash was written consumed the source all the
+	// same, e.g. with deferred installs; recording it again is a no-op
+	// otherwise
+	dbHash, err := cxfw.UpdateIntegrityDatabase(dest, op.Checksum)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return false, fmt.Errorf("failed to update integrity database: %w", err)
+	}
+	if err := cxfw.UpdateFolderFile(filepath.Dir(dest), dbHash); err != nil {
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+		return false, fmt.Errorf("failed to update folder file: %w", err)
+	}
+	satisfiedPaths = append(satisfiedPaths, dest)
+	return true, nil
+}
+
+// alreadyInstalled reports whether dest already holds the content op
+// installs, e.g. after a re-run of a manifest that failed later on, so the
+// copy can be skipped. The integrity database and folder file are then
+// rewritten only if they do not record it yet, and the source is still
+// consumed.
+func alreadyInstalled(op cxfw.Operation, dest string) bool {
+	if op.Checksum == "" {
+		return false
+	}
+	checksum, err := cxfw.ComputeChecksum(dest)
+	return err == nil && checksum == op.Checksum
+}
+
+// loadPermissionPolicy reads the permission policy file. A missing file means
+// no policy is in force.
+func loadPermissionPolicy(path string) (map[string]os.FileMode, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	policy := make(map[string]os.FileMode)
+	for prefix, modeString := range raw {
+		mode, err := strconv.ParseUint(modeString, 8, 32)
+		if err != nil || mode > 0o7777 {
+			return nil, fmt.Errorf("invalid mode %q for %s", modeString, prefix)
+		}
+		policy[filepath.Clean(prefix)] = cxfw.FileModeOf(uint32(mode))
+	}
+	return policy, nil
+}
+
+// modeBits are the bits of a mode the permission policy governs: the
+// permission bits and the setuid, setgid and sticky bits. A policy allows the
+// special bits only where its mode sets them, e.g. "4755".
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// clampMode limits mode to the bits the permission policy allows for path.
+// Clamped paths are logged and recorded; with strict_permissions set on the
+// manifest an excessive mode is an error instead.
+func clampMode(path string, mode os.FileMode) (os.FileMode, error) {
+	mode &= modeBits
+	imagePath := cxfw.ImagePath(path)
+	longest := ""
+	for prefix := range permissionPolicy {
+		if (imagePath == prefix || strings.HasPrefix(imagePath, prefix+"/") || prefix == "/") && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return mode, nil
+	}
+
+	allowed := permissionPolicy[longest]
+	if mode&^allowed == 0 {
+		return mode, nil
+	}
+	if strictPermissions {
+		return mode, fmt.Errorf("mode %04o of %s exceeds permission policy %04o for %s", cxfw.UnixMode(mode), path, cxfw.UnixMode(allowed), longest)
+	}
+	cxfw.LogToFile(fmt.Sprintf("WARNING: Clamped mode of %s from %04o to %04o (policy for %s)", path, cxfw.UnixMode(mode), cxfw.UnixMode(mode&allowed), longest))
+	clampedPaths = append(clampedPaths, path)
+	return mode & allowed, nil
+}
+
+// parseMode parses the octal permission bits of a manifest mode field.
+func parseMode(mode string) (os.FileMode, error) {
+	parsed, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || parsed > 0777 {
+		return 0, fmt.Errorf("invalid mode %q", mode)
+	}
+	return os.FileMode(parsed), nil
+}
+
+// applyFileAttributes sets the mode, owner and group op gives explicitly on
+// path. Without them the mode copied from the source is kept.
+func applyFileAttributes(op cxfw.Operation, path string) error {
+	if op.Mode != "" {
+		mode, err := parseMode(op.Mode)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return err
+		}
+	}
+	if op.Owner != "" || op.Group != "" {
+		uid, gid, err := cxfw.LookupOwner(op.Owner, op.Group)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enforcePermissionPolicy clamps the mode of an installed file or directory.
+func enforcePermissionPolicy(path string) error {
+	return enforcePermissionPolicyAs(path, path)
+}
+
+// enforcePermissionPolicyAs clamps the mode of file by the policy for path,
+// where file is about to be installed.
+func enforcePermissionPolicyAs(file, path string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	mode, err := clampMode(path, info.Mode())
+	if err != nil {
+		return err
+	}
+	if mode != info.Mode()&modeBits {
+		return os.Chmod(file, mode)
+	}
+	return nil
+}
+
+func removeFile(op cxfw.Operation) error {
+	if (op.Path == "") == (len(op.Paths) == 0) {
+		cxfw.LogToFile("ERROR: Invalid remove operation, expected either path or paths")
+		return fmt.Errorf("invalid remove operation, expected either path or paths")
+	}
+	if len(op.Paths) > 0 {
+		return removeFiles(op)
+	}
+
+	// Step 1: Copy file to backup directory
+	if _, err := os.Stat(op.Path); err == nil {
+		if _, err := backupFile(op.Path); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		cxfw.LogToFile("WARNING: File does not exist, skipping backup - " + op.Path)
+	} else {
+		cxfw.LogToFile("ERROR: Failed to check file existence - " + err.Error())
+		return fmt.Errorf("failed to check file existence: %w", err)
+	}
+
+	// Step 2: Remove hash from integrity database and update folder-specific JSON,
+	// also when the file is already gone, so no stale entry is left behind
+	changed, dbHash, err := cxfw.RemoveFromIntegrityDatabase(op.Path)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
+	}
+	if changed {
+		dir := filepath.Dir(op.Path)
+		err = cxfw.UpdateFolderFile(dir, dbHash)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+			return fmt.Errorf("failed to update folder file: %w", err)
+		}
+	}
+
+	// Remove the original file
+	cxfw.LogToFile("INFO: Removing file " + op.Path)
+	if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
+		cxfw.LogToFile("ERROR: Failed to remove file - " + err.Error())
+		return fmt.Errorf("failed to remove file: %w", err)
+	}
+
+	cxfw.LogToFile("SUCCESS: File removed successfully - " + op.Path)
+	return nil
+}
+
+// removeFiles removes every file of a batch remove. The files are backed
+// up first, then the integrity database and folder file of each affected
+// directory are rewritten once, and the files are removed. Paths that are
+// already absent are skipped with a warning, but their hashes are removed
+// all the same.
+func removeFiles(op cxfw.Operation) error {
+	// Step 1: Copy the files to the backup directory, grouped by directory
+	var dirs []string
+	byDir := make(map[string][]string)
+	present := make(map[string][]string)
+	for _, path := range op.Paths {
+		dir := filepath.Dir(path)
+		if byDir[dir] == nil {
+			dirs = append(dirs, dir)
+		}
+		byDir[dir] = append(byDir[dir], path)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			cxfw.LogToFile("WARNING: File does not exist, skipping - " + path)
+			continue
+		} else if err != nil {
+			cxfw.LogToFile("ERROR: Failed to check file existence - " + err.Error())
+			return fmt.Errorf("failed to check file existence: %w", err)
+		}
+		if _, err := backupFile(path); err != nil {
+			return err
+		}
+		present[dir] = append(present[dir], path)
+	}
+
+	// Step 2: Remove their hashes with one rewrite per directory
+	for _, dir := range dirs {
+		_, dbHash, err := cxfw.PruneIntegrityDatabase(dir, byDir[dir])
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+			return fmt.Errorf("failed to update integrity database: %w", err)
+		}
+		if dbHash == "" {
+			continue
+		}
+		if err := cxfw.UpdateFolderFile(dir, dbHash); err != nil {
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+			return fmt.Errorf("failed to update folder file: %w", err)
+		}
+	}
+
+	// Step 3: Remove the files
+	removed := 0
+	for _, dir := range dirs {
+		for _, path := range present[dir] {
+			cxfw.LogToFile("INFO: Removing file " + path)
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				cxfw.LogToFile("ERROR: Failed to remove file - " + err.Error())
+				return fmt.Errorf("failed to remove file: %w", err)
+			}
+			removed++
+		}
+	}
+
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: %d of %d files removed successfully", removed, len(op.Paths)))
+	return nil
+}
+
+func extractTar(op cxfw.Operation) error {
+	if op.Source == "" || op.Path == "" || op.Checksum == "" {
+		cxfw.LogToFile("ERROR: Invalid extract_tar operation, missing source, path or checksum")
+		return fmt.Errorf("invalid extract_tar operation, missing source, path or checksum")
+	}
+
+	// Step 1: Verify the archive checksum
+	archiveChecksum, err := cxfw.ComputeChecksum(op.Source)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to compute archive checksum - " + err.Error())
+		return fmt.Errorf("failed to compute archive checksum: %w", err)
+	}
+	if archiveChecksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for archive " + op.Source)
+		return fmt.Errorf("%w for archive %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Source, op.Checksum, archiveChecksum)
+	}
+
+	// Step 2: Reject unsafe entries before anything is written
+	var total int64
+	if err := walkTar(op.Source, func(header *tar.Header, _ io.Reader) error {
+		total += header.Size
+		return validateTarEntry(header)
+	}); err != nil {
+		cxfw.LogToFile("ERROR: Rejected archive " + op.Source + " - " + err.Error())
+		return fmt.Errorf("rejected archive %s: %w", op.Source, err)
+	}
+
+	// Step 3: Extract, hashing every regular file as it is written
+	installed := make(map[string]string)
+	var dirs []string
+	extracted := &cxfw.ProgressWriter{Progress: cxfw.CopyProgress(total)}
+	err = walkTar(op.Source, func(header *tar.Header, content io.Reader) error {
+		target := filepath.Join(op.Path, filepath.Clean(header.Name))
+		mode, err := clampMode(target, os.FileMode(header.Mode).Perm())
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+			return os.Chmod(target, mode)
+		}
+
+		dir := filepath.Dir(target)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		if n, err := io.CopyBuffer(io.MultiWriter(file, hash, extracted), content, cxfw.NewCopyBuffer()); err != nil {
+			file.Close()
+			os.Remove(target)
+			return cxfw.ClassifyWriteError(target, n, err)
+		}
+		if err := os.Chmod(target, mode); err != nil {
+			return err
+		}
+
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+		installed[target] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to extract archive - " + err.Error())
+		return fmt.Errorf("failed to extract archive: %w", err)
+	}
+
+	// Step 4: Update the integrity database and folder file of every directory touched
+	for _, dir := range dirs {
+		var dbHash string
+		for _, target := range slices.Sorted(maps.Keys(installed)) {
+			if filepath.Dir(target) != dir {
+				continue
+			}
+			dbHash, err = cxfw.UpdateIntegrityDatabase(target, installed[target])
+			if err != nil {
+				cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+				return fmt.Errorf("failed to update integrity database: %w", err)
+			}
+		}
+		if err := cxfw.UpdateFolderFile(dir, dbHash); err != nil {
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+			return fmt.Errorf("failed to update folder file: %w", err)
+		}
+	}
+
+	// Step 5: Remove the archive unless another operation still needs it
+	if !op.KeepSource {
+		if err := os.Remove(op.Source); err != nil {
+			cxfw.LogToFile("WARNING: Failed to remove source archive - " + err.Error())
+			return fmt.Errorf("failed to remove source archive: %w", err)
+		}
+	}
+
+	for _, target := range slices.Sorted(maps.Keys(installed)) {
+		cxfw.LogToFile("INFO: Installed " + target + " - " + installed[target])
+	}
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: Archive extracted successfully - %d files installed under %s", len(installed), op.Path))
+	return nil
 }
 
-func logToFile(message string) {
-	logEntry := time.Now().Format("2006-01-02 15:04:05") + " | " + message + "\n"
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		defer file.Close()
-		file.WriteString(logEntry)
+func applyDelta(op cxfw.Operation) error {
+	if op.Path == "" || op.Source == "" || op.BaseChecksum == "" || op.Checksum == "" {
+		cxfw.LogToFile("ERROR: Invalid delta operation, missing path, source, base_checksum or checksum")
+		return fmt.Errorf("invalid delta operation, missing path, source, base_checksum or checksum")
+	}
+	if done, err := alreadySatisfied(op, op.Path); done || err != nil {
+		return err
 	}
-}
 
-func loadManifest(path string) (*Manifest, error) {
-	data, err := os.ReadFile(path)
+	// Step 1: Verify the file being patched is the expected base
+	baseChecksum, err := cxfw.ComputeChecksum(op.Path)
 	if err != nil {
-		return nil, err
+		cxfw.LogToFile("ERROR: Failed to compute base checksum - " + err.Error())
+		return fmt.Errorf("failed to compute base checksum: %w", err)
 	}
-	var manifest Manifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
-		return nil, err
+	if baseChecksum != op.BaseChecksum && !forceMismatch("base checksum", op.Path, op.BaseChecksum, baseChecksum) {
+		cxfw.LogToFile("ERROR: Base checksum mismatch for " + op.Path + ", file left untouched")
+		return fmt.Errorf("base %w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Path, op.BaseChecksum, baseChecksum)
 	}
-	return &manifest, nil
-}
 
-func computeChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
+	patch, err := os.ReadFile(op.Source)
 	if err != nil {
-		return "", err
+		cxfw.LogToFile("ERROR: Failed to read delta - " + err.Error())
+		return fmt.Errorf("failed to read delta: %w", err)
 	}
-	defer file.Close()
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
+	// Step 2: Apply the delta to a temp file next to the target
+	base, err := os.Open(op.Path)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to open base file - " + err.Error())
+		return fmt.Errorf("failed to open base file: %w", err)
 	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
+	defer base.Close()
 
-func addFile(op Operation) error {
-	if op.Source == "" || op.Path == "" {
-		logToFile("ERROR: Invalid add operation, missing source or path")
-		os.Exit(1)
+	baseInfo, err := base.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat base file: %w", err)
 	}
 
-	// Step 1: Copy file to destination
-	filename := filepath.Base(op.Source)
-	destFile := filepath.Join(op.Path, filename)
-
-	if err := os.MkdirAll(op.Path, 0755); err != nil {
-		logToFile("ERROR: Failed to create directory - " + op.Path)
-		os.Exit(1)
+	tempFile := op.Path + ".delta.tmp"
+	cxfw.TrackTempFile(tempFile)
+	defer cxfw.UntrackTempFile(tempFile)
+	out, err := os.OpenFile(tempFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, baseInfo.Mode().Perm())
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to create temp file - " + err.Error())
+		return fmt.Errorf("failed to create temp file: %w", err)
 	}
+	defer os.Remove(tempFile)
+	defer out.Close()
 
-	logToFile("INFO: Copying file from " + op.Source + " to " + destFile)
-	err := copyFile(op.Source, destFile)
-	if err != nil {
-		logToFile("ERROR: Failed to copy file - " + err.Error())
-		os.Exit(1)
+	cxfw.LogToFile("INFO: Applying delta " + op.Source + " to " + op.Path)
+	hash := sha256.New()
+	counter := &cxfw.CountingWriter{}
+	if err := applyBsdiff(base, patch, io.MultiWriter(out, hash, counter)); err != nil {
+		err = cxfw.ClassifyWriteError(tempFile, counter.N, err)
+		cxfw.LogToFile("ERROR: Failed to apply delta - " + err.Error())
+		return fmt.Errorf("failed to apply delta: %w", err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temp file: %w", cxfw.ClassifyWriteError(tempFile, counter.N, err))
 	}
 
-	// Step 2: Verify checksum of copied file
-	copiedChecksum, err := computeChecksum(destFile)
-	if err != nil {
-		logToFile("ERROR: Failed to compute checksum of copied file - " + err.Error())
-		os.Exit(1)
+	// Step 3: Verify the result before it replaces the original
+	resultChecksum := hex.EncodeToString(hash.Sum(nil))
+	if resultChecksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for patched file " + op.Path + ", file left untouched")
+		return fmt.Errorf("%w for patched %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Path, op.Checksum, resultChecksum)
+	}
+	if err := out.Chmod(baseInfo.Mode()); err != nil {
+		return fmt.Errorf("failed to set mode on patched file: %w", err)
 	}
 
-	if copiedChecksum != op.Checksum {
-		logToFile("ERROR: Checksum mismatch for copied file " + destFile)
-		os.Exit(1)
+	if err := os.Rename(tempFile, op.Path); err != nil {
+		cxfw.LogToFile("ERROR: Failed to replace file - " + err.Error())
+		return fmt.Errorf("failed to replace file: %w", err)
 	}
 
-	// Step 3: Update integrity database and get encrypted .db.json hash
-	dbHash, err := updateIntegrityDatabase(destFile, copiedChecksum)
+	// Step 4: Update integrity database and folder file
+	dbHash, err := cxfw.UpdateIntegrityDatabase(op.Path, resultChecksum)
 	if err != nil {
-		logToFile("ERROR: Failed to update integrity database - " + err.Error())
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
 		return fmt.Errorf("failed to update integrity database: %w", err)
 	}
-
-	// Step 4: Update folder-specific JSON file (e.g., .apps.json, .basic.json)
-	err = updateFolderFile(op.Path, dbHash)
-	if err != nil {
-		logToFile("ERROR: Failed to update folder file - " + err.Error())
+	if err := cxfw.UpdateFolderFile(filepath.Dir(op.Path), dbHash); err != nil {
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
 		return fmt.Errorf("failed to update folder file: %w", err)
 	}
 
-	// Step 5: Remove source file
-	err = os.Remove(op.Source)
-	if err != nil {
-		logToFile("WARNING: Failed to remove source file - " + err.Error())
-		return fmt.Errorf("failed to remove source file: %w", err)
+	// Step 5: Remove the delta unless another operation still needs it
+	if !op.KeepSource {
+		if err := os.Remove(op.Source); err != nil {
+			cxfw.LogToFile("WARNING: Failed to remove source delta - " + err.Error())
+			return fmt.Errorf("failed to remove source delta: %w", err)
+		}
 	}
 
-	logToFile("SUCCESS: File added and verified successfully - " + destFile)
+	cxfw.LogToFile("SUCCESS: Delta applied and verified successfully - " + op.Path)
 	return nil
 }
 
-// Helper function to copy file contents
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer sourceFile.Close()
-
-	destFile, err := os.Create(dst)
+// walkTar calls fn for every entry of the gzip-compressed tar archive at path.
+func walkTar(path string, fn func(header *tar.Header, content io.Reader) error) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
+	defer file.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
+	gz, err := gzip.NewReader(file)
 	if err != nil {
 		return err
 	}
+	defer gz.Close()
 
-	// Ensure file permissions are preserved
-	srcInfo, err := os.Stat(src)
-	if err != nil {
-		return err
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return fmt.Errorf("%s: %w", header.Name, err)
+		}
 	}
-	return os.Chmod(dst, srcInfo.Mode())
 }
 
-func removeFile(op Operation) error {
-	if op.Path == "" {
-		logToFile("ERROR: Invalid remove operation, missing path")
-		os.Exit(1)
+// validateTarEntry accepts only plain files and directories that stay below
+// the extraction root.
+func validateTarEntry(header *tar.Header) error {
+	if !filepath.IsLocal(header.Name) {
+		return fmt.Errorf("path escapes extraction root")
 	}
-
-	// Step 1: Copy file to backup directory
-	backupPath := filepath.Join(backupDir, strings.ReplaceAll(op.Path, "/", "_"))
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
-		logToFile("ERROR: Failed to create backup directory - " + err.Error())
-		os.Exit(1)
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeDir:
+		return nil
+	case tar.TypeSymlink, tar.TypeLink:
+		return fmt.Errorf("links are not allowed")
+	default:
+		return fmt.Errorf("unsupported entry type %q", string(header.Typeflag))
 	}
+}
 
-	if _, err := os.Stat(op.Path); err == nil {
-		logToFile("INFO: Copying file to backup: " + op.Path + " -> " + backupPath)
-		if err := copyFile(op.Path, backupPath); err != nil {
-			logToFile("ERROR: Failed to copy file to backup - " + err.Error())
-			os.Exit(1)
-		}
-
-		// Step 2: Verify checksum of copied file
-		backupChecksum, err := computeChecksum(backupPath)
-		if err != nil {
-			logToFile("ERROR: Failed to compute backup checksum - " + err.Error())
-			os.Exit(1)
-		}
+// protectedDirs can never be the target of remove_dir.
+var protectedDirs = []string{"/", "/sda1", "/sda1/data", "/sda1/boot", "/sda1/data/apps", "/sda1/data/basic", "/sda1/data/core", cxfw.DefaultBackupDir}
 
-		originalChecksum, err := computeChecksum(op.Path)
-		if err != nil {
-			logToFile("ERROR: Failed to compute original checksum - " + err.Error())
-			os.Exit(1)
+func removeDir(op cxfw.Operation) error {
+	if op.Path == "" {
+		cxfw.LogToFile("ERROR: Invalid remove_dir operation, missing path")
+		return fmt.Errorf("invalid remove_dir operation, missing path")
+	}
+
+	dir := filepath.Clean(op.Path)
+	if !filepath.IsAbs(dir) || slices.Contains(protectedDirs, cxfw.ImagePath(dir)) || cxfw.ImagePath(dir) == cxfw.BackupDir {
+		cxfw.LogToFile("ERROR: Refusing to remove protected directory - " + dir)
+		return fmt.Errorf("refusing to remove protected directory %s", dir)
+	}
+
+	info, err := os.Lstat(dir)
+	if os.IsNotExist(err) {
+		cxfw.LogToFile("WARNING: Directory does not exist, nothing to remove - " + dir)
+		return nil
+	} else if err != nil {
+		cxfw.LogToFile("ERROR: Failed to check directory - " + err.Error())
+		return fmt.Errorf("failed to check directory: %w", err)
+	} else if !info.IsDir() {
+		cxfw.LogToFile("ERROR: Not a directory - " + dir)
+		return fmt.Errorf("not a directory: %s", dir)
+	}
+
+	// Step 1: Archive the whole tree, databases included, into the backup directory
+	hostBackupDir := cxfw.HostPath(cxfw.BackupDir)
+	if err := os.MkdirAll(hostBackupDir, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create backup directory - " + err.Error())
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	flattened := strings.ReplaceAll(cxfw.ImagePath(dir), "/", "_")
+	archivePath := filepath.Join(hostBackupDir, flattened+".tar.gz")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+			break
 		}
+		archivePath = filepath.Join(hostBackupDir, fmt.Sprintf("%s.%d.tar.gz", flattened, i))
+	}
 
-		if backupChecksum != originalChecksum {
-			logToFile("ERROR: Backup checksum mismatch for " + backupPath)
-			os.Exit(1)
-		}
-		logToFile("SUCCESS: File backed up successfully - " + backupPath)
-	} else if os.IsNotExist(err) {
-		logToFile("WARNING: File does not exist, skipping backup - " + op.Path)
-	} else {
-		logToFile("ERROR: Failed to check file existence - " + err.Error())
-		os.Exit(1)
+	cxfw.LogToFile("INFO: Archiving directory to backup: " + dir + " -> " + archivePath)
+	if err := archiveDir(dir, archivePath); err != nil {
+		os.Remove(archivePath)
+		cxfw.LogToFile("ERROR: Failed to archive directory - " + err.Error())
+		return fmt.Errorf("failed to archive directory: %w", err)
+	}
+	archiveChecksum, err := cxfw.ComputeChecksum(archivePath)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to compute archive checksum - " + err.Error())
+		return fmt.Errorf("failed to compute archive checksum: %w", err)
+	}
+	if err := cxfw.RecordBackup(hostBackupDir, cxfw.BackupRecord{Path: dir, Backup: archivePath, Checksum: archiveChecksum}); err != nil {
+		cxfw.LogToFile("ERROR: Failed to record backup - " + err.Error())
+		return fmt.Errorf("failed to record backup: %w", err)
 	}
 
-	// Step 3: Remove hash from integrity database and update folder-specific JSON
-	if _, err := os.Stat(op.Path); err == nil {
-		dbHash, err := removeFromIntegrityDatabase(op.Path)
-		if err != nil {
-			logToFile("ERROR: Failed to update integrity database - " + err.Error())
-			return fmt.Errorf("failed to update integrity database: %w", err)
+	// Step 2: Drop the entries of every contained file and the folder files
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() {
+			return err
 		}
-
-		dir := filepath.Dir(op.Path)
-		err = updateFolderFile(dir, dbHash)
-		if err != nil {
-			logToFile("ERROR: Failed to update folder file - " + err.Error())
-			return fmt.Errorf("failed to update folder file: %w", err)
+		if err := cxfw.ClearIntegrityDatabase(path); err != nil {
+			return err
+		}
+		folderFile := filepath.Join(path, "."+filepath.Base(path)+".json")
+		if err := os.Remove(folderFile); err != nil && !os.IsNotExist(err) {
+			return err
 		}
+		return nil
+	})
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
 	}
 
-	// Remove the original file
-	logToFile("INFO: Removing file " + op.Path)
-	if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
-		logToFile("ERROR: Failed to remove file - " + err.Error())
-		return fmt.Errorf("failed to remove file: %w", err)
+	// Step 3: Remove the tree
+	cxfw.LogToFile("INFO: Removing directory " + dir)
+	if err := os.RemoveAll(dir); err != nil {
+		cxfw.LogToFile("ERROR: Failed to remove directory - " + err.Error())
+		return fmt.Errorf("failed to remove directory: %w", err)
 	}
 
-	logToFile("SUCCESS: File removed successfully - " + op.Path)
+	cxfw.LogToFile("SUCCESS: Directory removed successfully - " + dir)
 	return nil
 }
 
-func removeFromIntegrityDatabase(filePath string) (string, error) {
-	dir := filepath.Dir(filePath)
-	dbPath := filepath.Join(dir, ".db.json")
-
-	key, err := extractKeyFromImage()
+// archiveDir writes dir, including hidden database files, as a gzip tar to
+// archivePath. Entries are stored relative to dir's parent.
+func archiveDir(dir, archivePath string) error {
+	file, err := os.Create(archivePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to extract key: %w", err)
+		return cxfw.ClassifyWriteError(archivePath, 0, err)
 	}
+	defer file.Close()
 
-	var entries []IntegrityEntry
-	if _, err := os.Stat(dbPath); err == nil {
-		encryptedData, err := os.ReadFile(dbPath)
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	parent := filepath.Dir(dir)
+
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
 		if err != nil {
-			return "", fmt.Errorf("failed to read encrypted db file: %w", err)
+			return err
 		}
-
-		decryptedData, err := decryptFile(key, encryptedData)
+		info, err := entry.Info()
 		if err != nil {
-			return "", fmt.Errorf("failed to decrypt db file: %w", err)
+			return err
 		}
-
-		err = json.Unmarshal(decryptedData, &entries)
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
 		if err != nil {
-			return "", fmt.Errorf("failed to unmarshal db data: %w", err)
+			return err
+		}
+		if header.Name, err = filepath.Rel(parent, path); err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
 		}
-	} else if !os.IsNotExist(err) {
-		return "", fmt.Errorf("failed to check db file existence: %w", err)
-	}
 
-	// Remove the entry for the file
-	updatedEntries := []IntegrityEntry{}
-	found := false
-	for _, entry := range entries {
-		if entry.Path != filePath {
-			updatedEntries = append(updatedEntries, entry)
-		} else {
-			found = true
+		src, err := os.Open(path)
+		if err != nil {
+			return err
 		}
+		defer src.Close()
+		_, err = io.CopyBuffer(tw, src, cxfw.NewCopyBuffer())
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
 	}
-
-	if !found && len(entries) > 0 {
-		logToFile("WARNING: File hash not found in integrity database - " + filePath)
+	if err == nil {
+		err = gz.Close()
 	}
-
-	// Marshal updated data
-	updatedJSON, err := json.MarshalIndent(updatedEntries, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal updated db: %w", err)
+	if err == nil {
+		err = file.Sync()
 	}
-
-	// Encrypt and write back
-	encryptedData, err := encryptFile(key, updatedJSON)
 	if err != nil {
-		return "", fmt.Errorf("failed to encrypt updated db: %w", err)
+		return cxfw.ClassifyWriteError(archivePath, 0, err)
 	}
+	return nil
+}
 
-	err = os.WriteFile(dbPath, encryptedData, 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to write encrypted db: %w", err)
+// executeCommand runs op.Command through the shell, or runs op.Argv[0]
+// directly with the remaining elements as its arguments. The argv form
+// involves no shell, so arguments are never split, globbed or expanded.
+func executeCommand(op cxfw.Operation) error {
+	if (op.Command == "") == (len(op.Argv) == 0) || (len(op.Argv) > 0 && op.Argv[0] == "") {
+		cxfw.LogToFile("ERROR: Invalid command operation, expected either command or a non-empty argv")
+		return fmt.Errorf("invalid command operation, expected either command or a non-empty argv")
+	}
+
+	// Command lines can carry credentials, so only DEBUG shows them in full
+	argv := []string{"sh", "-c", op.Command}
+	if len(op.Argv) > 0 {
+		cxfw.LogToFile("INFO: Executing command " + filepath.Base(op.Argv[0]))
+		cxfw.LogToFile(fmt.Sprintf("DEBUG: Command line: %q", op.Argv))
+		argv = op.Argv
+	} else {
+		cxfw.LogToFile("INFO: Executing shell command")
+		cxfw.LogToFile("DEBUG: Command line: " + op.Command)
 	}
 
-	// Calculate hash of encrypted .db.json
-	dbHash, err := computeChecksum(dbPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to compute db hash: %w", err)
+	err := runProcess(op, argv[0], argv[1:]...)
+	if code, ok := expectedExit(op, err); ok {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Command exited with expected code %d", code))
+		err = nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		cxfw.LogToFile("ERROR: Command " + err.Error() + ", process group killed")
+		return fmt.Errorf("command %w", err)
+	} else if err != nil {
+		cxfw.LogToFile("ERROR: Command execution failed - " + err.Error())
+		return fmt.Errorf("command execution failed: %w", err)
 	}
 
-	logToFile("INFO: Integrity database updated - removed entry for " + filePath)
-	return dbHash, nil
+	cxfw.LogToFile("SUCCESS: Command executed successfully")
+	return nil
 }
 
-func executeCommand(op Operation) error {
-	if op.Command == "" {
-		logToFile("ERROR: Invalid command operation, missing command")
-		return fmt.Errorf("invalid command operation, missing command")
+// scriptBody returns the script a script operation runs: op.Script, the
+// decoded op.ScriptBase64 or the file op.Source shipped in the bundle. It
+// must match op.Checksum, which a shipped file needs.
+func scriptBody(op cxfw.Operation) ([]byte, error) {
+	given := 0
+	for _, field := range []string{op.Source, op.Script, op.ScriptBase64} {
+		if field != "" {
+			given++
+		}
 	}
 
-	logToFile("INFO: Executing command: " + op.Command)
-	cmd := exec.Command("sh", "-c", op.Command)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		logToFile("ERROR: Command execution failed - " + err.Error())
-		return fmt.Errorf("command execution failed: %w", err)
+	var body []byte
+	var err error
+	switch {
+	case given != 1:
+		return nil, fmt.Errorf("expected exactly one of source, script_content and script_content_base64")
+	case op.Source != "" && op.Checksum == "":
+		return nil, fmt.Errorf("source needs a checksum")
+	case op.Source != "":
+		if body, err = os.ReadFile(op.Source); err != nil {
+			return nil, fmt.Errorf("failed to read script: %w", err)
+		}
+	case op.ScriptBase64 != "":
+		if body, err = base64.StdEncoding.DecodeString(op.ScriptBase64); err != nil {
+			return nil, fmt.Errorf("invalid script_content_base64: %w", err)
+		}
+	default:
+		body = []byte(op.Script)
 	}
 
-	logToFile("SUCCESS: Command executed successfully")
-	return nil
+	if op.Checksum != "" {
+		sum := sha256.Sum256(body)
+		if checksum := hex.EncodeToString(sum[:]); checksum != op.Checksum {
+			return nil, fmt.Errorf("%w for script: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Checksum, checksum)
+		}
+	}
+	return body, nil
 }
 
-func executeScript(op Operation) error {
-	if op.Script == "" {
-		logToFile("ERROR: Invalid script operation, missing script content")
-		return fmt.Errorf("invalid script operation, missing script content")
+// executeScript runs the script of op from a private temporary file rather
+// than through sh -c, so scripts of any size work and a shebang picks the
+// interpreter.
+func executeScript(op cxfw.Operation) error {
+	// Step 1: Resolve the script and verify it, on the bytes that will run
+	body, err := scriptBody(op)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Cannot run script - " + err.Error())
+		return fmt.Errorf("cannot run script: %w", err)
 	}
 
-	logToFile("INFO: Executing script")
-	cmd := exec.Command("sh", "-c", op.Script)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
-		logToFile("ERROR: Script execution failed - " + err.Error())
+	// Step 2: Run it
+	if op.Source != "" {
+		cxfw.LogToFile("INFO: Executing script " + op.Source)
+	} else {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Executing script (%d bytes)", len(body)))
+	}
+	err = runScript(op, body)
+	if code, ok := expectedExit(op, err); ok {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Script exited with expected code %d", code))
+		err = nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		cxfw.LogToFile("ERROR: Script " + err.Error() + ", process group killed")
+		return fmt.Errorf("script %w", err)
+	} else if err != nil {
+		cxfw.LogToFile("ERROR: Script execution failed - " + err.Error())
 		return fmt.Errorf("script execution failed: %w", err)
 	}
 
-	logToFile("SUCCESS: Script executed successfully")
+	cxfw.LogToFile("SUCCESS: Script executed successfully")
 	return nil
 }
 
-func modifyDefaults(op Operation) error {
-	if len(op.Entries) == 0 {
-		logToFile("ERROR: Invalid modify_defaults operation, missing entries")
-		return fmt.Errorf("invalid modify_defaults operation, missing entries")
+// createFile writes a small file whose body is carried in the manifest, in
+// content_base64, content or script_content, and records it in the
+// integrity database like an added file.
+func createFile(op cxfw.Operation) error {
+	if op.Path == "" || op.Checksum == "" {
+		cxfw.LogToFile("ERROR: Invalid create_file operation, missing path or checksum")
+		return fmt.Errorf("invalid create_file operation, missing path or checksum")
+	}
+
+	var body []byte
+	switch {
+	case op.ContentBase64 != "" && (op.Content != "" || op.Script != ""), op.Content != "" && op.Script != "":
+		cxfw.LogToFile("ERROR: Invalid create_file operation, more than one of content_base64, content and script_content")
+		return fmt.Errorf("invalid create_file operation, more than one of content_base64, content and script_content")
+	case op.ContentBase64 != "":
+		decoded, err := base64.StdEncoding.DecodeString(op.ContentBase64)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Invalid content_base64 - " + err.Error())
+			return fmt.Errorf("invalid content_base64: %w", err)
+		}
+		body = decoded
+	case op.Content != "":
+		body = []byte(op.Content)
+	default:
+		body = []byte(op.Script)
 	}
 
-	defaultsFile := "/sda1/data/.defaultvalues"
-	tempFile := defaultsFile + ".tmp"
-
-	input, err := os.ReadFile(defaultsFile)
+	mode := os.FileMode(0644)
+	if op.Mode != "" {
+		parsed, err := parseMode(op.Mode)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Invalid mode " + op.Mode)
+			return err
+		}
+		mode = parsed
+	}
+	mode, err := clampMode(op.Path, mode)
 	if err != nil {
-		logToFile("ERROR: Failed to read defaults file - " + err.Error())
-		return fmt.Errorf("failed to read defaults file: %w", err)
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
 	}
 
-	lines := strings.Split(string(input), "\n")
-	modifiedLines := []string{}
-	modifiedEntries := make(map[string]bool)
-
-	// Extract key-value pairs from JSON (handling nested "global" structure)
-	flatEntries := make(map[string]string)
-	for _, section := range op.Entries {
-		for key, value := range section {
-			flatEntries[key] = value
-		}
+	// Step 1: Verify the decoded content before touching the file
+	sum := sha256.Sum256(body)
+	if checksum := hex.EncodeToString(sum[:]); checksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for content of " + op.Path)
+		return fmt.Errorf("%w for content of %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Path, op.Checksum, checksum)
 	}
 
-	// Modify existing entries
-	for _, line := range lines {
-		keyValue := strings.SplitN(line, "=", 2)
-		if len(keyValue) == 2 {
-			key := strings.TrimSpace(keyValue[0])
-			if value, exists := flatEntries[key]; exists {
-				// Update the entry
-				modifiedLines = append(modifiedLines, key+"="+value)
-				modifiedEntries[key] = true
-				continue
-			}
-		}
-		// Keep unchanged lines
-		modifiedLines = append(modifiedLines, line)
+	// Step 2: Write the file atomically
+	dir := filepath.Dir(op.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + dir)
+		return fmt.Errorf("failed to create directory: %w", err)
 	}
-
-	// Append new entries if they were not modified
-	for key, value := range flatEntries {
-		if !modifiedEntries[key] {
-			modifiedLines = append(modifiedLines, key+"="+value)
-		}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Creating file %s (%d bytes, mode %04o)", op.Path, len(body), mode))
+	if err := cxfw.WriteFileAtomic(op.Path, body, mode); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write file - " + err.Error())
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := os.Chmod(op.Path, mode); err != nil {
+		cxfw.LogToFile("ERROR: Failed to set mode - " + err.Error())
+		return fmt.Errorf("failed to set mode: %w", err)
 	}
 
-	// Write back the modified file
-	err = os.WriteFile(tempFile, []byte(strings.Join(modifiedLines, "\n")), 0644)
+	// Step 3: Verify checksum of the written file
+	writtenChecksum, err := cxfw.ComputeChecksum(op.Path)
 	if err != nil {
-		logToFile("ERROR: Failed to write temp defaults file - " + err.Error())
-		return fmt.Errorf("failed to write temp defaults file: %w", err)
+		cxfw.LogToFile("ERROR: Failed to compute checksum of written file - " + err.Error())
+		return fmt.Errorf("failed to compute checksum of written file: %w", err)
+	}
+	if writtenChecksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for written file " + op.Path)
+		return fmt.Errorf("%w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Path, op.Checksum, writtenChecksum)
 	}
 
-	// Replace original file
-	err = os.Rename(tempFile, defaultsFile)
+	// Step 4: Update integrity database and folder-specific JSON file
+	dbHash, err := cxfw.UpdateIntegrityDatabase(op.Path, writtenChecksum)
 	if err != nil {
-		logToFile("ERROR: Failed to replace defaults file - " + err.Error())
-		return fmt.Errorf("failed to replace defaults file: %w", err)
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
+	}
+	if err := cxfw.UpdateFolderFile(dir, dbHash); err != nil {
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+		return fmt.Errorf("failed to update folder file: %w", err)
 	}
 
-	logToFile("SUCCESS: .defaultvalues file updated")
+	cxfw.LogToFile("SUCCESS: File created and verified successfully - " + op.Path)
 	return nil
 }
 
-func updateIntegrityDatabase(filePath, hash string) (string, error) {
-	dir := filepath.Dir(filePath)
-	dbPath := filepath.Join(dir, ".db.json")
-
-	key, err := extractKeyFromImage()
-	if err != nil {
-		return "", fmt.Errorf("failed to extract key: %w", err)
+func appendToFile(op cxfw.Operation) error {
+	if op.Path == "" || op.Content == "" {
+		cxfw.LogToFile("ERROR: Invalid append operation, missing path or content")
+		return fmt.Errorf("invalid append operation, missing path or content")
 	}
 
-	var entries []IntegrityEntry
-	if _, err := os.Stat(dbPath); err == nil {
-		encryptedData, err := os.ReadFile(dbPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to read encrypted db file: %w", err)
-		}
+	block := strings.TrimSuffix(op.Content, "\n") + "\n"
+	mode := os.FileMode(0644)
 
-		decryptedData, err := decryptFile(key, encryptedData)
-		if err != nil {
-			return "", fmt.Errorf("failed to decrypt db file: %w", err)
+	existing, err := os.ReadFile(op.Path)
+	if os.IsNotExist(err) {
+		if !op.Create {
+			cxfw.LogToFile("ERROR: File to append to does not exist - " + op.Path)
+			return fmt.Errorf("file to append to does not exist: %s", op.Path)
 		}
-
-		err = json.Unmarshal(decryptedData, &entries)
+		cxfw.LogToFile("INFO: Creating file " + op.Path)
+	} else if err != nil {
+		cxfw.LogToFile("ERROR: Failed to read file - " + err.Error())
+		return fmt.Errorf("failed to read file: %w", err)
+	} else {
+		info, err := os.Stat(op.Path)
 		if err != nil {
-			return "", fmt.Errorf("failed to unmarshal db data: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		return "", fmt.Errorf("failed to check db file existence: %w", err)
-	}
-
-	// Check for existing entry by path and hash
-	for i, entry := range entries {
-		if entry.Path == filePath {
-			if entry.Hash == hash {
-				logToFile("INFO: File already exists with matching hash in database - " + filePath)
-				// Return current .db.json hash without modification
-				dbHash, err := computeChecksum(dbPath)
-				if err != nil {
-					return "", fmt.Errorf("failed to compute db hash: %w", err)
-				}
-				return dbHash, nil
-			}
-			// Update hash if path matches but hash differs
-			entries[i].Hash = hash
-			logToFile("INFO: Updated existing file hash in database - " + filePath)
-			goto writeUpdate
+			return fmt.Errorf("failed to stat file: %w", err)
 		}
+		mode = info.Mode().Perm()
 	}
 
-	// Add new entry if no match found
-	entries = append(entries, IntegrityEntry{
-		Path: filePath,
-		Hash: hash,
-	})
-	logToFile("INFO: Added new file entry to database - " + filePath)
+	content := string(existing)
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
 
-writeUpdate:
-	// Marshal updated data
-	updatedJSON, err := json.MarshalIndent(entries, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal updated db: %w", err)
+	// The block counts as present only when it starts on a line boundary
+	if strings.Contains("\n"+content, "\n"+block) {
+		cxfw.LogToFile("INFO: Block already present, skipped append - " + op.Path)
+		return nil
 	}
 
-	// Encrypt and write back
-	encryptedData, err := encryptFile(key, updatedJSON)
-	if err != nil {
-		return "", fmt.Errorf("failed to encrypt updated db: %w", err)
+	if err := cxfw.WriteFileAtomic(op.Path, []byte(content+block), mode); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write file - " + err.Error())
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 
-	err = os.WriteFile(dbPath, encryptedData, 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to write encrypted db: %w", err)
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: Appended %d lines to %s", strings.Count(block, "\n"), op.Path))
+	return nil
+}
+
+func replaceText(op cxfw.Operation) error {
+	if op.Path == "" || op.Pattern == "" {
+		cxfw.LogToFile("ERROR: Invalid replace_text operation, missing path or pattern")
+		return fmt.Errorf("invalid replace_text operation, missing path or pattern")
 	}
 
-	// Calculate hash of encrypted .db.json
-	dbHash, err := computeChecksum(dbPath)
+	re, err := regexp.Compile(op.Pattern)
 	if err != nil {
-		return "", fmt.Errorf("failed to compute db hash: %w", err)
+		cxfw.LogToFile("ERROR: Invalid replace_text pattern - " + err.Error())
+		return fmt.Errorf("invalid replace_text pattern: %w", err)
 	}
 
-	return dbHash, nil
-}
-
-func updateFolderFile(dir, dbHash string) error {
-	// Extract folder name and construct the specific JSON filename
-	folderName := filepath.Base(dir)
-	folderFile := filepath.Join(dir, "."+folderName+".json") // e.g., .apps.json, .basic.json
-	dbPath := filepath.Join(dir, ".db.json")                 // Path to .db.json
-
-	key, err := extractKeyFromImage()
+	info, err := os.Stat(op.Path)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to stat file - " + err.Error())
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	input, err := os.ReadFile(op.Path)
 	if err != nil {
-		return fmt.Errorf("failed to extract key: %w", err)
+		cxfw.LogToFile("ERROR: Failed to read file - " + err.Error())
+		return fmt.Errorf("failed to read file: %w", err)
 	}
+	beforeChecksum := fmt.Sprintf("%x", sha256.Sum256(input))
 
-	// Read and decrypt existing folder-specific JSON
-	var folderData FolderEntry
-	if _, err := os.Stat(folderFile); err == nil {
-		encryptedData, err := os.ReadFile(folderFile)
-		if err != nil {
-			return fmt.Errorf("failed to read encrypted folder file: %w", err)
+	// A count of zero replaces every match
+	limit := -1
+	if op.Count > 0 {
+		limit = op.Count
+	}
+	matches := re.FindAllSubmatchIndex(input, limit)
+	if len(matches) == 0 {
+		if op.AllowNoMatch {
+			cxfw.LogToFile("INFO: Pattern did not match, file left unchanged - " + op.Path)
+			return nil
 		}
+		cxfw.LogToFile("ERROR: Pattern did not match anything in " + op.Path)
+		return fmt.Errorf("pattern %q did not match anything in %s", op.Pattern, op.Path)
+	}
 
-		decryptedData, err := decryptFile(key, encryptedData)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt folder file: %w", err)
-		}
+	var output []byte
+	last := 0
+	for _, match := range matches {
+		output = append(output, input[last:match[0]]...)
+		output = re.Expand(output, []byte(op.Replacement), input, match)
+		last = match[1]
+	}
+	output = append(output, input[last:]...)
 
-		err = json.Unmarshal(decryptedData, &folderData)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal folder data: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		return fmt.Errorf("failed to check folder file existence: %w", err)
-	} else {
-		// If file doesn't exist, initialize with the correct path
-		folderData.Path = dbPath
+	if err := cxfw.WriteFileAtomic(op.Path, output, info.Mode().Perm()); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write file - " + err.Error())
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 
-	// Update the hash value (path remains constant)
-	folderData.Hash = dbHash
+	afterChecksum := fmt.Sprintf("%x", sha256.Sum256(output))
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: Replaced %d matches in %s (checksum %s -> %s)", len(matches), op.Path, beforeChecksum, afterChecksum))
+	return nil
+}
+
+func patchFile(op cxfw.Operation) error {
+	diff := op.Diff
+	if diff == "" {
+		diff = op.Script
+	}
+	if op.Path == "" || diff == "" || op.Checksum == "" {
+		cxfw.LogToFile("ERROR: Invalid patch operation, missing path, diff or checksum")
+		return fmt.Errorf("invalid patch operation, missing path, diff or checksum")
+	}
 
-	// Marshal updated data
-	updatedJSON, err := json.MarshalIndent(folderData, "", "  ")
+	hunks, err := parseUnifiedDiff(diff)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated folder data: %w", err)
+		cxfw.LogToFile("ERROR: Failed to parse diff - " + err.Error())
+		return fmt.Errorf("failed to parse diff: %w", err)
 	}
 
-	// Encrypt and write back
-	encryptedData, err := encryptFile(key, updatedJSON)
+	info, err := os.Stat(op.Path)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to stat file - " + err.Error())
+		return fmt.Errorf("failed to stat file: %w", err)
+	}
+	input, err := os.ReadFile(op.Path)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt updated folder data: %w", err)
+		cxfw.LogToFile("ERROR: Failed to read file - " + err.Error())
+		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	err = os.WriteFile(folderFile, encryptedData, 0644)
+	output, err := applyUnifiedDiff(string(input), hunks)
 	if err != nil {
-		return fmt.Errorf("failed to write encrypted folder file: %w", err)
+		cxfw.LogToFile("ERROR: Diff does not apply to " + op.Path + ", file left untouched - " + err.Error())
+		return fmt.Errorf("diff does not apply to %s: %w", op.Path, err)
+	}
+
+	resultChecksum := fmt.Sprintf("%x", sha256.Sum256([]byte(output)))
+	if resultChecksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for patched file " + op.Path + ", file left untouched")
+		return fmt.Errorf("%w for patched %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Path, op.Checksum, resultChecksum)
+	}
+
+	if err := cxfw.WriteFileAtomic(op.Path, []byte(output), info.Mode().Perm()); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write file - " + err.Error())
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 
-	logToFile("INFO: Folder database updated with db hash: " + dbHash)
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: Applied %d hunks to %s", len(hunks), op.Path))
 	return nil
 }
 
-// Ensure these helper functions are present
-func extractKeyFromImage() ([]byte, error) {
-	tempKeyFile := "/tmp/extracted_key.txt"
-	cmd := exec.Command("steghide", "extract", "-sf", "/sda1/data/.gems.jpeg", "-xf", tempKeyFile, "-p", "Sundyne@123")
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("steghide extraction failed: %v", err)
+// verifyPath asserts the state of a path without modifying anything: with
+// absent set the path must not exist, with a checksum it must be a file with
+// that content, and otherwise it only has to exist.
+func verifyPath(op cxfw.Operation) error {
+	if op.Path == "" {
+		cxfw.LogToFile("ERROR: Invalid verify operation, missing path")
+		return fmt.Errorf("invalid verify operation, missing path")
+	}
+	if op.Absent && op.Checksum != "" {
+		cxfw.LogToFile("ERROR: Invalid verify operation, absent and checksum are mutually exclusive")
+		return fmt.Errorf("invalid verify operation, absent and checksum are mutually exclusive")
+	}
+
+	info, err := os.Lstat(op.Path)
+	if err != nil && !os.IsNotExist(err) {
+		cxfw.LogToFile("ERROR: Failed to check path - " + err.Error())
+		return fmt.Errorf("failed to check path: %w", err)
+	}
+	exists := err == nil
+
+	if op.Absent {
+		if exists {
+			cxfw.LogToFile("ERROR: Verification failed, path should not exist - " + op.Path)
+			return fmt.Errorf("verification failed: %s exists", op.Path)
+		}
+		cxfw.LogToFile("SUCCESS: Verified absent - " + op.Path)
+		return nil
+	}
+	if !exists {
+		cxfw.LogToFile("ERROR: Verification failed, path does not exist - " + op.Path)
+		return fmt.Errorf("verification failed: %s does not exist", op.Path)
+	}
+	if op.Checksum == "" {
+		cxfw.LogToFile("SUCCESS: Verified present - " + op.Path)
+		return nil
+	}
+
+	if !info.Mode().IsRegular() {
+		cxfw.LogToFile("ERROR: Verification failed, not a regular file - " + op.Path)
+		return fmt.Errorf("verification failed: %s is not a regular file", op.Path)
 	}
-	defer os.Remove(tempKeyFile)
-	key, err := os.ReadFile(tempKeyFile)
+	checksum, err := cxfw.ComputeChecksum(op.Path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read extracted key: %v", err)
+		cxfw.LogToFile("ERROR: Failed to compute checksum - " + err.Error())
+		return fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	if checksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Verification failed, checksum mismatch for " + op.Path + " - expected " + op.Checksum + ", got " + checksum)
+		return fmt.Errorf("verification failed: %w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, op.Path, op.Checksum, checksum)
 	}
-	return key, nil
+	cxfw.LogToFile("SUCCESS: Verified checksum - " + op.Path)
+	return nil
 }
 
-func decryptFile(key, encryptedData []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+func modifyDefaults(op cxfw.Operation) error {
+	if len(op.Entries) == 0 {
+		cxfw.LogToFile("ERROR: Invalid modify_defaults operation, missing entries")
+		return fmt.Errorf("invalid modify_defaults operation, missing entries")
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	defaultsFile := cxfw.HostPath("/sda1/data/.defaultvalues")
+
+	input, err := os.ReadFile(defaultsFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %v", err)
+		cxfw.LogToFile("ERROR: Failed to read defaults file - " + err.Error())
+		return fmt.Errorf("failed to read defaults file: %w", err)
 	}
 
-	nonceSize := gcm.NonceSize()
-	if len(encryptedData) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
+	lines := strings.Split(string(input), "\n")
+	modifiedLines := []string{}
+	modifiedEntries := make(map[string]bool)
+
+	// Extract key-value pairs from JSON (handling nested "global" structure)
+	flatEntries := make(map[string]string)
+	for _, section := range op.Entries {
+		for key, value := range section {
+			flatEntries[key] = value
+		}
 	}
 
-	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("decryption failed: %v", err)
+	// Modify existing entries
+	for _, line := range lines {
+		keyValue := strings.SplitN(line, "=", 2)
+		if len(keyValue) == 2 {
+			key := strings.TrimSpace(keyValue[0])
+			if value, exists := flatEntries[key]; exists {
+				// Update the entry
+				modifiedLines = append(modifiedLines, key+"="+value)
+				modifiedEntries[key] = true
+				continue
+			}
+		}
+		// Keep unchanged lines
+		modifiedLines = append(modifiedLines, line)
 	}
-	return plaintext, nil
-}
 
-func encryptFile(key, plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	// Append new entries if they were not modified
+	for key, value := range flatEntries {
+		if !modifiedEntries[key] {
+			modifiedLines = append(modifiedLines, key+"="+value)
+		}
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	// Write back the modified file via a temp file and rename
+	err = cxfw.WriteFileAtomic(defaultsFile, []byte(strings.Join(modifiedLines, "\n")), 0644)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+		cxfw.LogToFile("ERROR: Failed to replace defaults file - " + err.Error())
+		return fmt.Errorf("failed to replace defaults file: %w", err)
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
+	cxfw.LogToFile("SUCCESS: .defaultvalues file updated")
+	return nil
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+// operationNeedsKey reports whether op reads or writes the encrypted
+// integrity databases.
+func operationNeedsKey(op cxfw.Operation) bool {
+	switch op.Operation {
+	case "add", "copy", "remove", "remove_dir", "cleanup", "extract_tar", "delta", "download", "replace_image", "create_file",
+		"snapshot_integrity", "restore_integrity":
+		return true
+	}
+	return false
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultMetricsFile is where node_exporter's textfile collector picks up
+// the metrics of the last run, unless --metrics-file names another file.
+const defaultMetricsFile = "/var/lib/node_exporter/textfile/cxfw_patch.prom"
+
+// metricsPath is the metrics file of the run, or empty for none.
+var metricsPath string
+
+// operationStatus maps the state of an operation to the status label of
+// cxfw_patch_operations_total.
+func operationStatus(state string) string {
+	switch state {
+	case cxfw.OpSucceeded, cxfw.OpSkippedAlreadySatisfied:
+		return "success"
+	case cxfw.OpFailed, cxfw.OpFailedAllowed:
+		return "failed"
+	}
+	return "skipped"
+}
+
+// writeMetrics replaces the metrics file with the outcome of the finished
+// run. Validation runs change nothing and leave it alone, and so does a
+// device without the collector's directory. Failing to write it never
+// fails the run.
+func writeMetrics(code int) {
+	if metricsPath == "" || cxfw.RunReport.Mode != "apply" {
+		return
+	}
+	if _, err := os.Stat(filepath.Dir(metricsPath)); os.IsNotExist(err) {
+		cxfw.LogToFile("DEBUG: No metrics written, " + filepath.Dir(metricsPath) + " does not exist")
+		return
+	}
+
+	counts := map[string]int{"success": 0, "failed": 0, "skipped": 0}
+	for _, result := range cxfw.RunReport.Operations {
+		counts[operationStatus(result.State)]++
+	}
+	success := 0
+	if code == 0 {
+		success = 1
+	}
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP cxfw_patch_last_run_timestamp Unix time the last patch run finished.")
+	fmt.Fprintln(&b, "# TYPE cxfw_patch_last_run_timestamp gauge")
+	fmt.Fprintf(&b, "cxfw_patch_last_run_timestamp %d\n", cxfw.RunReport.FinishedAt.Unix())
+	fmt.Fprintln(&b, "# HELP cxfw_patch_last_run_success Whether the last patch run succeeded.")
+	fmt.Fprintln(&b, "# TYPE cxfw_patch_last_run_success gauge")
+	fmt.Fprintf(&b, "cxfw_patch_last_run_success %d\n", success)
+	fmt.Fprintln(&b, "# HELP cxfw_patch_operations_total Operations of the last patch run by status.")
+	fmt.Fprintln(&b, "# TYPE cxfw_patch_operations_total gauge")
+	for _, status := range []string{"success", "failed", "skipped"} {
+		fmt.Fprintf(&b, "cxfw_patch_operations_total{status=%q} %d\n", status, counts[status])
+	}
+	fmt.Fprintln(&b, "# HELP cxfw_patch_duration_seconds Wall time of the last patch run.")
+	fmt.Fprintln(&b, "# TYPE cxfw_patch_duration_seconds gauge")
+	fmt.Fprintf(&b, "cxfw_patch_duration_seconds %.3f\n", float64(cxfw.RunReport.DurationMs)/1000)
+	fmt.Fprintln(&b, "# HELP cxfw_patch_manifest_version Manifest version of the last patch run.")
+	fmt.Fprintln(&b, "# TYPE cxfw_patch_manifest_version gauge")
+	fmt.Fprintf(&b, "cxfw_patch_manifest_version{version=\"%s\"} 1\n", metricLabel(cxfw.RunReport.ManifestVersion))
+
+	// The temporary file does not end in .prom, so the collector skips it
+	if err := cxfw.WriteFileAtomic(metricsPath, []byte(b.String()), 0644); err != nil {
+		cxfw.LogToFile("WARNING: Failed to write metrics - " + err.Error())
+	} else {
+		cxfw.LogToFile("INFO: Metrics written to " + metricsPath)
+	}
+}
+
+// metricLabel escapes value for a Prometheus label.
+func metricLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
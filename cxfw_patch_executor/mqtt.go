@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultMQTTTopicPrefix is the topic prefix of the status messages unless
+// --mqtt-topic-prefix gives another.
+const defaultMQTTTopicPrefix = "cxfw/patch"
+
+// mqttTimeout bounds connecting to the broker and every publish; after a
+// failure the broker is left alone for mqttRetryInterval so an unreachable
+// broker cannot slow every operation down.
+const (
+	mqttTimeout       = 5 * time.Second
+	mqttRetryInterval = 30 * time.Second
+)
+
+// mqttConfig is the broker status messages are published to, from the
+// --mqtt-* flags. Broker is an mqtt:// or mqtts:// URL, or empty for none.
+type mqttConfig struct {
+	Broker      string
+	TopicPrefix string
+	CACert      string
+	ClientCert  string
+	ClientKey   string
+}
+
+// mqttStatus is the retained status message published on the start of the
+// operations, after each operation and at the end of the run.
+type mqttStatus struct {
+	State           string                `json:"state"`
+	RunID           string                `json:"run_id"`
+	DeviceID        string                `json:"device_id,omitempty"`
+	ManifestVersion string                `json:"manifest_version,omitempty"`
+	Total           int                   `json:"total,omitempty"`
+	Operation       *cxfw.OperationResult `json:"operation,omitempty"`
+	ExitCode        *int                  `json:"exit_code,omitempty"`
+	UpdatedAt       time.Time             `json:"updated_at"`
+}
+
+// mqtt holds the publisher of the run: its settings, the address and TLS
+// configuration derived from them, and the connection while it is up.
+var mqtt struct {
+	config   mqttConfig
+	address  string
+	tls      *tls.Config
+	conn     net.Conn
+	failedAt time.Time
+	total    int
+}
+
+// setMQTT checks the broker settings and prepares the connection, which is
+// only made at the first publish.
+func setMQTT(config mqttConfig) error {
+	u, err := url.Parse(config.Broker)
+	if err != nil {
+		return fmt.Errorf("invalid MQTT broker: %w", err)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "mqtt", "tcp":
+		if port == "" {
+			port = "1883"
+		}
+	case "mqtts", "ssl":
+		if port == "" {
+			port = "8883"
+		}
+		mqtt.tls = &tls.Config{ServerName: u.Hostname()}
+		if config.CACert != "" {
+			data, err := os.ReadFile(config.CACert)
+			if err != nil {
+				return fmt.Errorf("failed to read MQTT CA certificate: %w", err)
+			}
+			mqtt.tls.RootCAs = x509.NewCertPool()
+			if !mqtt.tls.RootCAs.AppendCertsFromPEM(data) {
+				return fmt.Errorf("no certificates in MQTT CA certificate %s", config.CACert)
+			}
+		}
+		if config.ClientCert != "" || config.ClientKey != "" {
+			certificate, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+			if err != nil {
+				return fmt.Errorf("failed to load MQTT client certificate: %w", err)
+			}
+			mqtt.tls.Certificates = []tls.Certificate{certificate}
+		}
+	default:
+		return fmt.Errorf("invalid MQTT broker %s, expected an mqtt:// or mqtts:// URL", config.Broker)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("invalid MQTT broker %s, no host", config.Broker)
+	}
+	mqtt.config, mqtt.address = config, net.JoinHostPort(u.Hostname(), port)
+	return nil
+}
+
+// publishStart publishes that the total operations of the run are starting.
+func publishStart(total int) {
+	mqtt.total = total
+	publishStatus(mqttStatus{State: "running"})
+}
+
+// publishOperation publishes the outcome of one operation.
+func publishOperation(result cxfw.OperationResult) {
+	publishStatus(mqttStatus{State: "running", Operation: &result})
+}
+
+// publishFinish publishes the outcome of the run and disconnects.
+func publishFinish(code int) {
+	publishStatus(mqttStatus{State: cxfw.RunReport.State, ExitCode: &code})
+	if mqtt.conn != nil {
+		mqtt.conn.SetDeadline(time.Now().Add(mqttTimeout))
+		mqtt.conn.Write([]byte{0xe0, 0x00})
+		mqtt.conn.Close()
+		mqtt.conn = nil
+	}
+}
+
+// publishStatus publishes status as the retained message of the status
+// topic, connecting first if needed. Broker problems are logged and never
+// fail the run.
+func publishStatus(status mqttStatus) {
+	if mqtt.address == "" {
+		return
+	}
+	if mqtt.conn == nil && time.Since(mqtt.failedAt) < mqttRetryInterval {
+		return
+	}
+	status.RunID, status.DeviceID, status.ManifestVersion = cxfw.RunID, cxfw.RunReport.DeviceID, cxfw.RunReport.ManifestVersion
+	status.Total, status.UpdatedAt = mqtt.total, time.Now().UTC()
+	payload, err := json.Marshal(status)
+	if err == nil && mqtt.conn == nil {
+		err = connectMQTT()
+	}
+	if err == nil {
+		err = writeMQTT(mqttPacket(0x31, mqttString(mqtt.config.TopicPrefix+"/status"), payload))
+	}
+	if err != nil {
+		cxfw.LogToFile("WARNING: Failed to publish status to MQTT broker " + mqtt.config.Broker + " - " + err.Error())
+		if mqtt.conn != nil {
+			mqtt.conn.Close()
+			mqtt.conn = nil
+		}
+		mqtt.failedAt = time.Now()
+	}
+}
+
+// connectMQTT connects to the broker with a clean session and no keep-alive,
+// since the run may go quiet for longer than any keep-alive interval.
+func connectMQTT() error {
+	dialer := &net.Dialer{Timeout: mqttTimeout}
+	var err error
+	if mqtt.tls != nil {
+		mqtt.conn, err = tls.DialWithDialer(dialer, "tcp", mqtt.address, mqtt.tls)
+	} else {
+		mqtt.conn, err = dialer.Dial("tcp", mqtt.address)
+	}
+	if err != nil {
+		mqtt.conn = nil
+		return err
+	}
+	// Protocol MQTT 3.1.1, clean session, keep-alive 0
+	header := append(mqttString("MQTT"), 0x04, 0x02, 0x00, 0x00)
+	if err := writeMQTT(mqttPacket(0x10, header, mqttString("cxfw-"+cxfw.RunID))); err != nil {
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(mqtt.conn, ack); err != nil {
+		return fmt.Errorf("no CONNACK from broker: %w", err)
+	}
+	if ack[0] != 0x20 || ack[3] != 0 {
+		return fmt.Errorf("broker refused connection with code %d", ack[3])
+	}
+	cxfw.LogToFile("INFO: Publishing status to MQTT broker " + mqtt.config.Broker)
+	return nil
+}
+
+// writeMQTT writes a packet to the broker within mqttTimeout.
+func writeMQTT(packet []byte) error {
+	mqtt.conn.SetDeadline(time.Now().Add(mqttTimeout))
+	_, err := mqtt.conn.Write(packet)
+	return err
+}
+
+// mqttPacket frames the parts of an MQTT packet of the type and flags in
+// first with its remaining length.
+func mqttPacket(first byte, parts ...[]byte) []byte {
+	length := 0
+	for _, part := range parts {
+		length += len(part)
+	}
+	packet := []byte{first}
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	for _, part := range parts {
+		packet = append(packet, part...)
+	}
+	return packet
+}
+
+// mqttString encodes s as an MQTT length-prefixed string.
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	"cxfw_common/cxfw"
+)
+
+// knownOperations lists the operations dispatchOperation handles.
+var knownOperations = []string{
+	"add", "copy", "remove", "remove_dir", "cleanup", "extract_tar", "delta", "create_file",
+	"append", "replace_text", "patch", "command", "script", "modify_defaults", "service",
+	"launcher", "kmod", "self_update", "verify", "download", "replace_image", "flash",
+	"remount", "install_cert", "cron", "reboot", "user", "snapshot_integrity", "restore_integrity",
+}
+
+// payloadOperations ship a payload or inline content that preflight checks.
+var payloadOperations = []string{
+	"add", "copy", "replace_image", "self_update", "flash", "delta", "extract_tar", "install_cert", "create_file",
+	"script",
+}
+
+// preflightProblem is one reason the patch cannot start.
+type preflightProblem struct {
+	index          int
+	reason, detail string
+}
+
+// preflightOperations checks the whole manifest before anything runs, so a
+// missing payload stops the patch before the first change rather than
+// halfway through. Every operation must be known and write only below the
+// writable roots, shipped payloads must exist with their declared size and
+// checksum, and the directories they are written to must be on a writable
+// filesystem. Payloads written by an earlier operation, e.g. a download,
+// and filesystems an earlier remount makes writable are taken on trust.
+// Every filesystem must keep spaceReserve free after taking the payloads
+// and the backups of replaced and removed files. Operations in completed,
+// which a resumed run skips, and operations --only and --skip leave out are
+// not checked. Every problem found is returned.
+func preflightOperations(ops []cxfw.Operation, completed map[int]bool) []preflightProblem {
+	var problems []preflightProblem
+	var produced, remounted []string
+	predictions := make([]prediction, len(ops))
+	for i, op := range ops {
+		op = cxfw.HostOperation(op)
+		if completed[i] || deselected[i] {
+			continue
+		}
+		writeErr := checkWritablePaths(op)
+		switch {
+		case !slices.Contains(knownOperations, op.Operation):
+			problems = append(problems, preflightProblem{i, cxfw.ReasonInvalidOperation, fmt.Sprintf("unknown operation %q", op.Operation)})
+		case writeErr != nil:
+			problems = append(problems, preflightProblem{i, cxfw.ReasonPolicyViolation, writeErr.Error()})
+		case operationTargetMismatch(op) != "" || !slices.Contains(payloadOperations, op.Operation):
+			// Skipped on this device, or nothing shipped to check
+		case op.Source != "" && slices.ContainsFunc(produced, func(dir string) bool { return isWithin(op.Source, dir) }):
+			// Written by an earlier operation
+		case op.Operation == "self_update" && isResumedStage(op):
+			// Staged by the resumed run, and re-verified when it runs again
+		default:
+			p := predictOperation(op)
+			if p.state == cxfw.OpWouldFail {
+				problems = append(problems, preflightProblem{i, p.reason, p.detail})
+			} else if err := checkWrittenDir(op, remounted); err != nil {
+				problems = append(problems, preflightProblem{i, cxfw.ReasonForError(err), err.Error()})
+				p = wouldFail(cxfw.ReasonForError(err), "%v", err)
+			}
+			predictions[i] = p
+		}
+		// Removes need room for their backups, downloads for the payload
+		if (op.Operation == "remove" || op.Operation == "download") && writeErr == nil && operationTargetMismatch(op) == "" {
+			predictions[i].writes = predictOperation(op).writes
+		}
+
+		switch op.Operation {
+		case "remount":
+			if op.Mode == "rw" {
+				remounted = append(remounted, op.Path)
+			}
+		case "add", "copy", "download", "extract_tar", "create_file":
+			produced = append(produced, op.Path)
+		}
+	}
+	for _, i := range checkSpace(predictions) {
+		problems = append(problems, preflightProblem{i, predictions[i].reason, predictions[i].detail})
+	}
+	slices.SortStableFunc(problems, func(a, b preflightProblem) int { return a.index - b.index })
+	return problems
+}
+
+// checkWrittenDir reports an error if the directory op writes into is on a
+// read-only filesystem, unless an earlier operation remounts it read-write.
+func checkWrittenDir(op cxfw.Operation, remounted []string) error {
+	dir := writtenDir(op)
+	if dir == "" || slices.ContainsFunc(remounted, func(mount string) bool { return isWithin(dir, mount) }) {
+		return nil
+	}
+	existing, _, ok := existingAncestor(dir)
+	if !ok {
+		return nil
+	}
+	if err := syscall.Access(existing, 2); err != nil {
+		return fmt.Errorf("cannot write to %s: %w", cxfw.ImagePath(existing), err)
+	}
+	return nil
+}
+
+// writtenDir is the directory a payload operation writes into, or empty
+// when it writes elsewhere, e.g. to a block device.
+func writtenDir(op cxfw.Operation) string {
+	switch op.Operation {
+	case "add", "copy", "extract_tar", "install_cert":
+		return op.Path
+	case "replace_image", "delta", "create_file", "self_update":
+		if op.Path != "" {
+			return filepath.Dir(op.Path)
+		}
+	}
+	return ""
+}
+
+// isWithin reports whether path is dir or lies below it.
+func isWithin(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// chroot is set by --chroot: command and script operations then run with
+// the image mounted at --root as their root directory, so they see and use
+// the image's binaries, libraries and accounts instead of the host's.
+var chroot bool
+
+// imageSearchPath is where commands given by name are looked up in the
+// image when running chrooted.
+var imageSearchPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// defaultOperationTimeout bounds command and script operations without a
+// timeout of their own: the manifest's default_timeout_seconds, or zero to
+// let them run as long as they need.
+var defaultOperationTimeout time.Duration
+
+// operationTimeout returns the timeout of op from timeout_seconds, or the
+// older timeout field, or fallback when it sets neither.
+func operationTimeout(op cxfw.Operation, fallback time.Duration) time.Duration {
+	switch {
+	case op.TimeoutSeconds > 0:
+		return time.Duration(op.TimeoutSeconds) * time.Second
+	case op.Timeout > 0:
+		return time.Duration(op.Timeout) * time.Second
+	}
+	return fallback
+}
+
+// runProcess runs name with args for the command or script operation op,
+// capturing its output into the log, in a process group of its own. It runs in
+// op.WorkingDir and as op.User when given, and fails without running
+// anything if either does not exist. With --chroot, name, op.WorkingDir and
+// op.User are looked up in the image. When the operation's timeout passes
+// the whole group is killed, so children of a hung shell go too, and a
+// timeoutError is returned. The group is killed too when a signal
+// interrupts the run.
+func runProcess(op cxfw.Operation, name string, args ...string) error {
+	timeout := operationTimeout(op, defaultOperationTimeout)
+	ctx, cancel := context.WithCancel(cxfw.RunCtx)
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	output := cxfw.NewOutputCapture()
+	cmd.Stdout, cmd.Stderr = output.Stdout, output.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	workingDir := op.WorkingDir
+	if chroot {
+		path, err := imageLookPath(name)
+		if err != nil {
+			return err
+		}
+		cmd.Path, cmd.Err = path, nil
+		cmd.SysProcAttr.Chroot = cxfw.Root
+		cmd.Dir = "/"
+		if workingDir != "" {
+			workingDir = cxfw.HostPath(workingDir)
+		}
+	}
+	if op.WorkingDir != "" {
+		if info, err := os.Stat(workingDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("working directory %s does not exist", op.WorkingDir)
+		}
+		cmd.Dir = op.WorkingDir
+	}
+	if op.User != "" {
+		credential, home, err := lookupCredential(op.User)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = credential
+		cmd.Env = append(os.Environ(), "HOME="+home, "USER="+op.User, "LOGNAME="+op.User)
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	err := cmd.Run()
+	output.Log()
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() == context.DeadlineExceeded:
+		err = timeoutError(timeout)
+	case cxfw.Interrupted():
+		err = fmt.Errorf("killed because the run was interrupted: %w", err)
+	}
+	return withOutputTail(err, output)
+}
+
+// withOutputTail adds the last lines of output to the error of a failed
+// process, so they reach the summary and the report.
+func withOutputTail(err error, output *cxfw.OutputCapture) error {
+	if tail := output.Tail(); tail != "" {
+		return fmt.Errorf("%w (last output: %s)", err, tail)
+	}
+	return err
+}
+
+// runScript writes body to a temporary file only root, or op.User, can
+// read and runs it for op. Its shebang picks the interpreter; a body
+// without one runs under sh. The file is removed afterwards.
+func runScript(op cxfw.Operation, body []byte) error {
+	tempDir := ""
+	if chroot {
+		tempDir = cxfw.HostPath("/tmp")
+	}
+	file, err := os.CreateTemp(tempDir, "cxfw-script-*")
+	if err != nil {
+		return fmt.Errorf("failed to create script file: %w", err)
+	}
+	cxfw.TrackTempFile(file.Name())
+	defer cxfw.UntrackTempFile(file.Name())
+	defer os.Remove(file.Name())
+	_, err = file.Write(body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0700)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write script file: %w", err)
+	}
+	if op.User != "" {
+		credential, _, err := lookupCredential(op.User)
+		if err != nil {
+			return err
+		}
+		if err := os.Chown(file.Name(), int(credential.Uid), int(credential.Gid)); err != nil {
+			return fmt.Errorf("failed to hand the script to %s: %w", op.User, err)
+		}
+	}
+
+	script := file.Name()
+	if chroot {
+		script = cxfw.ImagePath(script)
+	}
+	if !bytes.HasPrefix(body, []byte("#!")) {
+		return runProcess(op, "sh", script)
+	}
+	return runProcess(op, script)
+}
+
+// imageLookPath returns the in-image path of the command name, searching
+// imageSearchPath when it has no slash. The entry itself is checked rather
+// than its target, since symlinks in the image resolve inside the chroot.
+func imageLookPath(name string) (string, error) {
+	candidates := []string{name}
+	if !strings.Contains(name, "/") {
+		candidates = candidates[:0]
+		for _, dir := range imageSearchPath {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+	for _, path := range candidates {
+		if _, err := os.Lstat(cxfw.HostPath(path)); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in the image at %s", name, cxfw.Root)
+}
+
+// lookupCredential returns the uid, primary gid and supplementary groups of
+// the user name from /etc/passwd and /etc/group, and the user's home. With
+// --chroot the user comes from the image and keeps no supplementary groups.
+func lookupCredential(name string) (*syscall.Credential, string, error) {
+	if chroot {
+		uid, gid, home, err := cxfw.LookupUser(name)
+		if err != nil {
+			return nil, "", fmt.Errorf("cannot run as %s: %w", name, err)
+		}
+		return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, home, nil
+	}
+	account, err := user.Lookup(name)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot run as %s: %w", name, err)
+	}
+	uid, _ := strconv.ParseUint(account.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(account.Gid, 10, 32)
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, err := account.GroupIds()
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read the groups of %s: %w", name, err)
+	}
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(id))
+		}
+	}
+	return credential, account.HomeDir, nil
+}
+
+// expectedExit reports whether err is an exit status that op lists in
+// expected_exit_codes, and returns the code.
+func expectedExit(op cxfw.Operation, err error) (int, bool) {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || !slices.Contains(op.ExpectedExitCodes, exitErr.ExitCode()) {
+		return 0, false
+	}
+	return exitErr.ExitCode(), true
+}
+
+// timeoutError is a process killed at its deadline. It wraps
+// context.DeadlineExceeded, which reports reason timed_out.
+type timeoutError time.Duration
+
+func (e timeoutError) Error() string { return "timed out after " + time.Duration(e).String() }
+
+func (e timeoutError) Unwrap() error { return context.DeadlineExceeded }
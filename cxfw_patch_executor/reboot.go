@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// rebootRequested is set by reboot operations and the manifest's reboot
+// flag. The reboot itself is deferred to the end of a successful run.
+var rebootRequested bool
+
+// rebootDelay is the longest delay_seconds of the reboot operations.
+var rebootDelay time.Duration
+
+// requestReboot records a reboot to perform once every operation has
+// completed, instead of rebooting in the middle of the manifest.
+func requestReboot(op cxfw.Operation) error {
+	if op.DelaySeconds < 0 {
+		cxfw.LogToFile("ERROR: Invalid reboot operation, negative delay_seconds")
+		return fmt.Errorf("invalid reboot operation, negative delay_seconds")
+	}
+	rebootRequested = true
+	if delay := time.Duration(op.DelaySeconds) * time.Second; delay > rebootDelay {
+		rebootDelay = delay
+	}
+	cxfw.LogToFile("INFO: Reboot requested, deferred until all operations complete")
+	return nil
+}
+
+// performDeferredReboot reboots the device if the run requested it and
+// ended with exit code 0. A failed run never reboots, so the device does
+// not boot into a half-patched state. The log is synced to disk first.
+func performDeferredReboot(code int) {
+	if !rebootRequested || cxfw.RunReport.Mode != "apply" {
+		return
+	}
+	if code != 0 {
+		cxfw.LogToFile("WARNING: Reboot suppressed because the patch did not complete")
+		return
+	}
+	if cxfw.Root != "" {
+		cxfw.LogToFile("INFO: Reboot skipped, the patch was applied with --root")
+		return
+	}
+	cxfw.LogToFile("INFO: Rebooting in " + rebootDelay.String())
+	syscall.Sync()
+	time.Sleep(rebootDelay)
+	if output, err := exec.Command("reboot").CombinedOutput(); err != nil {
+		cxfw.LogToFile("ERROR: Reboot failed - " + err.Error() + " " + string(output))
+	}
+}
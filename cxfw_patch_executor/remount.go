@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// remountTimeout bounds a single mount -o remount call.
+const remountTimeout = 30 * time.Second
+
+// remountedRW are the mount points this run flipped from ro to rw. They are
+// flipped back by restoreReadOnly when the run ends, whether or not the
+// manifest remounts them ro itself.
+var remountedRW []string
+
+// remountPath remounts the mount point op.Path read-write or read-only, as
+// given by op.Mode, and verifies the result in /proc/mounts.
+func remountPath(op cxfw.Operation) error {
+	if op.Path == "" || (op.Mode != "rw" && op.Mode != "ro") {
+		cxfw.LogToFile("ERROR: Invalid remount operation, missing path or mode rw/ro")
+		return fmt.Errorf("invalid remount operation, missing path or mode rw/ro")
+	}
+	if cxfw.Root != "" {
+		cxfw.LogToFile("ERROR: Remount operations act on the running system's mounts and cannot be applied with --root")
+		return fmt.Errorf("remount operations cannot be applied with --root")
+	}
+	mountPoint := filepath.Clean(op.Path)
+
+	current, err := mountMode(mountPoint)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	if current == op.Mode {
+		cxfw.LogToFile("INFO: " + mountPoint + " already mounted " + op.Mode + ", skipped")
+		return nil
+	}
+
+	if err := remount(mountPoint, op.Mode); err != nil {
+		return err
+	}
+	if op.Mode == "rw" {
+		remountedRW = append(remountedRW, mountPoint)
+	} else {
+		remountedRW = slices.DeleteFunc(remountedRW, func(path string) bool { return path == mountPoint })
+	}
+	return nil
+}
+
+// remount runs mount -o remount,mode on mountPoint and checks /proc/mounts
+// afterwards, since mount can exit zero without changing the mode.
+func remount(mountPoint, mode string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), remountTimeout)
+	defer cancel()
+
+	cxfw.LogToFile("INFO: Remounting " + mountPoint + " " + mode)
+	if output, err := exec.CommandContext(ctx, "mount", "-o", "remount,"+mode, mountPoint).CombinedOutput(); err != nil {
+		cxfw.LogToFile("ERROR: Failed to remount " + mountPoint + " " + mode + " - " + err.Error())
+		logCommandOutput(string(output))
+		return fmt.Errorf("failed to remount %s %s: %w", mountPoint, mode, err)
+	}
+	current, err := mountMode(mountPoint)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	if current != mode {
+		cxfw.LogToFile("ERROR: " + mountPoint + " still mounted " + current + " after remount")
+		return fmt.Errorf("%s still mounted %s after remount %s", mountPoint, current, mode)
+	}
+	cxfw.LogToFile("SUCCESS: Remounted " + mountPoint + " " + mode)
+	return nil
+}
+
+// restoreReadOnly flips the mount points this run made writable back to
+// read-only, most recent first. Failures are logged and leave the mount
+// writable; they do not change the outcome of the run.
+func restoreReadOnly() {
+	for i := len(remountedRW) - 1; i >= 0; i-- {
+		cxfw.LogToFile("INFO: Restoring read-only mount of " + remountedRW[i])
+		if err := remount(remountedRW[i], "ro"); err != nil {
+			cxfw.LogToFile("WARNING: " + remountedRW[i] + " left mounted rw")
+		}
+	}
+	remountedRW = nil
+}
+
+// mountMode returns "rw" or "ro" for the mount point as listed in
+// /proc/mounts. The last entry wins when mounts are stacked.
+func mountMode(mountPoint string) (string, error) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return "", fmt.Errorf("failed to read /proc/mounts: %w", err)
+	}
+	defer file.Close()
+
+	mode := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || unescapeMountField(fields[1]) != mountPoint {
+			continue
+		}
+		mode = "rw"
+		if slices.Contains(strings.Split(fields[3], ","), "ro") {
+			mode = "ro"
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read /proc/mounts: %w", err)
+	}
+	if mode == "" {
+		return "", fmt.Errorf("%s is not a mount point", mountPoint)
+	}
+	return mode, nil
+}
+
+// unescapeMountField decodes the octal escapes /proc/mounts uses for space,
+// tab, newline and backslash in paths.
+func unescapeMountField(field string) string {
+	return strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(field)
+}
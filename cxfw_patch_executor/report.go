@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// skippedOperations lists the operations skipped by their condition or
+// target, for the summary at the end of the run.
+var skippedOperations []string
+
+// addOperationResult records the outcome of an operation that ran, or was
+// skipped, in the report and publishes it.
+func addOperationResult(result cxfw.OperationResult) {
+	cxfw.RunReport.Operations = append(cxfw.RunReport.Operations, result)
+	publishOperation(result)
+}
+
+// skipOperation logs and reports the operation at index as skipped with
+// state for reason. op.Path is the host path.
+func skipOperation(index int, op cxfw.Operation, result cxfw.OperationResult, state, reason string) {
+	cxfw.LogToFile("SKIPPED: " + reason)
+	result.State, result.Detail = state, reason
+	addOperationResult(result)
+	skipped := strings.TrimSpace(fmt.Sprintf("#%d %s %s", index+1, op.Operation, cxfw.ImagePath(op.Path)))
+	skippedOperations = append(skippedOperations, skipped+" ("+reason+")")
+}
+
+// operationTiming is the wall time one operation took.
+type operationTiming struct {
+	index    int
+	label    string
+	duration time.Duration
+}
+
+// operationTimings lists the operations that ran, for the timing summary.
+var operationTimings []operationTiming
+
+// slowestShown is how many operations the timing summary lists.
+const slowestShown = 5
+
+// logOperationTime logs how long the operation at index took and records
+// it for the summary. op is the operation as given in the manifest.
+func logOperationTime(index int, op cxfw.Operation, duration time.Duration, err error) {
+	label := op.Operation
+	if dest, destErr := addDestination(op); (op.Operation == "add" || op.Operation == "copy") && op.Source != "" && destErr == nil {
+		label += " " + dest
+	} else if op.Path != "" {
+		label += " " + op.Path
+	}
+	if err != nil {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Operation %d (%s) failed after %.2fs", index+1, label, duration.Seconds()))
+	} else {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Operation %d (%s) completed in %.2fs", index+1, label, duration.Seconds()))
+	}
+	operationTimings = append(operationTimings, operationTiming{index, label, duration})
+}
+
+// logTimings logs the slowest operations that ran, with the total wall
+// time of the run, so a slow patch shows where its time went.
+func logTimings() {
+	if len(operationTimings) == 0 {
+		return
+	}
+	slowest := slices.Clone(operationTimings)
+	slices.SortStableFunc(slowest, func(a, b operationTiming) int { return cmp.Compare(b.duration, a.duration) })
+	cxfw.LogToFile(fmt.Sprintf("INFO: Slowest of %d operations run, total wall time %.2fs:", len(slowest), time.Since(cxfw.RunStart).Seconds()))
+	for _, timing := range slowest[:min(len(slowest), slowestShown)] {
+		cxfw.LogToFile(fmt.Sprintf("INFO:   %8.2fs  #%d %s", timing.duration.Seconds(), timing.index+1, timing.label))
+	}
+}
+
+// finishCleanup is the Cleanup hook of cxfw.FinishRun: it writes the
+// integrity entries of the installs that completed, restores the mounts the
+// run made writable, records the run in the history and adds the executor's
+// fields to the report.
+func finishCleanup(code int, reason string) {
+	// The installs that completed before a failure keep their hashes
+	flushIntegrity()
+	restoreReadOnly()
+	recordHistory(code, reason)
+	removeBundleStaging()
+	for _, path := range clampedPaths {
+		cxfw.RunReport.ClampedPaths = append(cxfw.RunReport.ClampedPaths, cxfw.ImagePath(path))
+	}
+	cxfw.RunReport.ForcedMismatches = forcedMismatches
+	logTimings()
+}
+
+// finishReported is the Reported hook of cxfw.FinishRun: it publishes the
+// outcome of the run and stops feeding the watchdog.
+func finishReported(code int) {
+	writeMetrics(code)
+	postReport()
+	publishFinish(code)
+	if force {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: FORCED: This run used --force and accepted %d mismatches", len(forcedMismatches)))
+	}
+	stopWatchdog()
+}
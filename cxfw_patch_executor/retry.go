@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// retryDelay is the wait before the first retry of an operation without
+// retry_delay_seconds. Each later retry waits one delay longer.
+const retryDelay = 5 * time.Second
+
+// retryableOperations start over cleanly when run again after failing
+// part way. download retries inside its own handler.
+var retryableOperations = []string{"add", "copy", "remove", "command", "script", "service"}
+
+// allowedFailures lists the operations that failed but had allow_failure
+// set, for the summary at the end of the run.
+var allowedFailures []string
+
+// failureAllowed reports whether the run continues past err because op
+// sets allow_failure. Only commands and scripts may fail, and never with a
+// storage error.
+func failureAllowed(op cxfw.Operation, err error) bool {
+	return op.AllowFailure && (op.Operation == "command" || op.Operation == "script") && cxfw.ExitCodeForError(err) == cxfw.ExitFailure
+}
+
+// retryBackoff returns the wait after failed attempt number attempt of op.
+func retryBackoff(op cxfw.Operation, attempt int) time.Duration {
+	delay := retryDelay
+	if op.RetryDelaySeconds > 0 {
+		delay = time.Duration(op.RetryDelaySeconds) * time.Second
+	}
+	return time.Duration(attempt) * delay
+}
+
+// runWithRetries runs op, and runs it again up to op.Retries times if it
+// fails, e.g. because another process briefly holds the integrity database.
+// Storage errors are not retried, since no wait fixes a full or failing
+// filesystem, and neither is anything once a signal interrupts the run.
+func runWithRetries(op cxfw.Operation) error {
+	attempts := 1
+	if slices.Contains(retryableOperations, op.Operation) {
+		attempts += max(op.Retries, 0)
+	} else if op.Retries > 0 && op.Operation != "download" {
+		cxfw.LogToFile("WARNING: Retries ignored, " + op.Operation + " operations are not retried")
+	}
+	for attempt := 1; ; attempt++ {
+		err := dispatchOperation(op)
+		if err == nil || attempt == attempts || cxfw.ExitCodeForError(err) != cxfw.ExitFailure || cxfw.Interrupted() {
+			return err
+		}
+		delay := retryBackoff(op, attempt)
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Attempt %d/%d failed, retrying in %s - %v", attempt, attempts, delay, err))
+		select {
+		case <-time.After(delay):
+		case <-cxfw.RunCtx.Done():
+			return err
+		}
+		cxfw.LogToFile(fmt.Sprintf("INFO: Retrying %s, attempt %d/%d", op.Operation, attempt+1, attempts))
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// deselected holds the indices of the operations --only and --skip leave
+// out. They are not preflighted, validated or run.
+var deselected = make(map[int]bool)
+
+// parseOperationSelection parses a list of 1-based operation indices and
+// ranges such as "2-5,9" for a manifest of total operations, and returns
+// the 0-based indices it selects.
+func parseOperationSelection(spec string, total int) (map[int]bool, error) {
+	selected := make(map[int]bool)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		low, high, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, fmt.Errorf("invalid operation %q in %q", part, spec)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(high); err != nil || last < first {
+				return nil, fmt.Errorf("invalid operation range %q in %q", part, spec)
+			}
+		}
+		if first < 1 || last > total {
+			return nil, fmt.Errorf("operation %q out of range, the manifest has %d operations", part, total)
+		}
+		for index := first; index <= last; index++ {
+			selected[index-1] = true
+		}
+	}
+	return selected, nil
+}
+
+// selectOperations fills deselected from the --only and --skip flags for a
+// manifest of total operations. Empty flags select every operation.
+func selectOperations(only, skip string, total int) error {
+	if only != "" {
+		selected, err := parseOperationSelection(only, total)
+		if err != nil {
+			return fmt.Errorf("--only: %w", err)
+		}
+		for index := 0; index < total; index++ {
+			if !selected[index] {
+				deselected[index] = true
+			}
+		}
+	}
+	if skip != "" {
+		skipped, err := parseOperationSelection(skip, total)
+		if err != nil {
+			return fmt.Errorf("--skip: %w", err)
+		}
+		for index := range skipped {
+			deselected[index] = true
+		}
+	}
+	return nil
+}
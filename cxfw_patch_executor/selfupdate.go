@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// selfUpdateProbeTimeout bounds the --version run of a staged binary.
+const selfUpdateProbeTimeout = 10 * time.Second
+
+// pendingSwap is a verified binary waiting to be renamed over target.
+type pendingSwap struct {
+	staged, target, checksum, version string
+}
+
+// pendingSwaps are applied by finishSelfUpdates once everything else in the
+// run has completed, so a running executor never replaces itself mid-run.
+var pendingSwaps []pendingSwap
+
+// selfUpdateTarget returns the binary op replaces: op.Path, or this
+// executor when op.Path is empty.
+func selfUpdateTarget(op cxfw.Operation) (string, error) {
+	if op.Path != "" {
+		return op.Path, nil
+	}
+	if cxfw.Root != "" {
+		return "", fmt.Errorf("self_update needs a path when applied with --root")
+	}
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the running executor: %w", err)
+	}
+	return executable, nil
+}
+
+// resumedStage returns the journal entry of the interrupted run that staged
+// the binary of op and removed op.Source, if a resumed run has one.
+func resumedStage(op cxfw.Operation) (journalEntry, bool) {
+	target, err := selfUpdateTarget(op)
+	if err != nil {
+		return journalEntry{}, false
+	}
+	entry, ok := resumedStages[target+".new"]
+	if _, err := os.Lstat(op.Source); !ok || !os.IsNotExist(err) {
+		return journalEntry{}, false
+	}
+	return entry, true
+}
+
+// isResumedStage reports whether the interrupted run of a resumed run
+// staged the binary of op and removed op.Source.
+func isResumedStage(op cxfw.Operation) bool {
+	_, ok := resumedStage(op)
+	return ok
+}
+
+// stageSelfUpdate stages op.Source as the new version of the patch tooling
+// binary op.Path, or of this executor when op.Path is empty. The staged
+// binary must match op.Checksum and answer --version; otherwise it is
+// removed and the current binary stays untouched. A resumed run whose
+// interrupted run already staged the binary and removed op.Source
+// re-verifies the staged binary instead.
+func stageSelfUpdate(op cxfw.Operation) error {
+	if op.Source == "" || op.Checksum == "" {
+		cxfw.LogToFile("ERROR: Invalid self_update operation, missing source or checksum")
+		return fmt.Errorf("invalid self_update operation, missing source or checksum")
+	}
+	target, err := selfUpdateTarget(op)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+
+	// Step 1: Stage the new binary next to the current one
+	staged := target + ".new"
+	if entry, ok := resumedStage(op); ok {
+		if _, err := os.Stat(staged); os.IsNotExist(err) {
+			// The swap happened, but the run did not get to remove the journal
+			if checksum, err := cxfw.ComputeChecksum(target); err == nil && checksum == op.Checksum {
+				cxfw.LogToFile("INFO: " + target + " already updated to version " + entry.Version)
+				return nil
+			}
+		}
+		cxfw.LogToFile("INFO: Source already removed, re-verifying " + staged + " staged by the interrupted run")
+	} else {
+		cxfw.LogToFile("INFO: Staging self-update from " + op.Source + " to " + staged)
+		if err := cxfw.CopyFile(op.Source, staged); err != nil {
+			cxfw.LogToFile("ERROR: Failed to stage binary - " + err.Error())
+			return fmt.Errorf("failed to stage binary: %w", err)
+		}
+	}
+	verified := false
+	defer func() {
+		if !verified {
+			os.Remove(staged)
+		}
+	}()
+	if err := os.Chmod(staged, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to set mode of staged binary - " + err.Error())
+		return fmt.Errorf("failed to set mode of staged binary: %w", err)
+	}
+
+	// Step 2: Verify checksum and that the binary runs
+	checksum, err := cxfw.ComputeChecksum(staged)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to compute checksum of staged binary - " + err.Error())
+		return fmt.Errorf("failed to compute checksum of staged binary: %w", err)
+	}
+	if checksum != op.Checksum {
+		cxfw.LogToFile("ERROR: Checksum mismatch for staged binary " + staged + ", current binary left untouched")
+		return fmt.Errorf("%w for %s: expected %s, got %s", cxfw.ErrChecksumMismatch, staged, op.Checksum, checksum)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selfUpdateProbeTimeout)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, staged, "--version").CombinedOutput()
+	if err != nil {
+		cxfw.LogToFile("ERROR: Staged binary failed to report its version, current binary left untouched - " + err.Error())
+		logCommandOutput(string(output))
+		return fmt.Errorf("staged binary %s failed to run: %w", staged, err)
+	}
+	version := strings.TrimSpace(string(output))
+	verified = true
+
+	// Step 3: Defer the swap to the end of the run
+	pendingSwaps = append(pendingSwaps, pendingSwap{staged: staged, target: target, checksum: checksum, version: version})
+	cxfw.LogToFile("SUCCESS: Staged version " + version + " of " + target + ", swap deferred to the end of the run")
+
+	if _, err := os.Lstat(op.Source); !op.KeepSource && !os.IsNotExist(err) {
+		if err := os.Remove(op.Source); err != nil {
+			cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
+			return fmt.Errorf("failed to remove source file: %w", err)
+		}
+	}
+	return nil
+}
+
+// finishSelfUpdates renames the staged binaries over their targets. The
+// previous binaries are kept in the backup directory for the rollback. A
+// run that stops early never gets here and leaves the current binaries in
+// place; the next run overwrites the stale staged copies.
+func finishSelfUpdates() error {
+	for _, swap := range pendingSwaps {
+		if _, err := os.Stat(swap.target); err == nil {
+			if _, err := backupFile(swap.target); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(swap.staged, swap.target); err != nil {
+			cxfw.LogToFile("ERROR: Failed to swap in " + swap.staged + " - " + err.Error())
+			return fmt.Errorf("failed to swap in %s: %w", swap.staged, err)
+		}
+		cxfw.LogToFile("SUCCESS: Updated " + swap.target + " to version " + swap.version)
+	}
+	return nil
+}
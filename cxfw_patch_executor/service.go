@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultServiceTemplate builds the init command from the service name and
+// action. Manifests for platforms using another init system override it
+// with service_template.
+const defaultServiceTemplate = "/etc/init.d/%s %s"
+
+// defaultServiceTimeout bounds an action plus the wait for the service to
+// reach the requested state, when the operation does not set timeout.
+const defaultServiceTimeout = 30 * time.Second
+
+// serviceStatusInterval is the delay between status checks.
+const serviceStatusInterval = time.Second
+
+// serviceNamePattern keeps service names from injecting into the shell
+// command built from the template.
+var serviceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.@-]*$`)
+
+var serviceTemplate = defaultServiceTemplate
+
+func controlService(op cxfw.Operation) error {
+	if op.Name == "" || op.Action == "" {
+		cxfw.LogToFile("ERROR: Invalid service operation, missing name or action")
+		return fmt.Errorf("invalid service operation, missing name or action")
+	}
+	if !serviceNamePattern.MatchString(op.Name) {
+		cxfw.LogToFile("ERROR: Invalid service name - " + op.Name)
+		return fmt.Errorf("invalid service name %q", op.Name)
+	}
+	if !slices.Contains([]string{"start", "stop", "restart"}, op.Action) {
+		cxfw.LogToFile("ERROR: Invalid service action - " + op.Action)
+		return fmt.Errorf("invalid service action %q, expected start, stop or restart", op.Action)
+	}
+
+	timeout := operationTimeout(op, defaultServiceTimeout)
+	ctx, cancel := context.WithTimeout(cxfw.RunCtx, timeout)
+	defer cancel()
+
+	// Step 1: Run the action through the init mechanism
+	command := fmt.Sprintf(serviceTemplate, op.Name, op.Action)
+	cxfw.LogToFile("DEBUG: Running service action: " + command)
+	if output, err := runCaptured(ctx, command); err != nil {
+		cxfw.LogToFile("ERROR: Service " + op.Action + " failed for " + op.Name + " - " + err.Error())
+		logCommandOutput(output)
+		return fmt.Errorf("service %s %s failed: %w", op.Name, op.Action, err)
+	}
+
+	// Step 2: Wait until the status command reports the requested state
+	statusCommand := fmt.Sprintf(serviceTemplate, op.Name, "status")
+	wantRunning := op.Action != "stop"
+	var lastOutput string
+	for {
+		output, err := runCaptured(ctx, statusCommand)
+		if ctx.Err() != nil {
+			break
+		}
+		lastOutput = output
+		if (err == nil) == wantRunning {
+			cxfw.LogToFile("SUCCESS: Service " + op.Name + " " + op.Action + " completed")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(serviceStatusInterval):
+		}
+	}
+
+	cxfw.LogToFile(fmt.Sprintf("ERROR: Service %s did not %s within %s, last output of %s:", op.Name, op.Action, timeout, statusCommand))
+	logCommandOutput(lastOutput)
+	return fmt.Errorf("service %s did not %s within %s", op.Name, op.Action, timeout)
+}
+
+// runCaptured runs command through the shell and returns its combined
+// stdout and stderr. Output goes to a temp file rather than a pipe because
+// daemons started by the command inherit it and would keep a pipe open.
+func runCaptured(ctx context.Context, command string) (string, error) {
+	outFile, err := os.CreateTemp("", "cxfw_output_")
+	if err != nil {
+		return "", err
+	}
+	cxfw.TrackTempFile(outFile.Name())
+	defer cxfw.UntrackTempFile(outFile.Name())
+	defer os.Remove(outFile.Name())
+	defer outFile.Close()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = outFile
+	cmd.Stderr = outFile
+	err = cmd.Run()
+	if ctxErr := ctx.Err(); err != nil && ctxErr != nil {
+		err = fmt.Errorf("%w (%v)", ctxErr, err)
+	}
+
+	output, readErr := os.ReadFile(outFile.Name())
+	if readErr != nil {
+		output = []byte("(output unavailable: " + readErr.Error() + ")")
+	}
+	return string(output), err
+}
+
+// logCommandOutput copies captured command output into the patch log.
+func logCommandOutput(output string) {
+	output = strings.TrimRight(output, "\n")
+	if output == "" {
+		cxfw.LogToFile("ERROR:   (no output)")
+		return
+	}
+	for _, line := range strings.Split(output, "\n") {
+		cxfw.LogToFile("ERROR:   " + line)
+	}
+}
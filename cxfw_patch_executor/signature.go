@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+
+	"cxfw_common/cxfw"
+)
+
+// loadManifestKey returns the manifest signing key, or nil when it is
+// unavailable and --allow-unsigned was given. keyFile is the --manifest-key
+// flag, empty for the built-in key or the default file.
+func loadManifestKey(keyFile string, allowUnsigned bool) (ed25519.PublicKey, string) {
+	key, source, err := cxfw.LoadSigningKey(keyFile)
+	if err == nil {
+		return key, source
+	}
+	if allowUnsigned {
+		cxfw.LogToFile("WARNING: Manifest signing key unavailable, manifests will not be verified - " + err.Error())
+		return nil, source
+	}
+	cxfw.LogToFile("ERROR: Manifest signing key unavailable, refusing to execute - " + err.Error())
+	cxfw.FinishRun(cxfw.ExitSignatureInvalid, cxfw.ReasonSignatureInvalid, fmt.Sprintf("signing key %s: %v", source, err))
+	return nil, source
+}
+
+// stdinSignature is the --signature file of a manifest read from standard
+// input, which has no path to find <manifest>.sig next to.
+var stdinSignature string
+
+// checkManifestSignature verifies the detached signature of the manifest
+// bytes data read from path, and ends the run if it is missing or does not
+// verify. --allow-unsigned accepts a missing signature or key, never a
+// signature that does not match. The manifest digest is logged either way.
+func checkManifestSignature(path string, data []byte, key ed25519.PublicKey, source string, allowUnsigned bool) {
+	digest := cxfw.ManifestDigest(data)
+	name := cxfw.ManifestName(path)
+	if key == nil {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Executing unverified manifest %s (sha256 %s)", name, digest))
+		return
+	}
+	var err error
+	switch {
+	case path != cxfw.StdinManifest:
+		err = cxfw.VerifyManifestSignature(path, data, key)
+	case stdinSignature != "":
+		err = cxfw.VerifySignature(stdinSignature, data, key)
+	default:
+		err = cxfw.ErrUnsigned
+	}
+	switch {
+	case err == nil:
+		cxfw.LogToFile(fmt.Sprintf("INFO: Manifest signature verified with %s (sha256 %s)", source, digest))
+	case errors.Is(err, cxfw.ErrUnsigned) && allowUnsigned:
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Executing unsigned manifest %s with --allow-unsigned (sha256 %s)", name, digest))
+	default:
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Manifest signature verification failed for %s (sha256 %s) - %v", name, digest, err))
+		cxfw.FinishRun(cxfw.ExitSignatureInvalid, cxfw.ReasonSignatureInvalid, fmt.Sprintf("%s: %v (sha256 %s)", name, err, digest))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cxfw_common/cxfw"
+)
+
+// patchVersionID is the VersionID of the manifest being applied. Integrity
+// snapshots are filed under it.
+var patchVersionID string
+
+// snapshotIntegrity stores the integrity state of the directory op.Path as
+// snapshot "<version>/<op.Name>", where the name defaults to the flattened
+// directory path. An existing snapshot is kept, so a re-run after a failure
+// part way through the patch does not replace the pre-patch state.
+func snapshotIntegrity(op cxfw.Operation) error {
+	if op.Path == "" {
+		cxfw.LogToFile("ERROR: Invalid snapshot_integrity operation, missing path")
+		return fmt.Errorf("invalid snapshot_integrity operation, missing path")
+	}
+	dir := filepath.Clean(op.Path)
+	name := op.Name
+	if name == "" {
+		name = strings.ReplaceAll(strings.TrimPrefix(cxfw.ImagePath(dir), "/"), "/", "_")
+	}
+	id := patchVersionID + "/" + name
+	snapshotPath, err := cxfw.SnapshotPath(cxfw.HostPath(cxfw.BackupDir), id)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	if _, err := os.Stat(snapshotPath); err == nil {
+		cxfw.LogToFile("INFO: Snapshot " + id + " already taken, kept")
+		return nil
+	}
+
+	snapshot, err := cxfw.TakeSnapshot(dir, id)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to snapshot " + dir + " - " + err.Error())
+		return fmt.Errorf("failed to snapshot %s: %w", dir, err)
+	}
+	if err := cxfw.WriteSnapshot(snapshotPath, snapshot); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write snapshot - " + err.Error())
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: Snapshot %s of %s taken, %d files", id, dir, len(snapshot.Files)))
+	return nil
+}
+
+// restoreIntegrity returns a directory to the snapshot op.Name.
+func restoreIntegrity(op cxfw.Operation) error {
+	if op.Name == "" {
+		cxfw.LogToFile("ERROR: Invalid restore_integrity operation, missing name")
+		return fmt.Errorf("invalid restore_integrity operation, missing name")
+	}
+	hostBackupDir := cxfw.HostPath(cxfw.BackupDir)
+	snapshotPath, err := cxfw.SnapshotPath(hostBackupDir, op.Name)
+	if err != nil {
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
+	}
+	snapshot, err := cxfw.LoadSnapshot(snapshotPath, op.Name)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Snapshot " + op.Name + " failed verification - " + err.Error())
+		return fmt.Errorf("snapshot %s failed verification: %w", op.Name, err)
+	}
+	cxfw.LogToFile("INFO: Restoring " + snapshot.Dir + " to snapshot " + op.Name)
+	if err := cxfw.RestoreSnapshot(snapshot, hostBackupDir); err != nil {
+		cxfw.LogToFile("ERROR: Failed to restore snapshot - " + err.Error())
+		return fmt.Errorf("failed to restore snapshot %s: %w", op.Name, err)
+	}
+	cxfw.LogToFile("SUCCESS: " + snapshot.Dir + " restored to snapshot " + op.Name)
+	return nil
+}
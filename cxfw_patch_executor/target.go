@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultModelFile holds the hardware model name of the device, as used
+// by patch_processor.sh to match USB bundles.
+const defaultModelFile = "/sda1/data/.model"
+
+// deviceArch and deviceModel identify the device operations are matched
+// against. deviceModel is empty when the model file cannot be read.
+var deviceArch, deviceModel string
+
+// manifestTarget is the manifest-level target applied to every operation.
+var manifestTarget *cxfw.Target
+
+// normalizeArch maps uname machine names to Go architecture names, so
+// manifests may use either.
+func normalizeArch(arch string) string {
+	arch = strings.ToLower(strings.TrimSpace(arch))
+	switch {
+	case arch == "x86_64" || arch == "x86-64":
+		return "amd64"
+	case arch == "x86" || arch == "i386" || arch == "i486" || arch == "i586" || arch == "i686":
+		return "386"
+	case arch == "aarch64" || arch == "armv8l":
+		return "arm64"
+	case strings.HasPrefix(arch, "arm") && arch != "arm64":
+		return "arm"
+	}
+	return arch
+}
+
+// detectDevice determines the device architecture from uname, falling back
+// to the architecture the executor was built for, unless archOverride is
+// set. The model is read from modelFile only if the manifest targets one.
+func detectDevice(manifest *cxfw.Manifest, archOverride, modelFile string) {
+	deviceArch = normalizeArch(archOverride)
+	if deviceArch == "" {
+		deviceArch = runtime.GOARCH
+		var uts syscall.Utsname
+		if err := syscall.Uname(&uts); err == nil {
+			var machine []byte
+			for _, c := range uts.Machine {
+				if c == 0 {
+					break
+				}
+				machine = append(machine, byte(c))
+			}
+			if len(machine) > 0 {
+				deviceArch = normalizeArch(string(machine))
+			}
+		}
+	}
+
+	targetsModel := slices.ContainsFunc(manifest.Operations, func(op cxfw.Operation) bool { return len(op.Model) > 0 })
+	if manifest.Target != nil && len(manifest.Target.Model) > 0 || targetsModel {
+		data, err := os.ReadFile(cxfw.HostPath(modelFile))
+		if err != nil {
+			cxfw.LogToFile("WARNING: Device model unknown, operations targeting a model will be skipped - " + err.Error())
+		} else {
+			deviceModel = strings.TrimSpace(string(data))
+		}
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: Device architecture %s, model %q", deviceArch, deviceModel))
+}
+
+// targetMismatch describes why the device does not match target, or
+// returns empty if it does.
+func targetMismatch(target cxfw.Target) string {
+	if len(target.Arch) > 0 && !slices.ContainsFunc(target.Arch, func(arch string) bool { return normalizeArch(arch) == deviceArch }) {
+		return fmt.Sprintf("targets architecture %s, device is %s", strings.Join(target.Arch, ","), deviceArch)
+	}
+	if len(target.Model) > 0 {
+		if deviceModel == "" {
+			return fmt.Sprintf("targets model %s, device model unknown", strings.Join(target.Model, ","))
+		}
+		if !slices.Contains(target.Model, deviceModel) {
+			return fmt.Sprintf("targets model %s, device is %s", strings.Join(target.Model, ","), deviceModel)
+		}
+	}
+	return ""
+}
+
+// operationTargetMismatch checks op against the manifest-level target and
+// its own arch and model fields.
+func operationTargetMismatch(op cxfw.Operation) string {
+	if manifestTarget != nil {
+		if mismatch := targetMismatch(*manifestTarget); mismatch != "" {
+			return mismatch
+		}
+	}
+	return targetMismatch(cxfw.Target{Arch: op.Arch, Model: op.Model})
+}
+
+// checkFirmwareVersion refuses the run unless the installed firmware, read
+// from path and key, is within the manifest's supported range. A version
+// that cannot be read is fatal unless the manifest allows it.
+func checkFirmwareVersion(manifest *cxfw.Manifest, path, key string) {
+	if manifest.MinFirmwareVersion == "" && manifest.MaxFirmwareVersion == "" {
+		return
+	}
+	installed, err := cxfw.ReadFirmwareVersion(path, key)
+	if err != nil {
+		if manifest.AllowUnknownVersion {
+			cxfw.LogToFile("WARNING: Installed firmware version unknown, allowed by the manifest - " + err.Error())
+			return
+		}
+		cxfw.LogToFile("ERROR: Installed firmware version unknown, no changes made - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitFirmwareMismatch, cxfw.ReasonFirmwareUnknown, err.Error())
+	}
+	if err := cxfw.CheckFirmwareRange(installed, manifest.MinFirmwareVersion, manifest.MaxFirmwareVersion); err != nil {
+		cxfw.LogToFile("ERROR: Patch does not support this firmware, no changes made - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitFirmwareMismatch, cxfw.ReasonFirmwareMismatch, err.Error())
+	}
+	cxfw.LogToFile("INFO: Installed firmware " + installed + " is supported")
+}
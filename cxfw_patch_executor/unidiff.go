@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// hunkHeader matches "@@ -oldStart[,oldCount] +newStart[,newCount] @@".
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// hunk is one section of a unified diff. Lines keep their "\n" terminator
+// unless the diff marks them with "\ No newline at end of file".
+type hunk struct {
+	oldStart int
+	oldCount int
+	oldLines []string
+	newLines []string
+}
+
+// parseUnifiedDiff extracts the hunks of a single-file unified diff. File
+// headers ("---", "+++") and any preamble before the first hunk are ignored.
+func parseUnifiedDiff(diff string) ([]hunk, error) {
+	var hunks []hunk
+	var current *hunk
+	var lastKind byte
+
+	for i, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+		if m := hunkHeader.FindStringSubmatch(line); m != nil {
+			oldStart, _ := strconv.Atoi(m[1])
+			oldCount := 1
+			if m[2] != "" {
+				oldCount, _ = strconv.Atoi(m[2])
+			}
+			hunks = append(hunks, hunk{oldStart: oldStart, oldCount: oldCount})
+			current = &hunks[len(hunks)-1]
+			continue
+		}
+		if current == nil {
+			continue
+		}
+
+		if line == "" {
+			// Some editors strip the single space from empty context lines
+			line = " "
+		}
+		switch line[0] {
+		case ' ':
+			current.oldLines = append(current.oldLines, line[1:]+"\n")
+			current.newLines = append(current.newLines, line[1:]+"\n")
+		case '-':
+			current.oldLines = append(current.oldLines, line[1:]+"\n")
+		case '+':
+			current.newLines = append(current.newLines, line[1:]+"\n")
+		case '\\':
+			// "\ No newline at end of file" applies to the preceding line
+			if lastKind == ' ' || lastKind == '-' {
+				trimLastNewline(current.oldLines)
+			}
+			if lastKind == ' ' || lastKind == '+' {
+				trimLastNewline(current.newLines)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unexpected diff line %q", i+1, line)
+		}
+		lastKind = line[0]
+	}
+
+	if len(hunks) == 0 {
+		return nil, fmt.Errorf("no hunks found in diff")
+	}
+	for i, h := range hunks {
+		if len(h.oldLines) != h.oldCount {
+			return nil, fmt.Errorf("hunk %d: header declares %d old lines, body has %d", i+1, h.oldCount, len(h.oldLines))
+		}
+	}
+	return hunks, nil
+}
+
+func trimLastNewline(lines []string) {
+	if len(lines) > 0 {
+		lines[len(lines)-1] = strings.TrimSuffix(lines[len(lines)-1], "\n")
+	}
+}
+
+// applyUnifiedDiff applies hunks to content. Every hunk must match the file
+// exactly at its stated position; no fuzz or offset search is attempted, so
+// a file that drifted from what the diff was made against is rejected.
+func applyUnifiedDiff(content string, hunks []hunk) (string, error) {
+	lines := strings.SplitAfter(content, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var result []string
+	next := 0 // index of the first original line not yet copied
+	for i, h := range hunks {
+		start := h.oldStart - 1
+		if h.oldCount == 0 {
+			// Pure insertions name the line they follow
+			start = h.oldStart
+		}
+		if start < next || start+len(h.oldLines) > len(lines) {
+			return "", fmt.Errorf("hunk %d: lines %d-%d are outside the file", i+1, start+1, start+len(h.oldLines))
+		}
+		for j, want := range h.oldLines {
+			if lines[start+j] != want {
+				return "", fmt.Errorf("hunk %d: context mismatch at line %d: expected %q, found %q", i+1, start+j+1, want, lines[start+j])
+			}
+		}
+		result = append(result, lines[next:start]...)
+		result = append(result, h.newLines...)
+		next = start + len(h.oldLines)
+	}
+	result = append(result, lines[next:]...)
+	return strings.Join(result, ""), nil
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// plannedWrite is space an operation needs on the filesystem holding dir.
+type plannedWrite struct {
+	dir   string
+	bytes int64
+}
+
+// prediction is the expected outcome of one operation.
+type prediction struct {
+	state, reason, detail string
+	writes                []plannedWrite
+}
+
+func wouldFail(reason, format string, args ...any) prediction {
+	return prediction{state: cxfw.OpWouldFail, reason: reason, detail: fmt.Sprintf(format, args...)}
+}
+
+// validateOperations predicts the outcome of every operation without
+// changing anything and records the predictions in the run report. With
+// --dry-run each operation's planned steps are logged as well. It returns
+// the reason of the first operation that would fail, or empty if none
+// would.
+func validateOperations(ops []cxfw.Operation) string {
+	predictions := make([]prediction, len(ops))
+	var remounted []string
+	for i, op := range ops {
+		op = cxfw.HostOperation(op)
+		if deselected[i] {
+			predictions[i] = prediction{state: cxfw.OpWouldSkip, detail: "not selected by --only or --skip"}
+			continue
+		}
+		if op.Operation == "remount" && op.Mode == "rw" {
+			remounted = append(remounted, op.Path)
+		}
+		if err := checkWritablePaths(op); err != nil {
+			predictions[i] = wouldFail(cxfw.ReasonPolicyViolation, "%v", err)
+			continue
+		}
+		if mismatch := operationTargetMismatch(op); mismatch != "" {
+			predictions[i] = prediction{state: cxfw.OpWouldSkip, detail: "operation " + mismatch}
+			continue
+		}
+		if met, err := conditionMet(op); err != nil {
+			predictions[i] = wouldFail(cxfw.ReasonOperationFailed, "%v", err)
+			continue
+		} else if !met {
+			predictions[i] = prediction{state: cxfw.OpWouldSkip, detail: "condition not met"}
+			continue
+		}
+		predictions[i] = predictOperation(op)
+		if predictions[i].state == cxfw.OpWouldSucceed {
+			if err := checkWrittenDir(op, remounted); err != nil {
+				predictions[i] = wouldFail(cxfw.ReasonForError(err), "%v", err)
+			}
+		}
+	}
+	checkSpace(predictions)
+
+	failed := ""
+	counts := make(map[string]int)
+	for i, op := range ops {
+		p := predictions[i]
+		result := cxfw.OperationResultFor(i, op)
+		result.State, result.Reason, result.Detail = p.state, p.reason, p.detail
+		cxfw.RunReport.Operations = append(cxfw.RunReport.Operations, result)
+		counts[p.state]++
+
+		message := fmt.Sprintf("INFO: Operation %d/%d (%s) %s", i+1, len(ops), op.Operation, p.state)
+		if p.state == cxfw.OpWouldFail {
+			message = fmt.Sprintf("ERROR: Operation %d/%d (%s) would fail: %s - %s", i+1, len(ops), op.Operation, p.reason, p.detail)
+			if failed == "" {
+				failed = p.reason
+			}
+		}
+		cxfw.LogToFile(message)
+		if dryRun && p.state != cxfw.OpWouldSkip {
+			for _, step := range describeOperation(cxfw.HostOperation(op)) {
+				cxfw.LogToFile("INFO:   " + step)
+			}
+		}
+	}
+	cxfw.LogToFile(fmt.Sprintf("INFO: %d operations: %d would succeed, %d would be skipped, %d would fail, %d unchecked",
+		len(ops), counts[cxfw.OpWouldSucceed], counts[cxfw.OpWouldSkip], counts[cxfw.OpWouldFail], counts[cxfw.OpUnchecked]))
+	return failed
+}
+
+// predictOperation checks what can be checked about op without running it:
+// payload presence and checksums, the permission policy and the space the
+// operation writes. Operations acting on the running system are reported
+// unchecked.
+func predictOperation(op cxfw.Operation) prediction {
+	switch op.Operation {
+	case "add", "copy":
+		if op.Path == "" || (op.Source == "") == (len(op.Files) == 0) {
+			return wouldFail(cxfw.ReasonInvalidOperation, "expected a path and either source or files")
+		}
+		if op.Mode != "" {
+			if _, err := parseMode(op.Mode); err != nil {
+				return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+			}
+		}
+		if _, _, err := cxfw.LookupOwner(op.Owner, op.Group); err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		if len(op.Files) > 0 {
+			return predictBatch(op)
+		}
+		dest, err := addDestination(op)
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		return predictAdd(op, dest)
+	case "replace_image":
+		if op.Source == "" || op.Path == "" || op.Checksum == "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing source, path or checksum")
+		}
+		p := predictPayload(op, op.Path, filepath.Dir(op.Path))
+		if p.state == cxfw.OpWouldSucceed {
+			if err := checkSquashfs(op.Source); err != nil {
+				return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+			}
+			p.writes = append(p.writes, backupWrite(op.Path))
+		}
+		return p
+	case "self_update":
+		if op.Source == "" || op.Checksum == "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing source or checksum")
+		}
+		target := op.Path
+		if target == "" {
+			if cxfw.Root != "" {
+				return wouldFail(cxfw.ReasonInvalidOperation, "self_update needs a path when applied with --root")
+			}
+			target, _ = os.Executable()
+		}
+		p := predictPayload(op, "", filepath.Dir(target))
+		p.writes = append(p.writes, backupWrite(target))
+		return p
+	case "flash":
+		if op.Source == "" || op.Path == "" || op.Checksum == "" || op.Size <= 0 {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing source, path, checksum or size")
+		}
+		if cxfw.Root != "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "flash operations cannot be applied with --root")
+		}
+		p := predictPayload(op, "", "")
+		if p.state == cxfw.OpWouldSucceed {
+			if info, _ := os.Stat(op.Source); info.Size() != op.Size {
+				return wouldFail(cxfw.ReasonChecksumMismatch, "%s is %d bytes, expected %d", op.Source, info.Size(), op.Size)
+			}
+			device, err := openFlashTarget(op.Path)
+			if err != nil {
+				return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+			}
+			device.Close()
+		}
+		return p
+	case "delta":
+		if op.Path == "" || op.Source == "" || op.BaseChecksum == "" || op.Checksum == "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing path, source, base_checksum or checksum")
+		}
+		if _, err := os.Stat(op.Source); os.IsNotExist(err) {
+			return predictPayload(op, op.Path, "")
+		}
+		if checksum, err := cxfw.ComputeChecksum(op.Path); err != nil || (checksum != op.BaseChecksum && !force) {
+			return wouldFail(cxfw.ReasonChecksumMismatch, "%s is not the expected base", op.Path)
+		}
+		// The patched file is written next to the base before replacing it
+		info, _ := os.Stat(op.Path)
+		return prediction{state: cxfw.OpWouldSucceed, writes: []plannedWrite{{filepath.Dir(op.Path), info.Size()}}}
+	case "extract_tar":
+		if op.Source == "" || op.Path == "" || op.Checksum == "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing source, path or checksum")
+		}
+		p := predictPayload(op, "", "")
+		if p.state != cxfw.OpWouldSucceed {
+			return p
+		}
+		var size int64
+		var policyErr error
+		err := walkTar(op.Source, func(header *tar.Header, _ io.Reader) error {
+			if err := validateTarEntry(header); err != nil {
+				return err
+			}
+			size += header.Size
+			if policyErr == nil {
+				policyErr = checkPolicy(filepath.Join(op.Path, filepath.Clean(header.Name)), os.FileMode(header.Mode).Perm())
+			}
+			return nil
+		})
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "rejected archive %s: %v", op.Source, err)
+		}
+		if policyErr != nil {
+			return wouldFail(cxfw.ReasonPolicyViolation, "%v", policyErr)
+		}
+		p.writes = []plannedWrite{{op.Path, size}}
+		return p
+	case "create_file":
+		return predictCreateFile(op)
+	case "install_cert":
+		if op.Source == "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing source")
+		}
+		p := predictPayload(op, "", "")
+		if p.state == cxfw.OpWouldSucceed {
+			data, err := os.ReadFile(op.Source)
+			if err == nil {
+				_, err = parseCertificates(data, time.Now())
+			}
+			if err != nil {
+				return wouldFail(cxfw.ReasonInvalidOperation, "rejected certificate %s: %v", op.Source, err)
+			}
+		}
+		return p
+	case "remove":
+		if (op.Path == "") == (len(op.Paths) == 0) {
+			return wouldFail(cxfw.ReasonInvalidOperation, "expected either path or paths")
+		}
+		paths := op.Paths
+		if op.Path != "" {
+			paths = []string{op.Path}
+		}
+		p := prediction{state: cxfw.OpWouldSucceed}
+		for _, path := range paths {
+			p.writes = append(p.writes, backupWrite(path))
+		}
+		return p
+	case "reboot":
+		if op.DelaySeconds < 0 {
+			return wouldFail(cxfw.ReasonInvalidOperation, "negative delay_seconds")
+		}
+		return prediction{state: cxfw.OpWouldSucceed}
+	case "user":
+		if err := cxfw.CheckAccountChange(op); err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		return prediction{state: cxfw.OpWouldSucceed}
+	case "snapshot_integrity":
+		if op.Path == "" {
+			return wouldFail(cxfw.ReasonInvalidOperation, "missing path")
+		}
+		return prediction{state: cxfw.OpWouldSucceed}
+	case "restore_integrity":
+		snapshotPath, err := cxfw.SnapshotPath(cxfw.HostPath(cxfw.BackupDir), op.Name)
+		if err == nil {
+			_, err = cxfw.LoadSnapshot(snapshotPath, op.Name)
+		}
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		return prediction{state: cxfw.OpUnchecked}
+	case "cleanup":
+		candidates, err := cleanupCandidates(op)
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		return prediction{state: cxfw.OpWouldSucceed, detail: fmt.Sprintf("%d files would be deleted", len(candidates))}
+	case "download":
+		return prediction{state: cxfw.OpUnchecked, writes: []plannedWrite{{op.Path, op.Size}}}
+	case "command":
+		if (op.Command == "") == (len(op.Argv) == 0) || (len(op.Argv) > 0 && op.Argv[0] == "") {
+			return wouldFail(cxfw.ReasonInvalidOperation, "expected either command or a non-empty argv")
+		}
+		if len(op.Argv) > 0 {
+			if _, err := exec.LookPath(op.Argv[0]); err != nil {
+				return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+			}
+		}
+		return prediction{state: cxfw.OpUnchecked}
+	case "script":
+		if op.Source != "" {
+			if p := predictPayload(op, "", ""); p.state == cxfw.OpWouldFail {
+				return p
+			}
+		}
+		if _, err := scriptBody(op); err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		return prediction{state: cxfw.OpUnchecked}
+	case "remove_dir", "append", "replace_text", "patch", "modify_defaults",
+		"service", "launcher", "kmod", "remount", "cron", "verify":
+		return prediction{state: cxfw.OpUnchecked}
+	default:
+		return wouldFail(cxfw.ReasonInvalidOperation, "unknown operation %q", op.Operation)
+	}
+}
+
+// predictPayload checks the payload op.Source against op.Size and
+// op.Checksum, where given, unless --force accepts mismatches. A missing
+// payload is fine when dest already holds the expected content, as a re-run
+// skips the operation then. The payload size is planned for writeDir unless
+// it is empty.
+func predictPayload(op cxfw.Operation, dest, writeDir string) prediction {
+	info, err := os.Stat(op.Source)
+	if os.IsNotExist(err) {
+		if dest != "" && op.Checksum != "" {
+			if checksum, err := cxfw.ComputeChecksum(dest); err == nil && checksum == op.Checksum {
+				return prediction{state: cxfw.OpWouldSkip, detail: dest + " already matches checksum"}
+			}
+		}
+		return wouldFail(cxfw.ReasonMissingPayload, "%s is missing", op.Source)
+	}
+	if err != nil {
+		return wouldFail(cxfw.ReasonIOError, "%v", err)
+	}
+	forced := force && forceable(op)
+	if op.Size > 0 && info.Size() != op.Size && !forced {
+		return wouldFail(cxfw.ReasonChecksumMismatch, "%s is %d bytes, expected %d", op.Source, info.Size(), op.Size)
+	}
+	p := prediction{state: cxfw.OpWouldSucceed}
+	if op.Checksum != "" {
+		checksum, err := cxfw.ComputeChecksum(op.Source)
+		if err != nil {
+			return wouldFail(cxfw.ReasonIOError, "%v", err)
+		}
+		if checksum != op.Checksum && !forced {
+			return wouldFail(cxfw.ReasonChecksumMismatch, "checksum mismatch for %s: expected %s, got %s", op.Source, op.Checksum, checksum)
+		}
+		if checksum != op.Checksum {
+			p.detail = fmt.Sprintf("checksum mismatch for %s accepted because of --force", op.Source)
+		}
+	}
+	if dest != "" {
+		if err := checkPolicy(dest, info.Mode()); err != nil {
+			return wouldFail(cxfw.ReasonPolicyViolation, "%v", err)
+		}
+	}
+	if writeDir != "" {
+		p.writes = []plannedWrite{{writeDir, info.Size()}}
+	}
+	return p
+}
+
+// predictAdd predicts the add of op.Source as dest, including the backup
+// of the file dest replaces.
+func predictAdd(op cxfw.Operation, dest string) prediction {
+	p := predictPayload(op, dest, filepath.Dir(dest))
+	if p.state == cxfw.OpWouldSucceed && !alreadyInstalled(op, dest) {
+		if _, err := os.Stat(dest); err == nil {
+			p.writes = append(p.writes, backupWrite(dest))
+		}
+	}
+	return p
+}
+
+// predictBatch predicts a batch add file by file. The batch would be
+// skipped only when every file would be.
+func predictBatch(op cxfw.Operation) prediction {
+	batch := prediction{state: cxfw.OpWouldSkip, detail: "every file already matches its checksum"}
+	for i, file := range op.Files {
+		single, dest, err := batchEntry(op, file)
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "file %d/%d: %v", i+1, len(op.Files), err)
+		}
+		p := predictAdd(single, dest)
+		if p.state == cxfw.OpWouldFail {
+			p.detail = fmt.Sprintf("file %d/%d: %s", i+1, len(op.Files), p.detail)
+			return p
+		}
+		if p.state != cxfw.OpWouldSkip {
+			batch.state, batch.detail = p.state, ""
+		}
+		batch.writes = append(batch.writes, p.writes...)
+	}
+	return batch
+}
+
+func predictCreateFile(op cxfw.Operation) prediction {
+	if op.Path == "" || op.Checksum == "" {
+		return wouldFail(cxfw.ReasonInvalidOperation, "missing path or checksum")
+	}
+	if (op.ContentBase64 != "" && (op.Content != "" || op.Script != "")) || (op.Content != "" && op.Script != "") {
+		return wouldFail(cxfw.ReasonInvalidOperation, "more than one of content_base64, content and script_content")
+	}
+	body := []byte(op.Content + op.Script)
+	if op.ContentBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(op.ContentBase64)
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "invalid content_base64: %v", err)
+		}
+		body = decoded
+	}
+	sum := sha256.Sum256(body)
+	if checksum := hex.EncodeToString(sum[:]); checksum != op.Checksum {
+		return wouldFail(cxfw.ReasonChecksumMismatch, "checksum mismatch for content of %s", op.Path)
+	}
+	mode := os.FileMode(0644)
+	if op.Mode != "" {
+		parsed, err := parseMode(op.Mode)
+		if err != nil {
+			return wouldFail(cxfw.ReasonInvalidOperation, "%v", err)
+		}
+		mode = parsed
+	}
+	if err := checkPolicy(op.Path, mode); err != nil {
+		return wouldFail(cxfw.ReasonPolicyViolation, "%v", err)
+	}
+	return prediction{state: cxfw.OpWouldSucceed, writes: []plannedWrite{{filepath.Dir(op.Path), int64(len(body))}}}
+}
+
+// checkPolicy reports whether installing path with mode would violate a
+// strict permission policy. Without strict_permissions a real run clamps
+// the mode instead, which is not a failure.
+func checkPolicy(path string, mode os.FileMode) error {
+	if !strictPermissions {
+		return nil
+	}
+	_, err := clampMode(path, mode)
+	return err
+}
+
+// backupWrite is the space the backup of path takes before path is
+// replaced or removed.
+func backupWrite(path string) plannedWrite {
+	write := plannedWrite{dir: cxfw.HostPath(cxfw.BackupDir)}
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		write.bytes = info.Size()
+	}
+	return write
+}
+
+// defaultSpaceReserve is the free space in MiB every filesystem must keep
+// after the patch, for logs and the integrity databases, unless
+// --space-reserve gives another amount.
+const defaultSpaceReserve = 16
+
+// spaceReserve is the free space in bytes every filesystem must keep.
+var spaceReserve int64 = defaultSpaceReserve << 20
+
+// checkSpace adds up the planned writes per filesystem and marks the
+// operations writing to a filesystem that would drop below spaceReserve. It
+// returns the indices of the operations it marked.
+func checkSpace(predictions []prediction) []int {
+	type filesystem struct {
+		dir      string
+		dev      uint64
+		required int64
+		ops      []int
+	}
+	var order []uint64
+	filesystems := make(map[uint64]*filesystem)
+	for i, p := range predictions {
+		if p.state == cxfw.OpWouldFail {
+			continue
+		}
+		for _, write := range p.writes {
+			dir, dev, ok := existingAncestor(write.dir)
+			if !ok {
+				continue
+			}
+			fs := filesystems[dev]
+			if fs == nil {
+				fs = &filesystem{dir: dir, dev: dev}
+				filesystems[dev] = fs
+				order = append(order, dev)
+			}
+			fs.required += write.bytes
+			fs.ops = append(fs.ops, i)
+		}
+	}
+
+	var marked []int
+	for _, dev := range order {
+		fs := filesystems[dev]
+		free := cxfw.FreeSpace(fs.dir)
+		if free < 0 || fs.required+spaceReserve <= free {
+			continue
+		}
+		mount := cxfw.ImagePath(mountPoint(fs.dir, fs.dev))
+		cxfw.RunReport.SpaceShortfalls = append(cxfw.RunReport.SpaceShortfalls, cxfw.SpaceShortfall{
+			Path:          mount,
+			RequiredBytes: fs.required + spaceReserve,
+			FreeBytes:     free,
+		})
+		detail := fmt.Sprintf("insufficient space: need %d MB on %s, have %d MB", megabytes(fs.required+spaceReserve), mount, megabytes(free))
+		cxfw.LogToFile(fmt.Sprintf("ERROR: Insufficient space: need %d MB on %s, have %d MB (%d MB for the patch, %d MB reserve)",
+			megabytes(fs.required+spaceReserve), mount, megabytes(free), megabytes(fs.required), megabytes(spaceReserve)))
+		for _, i := range fs.ops {
+			if predictions[i].state != cxfw.OpWouldFail {
+				predictions[i] = wouldFail(cxfw.ReasonInsufficientSpace, "%s", detail)
+				marked = append(marked, i)
+			}
+		}
+	}
+	return marked
+}
+
+// megabytes rounds bytes up to whole MiB.
+func megabytes(bytes int64) int64 {
+	return (bytes + 1<<20 - 1) >> 20
+}
+
+// mountPoint returns the topmost directory at or above dir on device dev,
+// the mount point of the filesystem holding dir.
+func mountPoint(dir string, dev uint64) string {
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		info, err := os.Stat(parent)
+		if err != nil {
+			return dir
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); !ok || uint64(st.Dev) != dev {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// existingAncestor returns the nearest existing directory at or above dir
+// and the device it lives on.
+func existingAncestor(dir string) (string, uint64, bool) {
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if st, ok := info.Sys().(*syscall.Stat_t); ok {
+				return dir, uint64(st.Dev), true
+			}
+			return "", 0, false
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", 0, false
+		}
+		dir = parent
+	}
+}
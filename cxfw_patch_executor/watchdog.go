@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"cxfw_common/cxfw"
+)
+
+// defaultWatchdogInterval is how often the watchdog is fed unless
+// --watchdog-interval gives another interval.
+const defaultWatchdogInterval = 10 * time.Second
+
+// watchdog is the hardware watchdog device fed during the run, or nil.
+var (
+	watchdogMu   sync.Mutex
+	watchdog     *os.File
+	watchdogStop chan struct{}
+)
+
+// startWatchdog opens the watchdog device at path and feeds it every
+// interval until stopWatchdog, so a long script does not get the device
+// rebooted mid-patch. A device that cannot be opened is logged and the run
+// carries on without it.
+func startWatchdog(path string, interval time.Duration) {
+	device, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		cxfw.LogToFile("WARNING: Failed to open watchdog, continuing without keep-alive - " + err.Error())
+		return
+	}
+	watchdog, watchdogStop = device, make(chan struct{})
+	feedWatchdog()
+	cxfw.LogToFile(fmt.Sprintf("INFO: Feeding watchdog %s every %s", path, interval))
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				feedWatchdog()
+			}
+		}
+	}(watchdogStop)
+}
+
+// feedWatchdog writes a keep-alive to the watchdog.
+func feedWatchdog() {
+	watchdogMu.Lock()
+	defer watchdogMu.Unlock()
+	if watchdog == nil {
+		return
+	}
+	if _, err := watchdog.Write([]byte{0}); err != nil {
+		cxfw.LogToFile("WARNING: Failed to feed watchdog - " + err.Error())
+	}
+}
+
+// stopWatchdog stops feeding the watchdog and disarms it with the magic
+// close, writing 'V' before closing the device.
+func stopWatchdog() {
+	watchdogMu.Lock()
+	defer watchdogMu.Unlock()
+	if watchdog == nil {
+		return
+	}
+	close(watchdogStop)
+	if _, err := watchdog.Write([]byte("V")); err != nil {
+		cxfw.LogToFile("WARNING: Failed to disarm watchdog - " + err.Error())
+	}
+	if err := watchdog.Close(); err != nil {
+		cxfw.LogToFile("WARNING: Failed to close watchdog - " + err.Error())
+	} else {
+		cxfw.LogToFile("INFO: Watchdog disarmed")
+	}
+	watchdog = nil
+}
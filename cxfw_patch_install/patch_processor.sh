@@ -9,6 +9,21 @@ DB_FILE="/newroot/data/sysconf.db"
 METADATA_FILE="/newroot/data/metadata.json"
 PATCH_FILE="/sda1/data/cxfw/patch/patch.cx"
 EXTRACT_DIR="/tmp/patch"
+REPORT_FILE="/tmp/cxfw_report.json"
+
+# Remediation of the last executor failure, shown by the UI with the status
+REMEDIATION_CODE=""
+REMEDIATION_HINT=""
+
+# USB patches: bundles on removable media are named cxfw_patch*.cx, with the
+# metadata in <bundle>.json and ed25519 signatures of the bundle in
+# <bundle>.sig and of the metadata in <bundle>.json.sig. They are staged to
+# internal flash before anything is verified.
+USB_STAGING_DIR="/sda1/data/cxfw/usb"
+USB_STATUS_FILE="$USB_STAGING_DIR/status.json"
+USB_APPROVAL_FILE="$USB_STAGING_DIR/approved"
+USB_PUBLIC_KEY="/cxfw/usb_signing_key.pem"
+MODEL_FILE="/sda1/data/.model"
 
 # Logging functions with levels
 debug() { echo "[DEBUG] $(date '+%Y-%m-%d %H:%M:%S') $1" >> "$LOG_FILE"; }
@@ -18,6 +33,7 @@ error() { echo "[ERROR] $(date '+%Y-%m-%d %H:%M:%S') $1" >> "$LOG_FILE"; }
 # Generic error handler
 handle_error() {
     error "$1"
+    [ "$usb_scan" = "1" ] && { write_usb_status "fail" "$1" >/dev/null 2>&1 || true; }
     update_metadata_status "fail" >/dev/null 2>&1 || true
     exit 1
 }
@@ -59,7 +75,9 @@ update_metadata_status() {
 
     # Use jq to update the status safely, writing to a temp file first
     tmp_file="/tmp/metadata_temp.json"
-    jq --arg status "$status" '.status = $status' "$METADATA_FILE" > "$tmp_file" 2>> "$LOG_FILE" || handle_error "Failed to update metadata.json"
+    jq --arg status "$status" --arg code "$REMEDIATION_CODE" --arg hint "$REMEDIATION_HINT" \
+        '.status = $status | if $code == "" then del(.remediation) else .remediation = {code: $code, hint: $hint} end' \
+        "$METADATA_FILE" > "$tmp_file" 2>> "$LOG_FILE" || handle_error "Failed to update metadata.json"
 
     # Verify the temp file is not empty and contains valid JSON before replacing the original
     if [ -s "$tmp_file" ] && jq empty "$tmp_file" 2>> "$LOG_FILE"; then
@@ -104,6 +122,15 @@ create_defaultvalues_reversal() {
     log "Successfully created defaultvalues_reversal.json"
 }
 
+# Read the remediation of a failed run from the executor report
+read_remediation() {
+    [ -f "$REPORT_FILE" ] || return 0
+    REMEDIATION_CODE=$(jq -r '.remediation.code // empty' "$REPORT_FILE" 2>> "$LOG_FILE")
+    REMEDIATION_HINT=$(jq -r '.remediation.hint // empty' "$REPORT_FILE" 2>> "$LOG_FILE")
+    [ -n "$REMEDIATION_CODE" ] && log "Remediation: $REMEDIATION_CODE - $REMEDIATION_HINT"
+    return 0
+}
+
 # Install patch_manifest.json
 install_patch_manifest() {
     log "Installing patch using patch_manifest.json"
@@ -114,12 +141,14 @@ install_patch_manifest() {
     fi
 
     # Run the patch executor
-    /cxfw/cxfw_patch_executor "$EXTRACT_DIR/patch_manifest.json" 2>> "$LOG_FILE"
+    rm -f "$REPORT_FILE"
+    /cxfw/cxfw_patch_executor --report "$REPORT_FILE" "$EXTRACT_DIR/patch_manifest.json" 2>> "$LOG_FILE"
     
     # Capture exit status
     exit_status=$?
     
     if [ $exit_status -ne 0 ]; then
+        read_remediation
         handle_error "Failed to install patch_manifest.json (exit code: $exit_status)"
     fi
 
@@ -182,6 +211,167 @@ EOF
 
 
 
+# Write the USB patch status shown by the UI, replacing the file atomically.
+# The patch name and description are only shown once the metadata signature
+# has been verified.
+write_usb_status() {
+    status="$1"
+    detail="$2"
+    staged_metadata="$USB_STAGING_DIR/metadata.json"
+    tmp_file="$USB_STATUS_FILE.tmp"
+    if [ "$usb_metadata_verified" = "1" ] && [ -f "$staged_metadata" ] && jq empty "$staged_metadata" 2>/dev/null; then
+        jq --arg status "$status" --arg detail "$detail" --arg code "$REMEDIATION_CODE" --arg hint "$REMEDIATION_HINT" \
+            '{status: $status, detail: $detail, patch_name: .patch_name, patch_version: .patch_version, description: .description, checksum: .checksum}
+            + if $code == "" then {} else {remediation: {code: $code, hint: $hint}} end' \
+            "$staged_metadata" > "$tmp_file" 2>> "$LOG_FILE"
+    else
+        jq -n --arg status "$status" --arg detail "$detail" '{status: $status, detail: $detail}' > "$tmp_file" 2>> "$LOG_FILE"
+    fi
+    mv "$tmp_file" "$USB_STATUS_FILE" 2>> "$LOG_FILE"
+    log "USB patch status: $status $detail"
+}
+
+# USB error handler: record why the patch was rejected for the UI and drop
+# the staged patch so it is not offered again
+handle_usb_error() {
+    error "$1"
+    write_usb_status "rejected" "$1" || true
+    rm -f "$USB_STAGING_DIR/patch.cx" "$USB_STAGING_DIR/patch.cx.sig" "$USB_STAGING_DIR/metadata.json.sig"
+    exit 1
+}
+
+# List the mount points of removable block devices other than /sda1, with
+# spaces escaped as \040 the way /proc/mounts has them
+find_usb_mounts() {
+    while read -r device mount_point rest; do
+        case "$device" in
+            /dev/sd*) ;;
+            *) continue ;;
+        esac
+        [ "$mount_point" = "/sda1" ] && continue
+        disk=$(basename "$device" | sed 's/[0-9]*$//')
+        if [ "$(cat "/sys/block/$disk/removable" 2>/dev/null)" = "1" ] || readlink -f "/sys/block/$disk" | grep -q "/usb"; then
+            echo "$mount_point"
+        fi
+    done < /proc/mounts
+}
+
+# Find the single patch bundle on the mounted removable media
+find_usb_bundle() {
+    bundles=""
+    count=0
+    for mount_point in $(find_usb_mounts); do
+        mount_point=$(printf '%s' "$mount_point" | sed 's/\\040/ /g')
+        for bundle in "$mount_point"/cxfw_patch*.cx; do
+            [ -f "$bundle" ] || continue
+            bundles="$bundle"
+            count=$((count + 1))
+            log "Found USB patch bundle $bundle"
+        done
+    done
+    [ "$count" -gt 1 ] && handle_usb_error "Found $count patch bundles on removable media, expected one"
+    printf '%s' "$bundles"
+}
+
+# Copy the bundle, metadata and signatures to internal flash. Everything is
+# verified on the staged copies, so removing the stick afterwards is safe.
+stage_usb_bundle() {
+    bundle="$1"
+    base="${bundle%.cx}"
+    for file in "$bundle" "$base.json" "$base.sig" "$base.json.sig"; do
+        [ -f "$file" ] || handle_usb_error "Missing $(basename "$file") next to $(basename "$bundle")"
+    done
+    rm -f "$USB_STAGING_DIR/patch.cx" "$USB_STAGING_DIR/patch.cx.sig" "$USB_STAGING_DIR/metadata.json" "$USB_STAGING_DIR/metadata.json.sig"
+    cp "$bundle" "$USB_STAGING_DIR/patch.cx.tmp" 2>> "$LOG_FILE" &&
+        cp "$base.sig" "$USB_STAGING_DIR/patch.cx.sig.tmp" 2>> "$LOG_FILE" &&
+        cp "$base.json" "$USB_STAGING_DIR/metadata.json.tmp" 2>> "$LOG_FILE" &&
+        cp "$base.json.sig" "$USB_STAGING_DIR/metadata.json.sig.tmp" 2>> "$LOG_FILE" &&
+        sync || handle_usb_error "Failed to copy the patch from removable media, was it removed?"
+    mv "$USB_STAGING_DIR/patch.cx.tmp" "$USB_STAGING_DIR/patch.cx" &&
+        mv "$USB_STAGING_DIR/patch.cx.sig.tmp" "$USB_STAGING_DIR/patch.cx.sig" &&
+        mv "$USB_STAGING_DIR/metadata.json.tmp" "$USB_STAGING_DIR/metadata.json" &&
+        mv "$USB_STAGING_DIR/metadata.json.sig.tmp" "$USB_STAGING_DIR/metadata.json.sig" 2>> "$LOG_FILE" ||
+        handle_usb_error "Failed to stage the patch"
+    log "Staged $(basename "$bundle") to $USB_STAGING_DIR"
+}
+
+# Verify the staged patch: signatures, metadata, checksum and device model.
+# The metadata is signed separately, since its models list and description
+# are trusted on their own, not only its checksum of the bundle.
+verify_usb_bundle() {
+    staged="$USB_STAGING_DIR/patch.cx"
+    [ -f "$USB_PUBLIC_KEY" ] || handle_usb_error "Signing key $USB_PUBLIC_KEY not found"
+    openssl pkeyutl -verify -pubin -inkey "$USB_PUBLIC_KEY" -rawin -in "$staged" -sigfile "$staged.sig" >> "$LOG_FILE" 2>&1 ||
+        handle_usb_error "Signature verification failed for the USB patch"
+    [ -f "$USB_STAGING_DIR/metadata.json.sig" ] || handle_usb_error "Missing signature of the USB patch metadata"
+    openssl pkeyutl -verify -pubin -inkey "$USB_PUBLIC_KEY" -rawin -in "$USB_STAGING_DIR/metadata.json" -sigfile "$USB_STAGING_DIR/metadata.json.sig" >> "$LOG_FILE" 2>&1 ||
+        handle_usb_error "Signature verification failed for the USB patch metadata"
+    usb_metadata_verified=1
+    log "Signature verification successful"
+
+    jq empty "$USB_STAGING_DIR/metadata.json" 2>> "$LOG_FILE" || handle_usb_error "Invalid patch metadata"
+    expected_checksum=$(jq -r '.checksum // empty' "$USB_STAGING_DIR/metadata.json")
+    actual_checksum=$(sha256sum "$staged" | cut -d' ' -f1)
+    [ "$actual_checksum" != "$expected_checksum" ] && handle_usb_error "Checksum mismatch. Expected: $expected_checksum, Got: $actual_checksum"
+
+    # An optional "models" list in the metadata restricts the patch to those models
+    if [ "$(jq -r 'has("models")' "$USB_STAGING_DIR/metadata.json")" = "true" ]; then
+        model=$(cat "$MODEL_FILE" 2>/dev/null | tr -d '[:space:]')
+        [ -n "$model" ] || handle_usb_error "Patch is restricted to specific models and $MODEL_FILE is missing"
+        jq -e --arg model "$model" '.models | index($model)' "$USB_STAGING_DIR/metadata.json" > /dev/null ||
+            handle_usb_error "Patch is not compatible with device model $model"
+    fi
+    log "USB patch verified"
+}
+
+# Move the verified staged patch to where process_patch expects it
+install_usb_bundle() {
+    mkdir -p "$(dirname "$PATCH_FILE")" 2>> "$LOG_FILE" || handle_usb_error "Failed to create $(dirname "$PATCH_FILE")"
+    mv "$USB_STAGING_DIR/patch.cx" "$PATCH_FILE" 2>> "$LOG_FILE" || handle_usb_error "Failed to install the staged patch"
+    cp "$USB_STAGING_DIR/metadata.json" "$METADATA_FILE.tmp" 2>> "$LOG_FILE" &&
+        mv "$METADATA_FILE.tmp" "$METADATA_FILE" 2>> "$LOG_FILE" || handle_usb_error "Failed to install the staged metadata"
+    rm -f "$USB_STAGING_DIR/patch.cx.sig" "$USB_STAGING_DIR/metadata.json.sig" "$USB_APPROVAL_FILE"
+}
+
+# Stage and verify a patch from removable media, then apply it once approved.
+# The UI approves by writing the patch checksum to the approval file and
+# running --usb-scan again; the stick may be removed by then.
+process_usb_patch() {
+    auto_approve="$1"
+    mkdir -p "$USB_STAGING_DIR" 2>> "$LOG_FILE" || handle_usb_error "Failed to create $USB_STAGING_DIR"
+
+    bundle=$(find_usb_bundle) || exit 1
+    if [ -n "$bundle" ]; then
+        write_usb_status "staging" ""
+        stage_usb_bundle "$bundle"
+    elif [ ! -f "$USB_STAGING_DIR/patch.cx" ]; then
+        log "No USB patch bundle found"
+        exit 0
+    fi
+    verify_usb_bundle
+
+    checksum=$(jq -r '.checksum' "$USB_STAGING_DIR/metadata.json")
+    if [ -f "$DB_FILE" ] && [ "$(sqlite3 "$DB_FILE" "SELECT EXISTS(SELECT 1 FROM MD5SUM WHERE Md5Sum = '$checksum')" 2>> "$LOG_FILE")" = "1" ]; then
+        rm -f "$USB_STAGING_DIR/patch.cx" "$USB_STAGING_DIR/patch.cx.sig" "$USB_STAGING_DIR/metadata.json.sig" "$USB_APPROVAL_FILE"
+        write_usb_status "already_applied" ""
+        exit 0
+    fi
+
+    if [ "$auto_approve" = "1" ]; then
+        log "USB patch approved automatically"
+    elif [ "$(cat "$USB_APPROVAL_FILE" 2>/dev/null | tr -d '[:space:]')" = "$checksum" ]; then
+        log "USB patch approved on the device"
+    else
+        write_usb_status "pending_approval" ""
+        exit 0
+    fi
+
+    write_usb_status "applying" ""
+    install_usb_bundle
+    process_patch
+    write_usb_status "success" ""
+}
+
 # Main processing function
 process_patch() {
     if [ ! -f "$PATCH_FILE" ]; then
@@ -203,12 +393,26 @@ process_patch() {
 
 # Main execution
 main() {
+    usb_scan=0
+    auto_approve=0
+    for arg in "$@"; do
+        case "$arg" in
+            --usb-scan) usb_scan=1 ;;
+            --auto-approve) auto_approve=1 ;;
+            *) echo "Usage: $0 [--usb-scan [--auto-approve]]" >&2; exit 2 ;;
+        esac
+    done
+
     init_logging
     mount_sda1
-    process_patch
+    if [ "$usb_scan" = "1" ]; then
+        process_usb_patch "$auto_approve"
+    else
+        process_patch
+    fi
     log "Script execution completed successfully"
     exit 0
 }
 
 # Start script
-main
\ No newline at end of file
+main "$@"
\ No newline at end of file
@@ -1,3 +1,7 @@
 module cxfw_patch_rollback
 
 go 1.24.0
+
+require cxfw_common v0.0.0
+
+replace cxfw_common => ../cxfw_common
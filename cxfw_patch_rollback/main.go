@@ -1,67 +1,165 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
-)
-
-type Manifest struct {
-	Version    string      `json:"version"`
-	Operations []Operation `json:"operations"`
-}
 
-type Operation struct {
-	Operation string                       `json:"operation"`
-	Path      string                       `json:"path,omitempty"`
-	Source    string                       `json:"source,omitempty"`
-	Checksum  string                       `json:"checksum,omitempty"`
-	Size      int64                        `json:"size,omitempty"`
-	Command   string                       `json:"command,omitempty"`
-	Script    string                       `json:"script_content,omitempty"`
-	Entries   map[string]map[string]string `json:"entries,omitempty"`
-}
-
-// Structure for integrity database entries
-type IntegrityEntry struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
-}
-
-// Structure for folder-specific JSON content (e.g., .apps.json, .basic.json)
-type FolderEntry struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
-}
-
-const logFile = "/newroot/var/log/cxfw_patch.log"
+	"cxfw_common/cxfw"
+)
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: cxfw_patch_rollback <manifest.json>")
-		os.Exit(1)
+	allowLegacyVersion := flag.Bool("allow-legacy-version", false, "accept a manifest version outside the MAJOR.MINOR[.PATCH] format")
+	logFile := flag.String("log-file", cxfw.EnvDefault("CXFW_LOG_FILE", cxfw.DefaultLogFile), "write the log to this file, defaults to $CXFW_LOG_FILE if set")
+	backupDir := flag.String("backup-dir", cxfw.EnvDefault("CXFW_BACKUP_DIR", cxfw.DefaultBackupDir), "restore backups from this directory, defaults to $CXFW_BACKUP_DIR if set")
+	readStdin := flag.Bool("stdin", false, "read the manifest from standard input, like the manifest argument -")
+	requireLog := flag.Bool("require-log", false, "fail at startup if the log file cannot be written, instead of logging to standard error")
+	runID := flag.String("run-id", "", "stamp the log with this run ID, e.g. the ID of the run being rolled back; a random ID by default")
+	logFormat := flag.String("log-format", cxfw.LogFormatPlain, "write log entries as plain lines or as json objects, one per line")
+	logLevel := flag.String("log-level", cxfw.EnvDefault("CXFW_LOG_LEVEL", "info"), "write log entries of this level and above: debug, info, warn or error; defaults to $CXFW_LOG_LEVEL if set")
+	logMaxSize := flag.Int64("log-max-size", cxfw.DefaultLogMaxSize>>10, "rotate the log once it would grow past this many KiB, 0 to never rotate")
+	logKeep := flag.Int("log-keep", cxfw.DefaultLogKeep, "keep this many rotated logs, 0 to discard the old log on rotation")
+	outputLimit := flag.Int64("output-limit", cxfw.DefaultOutputLimit>>10, "log at most this many KiB of the output of each command or script")
+	flag.StringVar(&cxfw.ReportPath, "report", cxfw.DefaultReportFile, "write a JSON report of the run to this file, empty for none")
+	flag.StringVar(&cxfw.ProgressPath, "progress-file", cxfw.DefaultProgressFile, "keep the progress of the run in this JSON file for the on-device UI, empty for none")
+	progressFD := flag.Int("progress-fd", 0, "also write every progress update as a JSON line to this inherited file descriptor, 0 for none")
+	lockPath := flag.String("lock-file", cxfw.DefaultLockFile, "serialize patch and rollback runs with a lock on this file")
+	flag.BoolVar(&cxfw.RebuildDatabases, "rebuild-db", false, "regenerate an integrity database that neither it nor its .db.json.bak backup decrypts by hashing the files in its directory")
+	flag.BoolVar(&cxfw.Verbose, "verbose", false, "mirror every log entry to standard output")
+	flag.BoolVar(&cxfw.Quiet, "quiet", false, "print nothing to standard output, not even the final exit code line")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: cxfw_patch_rollback [options] <manifest.json>")
+		fmt.Fprintln(flag.CommandLine.Output(), "       A manifest argument of - or --stdin without an argument reads the manifest from standard input.")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	cxfw.RunReport.Mode = "rollback"
+	if *showVersion {
+		fmt.Println(cxfw.Version)
+		return
+	}
+	manifestPath := flag.Arg(0)
+	if *readStdin && flag.NArg() == 0 {
+		manifestPath = cxfw.StdinManifest
+	} else if flag.NArg() != 1 || *readStdin {
+		flag.Usage()
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if cxfw.Verbose && cxfw.Quiet {
+		flag.Usage()
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetRunID(*runID); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetLogFormat(*logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetLogLevel(*logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetLogRotation(*logMaxSize<<10, *logKeep); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetOutputLimit(*outputLimit << 10); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	if err := cxfw.SetProgressFD(*progressFD); err != nil {
+		fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+		os.Exit(cxfw.ExitInvalidArguments)
+	}
+	// The log directory is only created for an explicit log file
+	if *logFile != cxfw.DefaultLogFile {
+		if err := cxfw.SetLogFile(*logFile); err != nil {
+			fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+			os.Exit(cxfw.ExitInvalidArguments)
+		}
+	}
+	if *requireLog {
+		if err := cxfw.CheckLogFile(); err != nil {
+			fmt.Fprintln(os.Stderr, "cxfw_patch_rollback: "+err.Error())
+			// A full or read-only log filesystem keeps its storage exit code
+			code, reason := cxfw.ExitCodeForError(err), cxfw.ReasonForError(err)
+			if code == cxfw.ExitFailure {
+				code, reason = cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments
+			}
+			cxfw.FinishRun(code, reason, err.Error())
+		}
 	}
 
-	manifestPath := os.Args[1]
-	logToFile("========== CloudX Firmware Patch Rollback Execution Started ==========")
-	logToFile("Loading manifest: " + manifestPath)
+	cxfw.LogToFile("========== CloudX Firmware Patch Rollback Execution Started ==========")
+	cxfw.HandleSignals()
+	cxfw.LockRun(*lockPath, []string{manifestPath})
+	if err := cxfw.SetBackupDir(*backupDir); err != nil {
+		cxfw.LogToFile("ERROR: Invalid backup directory - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidArguments, cxfw.ReasonInvalidArguments, err.Error())
+	}
+	if cxfw.BackupDir != cxfw.DefaultBackupDir {
+		cxfw.LogToFile("INFO: Restoring backups from " + cxfw.BackupDir)
+		if err := os.MkdirAll(cxfw.BackupDir, 0755); err != nil {
+			cxfw.LogToFile("ERROR: Failed to create backup directory - " + err.Error())
+			cxfw.FinishRun(cxfw.ExitCodeForError(err), cxfw.ReasonForError(err), err.Error())
+		}
+	}
+	cxfw.LogToFile("Loading manifest: " + cxfw.ManifestName(manifestPath))
 
-	manifest, err := loadManifest(manifestPath)
+	data, err := cxfw.ReadManifest(manifestPath)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to load manifest - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+	}
+	if manifestPath == cxfw.StdinManifest {
+		cxfw.LogToFile(fmt.Sprintf("INFO: Received %d bytes of manifest on standard input (sha256 %s)", len(data), cxfw.ManifestDigest(data)))
+	}
+	manifest, err := cxfw.ParseManifest(data)
+	if err != nil {
+		cxfw.LogToFile("ERROR: Failed to load manifest - " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
+	}
+	legacy, err := cxfw.NormalizeVersion(manifest, *allowLegacyVersion)
 	if err != nil {
-		logToFile("ERROR: Failed to load manifest - " + err.Error())
-		os.Exit(1)
+		cxfw.LogToFile("ERROR: " + err.Error())
+		cxfw.FinishRun(cxfw.ExitInvalidManifest, cxfw.ReasonInvalidManifest, err.Error())
 	}
+	cxfw.RunReport.ManifestVersion = manifest.Version
+	if legacy {
+		cxfw.LogToFile(fmt.Sprintf("WARNING: Accepted legacy manifest version %q, using identifier %s", manifest.Version, manifest.VersionID))
+	}
+
+	// Fail before any modification if the database key cannot be extracted
+	if slices.ContainsFunc(manifest.Operations, operationNeedsKey) {
+		if _, err := cxfw.ExtractKeyFromImage(); err != nil {
+			cxfw.LogToFile("ERROR: Key self-test failed, no changes made - " + err.Error())
+			cxfw.ReportNotRun(manifest.Operations, 0)
+			cxfw.FinishRun(cxfw.ExitKeyUnavailable, cxfw.ReasonKeyUnavailable, err.Error())
+		}
+		cxfw.LogToFile("INFO: Key self-test passed")
+	}
+
+	for i, op := range manifest.Operations {
+		if cxfw.Interrupted() {
+			cxfw.ReportNotRun(manifest.Operations, i)
+			cxfw.StopInterrupted()
+		}
+		cxfw.SetLogOperation(i, op)
+		cxfw.LogToFile(cxfw.OperationStartMessage(i, len(manifest.Operations), op))
+		cxfw.StartProgress(i, len(manifest.Operations), op)
+		result := cxfw.OperationResultFor(i, op)
+		opStart := time.Now()
 
-	for _, op := range manifest.Operations {
 		var err error
 		switch op.Operation {
 		case "add":
@@ -72,509 +170,450 @@ func main() {
 			err = executeCommand(op)
 		case "script":
 			err = executeScript(op)
+		case "remove_block":
+			err = removeBlock(op)
+		case "restore_integrity":
+			err = restoreIntegrity(op)
+		case "user":
+			err = provisionUser(op)
 		default:
-			logToFile("ERROR: Unknown operation - " + op.Operation)
+			cxfw.LogToFile("ERROR: Unknown operation - " + op.Operation)
+			err = fmt.Errorf("%w %q", cxfw.ErrUnknownOperation, op.Operation)
 		}
+		result.DurationMs = time.Since(opStart).Milliseconds()
+		result.State = cxfw.OpSucceeded
 		if err != nil {
-			logToFile("ERROR: Failed to execute operation - " + op.Operation)
-			logToFile("Execution stopped due to error.")
-			os.Exit(1)
+			result.State, result.Reason, result.Detail = cxfw.OpFailed, cxfw.ReasonForError(err), err.Error()
+			if cxfw.Interrupted() {
+				result.Reason = cxfw.ReasonInterrupted
+			}
+		}
+		cxfw.RunReport.Operations = append(cxfw.RunReport.Operations, result)
+		if err != nil {
+			cxfw.ReportNotRun(manifest.Operations, i+1)
+			cxfw.LogToFile("ERROR: Failed to execute operation - " + op.Operation)
+			if result.Reason == cxfw.ReasonInterrupted {
+				cxfw.StopInterrupted()
+			}
+			if errors.Is(err, syscall.EIO) {
+				// Stop writing to the failing filesystem and ask for a technician
+				cxfw.LogToFile("ERROR: Storage I/O error, no further writes attempted - device needs service")
+			}
+			cxfw.LogToFile("Execution stopped due to error.")
+			code := cxfw.ExitCodeForError(err)
+			if code == cxfw.ExitFailure {
+				code = cxfw.ExitRollbackFailed
+			}
+			cxfw.FinishRun(code, result.Reason, result.Detail)
 		}
 	}
-	logToFile("========== CloudX Firmware Patch Rollback Execution Completed ==========")
-}
-
-func logToFile(message string) {
-	logEntry := time.Now().Format("2006-01-02 15:04:05") + " | " + message + "\n"
-	file, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err == nil {
-		defer file.Close()
-		file.WriteString(logEntry)
-	}
-}
-
-func loadManifest(path string) (*Manifest, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var manifest Manifest
-	if err := json.Unmarshal(data, &manifest); err != nil {
-		return nil, err
-	}
-	return &manifest, nil
+	cxfw.ClearLogOperation()
+	cxfw.LogToFile("Total execution time: " + time.Since(cxfw.RunStart).Round(time.Millisecond).String())
+	cxfw.LogToFile("========== CloudX Firmware Patch Rollback Execution Completed ==========")
+	cxfw.FinishRun(0, "", "")
 }
 
-func computeChecksum(filePath string) (string, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return "", err
+func addFile(op cxfw.Operation) error {
+	if op.Path == "" || (op.Source == "") == (len(op.Files) == 0) {
+		cxfw.LogToFile("ERROR: Invalid add operation, expected a path and either source or files")
+		return fmt.Errorf("invalid add operation, expected a path and either source or files")
 	}
-	defer file.Close()
-
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(hash.Sum(nil)), nil
-}
-
-func addFile(op Operation) error {
-	if op.Source == "" || op.Path == "" {
-		logToFile("ERROR: Invalid add operation, missing source or path")
-		return fmt.Errorf("invalid add operation, missing source or path")
+	if len(op.Files) > 0 {
+		return addFiles(op)
 	}
 	// The destination path is provided in op.Path (e.g., "/sda1/data/basic/app2.bin")
 	destFile := op.Path
-	sourceFile := op.Source // e.g., "/sda1/data/restore/backup/_sda1_data_basic_app2.bin"
+	sourceFile := cxfw.ResolveBackupSource(op.Path, op.Source) // e.g., "/sda1/data/restore/backup/_sda1_data_basic_app2.bin"
 
 	// Step 1: Create destination directory if it doesn't exist
 	destDir := filepath.Dir(destFile)
 	if err := os.MkdirAll(destDir, 0755); err != nil {
-		logToFile("ERROR: Failed to create directory - " + destDir)
+		cxfw.LogToFile("ERROR: Failed to create directory - " + destDir)
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	// Step 2: Copy file from source to destination
-	logToFile("INFO: Copying file from " + sourceFile + " to " + destFile)
-	err := copyFile(sourceFile, destFile)
-	if err != nil {
-		logToFile("ERROR: Failed to copy file - " + err.Error())
-		return fmt.Errorf("failed to copy file: %w", err)
-	}
-
-	// Step 3: Compute and verify checksums
-	sourceChecksum, err := computeChecksum(sourceFile)
+	// Steps 2 and 3: Copy the backup over the destination and verify the copy
+	destChecksum, err := restoreFile(sourceFile, destFile)
 	if err != nil {
-		logToFile("ERROR: Failed to compute source checksum - " + err.Error())
-		return fmt.Errorf("failed to compute source checksum: %w", err)
-	}
-
-	destChecksum, err := computeChecksum(destFile)
-	if err != nil {
-		logToFile("ERROR: Failed to compute destination checksum - " + err.Error())
-		return fmt.Errorf("failed to compute destination checksum: %w", err)
-	}
-
-	if sourceChecksum != destChecksum {
-		logToFile("ERROR: Checksum mismatch for copied file " + destFile)
-		return fmt.Errorf("checksum mismatch for %s: source %s, got %s", destFile, sourceChecksum, destChecksum)
+		return err
 	}
-	logToFile("INFO: File checksum verified successfully - " + destFile)
+	cxfw.LogToFile("DEBUG: File checksum verified successfully - " + destFile)
 
 	// Step 4: Update integrity database with the verified hash
-	dbHash, err := updateIntegrityDatabase(destFile, destChecksum)
+	dbHash, err := cxfw.UpdateIntegrityDatabase(destFile, destChecksum)
 	if err != nil {
-		logToFile("ERROR: Failed to update integrity database - " + err.Error())
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
 		return fmt.Errorf("failed to update integrity database: %w", err)
 	}
 
 	// Step 5: Update folder-specific JSON file
-	err = updateFolderFile(destDir, dbHash)
+	err = cxfw.UpdateFolderFile(destDir, dbHash)
 	if err != nil {
-		logToFile("ERROR: Failed to update folder file - " + err.Error())
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
 		return fmt.Errorf("failed to update folder file: %w", err)
 	}
 
 	// Step 6: Remove source file after successful verification and DB update
 	err = os.Remove(sourceFile)
 	if err != nil {
-		logToFile("WARNING: Failed to remove source file - " + err.Error())
+		cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
 		return fmt.Errorf("failed to remove source file: %w", err)
 	}
+	if err := cxfw.ForgetBackup(sourceFile); err != nil {
+		cxfw.LogToFile("WARNING: Failed to update backup index - " + err.Error())
+	}
 
-	logToFile("SUCCESS: File added and verified successfully - " + destFile)
+	cxfw.LogToFile("SUCCESS: File added and verified successfully - " + destFile)
 	return nil
 }
 
-// Helper function to copy file contents
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+// restoreFile copies the backup sourceFile over destFile through a temp file
+// next to it, like the executor installs files, so a power cut never leaves
+// a truncated destFile. The copy is verified against the backup before it
+// replaces destFile. It returns the checksum of the restored file.
+func restoreFile(sourceFile, destFile string) (string, error) {
+	sourceChecksum, err := cxfw.ComputeChecksum(sourceFile)
 	if err != nil {
-		return err
+		cxfw.LogToFile("ERROR: Failed to compute source checksum - " + err.Error())
+		return "", fmt.Errorf("failed to compute source checksum: %w", err)
 	}
-	defer sourceFile.Close()
+	cxfw.LogToFile("DEBUG: Copying file from " + sourceFile + " to " + destFile)
+	return cxfw.InstallAtomic(destFile, func(temp string) (string, error) {
+		destChecksum, err := cxfw.CopyFileChecksum(sourceFile, temp, nil)
+		if err != nil {
+			cxfw.LogToFile("ERROR: Failed to copy file - " + err.Error())
+			return "", fmt.Errorf("failed to copy file %s: %w", sourceFile, err)
+		}
+		if destChecksum != sourceChecksum {
+			cxfw.LogToFile("ERROR: Checksum mismatch for copied file " + destFile)
+			return "", fmt.Errorf("%w for %s: source %s, got %s", cxfw.ErrChecksumMismatch, destFile, sourceChecksum, destChecksum)
+		}
+		return destChecksum, nil
+	})
+}
 
-	destFile, err := os.Create(dst)
-	if err != nil {
-		return err
+// addFiles restores the backups of a batch remove into the directory
+// op.Path, each as its name, then records them in the integrity database
+// and folder file with one rewrite each. Files without a backup were
+// already absent when the patch ran and are skipped.
+func addFiles(op cxfw.Operation) error {
+	// Step 1: Create destination directory if it doesn't exist
+	if err := os.MkdirAll(op.Path, 0755); err != nil {
+		cxfw.LogToFile("ERROR: Failed to create directory - " + op.Path)
+		return fmt.Errorf("failed to create directory: %w", err)
 	}
-	defer destFile.Close()
 
-	_, err = io.Copy(destFile, sourceFile)
-	if err != nil {
-		return err
+	// Step 2: Copy each backup and verify the copy
+	var restored []cxfw.IntegrityEntry
+	var sources []string
+	for _, file := range op.Files {
+		name := file.Name
+		if name == "" || name != filepath.Base(name) || file.Source == "" {
+			cxfw.LogToFile("ERROR: Invalid batch entry, expected a source and a plain file name")
+			return fmt.Errorf("invalid batch entry, expected a source and a plain file name")
+		}
+		destFile := filepath.Join(op.Path, name)
+		sourceFile := cxfw.ResolveBackupSource(destFile, file.Source)
+		if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
+			// The patch skipped files that were already absent
+			cxfw.LogToFile("WARNING: No backup of " + destFile + ", skipping - " + sourceFile)
+			continue
+		}
+
+		destChecksum, err := restoreFile(sourceFile, destFile)
+		if err != nil {
+			return err
+		}
+		restored = append(restored, cxfw.IntegrityEntry{Path: destFile, Hash: destChecksum})
+		sources = append(sources, sourceFile)
 	}
 
-	// Ensure file permissions are preserved
-	srcInfo, err := os.Stat(src)
+	if len(restored) == 0 {
+		cxfw.LogToFile("SUCCESS: No files to restore - " + op.Path)
+		return nil
+	}
+
+	// Step 3: Update integrity database and folder-specific JSON file once
+	dbHash, err := cxfw.UpdateIntegrityEntries(op.Path, restored)
 	if err != nil {
-		return err
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+		return fmt.Errorf("failed to update integrity database: %w", err)
+	}
+	if err := cxfw.UpdateFolderFile(op.Path, dbHash); err != nil {
+		cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+		return fmt.Errorf("failed to update folder file: %w", err)
+	}
+
+	// Step 4: Remove the backups after successful verification and DB update
+	for _, sourceFile := range sources {
+		if err := os.Remove(sourceFile); err != nil {
+			cxfw.LogToFile("WARNING: Failed to remove source file - " + err.Error())
+			return fmt.Errorf("failed to remove source file: %w", err)
+		}
+		if err := cxfw.ForgetBackup(sourceFile); err != nil {
+			cxfw.LogToFile("WARNING: Failed to update backup index - " + err.Error())
+		}
 	}
-	return os.Chmod(dst, srcInfo.Mode())
+
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: %d files restored and verified successfully - %s", len(restored), op.Path))
+	return nil
 }
 
-func removeFile(op Operation) error {
-	if op.Path == "" {
-		logToFile("ERROR: Invalid remove operation, missing path")
-		return fmt.Errorf("invalid remove operation, missing path")
+func removeFile(op cxfw.Operation) error {
+	if (op.Path == "") == (len(op.Paths) == 0) {
+		cxfw.LogToFile("ERROR: Invalid remove operation, expected either path or paths")
+		return fmt.Errorf("invalid remove operation, expected either path or paths")
+	}
+	if len(op.Paths) > 0 {
+		return removeFiles(op)
 	}
 
 	// Step 1: Calculate and store the hash of the file to be removed
 	var fileHash string
 	if _, err := os.Stat(op.Path); err == nil {
-		hash, err := computeChecksum(op.Path)
+		hash, err := cxfw.ComputeChecksum(op.Path)
 		if err != nil {
-			logToFile("ERROR: Failed to compute file checksum - " + err.Error())
+			cxfw.LogToFile("ERROR: Failed to compute file checksum - " + err.Error())
 			return fmt.Errorf("failed to compute file checksum: %w", err)
 		}
 		fileHash = hash
-		logToFile("INFO: Computed hash for file to be removed: " + op.Path + " - " + fileHash)
+		cxfw.LogToFile("DEBUG: Computed hash for file to be removed: " + op.Path + " - " + fileHash)
 	} else if os.IsNotExist(err) {
-		logToFile("WARNING: File does not exist, proceeding with database cleanup - " + op.Path)
+		cxfw.LogToFile("WARNING: File does not exist, proceeding with database cleanup - " + op.Path)
 	} else {
-		logToFile("ERROR: Failed to check file existence - " + err.Error())
+		cxfw.LogToFile("ERROR: Failed to check file existence - " + err.Error())
 		return fmt.Errorf("failed to check file existence: %w", err)
 	}
 
 	// Step 2: Remove the file from the path
 	if _, err := os.Stat(op.Path); err == nil {
-		logToFile("INFO: Removing file " + op.Path)
+		cxfw.LogToFile("INFO: Removing file " + op.Path)
 		if err := os.Remove(op.Path); err != nil {
-			logToFile("ERROR: Failed to remove file - " + err.Error())
+			cxfw.LogToFile("ERROR: Failed to remove file - " + err.Error())
 			return fmt.Errorf("failed to remove file: %w", err)
 		}
-		logToFile("SUCCESS: File removed from path - " + op.Path)
+		cxfw.LogToFile("SUCCESS: File removed from path - " + op.Path)
 	}
 
 	// Step 3: Remove the hash from integrity database and update folder-specific JSON
-	dbHash, err := removeFromIntegrityDatabase(op.Path)
+	changed, dbHash, err := cxfw.RemoveFromIntegrityDatabase(op.Path)
 	if err != nil {
-		logToFile("ERROR: Failed to update integrity database - " + err.Error())
+		cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
 		return fmt.Errorf("failed to update integrity database: %w", err)
 	}
 
 	// Update folder-specific JSON file if database was modified
-	if dbHash != "" {
+	if changed {
 		dir := filepath.Dir(op.Path)
-		err = updateFolderFile(dir, dbHash)
+		err = cxfw.UpdateFolderFile(dir, dbHash)
 		if err != nil {
-			logToFile("ERROR: Failed to update folder file - " + err.Error())
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
 			return fmt.Errorf("failed to update folder file: %w", err)
 		}
 	}
 
-	logToFile("SUCCESS: File removal operation completed - " + op.Path)
+	cxfw.LogToFile("SUCCESS: File removal operation completed - " + op.Path)
 	return nil
 }
 
-func removeFromIntegrityDatabase(filePath string) (string, error) {
-	dir := filepath.Dir(filePath)
-	dbPath := filepath.Join(dir, ".db.json")
-
-	key, err := extractKeyFromImage()
-	if err != nil {
-		return "", fmt.Errorf("failed to extract key: %w", err)
-	}
-
-	var entries []IntegrityEntry
-	if _, err := os.Stat(dbPath); err == nil {
-		encryptedData, err := os.ReadFile(dbPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to read encrypted db file: %w", err)
+// removeFiles removes every file of a batch remove, then drops their hashes
+// with one integrity database and folder file rewrite per directory.
+func removeFiles(op cxfw.Operation) error {
+	// Step 1: Remove the files from their paths
+	var dirs []string
+	byDir := make(map[string][]string)
+	for _, path := range op.Paths {
+		cxfw.LogToFile("INFO: Removing file " + path)
+		if err := os.Remove(path); os.IsNotExist(err) {
+			cxfw.LogToFile("WARNING: File does not exist, proceeding with database cleanup - " + path)
+		} else if err != nil {
+			cxfw.LogToFile("ERROR: Failed to remove file - " + err.Error())
+			return fmt.Errorf("failed to remove file: %w", err)
 		}
-
-		decryptedData, err := decryptFile(key, encryptedData)
-		if err != nil {
-			return "", fmt.Errorf("failed to decrypt db file: %w", err)
+		dir := filepath.Dir(path)
+		if byDir[dir] == nil {
+			dirs = append(dirs, dir)
 		}
+		byDir[dir] = append(byDir[dir], path)
+	}
 
-		err = json.Unmarshal(decryptedData, &entries)
+	// Step 2: Remove the hashes from each directory's integrity database
+	for _, dir := range dirs {
+		_, dbHash, err := cxfw.PruneIntegrityDatabase(dir, byDir[dir])
 		if err != nil {
-			return "", fmt.Errorf("failed to unmarshal db data: %w", err)
+			cxfw.LogToFile("ERROR: Failed to update integrity database - " + err.Error())
+			return fmt.Errorf("failed to update integrity database: %w", err)
 		}
-	} else if !os.IsNotExist(err) {
-		return "", fmt.Errorf("failed to check db file existence: %w", err)
-	}
-
-	// Remove the entry for the file
-	updatedEntries := []IntegrityEntry{}
-	found := false
-	for _, entry := range entries {
-		if entry.Path != filePath {
-			updatedEntries = append(updatedEntries, entry)
-		} else {
-			found = true
+		if dbHash == "" {
+			continue
+		}
+		if err := cxfw.UpdateFolderFile(dir, dbHash); err != nil {
+			cxfw.LogToFile("ERROR: Failed to update folder file - " + err.Error())
+			return fmt.Errorf("failed to update folder file: %w", err)
 		}
 	}
 
-	if !found && len(entries) > 0 {
-		logToFile("WARNING: File hash not found in integrity database - " + filePath)
-	}
-
-	// Marshal updated data
-	updatedJSON, err := json.MarshalIndent(updatedEntries, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal updated db: %w", err)
-	}
-
-	// Encrypt and write back
-	encryptedData, err := encryptFile(key, updatedJSON)
-	if err != nil {
-		return "", fmt.Errorf("failed to encrypt updated db: %w", err)
-	}
-
-	err = os.WriteFile(dbPath, encryptedData, 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to write encrypted db: %w", err)
-	}
+	cxfw.LogToFile(fmt.Sprintf("SUCCESS: File removal operation completed - %d files", len(op.Paths)))
+	return nil
+}
 
-	// Calculate hash of encrypted .db.json
-	dbHash, err := computeChecksum(dbPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to compute db hash: %w", err)
+// shellCommand returns the command running script under sh. SIGTERM or
+// SIGINT kills its whole process group, so a child holding its output open
+// cannot keep the run waiting.
+func shellCommand(script string) *exec.Cmd {
+	cmd := exec.CommandContext(cxfw.RunCtx, "sh", "-c", script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 	}
-
-	logToFile("INFO: Integrity database updated - removed entry for " + filePath)
-	return dbHash, nil
+	return cmd
 }
 
-func executeCommand(op Operation) error {
+func executeCommand(op cxfw.Operation) error {
 	if op.Command == "" {
-		logToFile("ERROR: Invalid command operation, missing command")
+		cxfw.LogToFile("ERROR: Invalid command operation, missing command")
 		return fmt.Errorf("invalid command operation, missing command")
 	}
 
-	logToFile("INFO: Executing command: " + op.Command)
-	cmd := exec.Command("sh", "-c", op.Command)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Command lines can carry credentials, so only DEBUG shows them in full
+	cxfw.LogToFile("INFO: Executing shell command")
+	cxfw.LogToFile("DEBUG: Command line: " + op.Command)
+	cmd := shellCommand(op.Command)
+	output := cxfw.NewOutputCapture()
+	cmd.Stdout, cmd.Stderr = output.Stdout, output.Stderr
 
-	if err := cmd.Run(); err != nil {
-		logToFile("ERROR: Command execution failed - " + err.Error())
+	err := cmd.Run()
+	output.Log()
+	if err != nil {
+		if tail := output.Tail(); tail != "" {
+			err = fmt.Errorf("%w (last output: %s)", err, tail)
+		}
+		cxfw.LogToFile("ERROR: Command execution failed - " + err.Error())
 		return fmt.Errorf("command execution failed: %w", err)
 	}
 
-	logToFile("SUCCESS: Command executed successfully")
+	cxfw.LogToFile("SUCCESS: Command executed successfully")
 	return nil
 }
 
-func executeScript(op Operation) error {
+func executeScript(op cxfw.Operation) error {
 	if op.Script == "" {
-		logToFile("ERROR: Invalid script operation, missing script content")
+		cxfw.LogToFile("ERROR: Invalid script operation, missing script content")
 		return fmt.Errorf("invalid script operation, missing script content")
 	}
 
-	logToFile("INFO: Executing script")
-	cmd := exec.Command("sh", "-c", op.Script)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cxfw.LogToFile("INFO: Executing script")
+	cmd := shellCommand(op.Script)
+	output := cxfw.NewOutputCapture()
+	cmd.Stdout, cmd.Stderr = output.Stdout, output.Stderr
 
-	if err := cmd.Run(); err != nil {
-		logToFile("ERROR: Script execution failed - " + err.Error())
+	err := cmd.Run()
+	output.Log()
+	if err != nil {
+		if tail := output.Tail(); tail != "" {
+			err = fmt.Errorf("%w (last output: %s)", err, tail)
+		}
+		cxfw.LogToFile("ERROR: Script execution failed - " + err.Error())
 		return fmt.Errorf("script execution failed: %w", err)
 	}
 
-	logToFile("SUCCESS: Script executed successfully")
+	cxfw.LogToFile("SUCCESS: Script executed successfully")
 	return nil
 }
 
-func updateIntegrityDatabase(filePath, hash string) (string, error) {
-	dir := filepath.Dir(filePath)
-	dbPath := filepath.Join(dir, ".db.json")
-
-	key, err := extractKeyFromImage()
-	if err != nil {
-		return "", fmt.Errorf("failed to extract key: %w", err)
+// removeBlock undoes an executor append operation by removing the last
+// occurrence of the exact block from the file.
+func removeBlock(op cxfw.Operation) error {
+	if op.Path == "" || op.Content == "" {
+		cxfw.LogToFile("ERROR: Invalid remove_block operation, missing path or content")
+		return fmt.Errorf("invalid remove_block operation, missing path or content")
 	}
 
-	var entries []IntegrityEntry
-	if _, err := os.Stat(dbPath); err == nil {
-		encryptedData, err := os.ReadFile(dbPath)
-		if err != nil {
-			return "", fmt.Errorf("failed to read encrypted db file: %w", err)
-		}
-
-		decryptedData, err := decryptFile(key, encryptedData)
-		if err != nil {
-			return "", fmt.Errorf("failed to decrypt db file: %w", err)
-		}
-
-		err = json.Unmarshal(decryptedData, &entries)
-		if err != nil {
-			return "", fmt.Errorf("failed to unmarshal db data: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		return "", fmt.Errorf("failed to check db file existence: %w", err)
-	}
-
-	// Check for existing entry by path and hash
-	for i, entry := range entries {
-		if entry.Path == filePath {
-			if entry.Hash == hash {
-				logToFile("INFO: File already exists with matching hash in database - " + filePath)
-				// Return current .db.json hash without modification
-				dbHash, err := computeChecksum(dbPath)
-				if err != nil {
-					return "", fmt.Errorf("failed to compute db hash: %w", err)
-				}
-				return dbHash, nil
-			}
-			// Update hash if path matches but hash differs
-			entries[i].Hash = hash
-			logToFile("INFO: Updated existing file hash in database - " + filePath)
-			goto writeUpdate
-		}
+	existing, err := os.ReadFile(op.Path)
+	if os.IsNotExist(err) {
+		cxfw.LogToFile("WARNING: File does not exist, nothing to remove - " + op.Path)
+		return nil
+	} else if err != nil {
+		cxfw.LogToFile("ERROR: Failed to read file - " + err.Error())
+		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	// Add new entry if no match found
-	entries = append(entries, IntegrityEntry{
-		Path: filePath,
-		Hash: hash,
-	})
-	logToFile("INFO: Added new file entry to database - " + filePath)
-
-writeUpdate:
-	// Marshal updated data
-	updatedJSON, err := json.MarshalIndent(entries, "", "  ")
+	info, err := os.Stat(op.Path)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal updated db: %w", err)
+		return fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	// Encrypt and write back
-	encryptedData, err := encryptFile(key, updatedJSON)
-	if err != nil {
-		return "", fmt.Errorf("failed to encrypt updated db: %w", err)
+	block := strings.TrimSuffix(op.Content, "\n") + "\n"
+	content := "\n" + string(existing)
+	if !strings.HasSuffix(content, "\n") {
+		content += "\n"
 	}
 
-	err = os.WriteFile(dbPath, encryptedData, 0644)
-	if err != nil {
-		return "", fmt.Errorf("failed to write encrypted db: %w", err)
+	// Match on line boundaries only, the same way the executor detects it
+	index := strings.LastIndex(content, "\n"+block)
+	if index < 0 {
+		cxfw.LogToFile("WARNING: Block not present, nothing to remove - " + op.Path)
+		return nil
 	}
+	updated := content[1:index+1] + content[index+1+len(block):]
 
-	// Calculate hash of encrypted .db.json
-	dbHash, err := computeChecksum(dbPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to compute db hash: %w", err)
+	if err := cxfw.WriteFileAtomic(op.Path, []byte(updated), info.Mode().Perm()); err != nil {
+		cxfw.LogToFile("ERROR: Failed to write file - " + err.Error())
+		return fmt.Errorf("failed to write file: %w", err)
 	}
 
-	return dbHash, nil
+	cxfw.LogToFile("SUCCESS: Block removed from " + op.Path)
+	return nil
 }
 
-func updateFolderFile(dir, dbHash string) error {
-	// Extract folder name and construct the specific JSON filename
-	folderName := filepath.Base(dir)
-	folderFile := filepath.Join(dir, "."+folderName+".json") // e.g., .apps.json, .basic.json
-	dbPath := filepath.Join(dir, ".db.json")                 // Path to .db.json
-
-	key, err := extractKeyFromImage()
-	if err != nil {
-		return fmt.Errorf("failed to extract key: %w", err)
-	}
-
-	// Read and decrypt existing folder-specific JSON
-	var folderData FolderEntry
-	if _, err := os.Stat(folderFile); err == nil {
-		encryptedData, err := os.ReadFile(folderFile)
-		if err != nil {
-			return fmt.Errorf("failed to read encrypted folder file: %w", err)
-		}
-
-		decryptedData, err := decryptFile(key, encryptedData)
-		if err != nil {
-			return fmt.Errorf("failed to decrypt folder file: %w", err)
-		}
-
-		err = json.Unmarshal(decryptedData, &folderData)
-		if err != nil {
-			return fmt.Errorf("failed to unmarshal folder data: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		return fmt.Errorf("failed to check folder file existence: %w", err)
-	} else {
-		// If file doesn't exist, initialize with the correct path
-		folderData.Path = dbPath
+// restoreIntegrity returns a directory to the integrity snapshot op.Name
+// taken by the patch being rolled back.
+func restoreIntegrity(op cxfw.Operation) error {
+	if op.Name == "" {
+		cxfw.LogToFile("ERROR: Invalid restore_integrity operation, missing name")
+		return fmt.Errorf("invalid restore_integrity operation, missing name")
 	}
-
-	// Update the hash value (path remains constant)
-	folderData.Hash = dbHash
-
-	// Marshal updated data
-	updatedJSON, err := json.MarshalIndent(folderData, "", "  ")
+	snapshotPath, err := cxfw.SnapshotPath(cxfw.BackupDir, op.Name)
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated folder data: %w", err)
+		cxfw.LogToFile("ERROR: " + err.Error())
+		return err
 	}
-
-	// Encrypt and write back
-	encryptedData, err := encryptFile(key, updatedJSON)
+	snapshot, err := cxfw.LoadSnapshot(snapshotPath, op.Name)
 	if err != nil {
-		return fmt.Errorf("failed to encrypt updated folder data: %w", err)
+		cxfw.LogToFile("ERROR: Snapshot " + op.Name + " failed verification - " + err.Error())
+		return fmt.Errorf("snapshot %s failed verification: %w", op.Name, err)
 	}
-
-	err = os.WriteFile(folderFile, encryptedData, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write encrypted folder file: %w", err)
+	cxfw.LogToFile("INFO: Restoring " + snapshot.Dir + " to snapshot " + op.Name)
+	if err := cxfw.RestoreSnapshot(snapshot, cxfw.BackupDir); err != nil {
+		cxfw.LogToFile("ERROR: Failed to restore snapshot - " + err.Error())
+		return fmt.Errorf("failed to restore snapshot %s: %w", op.Name, err)
 	}
-
-	logToFile("INFO: Folder database updated with db hash: " + dbHash)
+	cxfw.LogToFile("SUCCESS: " + snapshot.Dir + " restored to snapshot " + op.Name)
 	return nil
 }
 
-// Ensure these helper functions are present
-func extractKeyFromImage() ([]byte, error) {
-	tempKeyFile := "/tmp/extracted_key.txt"
-	cmd := exec.Command("steghide", "extract", "-sf", "/sda1/data/.gems.jpeg", "-xf", tempKeyFile, "-p", "Sundyne@123")
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("steghide extraction failed: %v", err)
-	}
-	defer os.Remove(tempKeyFile)
-	key, err := os.ReadFile(tempKeyFile)
+// provisionUser undoes a user operation of the patch with the inverse
+// action: removing a user the patch added, or adding back one it removed.
+func provisionUser(op cxfw.Operation) error {
+	changed, err := cxfw.ApplyAccountChange(op)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read extracted key: %v", err)
+		cxfw.LogToFile("ERROR: Failed to " + op.Action + " user " + op.Name + " - " + err.Error())
+		return fmt.Errorf("failed to %s user %s: %w", op.Action, op.Name, err)
 	}
-	return key, nil
-}
-
-func decryptFile(key, encryptedData []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %v", err)
+	if !changed {
+		cxfw.LogToFile("INFO: User " + op.Name + " already as expected, skipped")
+		return nil
 	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %v", err)
-	}
-
-	nonceSize := gcm.NonceSize()
-	if len(encryptedData) < nonceSize {
-		return nil, fmt.Errorf("ciphertext too short")
-	}
-
-	nonce, ciphertext := encryptedData[:nonceSize], encryptedData[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("decryption failed: %v", err)
-	}
-	return plaintext, nil
+	cxfw.LogToFile("SUCCESS: User " + op.Name + " " + op.Action + " completed")
+	return nil
 }
 
-func encryptFile(key, plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create GCM: %w", err)
+// operationNeedsKey reports whether op reads or writes the encrypted
+// integrity databases.
+func operationNeedsKey(op cxfw.Operation) bool {
+	switch op.Operation {
+	case "add", "remove", "restore_integrity":
+		return true
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return nil, fmt.Errorf("failed to generate nonce: %w", err)
-	}
-
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	return false
 }